@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration of the access log in the configuration file
+type AccessLogConfig struct {
+	File   string `json:"file"`
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+// An entry in the access log
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Duration  float64 `json:"duration_ms"`
+	Bytes     int64   `json:"bytes"`
+	Remote    string  `json:"remote"`
+	User      string  `json:"user,omitempty"`
+	RequestId string  `json:"request_id,omitempty"`
+}
+
+/**
+ * The minimum status code for a request to be logged for each level.
+ * "info" logs all requests, "warn" logs the failed requests and "error"
+ * only logs the requests which failed due to a server error.
+ */
+var accessLogLevels = map[string]int{
+	"info":  0,
+	"warn":  400,
+	"error": 500,
+}
+
+var accessLogger *log.Logger
+var accessLogMinStatus int
+
+type accessLogKey struct{}
+
+/**
+ * accessLogWriter wraps the http.ResponseWriter to record the status
+ * code and the number of bytes sent to the client.
+ */
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessLogWriter) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessLogWriter) Write(data []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(data)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Let http.ResponseController reach the connection (see timeouts.go)
+func (a *accessLogWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// Pass on io.ReaderFrom so that the files may be sent with sendfile
+func (a *accessLogWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := readFrom(a.ResponseWriter, reader)
+	a.bytes += n
+	return n, err
+}
+
+// Flush the response to the client (used by the event stream)
+func (a *accessLogWriter) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Open the access log specified in the configuration
+func openAccessLog() error {
+	config := configuration.AccessLog
+	level := config.Level
+	if len(level) == 0 {
+		level = "info"
+	}
+	if level == "none" {
+		return nil
+	}
+
+	status, ok := accessLogLevels[level]
+	if !ok {
+		return fmt.Errorf("Invalid access log level \"%s\"", level)
+	}
+	accessLogMinStatus = status
+
+	switch config.Format {
+	case "", "logfmt", "json":
+	default:
+		return fmt.Errorf("Invalid access log format \"%s\"", config.Format)
+	}
+
+	out := os.Stderr
+	if len(config.File) > 0 && config.File != "-" {
+		f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	accessLogger = log.New(out, "", 0)
+	return nil
+}
+
+// Quote the value if it can't be used as is in logfmt
+func logfmtValue(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " \"=\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func (e *accessLogEntry) String() string {
+	if configuration.AccessLog.Format == "json" {
+		a, _ := json.Marshal(e)
+		return string(a)
+	}
+
+	line := fmt.Sprintf("time=%s method=%s path=%s status=%d duration_ms=%.3f bytes=%d remote=%s",
+		e.Time, logfmtValue(e.Method), logfmtValue(e.Path), e.Status,
+		e.Duration, e.Bytes, logfmtValue(e.Remote))
+	if len(e.User) > 0 {
+		line += " user=" + logfmtValue(e.User)
+	}
+	if len(e.RequestId) > 0 {
+		line += " request_id=" + logfmtValue(e.RequestId)
+	}
+	return line
+}
+
+/**
+ * Record the authenticated user in the access log entry for the
+ * request (called when the user is authenticated)
+ */
+func accessLogUser(r *http.Request, user *UserEntry) {
+	entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry)
+	if ok && user != nil {
+		entry.User = user.Name
+	}
+}
+
+// Wrap the handler to log all requests (if enabled)
+func withAccessLog(handler http.Handler) http.Handler {
+	if accessLogger == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			Method:    r.Method,
+			Path:      r.URL.RequestURI(),
+			Remote:    r.RemoteAddr,
+			RequestId: requestId(r),
+		}
+		writer := &accessLogWriter{ResponseWriter: w}
+		handler.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+		entry.Status = writer.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Bytes = writer.bytes
+		entry.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+		if entry.Status >= accessLogMinStatus {
+			accessLogger.Print(entry.String())
+		}
+	})
+}
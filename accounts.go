@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+)
+
+/**
+ * Get the user to use for a request to /:account/images. The account
+ * may be given by its uuid or the name of the user, and users may only
+ * use their own account while operators may use all accounts.
+ *
+ * The request is performed as a regular user in the account (even for
+ * operators) so that it only sees the images owned by the account, the
+ * public images and the images shared with the account, and may only
+ * modify (and create) images owned by the account.
+ */
+func accountScopedUser(user *UserEntry, account string) (*UserEntry, int, map[string]interface{}) {
+	if user == nil {
+		code, content := errorResponse(CodeUnauthorizedError, "Authentication is required for /:account/images")
+		return nil, code, content
+	}
+
+	uuid := account
+	if !isValidUuid(account) {
+		uuid = ""
+		if account == user.Name {
+			uuid = user.Uuid
+		} else if isOperator(user) {
+			if entry := lookupUser(account); entry != nil {
+				uuid = entry.Uuid
+			}
+		}
+		if len(uuid) == 0 {
+			code, content := errorResponse(CodeAccountDoesNotExist, fmt.Sprintf("Account %s does not exist", account))
+			return nil, code, content
+		}
+	}
+
+	if !isOperator(user) && uuid != user.Uuid {
+		code, content := errorResponse(CodeNotAuthorizedError, fmt.Sprintf("User %s may not access account %s", user.Name, account))
+		return nil, code, content
+	}
+
+	role := RoleUser
+	if userRole(user) == RoleReadOnly {
+		role = RoleReadOnly
+	}
+	return &UserEntry{Name: user.Name, Role: role, Uuid: uuid}, Success, nil
+}
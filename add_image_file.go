@@ -4,170 +4,362 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 )
 
-func doServerAddImageFile(path string, params url.Values, reader io.Reader) (int, map[string]interface{}) {
-	var expectedsha1 string
-	var compression string
+// The prefix of the names of the temporary files used by spoolImageFile
+const spoolPrefix = ".upload"
+
+/**
+ * Get the directory used for the temporary files. Keep the temporary
+ * files in the data directory so that the local storage may rename
+ * them into place.
+ */
+func spoolDir() string {
+	if storageType(configuration) == "local" {
+		return configuration.Datadir
+	}
+	return os.TempDir()
+}
+
+/**
+ * Spool the uploaded file to a temporary file while computing the
+ * digests and size of the file.
+ *
+ * @param reader the file to store
+ * @return path the name of the temporary file (the caller must remove it)
+ *         sums the digests of the file (see checksums.go)
+ *         size the size of the file
+ */
+func spoolImageFile(reader io.Reader) (path string, sums fileDigests, size int64, err error) {
+	f, err := ioutil.TempFile(spoolDir(), spoolPrefix)
+	if err != nil {
+		return "", sums, 0, err
+	}
+
+	hasher := newFileHasher()
+	size, err = io.Copy(io.MultiWriter(f, hasher), reader)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", sums, 0, err
+	}
+
+	return f.Name(), hasher.digests(), size, nil
+}
+
+func checksumError(format string, args ...interface{}) (int, map[string]interface{}) {
+	return errorResponse(CodeChecksumError, fmt.Sprintf(format, args...))
+}
+
+// The parameters of AddImageFile (and of the chunks of a resumable upload)
+type imageFileParams struct {
+	// The digests the file must match
+	expected    map[string]interface{}
+	compression string
+	index       int
+	deltaBase   string
+	deltaIndex  int
+}
+
+// Parse and validate the parameters of AddImageFile
+func parseImageFileParams(params url.Values, p *imageFileParams) (int, map[string]interface{}) {
+	p.expected = map[string]interface{}{}
 	for k, v := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
 			fallthrough
-		case "storage":
-			fallthrough
 		case "dataset_guid":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+
+		case "storage":
+			if v[0] != storageType(configuration) {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("The server use \"%s\" storage", storageType(configuration)))
 			}
-			return InsufficientServerVersion, message
+			break
 
 		case "compression":
-			compression = v[0]
-			switch compression {
-			case "gzip":
-				fallthrough
-			case "bzip2":
+			p.compression = v[0]
+			switch p.compression {
+			case "gzip", "bzip2", "xz", "none":
 				break
 			default:
-				message := map[string]interface{}{
-					"code":    "InvalidParameter",
-					"message": "compression may be gzip of bzip2",
-				}
-				return InvalidParameter, message
+				return errorResponse(CodeInvalidParameter, "compression may be gzip, bzip2, xz or none")
 			}
 
 			break
 
-		case "sha1":
-			expectedsha1 = v[0]
+		case "sha1", "sha256", "sha512":
+			p.expected[k] = v[0]
 			break
 
-		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
+		case "index":
+			var err error
+			p.index, err = parseFileIndex(v[0])
+			if err != nil {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+			}
+
+		case "delta":
+			p.deltaBase = v[0]
+
+		case "delta_index":
+			var err error
+			p.deltaIndex, err = parseFileIndex(v[0])
+			if err != nil {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
 			}
-			return InvalidParameter, message
+
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 		}
 	}
+	return Success, nil
+}
 
-	manifestfile := path + "/manifest.json"
-
-	m, err := LoadManifest(manifestfile)
+func doServerAddImageFile(uuid string, params url.Values, reader io.Reader) (int, map[string]interface{}) {
+	var p imageFileParams
+	code, content := parseImageFileParams(params, &p)
+	if content != nil {
+		return code, content
+	}
+	m, err := storage.GetManifest(uuid)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to load manifest: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
 	}
 
-	if m["state"] == "active" {
-		message := map[string]interface{}{
-			"code":    "ImageAlreadyActivated",
-			"message": "Can't replace file for an active image",
-		}
-		return ImageAlreadyActivated, message
+	if !imageFileMutable(m) {
+		return errorResponse(CodeImageAlreadyActivated, "Can't replace file for an active image")
 	}
 
-	filename := path + "/image.gz"
-	f, err := os.Create(filename)
-	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to create image file: %v", err),
+	// The files is stored in the order of the files array
+	files := getManifestFiles(m)
+	if p.index > len(files) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("index must be between 0 and %d", len(files)))
+	}
+
+	// The file must match the file declared in the manifest when the
+	// manifest was created with the files (as when importing an image)
+	var declared map[string]interface{}
+	if _, exists := getImageFileAt(uuid, p.index); !exists {
+		declared = getDeclaredFileAt(m, p.index)
+	}
+	if value, ok := declared["compression"].(string); ok && len(p.compression) > 0 && value != p.compression {
+		return checksumError("Incorrect compression. expected \"%s\" got \"%s\"", value, p.compression)
+	}
+
+	// The body is a delta against a file of another image (see delta.go)
+	if len(p.deltaBase) > 0 {
+		if len(p.compression) == 0 {
+			return errorResponse(CodeInvalidParameter, "compression must be specified with delta")
+		}
+		code, content := checkDeltaBase(uuid, p.deltaBase)
+		if content != nil {
+			return code, content
+		}
+		base, baseSize, closeBase, err := openDeltaBase(p.deltaBase, p.deltaIndex)
+		if err == ErrImageNotFound {
+			return errorResponse(CodeResourceNotFound, fmt.Sprintf("Image %s does not have file %d", p.deltaBase, p.deltaIndex))
 		}
-		return InternalError, message
+		if err != nil {
+			return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read file of %s: %v", p.deltaBase, err))
+		}
+		defer closeBase()
+
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		delta := reader
+		go func() {
+			pw.CloseWithError(applyDelta(pw, delta, base, baseSize))
+		}()
+		reader = pr
 	}
 
-	var writer io.Writer
-	if len(compression) == 0 {
-		writer, err = gzip.NewWriterLevel(f, gzip.BestCompression)
+	var source io.Reader = reader
+	if len(p.compression) > 0 {
+		source, err = verifyCompression(p.compression, reader)
 		if err != nil {
-			os.Remove(filename)
-			message := map[string]interface{}{
-				"code":    "InternalError",
-				"message": fmt.Sprintf("Failed to create zip stream: %v", err),
-			}
-			return InternalError, message
+			return checksumError("%v", err)
 		}
-		compression = "gzip"
 	} else {
-		writer = f
+		// Compress the file while it is being stored
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			writer, err := gzip.NewWriterLevel(pw, gzip.BestCompression)
+			if err == nil {
+				_, err = io.Copy(writer, reader)
+				if err == nil {
+					err = writer.Close()
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		source = pr
+		p.compression = "gzip"
 	}
 
-	_, err = io.Copy(writer, reader)
-	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store image file: %v", err),
-		}
-		return InternalError, message
+	limit, limitErr := uploadSizeLimit(uuid, m, p.index)
+	if limit == 0 && limitErr != errFileTooLarge {
+		return uploadLimitResponse(limitErr, limit)
+	}
+	if limit >= 0 {
+		source = &sizeLimitReader{reader: source, remaining: limit, err: limitErr}
 	}
 
-	stat, err := os.Stat(filename)
+	path, sums, size, err := spoolImageFile(source)
+	if err == limitErr {
+		return uploadLimitResponse(err, limit)
+	}
+	if err == errInvalidDelta {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
 	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to lookup image file: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to receive image file: %v", err))
 	}
+	defer os.Remove(path)
 
-	// ok, generate the SHA1
-	sha1sum, err := GetSha1Sum(filename)
+	err = sums.verify(p.expected)
+	if err == nil {
+		err = sums.verify(declared)
+	}
 	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to get SHA1 for image file: %v", err),
-		}
-		return InternalError, message
+		return checksumError("%v", err)
 	}
 
-	if len(expectedsha1) > 0 && sha1sum != expectedsha1 {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Incorrect SHA. expected \"%s\" got \"%s\"", expectedsha1, sha1sum),
+	if currentConfiguration().EnforceSize {
+		declaredSize, ok := getDeclaredFileSize(m, p.index)
+		if ok && declaredSize != size {
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("Incorrect size. expected %d got %d", declaredSize, size))
 		}
-		return InternalError, message
+	}
+
+	scan, code, content := scanImageFile(uuid, path)
+	if content != nil {
+		return code, content
+	}
+
+	filename := imageFileNameAt(p.index, p.compression)
+	_, err = storage.MoveFile(uuid, filename, path)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store image file: %v", err))
 	}
 
 	entry := map[string]interface{}{
-		"compression": compression,
-		"sha1":        sha1sum,
-		"size":        stat.Size(),
+		"compression": p.compression,
+		"size":        size,
+	}
+	sums.addTo(entry)
+	if scan != nil {
+		entry["scan"] = scan
 	}
 
-	files := []map[string]interface{}{
-		entry,
+	if p.index < len(files) {
+		files[p.index] = entry
+	} else {
+		files = append(files, entry)
 	}
 
 	m["files"] = files
-	err = StoreManifest(manifestfile, m)
+	err = storage.PutManifest(uuid, m)
 	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store manifest: %v", err),
+		storage.DeleteFile(uuid, filename)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest: %v", err))
+	}
+
+	// Remove the image file if it was stored with another compression
+	for _, name := range imageFileNamesAt(p.index) {
+		if name != filename {
+			storage.DeleteFile(uuid, name)
 		}
-		return InternalError, message
 	}
 
+	publishImageEvent(EventFileUploaded, uuid)
 	return Success, m
 }
 
-func serverAddImageFile(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerAddImageFile(path, params, r.Body)
+// Get the files list in the manifest
+func getManifestFiles(m map[string]interface{}) []interface{} {
+	switch files := m["files"].(type) {
+	case []interface{}:
+		return files
+	case []map[string]interface{}:
+		var list []interface{}
+		for _, entry := range files {
+			list = append(list, entry)
+		}
+		return list
+	}
+	return nil
+}
+
+// Get the first entry in the files list in the manifest (if any)
+func getDeclaredFile(m map[string]interface{}) map[string]interface{} {
+	return getDeclaredFileAt(m, 0)
+}
+
+// Get the entry with the index in the files list in the manifest (if any)
+func getDeclaredFileAt(m map[string]interface{}, index int) map[string]interface{} {
+	files := getManifestFiles(m)
+	if index >= len(files) {
+		return nil
+	}
+
+	entry, _ := files[index].(map[string]interface{})
+	return entry
+}
+
+/**
+ * Get the size of the image file as declared in the manifest
+ *
+ * @param m the manifest to search
+ * @param index the index in the files list
+ * @return size the declared size
+ *         ok true if the manifest declares the size
+ */
+func getDeclaredFileSize(m map[string]interface{}, index int) (size int64, ok bool) {
+	switch value := getDeclaredFileAt(m, index)["size"].(type) {
+	case float64:
+		return int64(value), true
+	case int64:
+		return value, true
+	}
+	return 0, false
+}
+
+func serverAddImageFile(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	if len(r.Header.Get("Content-Range")) > 0 {
+		code, content := doServerAddImageFileChunk(w, uuid, params, r)
+		publishUploadFailure(uuid, content)
+		sendResponse(w, code, content)
+		return
+	}
+
+	code, content := doServerAddImageFile(uuid, params, r.Body)
+	publishUploadFailure(uuid, content)
 	sendResponse(w, code, content)
 }
+
+// Publish the failed upload (or the quota breach) for the error response
+func publishUploadFailure(uuid string, content map[string]interface{}) {
+	message, failed := content["message"].(string)
+	if !failed {
+		return
+	}
+
+	eventType := EventFileUploadFailed
+	if content["code"] == string(CodeQuotaExceeded) {
+		eventType = EventQuotaExceeded
+	}
+	m, _ := index.get(uuid)
+	publishEvent(ImageEvent{Type: eventType, Uuid: uuid, Error: message, Manifest: m})
+}
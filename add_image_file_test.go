@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Upload content as the file of an unactivated image declaring the size
+func uploadDeclaredSize(t *testing.T, uuid string, declared int, content string) (int, map[string]interface{}) {
+	t.Helper()
+	m := testManifest("sized", map[string]interface{}{"size": declared})
+	m["state"] = StateUnactivated
+	addTestImage(t, uuid, m, "")
+	return doServerAddImageFile(uuid, url.Values{"compression": {"none"}}, strings.NewReader(content))
+}
+
+func TestAddImageFileMatchingSize(t *testing.T) {
+	setupTestStorage(t)
+	configuration.EnforceSize = true
+
+	uuid := "00000000-0000-0000-0000-000000000001"
+	code, content := uploadDeclaredSize(t, uuid, 5, "hello")
+	if code != Success {
+		t.Fatalf("Expected the upload to succeed, got %d: %v", code, content["message"])
+	}
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		t.Fatalf("Failed to load manifest: %v", err)
+	}
+	if size, _ := getDeclaredFileSize(m, 0); size != 5 {
+		t.Errorf("Expected the size 5 in the manifest, got %d", size)
+	}
+}
+
+func TestAddImageFileMismatchingSize(t *testing.T) {
+	setupTestStorage(t)
+	configuration.EnforceSize = true
+
+	uuid := "00000000-0000-0000-0000-000000000001"
+	code, content := uploadDeclaredSize(t, uuid, 5, "hello world")
+	if code != ValidationFailed || content["code"] != string(CodeValidationFailed) {
+		t.Fatalf("Expected ValidationFailed, got %d: %v", code, content)
+	}
+	if _, ok := getImageFile(uuid); ok {
+		t.Errorf("The rejected file is stored")
+	}
+
+	// The size is only checked if enforce_file_size is set
+	configuration.EnforceSize = false
+	code, content = uploadDeclaredSize(t, "00000000-0000-0000-0000-000000000002", 5, "hello world")
+	if code != Success {
+		t.Errorf("Expected the upload to succeed, got %d: %v", code, content["message"])
+	}
+}
@@ -5,32 +5,17 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 )
 
-func doServerAddImageIcon(path string, params url.Values, header http.Header, reader io.Reader) (int, map[string]interface{}) {
+func doServerAddImageIcon(uuid string, params url.Values, header http.Header, reader io.Reader) (int, map[string]interface{}) {
 	content_type := header.Get("Content-Type")
-	var extension string
-
 	switch content_type {
-	case "image/jpeg":
-		extension = ".jpg"
-	case "image/png":
-		extension = ".png"
-	case "image/gif":
-		extension = ".gif"
+	case "image/jpeg", "image/jpg", "image/png", "image/gif":
+		break
 	case "":
-		message := map[string]interface{}{
-			"code":    "InvalidParameter",
-			"message": "Content-Type not present",
-		}
-		return InvalidParameter, message
+		return errorResponse(CodeInvalidParameter, "Content-Type not present")
 	default:
-		message := map[string]interface{}{
-			"code":    "InvalidParameter",
-			"message": fmt.Sprintf("Unknown Content-Type \"%s\"", content_type),
-		}
-		return InvalidParameter, message
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Unknown Content-Type \"%s\"", content_type))
 	}
 
 	var expectedsha1 string
@@ -41,90 +26,49 @@ func doServerAddImageIcon(path string, params url.Values, header http.Header, re
 		case "channel":
 			fallthrough
 		case "storage":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
-			}
-			return InsufficientServerVersion, message
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
 
 		case "sha1":
 			expectedsha1 = v[0]
 
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
-		}
-	}
-
-	filename := path + "/icon" + extension
-	writer, err := os.Create(filename)
-	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to create image file: %v", err),
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 		}
-		return InternalError, message
 	}
 
-	_, err = io.Copy(writer, reader)
-	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store image file: %v", err),
-		}
-		return InternalError, message
+	icon, filename, code, message := readIcon(content_type, reader)
+	if message != nil {
+		return code, message
 	}
 
 	if len(expectedsha1) > 0 {
-		sha1, err := GetSha1Sum(filename)
-		if err != nil {
-			os.Remove(filename)
-			message := map[string]interface{}{
-				"code":    "InternalError",
-				"message": fmt.Sprintf("Failed to generate sha1: %v", err),
-			}
-			return InternalError, message
-		}
-
+		sha1 := iconSha1(icon)
 		if expectedsha1 != sha1 {
-			os.Remove(filename)
-			message := map[string]interface{}{
-				"code":    "InternalError",
-				"message": fmt.Sprintf("Incorrect SHA. expected \"%s\" got \"%s\"", expectedsha1, sha1),
-			}
-			return InternalError, message
+			return checksumError("Incorrect SHA. expected \"%s\" got \"%s\"", expectedsha1, sha1)
 		}
 	}
 
-	m, err := LoadManifest(path + "/manifest.json")
+	err := storeIcon(uuid, filename, icon)
 	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to load manifest: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store image file: %v", err))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		storage.DeleteFile(uuid, filename)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
 	}
 	m["icon"] = true
-	err = StoreManifest(path+"/manifest.json", m)
+	err = storage.PutManifest(uuid, m)
 	if err != nil {
-		os.Remove(filename)
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store manifest: %v", err),
-		}
-		return InternalError, message
+		storage.DeleteFile(uuid, filename)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest: %v", err))
 	}
 
 	return Success, m
 }
 
-func serverAddImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerAddImageIcon(path, params, r.Header, r.Body)
+func serverAddImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerAddImageIcon(uuid, params, r.Header, r.Body)
 	sendResponse(w, code, content)
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// The prefix of the names of the files the attachments is stored in
+const attachmentFilePrefix = "attachment."
+
+// The maximum size of an attachment unless max_size is set
+const defaultMaxAttachmentSize = 16 * 1024 * 1024
+
+// The maximum number of attachments of an image unless max_count is set
+const defaultMaxAttachments = 32
+
+var attachmentNameRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$")
+
+// The error returned when an attachment exceeds max_size
+var errAttachmentTooLarge = errors.New("The attachment is too large")
+
+// The configuration of the attachments in the configuration file
+type AttachmentsConfig struct {
+	// The maximum size of an attachment (in bytes)
+	MaxSize int64 `json:"max_size"`
+	// The maximum number of attachments of an image
+	MaxCount int `json:"max_count"`
+	// The accepted content types (all unless set)
+	ContentTypes []string `json:"content_types"`
+}
+
+/**
+ * The attachments is arbitrary files stored next to the image, like the
+ * reports from the vulnerability scanners (trivy, grype) published by
+ * CI. Unlike the files in the files list they isn't part of the image,
+ * so they may be added and removed after the image is activated. The
+ * attachments is listed in "attachments" in the manifest:
+ *
+ *     "attachments" : {
+ *         "trivy.json" : {
+ *             "content_type" : "application/json",
+ *             "size" : 18230,
+ *             "sha256" : "...",
+ *             "created_at" : "2024-05-02T12:00:00Z"
+ *         }
+ *     }
+ */
+func getManifestAttachments(m map[string]interface{}) map[string]interface{} {
+	attachments, ok := m["attachments"].(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return attachments
+}
+
+// Get the name of the file the attachment is stored in
+func attachmentFileName(name string) string {
+	return attachmentFilePrefix + name
+}
+
+func maxAttachmentSize() int64 {
+	if configuration.Attachments.MaxSize > 0 {
+		return configuration.Attachments.MaxSize
+	}
+	return defaultMaxAttachmentSize
+}
+
+func maxAttachments() int {
+	if configuration.Attachments.MaxCount > 0 {
+		return configuration.Attachments.MaxCount
+	}
+	return defaultMaxAttachments
+}
+
+// Verify the attachments configuration
+func validateAttachments(config AttachmentsConfig) error {
+	if config.MaxSize < 0 || config.MaxCount < 0 {
+		return errors.New("The attachments max_size and max_count can't be negative")
+	}
+	for _, contentType := range config.ContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return fmt.Errorf("Invalid attachment content type \"%s\"", contentType)
+		}
+	}
+	return nil
+}
+
+// Validate the attachments in the manifest
+func validateManifestAttachments(errs *manifestErrors, value interface{}) {
+	attachments, ok := value.(map[string]interface{})
+	if !ok {
+		errs.add("attachments", "Invalid", "\"attachments\" must be an object")
+		return
+	}
+	for name, entry := range attachments {
+		if !attachmentNameRegexp.MatchString(name) {
+			errs.add("attachments", "Invalid", "Invalid attachment name \"%s\"", name)
+			continue
+		}
+		attachment, ok := entry.(map[string]interface{})
+		if _, typed := attachment["content_type"].(string); !ok || !typed {
+			errs.add("attachments", "Invalid", "The attachment \"%s\" must be an object with a content_type", name)
+		}
+	}
+}
+
+/**
+ * Get the content type of the attachment from the Content-Type header
+ * (application/octet-stream if it isn't provided).
+ *
+ * @return the content type or the error to return to the client
+ */
+func attachmentContentType(header http.Header) (string, int, map[string]interface{}) {
+	contentType := header.Get("Content-Type")
+	if len(contentType) == 0 {
+		return "application/octet-stream", Success, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid Content-Type \"%s\"", contentType))
+		return "", code, content
+	}
+	if len(configuration.Attachments.ContentTypes) > 0 {
+		accepted := false
+		for _, allowed := range configuration.Attachments.ContentTypes {
+			t, _, _ := mime.ParseMediaType(allowed)
+			accepted = accepted || t == mediaType
+		}
+		if !accepted {
+			code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("Content-Type \"%s\" is not accepted for attachments", mediaType))
+			return "", code, content
+		}
+	}
+	return contentType, Success, nil
+}
+
+// Verify the parameters of the requests for an attachment
+func checkAttachmentParameters(params url.Values, allowed ...string) (int, map[string]interface{}) {
+	for k := range params {
+		if k != "name" && !stringInSlice(k, allowed) {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+	name := params.Get("name")
+	if !attachmentNameRegexp.MatchString(name) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid attachment name \"%s\"", name))
+	}
+	return Success, nil
+}
+
+/**
+ * Store the attachment in the body of the request and add it to the
+ * manifest (replacing the attachment with the same name).
+ *
+ * @return the HTTP code and the updated manifest (or the error)
+ */
+func doServerPutImageAttachment(r *http.Request, params url.Values, uuid string) (int, map[string]interface{}) {
+	code, content := checkAttachmentParameters(params, "sha256")
+	if content != nil {
+		return code, content
+	}
+	name := params.Get("name")
+
+	contentType, code, content := attachmentContentType(r.Header)
+	if content != nil {
+		return code, content
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	attachments := map[string]interface{}{}
+	for k, v := range getManifestAttachments(m) {
+		attachments[k] = v
+	}
+	if _, exists := attachments[name]; !exists && len(attachments) >= maxAttachments() {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("The image can't have more than %d attachments", maxAttachments()))
+	}
+
+	code, content = checkUploadSpace()
+	if content != nil {
+		return code, content
+	}
+
+	limit := maxAttachmentSize()
+	path, sums, size, err := spoolImageFile(&sizeLimitReader{reader: r.Body, remaining: limit, err: errAttachmentTooLarge})
+	if err == errAttachmentTooLarge {
+		return uploadLimitResponse(err, limit)
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to receive attachment: %v", err))
+	}
+	defer os.Remove(path)
+
+	if expected := params.Get("sha256"); len(expected) > 0 && expected != sums.Sha256 {
+		return checksumError("Incorrect SHA256. expected \"%s\" got \"%s\"", expected, sums.Sha256)
+	}
+
+	filename := attachmentFileName(name)
+	_, err = storage.MoveFile(uuid, filename, path)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store attachment: %v", err))
+	}
+
+	attachments[name] = map[string]interface{}{
+		"content_type": contentType,
+		"size":         size,
+		"sha256":       sums.Sha256,
+		"created_at":   time.Now().UTC().Format(time.RFC3339),
+	}
+	m["attachments"] = attachments
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageUpdated, uuid)
+	return Success, m
+}
+
+// Remove the attachment from the manifest and the storage
+func doServerDeleteImageAttachment(params url.Values, uuid string) (int, map[string]interface{}) {
+	code, content := checkAttachmentParameters(params)
+	if content != nil {
+		return code, content
+	}
+	name := params.Get("name")
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	attachments := map[string]interface{}{}
+	for k, v := range getManifestAttachments(m) {
+		attachments[k] = v
+	}
+	if _, exists := attachments[name]; !exists {
+		return errorResponse(CodeResourceNotFound, fmt.Sprintf("The image has no attachment \"%s\"", name))
+	}
+
+	delete(attachments, name)
+	if len(attachments) == 0 {
+		delete(m, "attachments")
+	} else {
+		m["attachments"] = attachments
+	}
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest: %v", err))
+	}
+
+	storage.DeleteFile(uuid, attachmentFileName(name))
+	publishImageEvent(EventImageUpdated, uuid)
+	return Success, m
+}
+
+/*
+ListImageAttachments	GET /images/:uuid/attachments	Get the attachments of the image.
+*/
+func serverListImageAttachments(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+	sendResponse(w, Success, getManifestAttachments(m))
+}
+
+/*
+GetImageAttachment	GET /images/:uuid/attachments/:name	Get an attachment of the image.
+*/
+func serverGetImageAttachment(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := checkAttachmentParameters(params)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+	name := params.Get("name")
+	attachment, ok := getManifestAttachments(m)[name].(map[string]interface{})
+	if !ok {
+		sendError(w, CodeResourceNotFound, fmt.Sprintf("The image has no attachment \"%s\"", name))
+		return
+	}
+
+	contentType, _ := attachment["content_type"].(string)
+	etag := ""
+	if sum, ok := attachment["sha256"].(string); ok {
+		etag = "\"" + sum + "\""
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	serveFile(w, r, uuid, attachmentFileName(name), contentType, etag)
+}
+
+/*
+PutImageAttachment	PUT /images/:uuid/attachments/:name	Add (or replace) an attachment of the image.
+*/
+func serverPutImageAttachment(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerPutImageAttachment(r, params, uuid)
+	sendResponse(w, code, content)
+}
+
+/*
+DeleteImageAttachment	DELETE /images/:uuid/attachments/:name	Remove an attachment from the image.
+*/
+func serverDeleteImageAttachment(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerDeleteImageAttachment(params, uuid)
+	sendResponse(w, code, content)
+}
+
+// Get the names of the attachments of the image (sorted)
+func attachmentNames(m map[string]interface{}) []string {
+	var names []string
+	for name := range getManifestAttachments(m) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/**
+ * Fetch the attachments listed in the manifest from the remote server
+ * (see doServerImportRemoteImage) and verify them against the sha256
+ * and size in the remote manifest.
+ */
+func doFetchRemoteAttachments(source string, uuid string, m map[string]interface{}) (int, map[string]interface{}) {
+	for _, name := range attachmentNames(m) {
+		attachment, _ := getManifestAttachments(m)[name].(map[string]interface{})
+		resp, err := remoteGet(source + "/attachments/" + url.PathEscape(name))
+		if err != nil {
+			return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to fetch attachment %s: %v", name, err))
+		}
+
+		// Verify the attachment before it replaces the current one
+		path, sums, size, err := spoolImageFile(&sizeLimitReader{reader: resp.Body, remaining: maxAttachmentSize(), err: errAttachmentTooLarge})
+		resp.Body.Close()
+		if err != nil {
+			return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to download attachment %s: %v", name, err))
+		}
+
+		err = sums.verify(attachment)
+		if expected, ok := attachment["size"].(float64); err == nil && ok && int64(expected) != size {
+			err = fmt.Errorf("Incorrect size. expected %d got %d", int64(expected), size)
+		}
+		if err != nil {
+			os.Remove(path)
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("Attachment %s: %v", name, err))
+		}
+		_, err = storage.MoveFile(uuid, attachmentFileName(name), path)
+		os.Remove(path)
+		if err != nil {
+			return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store attachment %s: %v", name, err))
+		}
+	}
+	return Success, nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of entries returned by GET /audit unless limit is set
+const defaultAuditLimit = 1000
+
+// An entry in the audit log
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	User      string    `json:"user,omitempty"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Uuid      string    `json:"uuid,omitempty"`
+	RequestId string    `json:"request_id,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	DryRun    bool      `json:"dry_run,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+}
+
+/**
+ * The audit log records all of the requests which may modify the images
+ * (POST, PUT and DELETE) as JSON lines appended to the file specified
+ * by audit_log in the configuration.
+ */
+var auditLog struct {
+	sync.Mutex
+	file *os.File
+}
+
+type auditLogKey struct{}
+
+/**
+ * auditWriter wraps the http.ResponseWriter to record the status code
+ * sent to the client.
+ */
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (a *auditWriter) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *auditWriter) Write(data []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	return a.ResponseWriter.Write(data)
+}
+
+// Let http.ResponseController reach the connection (see timeouts.go)
+func (a *auditWriter) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
+
+// Pass on io.ReaderFrom so that the files may be sent with sendfile
+func (a *auditWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	return readFrom(a.ResponseWriter, reader)
+}
+
+// Flush the response to the client (used by the event stream)
+func (a *auditWriter) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Open the audit log specified in the configuration
+func openAuditLog() error {
+	if len(configuration.AuditLog) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(configuration.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog.file = f
+	return nil
+}
+
+/**
+ * Record the authenticated user in the audit log entry for the
+ * request (called when the user is authenticated)
+ */
+func auditLogUser(r *http.Request, user *UserEntry) {
+	entry, ok := r.Context().Value(auditLogKey{}).(*auditEntry)
+	if ok && user != nil {
+		entry.User = user.Name
+	}
+}
+
+// Record the uuid of the image created by the request in the audit log
+func auditLogUuid(r *http.Request, uuid string) {
+	entry, ok := r.Context().Value(auditLogKey{}).(*auditEntry)
+	if ok {
+		entry.Uuid = uuid
+	}
+}
+
+func isMutatingRequest(r *http.Request) bool {
+	return r.Method == "POST" || r.Method == "PUT" || r.Method == "DELETE"
+}
+
+// Get the IP address of the client (without the port)
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func appendAuditEntry(entry *auditEntry) error {
+	a, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditLog.Lock()
+	defer auditLog.Unlock()
+	_, err = auditLog.file.Write(append(a, '\n'))
+	return err
+}
+
+// Wrap the handler to record the mutating requests (if enabled)
+func withAuditLog(handler http.Handler) http.Handler {
+	if auditLog.file == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutatingRequest(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		entry := &auditEntry{
+			Time:      time.Now().UTC(),
+			Remote:    remoteIp(r),
+			Method:    r.Method,
+			Action:    r.URL.Query().Get("action"),
+			RequestId: requestId(r),
+		}
+		if route, vars, _, _ := imageRouter.lookup(r); route != nil {
+			entry.Endpoint = route.name
+			entry.Uuid = vars["uuid"]
+		}
+
+		writer := &auditWriter{ResponseWriter: w}
+		handler.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), auditLogKey{}, entry)))
+
+		entry.Status = writer.status
+		entry.DryRun = w.Header().Get(dryRunHeader) == "true"
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		entry.Outcome = "success"
+		if entry.Status >= 400 {
+			entry.Outcome = "failure"
+		}
+
+		err := appendAuditEntry(entry)
+		if err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	})
+}
+
+// Parse a time in RFC3339 format for the since and until parameters
+func parseAuditTime(key string, value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid value for \"%s\": \"%s\"", key, value)
+	}
+	return t, nil
+}
+
+/**
+ * Search the audit log
+ *
+ * @param params the filters (user, since, until and limit)
+ * @return the HTTP code and the matching entries (the latest entries
+ *         if there is more than limit)
+ */
+func doServerGetAudit(params url.Values) (int, map[string]interface{}) {
+	var user string
+	var since, until time.Time
+	limit := defaultAuditLimit
+	var err error
+	for k, v := range params {
+		switch k {
+		case "user":
+			user = v[0]
+		case "since":
+			since, err = parseAuditTime(k, v[0])
+		case "until":
+			until, err = parseAuditTime(k, v[0])
+		case "limit":
+			limit, err = strconv.Atoi(v[0])
+			if err == nil && limit <= 0 {
+				err = fmt.Errorf("Invalid value for \"limit\": \"%s\"", v[0])
+			}
+		default:
+			err = fmt.Errorf("Invalid parameter: %s", k)
+		}
+		if err != nil {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+		}
+	}
+
+	if auditLog.file == nil {
+		return errorResponse(CodeNotAvailable, "The audit log is not enabled")
+	}
+
+	f, err := os.Open(configuration.AuditLog)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to open audit log: %v", err))
+	}
+	defer f.Close()
+
+	entries := make([]auditEntry, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if len(user) > 0 && entry.User != user {
+			continue
+		}
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			continue
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read audit log: %v", err))
+	}
+
+	return Success, map[string]interface{}{
+		"entries": entries,
+	}
+}
+
+/*
+AdminGetAudit	GET /audit	Search the audit log of the requests modifying the images.
+*/
+func serverGetAudit(w http.ResponseWriter, r *http.Request) {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+		return
+	}
+
+	code, content = requireOperator(user)
+	if content == nil {
+		code, content = doServerGetAudit(r.URL.Query())
+	}
+	sendResponse(w, code, content)
+}
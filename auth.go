@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The maximum difference between the Date header and the local clock
+const maxSignatureClockSkew = 5 * time.Minute
+
+/**
+ * Authenticate the user making the request. The user may use Basic
+ * Auth, an API token (see tokens.go) or http-signature (as used by
+ * imgadm and node-imgapi) where the request is signed with one of the
+ * SSH keys in the users keys directory. The users which isn't in the
+ * userdb is authenticated by the authentication provider (see
+ * auth_provider.go) if one is configured.
+ *
+ * @param r the request to authenticate
+ * @return user the authenticated user (nil if no credentials provided)
+ *         code the HTTP code to return if authentication failed
+ *         message the error message to return if authentication failed
+ */
+func authenticateRequest(r *http.Request) (user *UserEntry, code int, message map[string]interface{}) {
+	defer func() {
+		accessLogUser(r, user)
+		auditLogUser(r, user)
+		if message == nil {
+			if throttled := rateLimitUser(r, user); throttled != nil {
+				user, code, message = nil, RequestThrottled, throttled
+			}
+		}
+	}()
+
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Signature ") {
+		return authenticateSignature(r, authorization[len("Signature "):])
+	}
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return authenticateToken(r, authorization[len("Bearer "):])
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, Success, nil
+	}
+
+	user = lookupUser(username)
+	if user == nil && currentAuthProvider() != nil {
+		return authenticateWithProvider(r, username, password)
+	}
+	if user == nil {
+		logRequestf(r, "User %s does not exist", username)
+		code, content := errorResponse(CodeAccountDoesNotExist,
+			fmt.Sprintf("User %s does not exist", username))
+		return nil, code, content
+	}
+
+	if !checkPassword(user, password) {
+		logRequestf(r, "Invalid username password combo for %s", username)
+		code, content := errorResponse(CodeUnauthorizedError, "Invalid username/password combination")
+		return nil, code, content
+	}
+
+	return user, Success, nil
+}
+
+// Authenticate the user which isn't in the userdb with the authentication provider
+func authenticateWithProvider(r *http.Request, username string, password string) (*UserEntry, int, map[string]interface{}) {
+	user, err := currentAuthProvider().AuthenticatePassword(username, password)
+	if err != nil {
+		logRequestf(r, "Authentication of %s failed: %v", username, err)
+		code, content := errorResponse(CodeUnauthorizedError, "Invalid username/password combination")
+		return nil, code, content
+	}
+	return user, Success, nil
+}
+
+func lookupUser(username string) *UserEntry {
+	// The user is copied so it isn't shared with the configuration
+	userdb := currentConfiguration().Userdb
+	for i := 0; i < len(userdb); i++ {
+		if userdb[i].Name == username {
+			user := userdb[i]
+			return &user
+		}
+	}
+	return nil
+}
+
+/**
+ * Parse the parameters in the http-signature Authorization header:
+ *
+ *     keyId="/user/keys/fingerprint",algorithm="rsa-sha256",
+ *     headers="date (request-target)",signature="base64"
+ */
+func parseSignatureParameters(value string) map[string]string {
+	params := make(map[string]string)
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " ,")
+		index := strings.Index(value, "=\"")
+		if index == -1 {
+			break
+		}
+		key := value[:index]
+		value = value[index+2:]
+
+		end := strings.Index(value, "\"")
+		if end == -1 {
+			break
+		}
+		params[key] = value[:end]
+		value = value[end+1:]
+	}
+	return params
+}
+
+func authenticateSignature(r *http.Request, value string) (*UserEntry, int, map[string]interface{}) {
+	user, err := verifySignature(r, parseSignatureParameters(value))
+	if err != nil {
+		logRequestf(r, "http-signature authentication failed: %v", err)
+		code, content := errorResponse(CodeUnauthorizedError, fmt.Sprintf("%v", err))
+		return nil, code, content
+	}
+	return user, Success, nil
+}
+
+func verifySignature(r *http.Request, params map[string]string) (*UserEntry, error) {
+	// keyId is "/login/keys/fingerprint" (the SHA256 fingerprint may contain /)
+	parts := strings.SplitN(params["keyId"], "/", 4)
+	if len(parts) != 4 || parts[0] != "" || parts[2] != "keys" {
+		return nil, fmt.Errorf("Invalid keyId \"%s\"", params["keyId"])
+	}
+
+	user := lookupUser(parts[1])
+	if user == nil || len(user.Keys) == 0 {
+		return nil, fmt.Errorf("No keys for user \"%s\"", parts[1])
+	}
+
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+
+	// The signature must cover the Date and the request (method and path)
+	// so that it can't be replayed later or for another request
+	if !stringInSlice("date", headers) ||
+		!(stringInSlice("(request-target)", headers) || stringInSlice("request-line", headers)) {
+		return nil, errors.New("The signed headers must include date and (request-target)")
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return nil, errors.New("Missing or invalid Date header")
+	}
+	skew := time.Since(date)
+	if skew > maxSignatureClockSkew || skew < -maxSignatureClockSkew {
+		return nil, errors.New("Date header is too skewed")
+	}
+
+	var lines []string
+	for _, header := range headers {
+		switch header {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s",
+				strings.ToLower(r.Method), r.URL.RequestURI()))
+		case "request-line":
+			lines = append(lines, fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), r.Proto))
+		case "host":
+			lines = append(lines, "host: "+r.Host)
+		default:
+			lines = append(lines, header+": "+r.Header.Get(header))
+		}
+	}
+	signingString := []byte(strings.Join(lines, "\n"))
+
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, errors.New("Invalid signature encoding")
+	}
+
+	key, err := findUserKey(user, parts[3])
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyWithKey(key, strings.ToLower(params["algorithm"]), signingString, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+/**
+ * Look for the SSH public key with the requested fingerprint in the
+ * users keys directory (all files named *.pub). The fingerprint may
+ * be the legacy MD5 (aa:bb:..) or the SHA256 (SHA256:base64) form.
+ */
+func findUserKey(user *UserEntry, fingerprint string) (crypto.PublicKey, error) {
+	files, err := filepath.Glob(filepath.Join(user.Keys, "*.pub"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Printf("Failed to read key %s: %v", file, err)
+			continue
+		}
+
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+
+			blob, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+
+			md5sum := md5.Sum(blob)
+			var md5hex []string
+			for _, b := range md5sum {
+				md5hex = append(md5hex, fmt.Sprintf("%02x", b))
+			}
+			sha256sum := sha256.Sum256(blob)
+
+			if fingerprint == strings.Join(md5hex, ":") ||
+				fingerprint == "SHA256:"+base64.RawStdEncoding.EncodeToString(sha256sum[:]) {
+				return parseSshPublicKey(blob)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown key \"%s\"", fingerprint)
+}
+
+// Read a length prefixed string from the SSH wire format
+func readSshString(blob []byte) (value []byte, rest []byte, err error) {
+	if len(blob) < 4 {
+		return nil, nil, errors.New("Invalid SSH key")
+	}
+	length := binary.BigEndian.Uint32(blob)
+	if uint32(len(blob)-4) < length {
+		return nil, nil, errors.New("Invalid SSH key")
+	}
+	return blob[4 : 4+length], blob[4+length:], nil
+}
+
+// Parse a public key in the SSH wire format (RSA, ECDSA and Ed25519)
+func parseSshPublicKey(blob []byte) (crypto.PublicKey, error) {
+	keytype, rest, err := readSshString(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	switch string(keytype) {
+	case "ssh-rsa":
+		var e, n []byte
+		e, rest, err = readSshString(rest)
+		if err == nil {
+			n, rest, err = readSshString(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+		var point []byte
+		_, rest, err = readSshString(rest)
+		if err == nil {
+			point, rest, err = readSshString(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var curve elliptic.Curve
+		switch string(keytype) {
+		case "ecdsa-sha2-nistp256":
+			curve = elliptic.P256()
+		case "ecdsa-sha2-nistp384":
+			curve = elliptic.P384()
+		default:
+			curve = elliptic.P521()
+		}
+
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errors.New("Invalid ECDSA key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "ssh-ed25519":
+		var key []byte
+		key, rest, err = readSshString(rest)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("Invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(key), nil
+	}
+
+	return nil, fmt.Errorf("Unsupported key type \"%s\"", keytype)
+}
+
+// Verify the signature of data with the public key
+func verifyWithKey(key crypto.PublicKey, algorithm string, data []byte, signature []byte) error {
+	hashes := map[string]crypto.Hash{
+		"sha1":   crypto.SHA1,
+		"sha256": crypto.SHA256,
+		"sha512": crypto.SHA512,
+	}
+
+	parts := strings.SplitN(algorithm, "-", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("Unsupported algorithm \"%s\"", algorithm)
+	}
+
+	var digest []byte
+	hash, ok := hashes[parts[1]]
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case crypto.SHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		digest = sum[:]
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if parts[0] != "rsa" || !ok {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+			return nil
+		}
+		return errors.New("Invalid signature")
+
+	case *ecdsa.PublicKey:
+		if parts[0] != "ecdsa" || !ok {
+			break
+		}
+		if ecdsa.VerifyASN1(k, digest, signature) {
+			return nil
+		}
+		return errors.New("Invalid signature")
+
+	case ed25519.PublicKey:
+		if parts[0] != "ed25519" {
+			break
+		}
+		if ed25519.Verify(k, data, signature) {
+			return nil
+		}
+		return errors.New("Invalid signature")
+	}
+
+	return fmt.Errorf("Algorithm \"%s\" does not match the key", algorithm)
+}
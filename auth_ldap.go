@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The result code of a successful LDAP operation
+const ldapSuccess = 0
+
+// The maximum size of the response to the bind request
+const maxLdapResponseSize = 64 * 1024
+
+/**
+ * The ldap provider verifies a username and password by binding to an
+ * LDAP server (a simple bind as described in RFC 4511) with the DN
+ * created from "bind_dn" where %s is replaced with the username:
+ *
+ *     "url" : "ldaps://ldap.example.com",
+ *     "bind_dn" : "uid=%s,ou=people,dc=example,dc=com"
+ *
+ * The connection use TLS for ldaps:// urls. The users get the
+ * default_role as the directory isn't searched for the role.
+ */
+type ldapAuthProvider struct {
+	config AuthProviderConfig
+	url    *url.URL
+}
+
+// The BindRequest (with the simple authentication)
+type ldapBindRequest struct {
+	Version  int
+	Name     []byte
+	Password []byte `asn1:"tag:0"`
+}
+
+// The LDAPMessage with the protocol operation
+type ldapMessage struct {
+	Id int
+	Op asn1.RawValue
+}
+
+var errInvalidLdapResponse = errors.New("Invalid LDAP response")
+
+func newLdapAuthProvider(config AuthProviderConfig) (AuthProvider, error) {
+	u, err := url.Parse(config.Url)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("ldap authentication provider requires an ldap:// or ldaps:// \"url\"")
+	}
+	if strings.Count(config.BindDn, "%s") != 1 {
+		return nil, fmt.Errorf("ldap authentication provider requires \"bind_dn\" with %%s for the username")
+	}
+	return &ldapAuthProvider{config: config, url: u}, nil
+}
+
+// Escape the special characters in a value in a DN (see RFC 4514)
+func escapeLdapDn(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) != -1,
+			c == ' ' && (i == 0 || i == len(value)-1),
+			c == '#' && i == 0:
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&escaped, "\\%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func (p *ldapAuthProvider) dial() (net.Conn, error) {
+	host := p.url.Host
+	if len(p.url.Port()) == 0 {
+		if p.url.Scheme == "ldaps" {
+			host = net.JoinHostPort(p.url.Hostname(), "636")
+		} else {
+			host = net.JoinHostPort(p.url.Hostname(), "389")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: authProviderTimeout}
+	if p.url.Scheme == "ldaps" {
+		return tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: p.url.Hostname()})
+	}
+	return dialer.Dial("tcp", host)
+}
+
+/**
+ * Get the next BER element in the data. The servers may use the long
+ * form of the length even for short elements (like Active Directory),
+ * so the response can't be decoded with encoding/asn1 which requires
+ * DER.
+ *
+ * @return tag the identifier octet of the element
+ *         content the content octets of the element
+ *         rest the data following the element
+ */
+func nextBerElement(data []byte) (tag byte, content []byte, rest []byte, err error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errInvalidLdapResponse
+	}
+	tag = data[0]
+	length := int(data[1])
+	data = data[2:]
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count == 0 || count > 4 || len(data) < count {
+			return 0, nil, nil, errInvalidLdapResponse
+		}
+		length = 0
+		for _, b := range data[:count] {
+			length = length<<8 | int(b)
+		}
+		data = data[count:]
+	}
+	if length < 0 || length > len(data) {
+		return 0, nil, nil, errInvalidLdapResponse
+	}
+	return tag, data[:length], data[length:], nil
+}
+
+// Read one LDAPMessage (a BER encoded sequence) from the connection
+func readLdapMessage(reader io.Reader) ([]byte, error) {
+	header := make([]byte, 2, 6)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x30 {
+		return nil, errInvalidLdapResponse
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		count := length & 0x7f
+		if count == 0 || count > 4 {
+			return nil, errInvalidLdapResponse
+		}
+		header = header[:2+count]
+		_, err = io.ReadFull(reader, header[2:])
+		if err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range header[2:] {
+			length = length<<8 | int(b)
+		}
+	}
+	if length < 0 || length > maxLdapResponseSize {
+		return nil, errors.New("The LDAP response is too large")
+	}
+
+	message := make([]byte, len(header)+length)
+	copy(message, header)
+	_, err = io.ReadFull(reader, message[len(header):])
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+/**
+ * Get the resultCode and diagnosticMessage from the BindResponse:
+ *
+ *     LDAPMessage ::= SEQUENCE {
+ *         messageID       INTEGER,
+ *         bindResponse    [APPLICATION 1] SEQUENCE {
+ *             resultCode         ENUMERATED,
+ *             matchedDN          OCTET STRING,
+ *             diagnosticMessage  OCTET STRING, ... }, ... }
+ */
+func parseLdapBindResponse(data []byte, id int) (int, string, error) {
+	tag, message, _, err := nextBerElement(data)
+	if err != nil || tag != 0x30 {
+		return 0, "", errInvalidLdapResponse
+	}
+
+	var value []byte
+	tag, value, message, err = nextBerElement(message)
+	if err != nil || tag != 0x02 || len(value) != 1 || int(value[0]) != id {
+		return 0, "", errInvalidLdapResponse
+	}
+
+	var response []byte
+	tag, response, _, err = nextBerElement(message)
+	if err != nil || tag != 0x61 {
+		return 0, "", errInvalidLdapResponse
+	}
+
+	tag, value, response, err = nextBerElement(response)
+	if err != nil || tag != 0x0a || len(value) == 0 || len(value) > 4 {
+		return 0, "", errInvalidLdapResponse
+	}
+	code := 0
+	for _, b := range value {
+		code = code<<8 | int(b)
+	}
+
+	// The diagnosticMessage follows the matchedDN
+	_, _, response, err = nextBerElement(response)
+	if err == nil {
+		_, value, _, err = nextBerElement(response)
+	}
+	if err != nil {
+		return 0, "", errInvalidLdapResponse
+	}
+	return code, string(value), nil
+}
+
+// Bind to the server as the DN with the password
+func (p *ldapAuthProvider) bind(dn string, password string) error {
+	op, err := asn1.MarshalWithParams(ldapBindRequest{
+		Version:  3,
+		Name:     []byte(dn),
+		Password: []byte(password),
+	}, "application,tag:0")
+	if err != nil {
+		return err
+	}
+	request, err := asn1.Marshal(ldapMessage{Id: 1, Op: asn1.RawValue{FullBytes: op}})
+	if err != nil {
+		return err
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %v", p.url.Host, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(authProviderTimeout))
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("Failed to send bind request: %v", err)
+	}
+	content, err := readLdapMessage(conn)
+	if err != nil {
+		return fmt.Errorf("Failed to read bind response: %v", err)
+	}
+
+	code, diagnostic, err := parseLdapBindResponse(content, 1)
+	if err != nil {
+		return err
+	}
+	if code != ldapSuccess {
+		return fmt.Errorf("LDAP bind failed with result code %d %s", code, diagnostic)
+	}
+	return nil
+}
+
+func (p *ldapAuthProvider) AuthenticatePassword(username string, password string) (*UserEntry, error) {
+	// A bind without a password is an anonymous bind which succeeds
+	if len(username) == 0 || len(password) == 0 {
+		return nil, errors.New("The username and password must be provided")
+	}
+
+	err := p.bind(fmt.Sprintf(p.config.BindDn, escapeLdapDn(username)), password)
+	if err != nil {
+		return nil, err
+	}
+	return providerUser(p.config, username, "", "")
+}
+
+func (p *ldapAuthProvider) AuthenticateToken(token string) (*UserEntry, error) {
+	return nil, errUnsupportedCredentials
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/asn1"
+	"net"
+	"testing"
+)
+
+// The start of the BindResponse (the LDAPResult)
+type testLdapBindResponse struct {
+	ResultCode asn1.Enumerated
+	MatchedDn  []byte
+	Message    []byte
+}
+
+// Answer the bind requests with success for the DN and password
+func startTestLdapServer(t *testing.T, dn string, password string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			var message ldapMessage
+			var request ldapBindRequest
+			content, err := readLdapMessage(conn)
+			if err == nil {
+				_, err = asn1.Unmarshal(content, &message)
+			}
+			if err == nil {
+				_, err = asn1.UnmarshalWithParams(message.Op.FullBytes, &request, "application,tag:0")
+			}
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			// 49 is invalidCredentials
+			response := testLdapBindResponse{ResultCode: 49, Message: []byte("Invalid credentials")}
+			if request.Version == 3 && string(request.Name) == dn && string(request.Password) == password {
+				response = testLdapBindResponse{ResultCode: ldapSuccess}
+			}
+			op, _ := asn1.MarshalWithParams(response, "application,tag:1")
+			reply, _ := asn1.Marshal(ldapMessage{Id: message.Id, Op: asn1.RawValue{FullBytes: op}})
+			conn.Write(reply)
+			conn.Close()
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func TestLdapAuthProvider(t *testing.T) {
+	url := startTestLdapServer(t, "uid=trond,ou=people,dc=example,dc=com", "secret")
+	provider, err := newLdapAuthProvider(AuthProviderConfig{
+		Type:        "ldap",
+		Url:         url,
+		BindDn:      "uid=%s,ou=people,dc=example,dc=com",
+		DefaultRole: RoleReadOnly,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+
+	user, err := provider.AuthenticatePassword("trond", "secret")
+	if err != nil {
+		t.Fatalf("Expected the bind to succeed: %v", err)
+	}
+	if user.Name != "trond" || user.Role != RoleReadOnly {
+		t.Errorf("Expected trond with the default role, got %v", user)
+	}
+
+	for _, credentials := range [][2]string{{"trond", "wrong"}, {"trond", ""}, {"trond,ou=admins", "secret"}} {
+		_, err = provider.AuthenticatePassword(credentials[0], credentials[1])
+		if err == nil {
+			t.Errorf("Expected the bind of %s with \"%s\" to fail", credentials[0], credentials[1])
+		}
+	}
+}
+
+func TestEscapeLdapDn(t *testing.T) {
+	tests := map[string]string{
+		"trond":        "trond",
+		"a,b=c":        "a\\,b\\=c",
+		" #admin ":     "\\ #admin\\ ",
+		"#admin":       "\\#admin",
+		"back\\slash+": "back\\\\slash\\+",
+		"nul\x00":      "nul\\00",
+	}
+	for value, expected := range tests {
+		if escaped := escapeLdapDn(value); escaped != expected {
+			t.Errorf("Expected %s to be escaped as %s, got %s", value, expected, escaped)
+		}
+	}
+}
+
+func TestParseLdapBindResponse(t *testing.T) {
+	// The lengths in the long form (as used by Active Directory)
+	response := []byte{
+		0x30, 0x84, 0x00, 0x00, 0x00, 0x10, 0x02, 0x01, 0x01,
+		0x61, 0x84, 0x00, 0x00, 0x00, 0x07, 0x0a, 0x01, 0x31, 0x04, 0x00, 0x04, 0x00,
+	}
+	code, _, err := parseLdapBindResponse(response, 1)
+	if err != nil || code != 49 {
+		t.Errorf("Expected the result code 49, got %d: %v", code, err)
+	}
+
+	_, _, err = parseLdapBindResponse(response, 2)
+	if err == nil {
+		t.Errorf("Expected the response to another message to be rejected")
+	}
+	_, _, err = parseLdapBindResponse(response[:len(response)-3], 1)
+	if err == nil {
+		t.Errorf("Expected the truncated response to be rejected")
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The seconds to remember a successful authentication unless cache_ttl is set
+const defaultAuthCacheTtl = 60
+
+// The timeout for the requests to the introspection endpoint
+const authProviderTimeout = 10 * time.Second
+
+/**
+ * An AuthProvider authenticates the users which isn't in the userdb
+ * (like the users in an LDAP directory or an OpenID Connect provider).
+ * The returned user is used like a user from the userdb, so the
+ * provider must set the role.
+ */
+type AuthProvider interface {
+	/**
+	 * Verify the username and password (as provided with Basic Auth)
+	 *
+	 * @return the user (or the error if the credentials is invalid)
+	 */
+	AuthenticatePassword(username string, password string) (*UserEntry, error)
+
+	/**
+	 * Verify the bearer token (which isn't an API token from the tokendb)
+	 *
+	 * @return the user (or the error if the token is invalid)
+	 */
+	AuthenticateToken(token string) (*UserEntry, error)
+}
+
+// The configuration of the authentication provider in the configuration file
+type AuthProviderConfig struct {
+	Type string `json:"type"`
+	// The introspection endpoint (for oidc) or the server (for ldap)
+	Url          string `json:"url"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// The DN to bind as with %s for the username (for ldap)
+	BindDn string `json:"bind_dn"`
+	// The command to run (for command)
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// The role of the users unless the provider specifies it
+	DefaultRole string `json:"default_role"`
+	// Seconds to remember a successful authentication
+	CacheTtl int `json:"cache_ttl"`
+}
+
+/**
+ * The registry of the available provider types. Each entry creates an
+ * AuthProvider for the provided configuration.
+ */
+var authProviderTypes = map[string]func(config AuthProviderConfig) (AuthProvider, error){
+	"oidc":    newOidcAuthProvider,
+	"ldap":    newLdapAuthProvider,
+	"command": newCommandAuthProvider,
+}
+
+// Register a new authentication provider type to the registry
+func RegisterAuthProviderType(name string, factory func(config AuthProviderConfig) (AuthProvider, error)) {
+	authProviderTypes[name] = factory
+}
+
+var errUnsupportedCredentials = errors.New("The authentication provider does not support the credentials")
+
+// The provider from the configuration (nil if only the userdb is used)
+var authProvider AuthProvider
+
+// Protects authProvider which is replaced when the configuration is reloaded
+var authProviderLock sync.RWMutex
+
+func currentAuthProvider() AuthProvider {
+	authProviderLock.RLock()
+	defer authProviderLock.RUnlock()
+	return authProvider
+}
+
+// Create the provider from the configuration (nil if there is none)
+func newAuthProvider(config AuthProviderConfig) (AuthProvider, error) {
+	if len(config.Type) == 0 {
+		return nil, nil
+	}
+
+	factory, ok := authProviderTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown authentication provider type \"%s\"", config.Type)
+	}
+
+	provider, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := config.CacheTtl
+	if ttl == 0 {
+		ttl = defaultAuthCacheTtl
+	}
+	if ttl > 0 {
+		provider = &cachingAuthProvider{
+			provider: provider,
+			ttl:      time.Duration(ttl) * time.Second,
+			users:    make(map[string]cachedAuthUser),
+		}
+	}
+	return provider, nil
+}
+
+// Set up the authentication provider from the configuration
+func initAuthProvider() error {
+	provider, err := newAuthProvider(currentConfiguration().Auth)
+	if err != nil {
+		return err
+	}
+	authProviderLock.Lock()
+	authProvider = provider
+	authProviderLock.Unlock()
+	return nil
+}
+
+// Get the role for the user (the default role unless the provider set it)
+func providerRole(config AuthProviderConfig, role string) string {
+	if len(role) > 0 {
+		return role
+	}
+	if len(config.DefaultRole) > 0 {
+		return config.DefaultRole
+	}
+	return RoleUser
+}
+
+// Verify that the role from the provider is valid
+func providerUser(config AuthProviderConfig, name string, role string, uuid string) (*UserEntry, error) {
+	user := &UserEntry{Name: name, Role: providerRole(config, role), Uuid: uuid}
+	err := validateUserRoles([]UserEntry{*user})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+type cachedAuthUser struct {
+	user    *UserEntry
+	expires time.Time
+}
+
+/**
+ * cachingAuthProvider remembers the successful authentications for a
+ * while so that the provider isn't asked for every request. The cache
+ * is keyed by a digest of the credentials.
+ */
+type cachingAuthProvider struct {
+	sync.Mutex
+	provider AuthProvider
+	ttl      time.Duration
+	users    map[string]cachedAuthUser
+}
+
+func (c *cachingAuthProvider) cached(key string, authenticate func() (*UserEntry, error)) (*UserEntry, error) {
+	digest := sha256.Sum256([]byte(key))
+	k := string(digest[:])
+
+	now := time.Now()
+	c.Lock()
+	entry, ok := c.users[k]
+	if ok && now.After(entry.expires) {
+		delete(c.users, k)
+		ok = false
+	}
+	c.Unlock()
+	if ok {
+		return entry.user, nil
+	}
+
+	user, err := authenticate()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	for key, entry := range c.users {
+		if now.After(entry.expires) {
+			delete(c.users, key)
+		}
+	}
+	c.users[k] = cachedAuthUser{user: user, expires: now.Add(c.ttl)}
+	c.Unlock()
+	return user, nil
+}
+
+func (c *cachingAuthProvider) AuthenticatePassword(username string, password string) (*UserEntry, error) {
+	return c.cached("password\x00"+username+"\x00"+password, func() (*UserEntry, error) {
+		return c.provider.AuthenticatePassword(username, password)
+	})
+}
+
+func (c *cachingAuthProvider) AuthenticateToken(token string) (*UserEntry, error) {
+	return c.cached("token\x00"+token, func() (*UserEntry, error) {
+		return c.provider.AuthenticateToken(token)
+	})
+}
+
+/**
+ * The oidc provider verifies bearer tokens with an OAuth 2.0 token
+ * introspection endpoint (RFC 7662) like the one provided by Keycloak
+ * or other OpenID Connect providers. The user name is the "username"
+ * (or "sub") in the response, and the role and account uuid may be
+ * provided in the "imgapi_role" and "imgapi_uuid" claims.
+ */
+type oidcAuthProvider struct {
+	config AuthProviderConfig
+	client *http.Client
+}
+
+func newOidcAuthProvider(config AuthProviderConfig) (AuthProvider, error) {
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("oidc authentication provider requires \"url\"")
+	}
+	return &oidcAuthProvider{config: config, client: &http.Client{Timeout: authProviderTimeout}}, nil
+}
+
+func (p *oidcAuthProvider) AuthenticatePassword(username string, password string) (*UserEntry, error) {
+	return nil, errUnsupportedCredentials
+}
+
+func (p *oidcAuthProvider) AuthenticateToken(token string) (*UserEntry, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest("POST", p.config.Url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if len(p.config.ClientId) > 0 {
+		req.SetBasicAuth(p.config.ClientId, p.config.ClientSecret)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Token introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Token introspection returned %s", resp.Status)
+	}
+
+	var result struct {
+		Active   bool   `json:"active"`
+		Username string `json:"username"`
+		Subject  string `json:"sub"`
+		Role     string `json:"imgapi_role"`
+		Uuid     string `json:"imgapi_uuid"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode introspection response: %v", err)
+	}
+	if !result.Active {
+		return nil, errors.New("The token is not active")
+	}
+
+	name := result.Username
+	if len(name) == 0 {
+		name = result.Subject
+	}
+	if len(name) == 0 {
+		return nil, errors.New("The introspection response has no username")
+	}
+	return providerUser(p.config, name, result.Role, result.Uuid)
+}
+
+/**
+ * The command provider runs an external command (like a script using
+ * ldapwhoami to bind to an LDAP server) to verify a username and
+ * password. The username is provided in the IMGAPI_USERNAME environment
+ * variable and the password on standard input. The credentials is
+ * valid if the command exits with 0, and the command may write a JSON
+ * object with the "role" and "uuid" of the user to standard output.
+ */
+type commandAuthProvider struct {
+	config AuthProviderConfig
+}
+
+func newCommandAuthProvider(config AuthProviderConfig) (AuthProvider, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("command authentication provider requires \"command\"")
+	}
+	return &commandAuthProvider{config: config}, nil
+}
+
+func (p *commandAuthProvider) AuthenticatePassword(username string, password string) (*UserEntry, error) {
+	cmd := exec.Command(p.config.Command, p.config.Args...)
+	cmd.Env = append(os.Environ(), "IMGAPI_USERNAME="+username)
+	cmd.Stdin = strings.NewReader(password + "\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v %s", p.config.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var result struct {
+		Role string `json:"role"`
+		Uuid string `json:"uuid"`
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) > 0 {
+		err = json.Unmarshal(stdout.Bytes(), &result)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode output from %s: %v", p.config.Command, err)
+		}
+	}
+	return providerUser(p.config, username, result.Role, result.Uuid)
+}
+
+func (p *commandAuthProvider) AuthenticateToken(token string) (*UserEntry, error) {
+	return nil, errUnsupportedCredentials
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Encode the values as strings in the SSH wire format
+func sshWireStrings(values ...[]byte) []byte {
+	var blob []byte
+	for _, value := range values {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(value)))
+		blob = append(append(blob, length...), value...)
+	}
+	return blob
+}
+
+// Add a user with an Ed25519 key and return the key and its keyId
+func setupSignatureUser(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	blob := sshWireStrings([]byte("ssh-ed25519"), public)
+	dir := t.TempDir()
+	line := "ssh-ed25519 " + base64.StdEncoding.EncodeToString(blob) + " trond@test\n"
+	err = ioutil.WriteFile(filepath.Join(dir, "id_ed25519.pub"), []byte(line), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	configuration = Configuration{Userdb: []UserEntry{{Name: "trond", Keys: dir}}}
+	sum := sha256.Sum256(blob)
+	return private, "/trond/keys/SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Create a request signed with the headers
+func signedRequest(t *testing.T, key ed25519.PrivateKey, keyId string, headers string) *http.Request {
+	t.Helper()
+	r, err := http.NewRequest("GET", "http://localhost/images?state=all", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	var lines []string
+	for _, header := range strings.Fields(headers) {
+		switch header {
+		case "(request-target)":
+			lines = append(lines, "(request-target): get /images?state=all")
+		case "request-line":
+			lines = append(lines, "GET /images?state=all "+r.Proto)
+		default:
+			lines = append(lines, header+": "+r.Header.Get(header))
+		}
+	}
+	signature := ed25519.Sign(key, []byte(strings.Join(lines, "\n")))
+	r.Header.Set("Authorization", fmt.Sprintf("Signature keyId=\"%s\",algorithm=\"ed25519-sha512\",headers=\"%s\",signature=\"%s\"",
+		keyId, headers, base64.StdEncoding.EncodeToString(signature)))
+	return r
+}
+
+func TestVerifySignatureHeaders(t *testing.T) {
+	key, keyId := setupSignatureUser(t)
+
+	for _, headers := range []string{"date (request-target)", "request-line date"} {
+		r := signedRequest(t, key, keyId, headers)
+		user, err := verifySignature(r, parseSignatureParameters(strings.TrimPrefix(r.Header.Get("Authorization"), "Signature ")))
+		if err != nil || user == nil || user.Name != "trond" {
+			t.Errorf("Expected the signature of \"%s\" to be valid, got %v", headers, err)
+		}
+	}
+
+	// The signature must cover both the date and the request
+	for _, headers := range []string{"", "date", "(request-target)", "host date"} {
+		r := signedRequest(t, key, keyId, headers)
+		_, err := verifySignature(r, parseSignatureParameters(strings.TrimPrefix(r.Header.Get("Authorization"), "Signature ")))
+		if err == nil {
+			t.Errorf("Expected the signature of \"%s\" to be rejected", headers)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * A backup is a tar archive (compressed with gzip if the name ends with
+ * .gz or .tgz) with all of the images and the user database:
+ *
+ *     backup.json                    {"v": 1, "created_at": ..., "changed": [...]}
+ *     images/uuid/manifest.json
+ *     images/uuid/file0.gz
+ *     images/uuid/icon
+ *     userdb.json                    (the userdb_file if configured)
+ *
+ * An incremental backup (with -since) only contains the files of the
+ * images published or with files modified after the time (listed in
+ * "changed"). The manifests of all of the images is always included
+ * since the storage doesn't track when they were modified, and all of
+ * the images in the storage is listed in "images" so that the images
+ * deleted since the previous backup is deleted when it is restored.
+ */
+const backupIndexName = "backup.json"
+
+type backupIndex struct {
+	V         int       `json:"v"`
+	CreatedAt time.Time `json:"created_at"`
+	Since     time.Time `json:"since,omitempty"`
+	// The images with files in the backup
+	Changed []string `json:"changed"`
+	// All of the images in the storage (only in incremental backups)
+	Images *[]string `json:"images,omitempty"`
+}
+
+func isCompressedBackup(path string) bool {
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// The files is stored directly in the image directory in the storage
+func isBackupFileName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+/**
+ * Check if the image has changed since the time: it is published after
+ * the time or one of its files (including the manifest) is modified
+ * after the time.
+ */
+func imageChangedSince(s Storage, uuid string, m map[string]interface{}, since time.Time) (bool, error) {
+	if published, ok := m["published_at"].(string); ok {
+		t, err := time.Parse(time.RFC3339, published)
+		if err == nil && t.After(since) {
+			return true, nil
+		}
+	}
+
+	names, err := s.ListFiles(uuid)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name == "manifest.json" {
+			continue
+		}
+		info, err := s.StatFile(uuid, name)
+		if err != nil {
+			return false, err
+		}
+		if info.ModTime.After(since) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Write the manifest (and the files if requested) of the image to the backup
+func writeBackupImage(s Storage, writer *tar.Writer, uuid string, m map[string]interface{}, files bool) error {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeBundleEntry(writer, "images/"+uuid+"/manifest.json", int64(len(manifest)), time.Now(), strings.NewReader(string(manifest)))
+	if err != nil {
+		return err
+	}
+	if !files {
+		return nil
+	}
+
+	names, err := s.ListFiles(uuid)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "manifest.json" {
+			continue
+		}
+		info, err := s.StatFile(uuid, name)
+		if err != nil {
+			return err
+		}
+		reader, err := s.GetFile(uuid, name)
+		if err != nil {
+			return err
+		}
+		err = writeBundleEntry(writer, "images/"+uuid+"/"+name, info.Size, info.ModTime, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to write %s/%s: %v", uuid, name, err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Write a backup of the images in the storage (changed after since
+ * unless it is zero) and the user database to the writer.
+ *
+ * @return the number of images in the backup
+ */
+func writeBackup(s Storage, w io.Writer, since time.Time) (int, error) {
+	uuids, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(uuids)
+
+	index := backupIndex{V: 1, CreatedAt: time.Now().UTC(), Since: since, Changed: []string{}}
+	manifests := map[string]map[string]interface{}{}
+	changed := map[string]bool{}
+	var images []string
+	for _, uuid := range uuids {
+		m, err := s.GetManifest(uuid)
+		if err == ErrImageNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Failed to read manifest for %s: %v", uuid, err)
+		}
+		manifests[uuid] = m
+		images = append(images, uuid)
+
+		include := since.IsZero()
+		if !include {
+			include, err = imageChangedSince(s, uuid, m, since)
+			if err != nil {
+				return 0, fmt.Errorf("Failed to check %s: %v", uuid, err)
+			}
+		}
+		if include {
+			changed[uuid] = true
+			index.Changed = append(index.Changed, uuid)
+		}
+	}
+	if !since.IsZero() {
+		all := append([]string{}, images...)
+		index.Images = &all
+	}
+
+	writer := tar.NewWriter(w)
+	content, _ := json.MarshalIndent(index, "", "  ")
+	err = writeBundleEntry(writer, backupIndexName, int64(len(content)), index.CreatedAt, strings.NewReader(string(content)))
+	for _, uuid := range images {
+		if err != nil {
+			break
+		}
+		err = writeBackupImage(s, writer, uuid, manifests[uuid], changed[uuid])
+	}
+
+	if err == nil && len(configuration.UserdbFile) > 0 {
+		content, rerr := ioutil.ReadFile(configuration.UserdbFile)
+		if rerr == nil {
+			err = writeBundleEntry(writer, "userdb.json", int64(len(content)), time.Now(), strings.NewReader(string(content)))
+		} else if !os.IsNotExist(rerr) {
+			err = rerr
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	return len(images), err
+}
+
+/**
+ * Restore the images (and the user database) in the backup. The images
+ * with files in the backup replaces the images with the same uuid, and
+ * only the manifest is replaced for the other images. Images which
+ * isn't in a full backup is left alone, while the images which isn't
+ * listed in an incremental backup is deleted. Restore the full backup
+ * first followed by the incremental backups in the order they were made.
+ *
+ * @return the number of images restored
+ */
+func readBackup(s Storage, r io.Reader) (int, error) {
+	var index *backupIndex
+	changed := map[string]bool{}
+	var current string
+	var manifest map[string]interface{}
+	restored := 0
+
+	// The manifest is stored once all of the files is written
+	finish := func() error {
+		if len(current) == 0 {
+			return nil
+		}
+		err := s.PutManifest(current, manifest)
+		if err != nil {
+			return fmt.Errorf("Failed to store manifest for %s: %v", current, err)
+		}
+		restored++
+		current = ""
+		return nil
+	}
+
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return restored, fmt.Errorf("Invalid backup: %v", err)
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		if header.Name == backupIndexName {
+			index = &backupIndex{}
+			err = json.NewDecoder(archive).Decode(index)
+			if err != nil || index.V != 1 {
+				return restored, errors.New("Invalid backup: unsupported backup.json")
+			}
+			for _, uuid := range index.Changed {
+				changed[uuid] = true
+			}
+			continue
+		}
+		if index == nil {
+			return restored, fmt.Errorf("Invalid backup: %s must be first", backupIndexName)
+		}
+
+		if header.Name == "userdb.json" {
+			err = restoreUserdb(archive)
+			if err != nil {
+				return restored, err
+			}
+			continue
+		}
+
+		parts := strings.Split(header.Name, "/")
+		if len(parts) != 3 || parts[0] != "images" || !isValidUuid(parts[1]) || !isBackupFileName(parts[2]) {
+			return restored, fmt.Errorf("Invalid backup: unexpected file %s", header.Name)
+		}
+		uuid, name := parts[1], parts[2]
+
+		if name == "manifest.json" {
+			err = finish()
+			if err != nil {
+				return restored, err
+			}
+			manifest = nil
+			err = json.NewDecoder(archive).Decode(&manifest)
+			if err != nil || manifest["uuid"] != uuid {
+				return restored, fmt.Errorf("Invalid manifest for %s in the backup", uuid)
+			}
+
+			if !changed[uuid] {
+				exists, err := s.Exists(uuid)
+				if err != nil {
+					return restored, err
+				}
+				if !exists {
+					log.Printf("Skipping %s without files in the backup (restore the full backup first)", uuid)
+					continue
+				}
+				current = uuid
+				continue
+			}
+
+			// Replace the image if it exists
+			err = s.Delete(uuid)
+			if err != nil && err != ErrImageNotFound {
+				return restored, fmt.Errorf("Failed to remove %s: %v", uuid, err)
+			}
+			err = s.Create(uuid)
+			if err != nil {
+				return restored, fmt.Errorf("Failed to create %s: %v", uuid, err)
+			}
+			current = uuid
+			continue
+		}
+
+		if uuid != current || !changed[uuid] {
+			return restored, fmt.Errorf("Invalid backup: unexpected file %s", header.Name)
+		}
+		_, err = s.PutFile(uuid, name, archive)
+		if err != nil {
+			return restored, fmt.Errorf("Failed to store %s/%s: %v", uuid, name, err)
+		}
+	}
+	err := finish()
+	if err == nil && index != nil && index.Images != nil {
+		err = deleteImagesNotInBackup(s, *index.Images)
+	}
+	return restored, err
+}
+
+// Delete the images in the storage which was deleted before the incremental backup was made
+func deleteImagesNotInBackup(s Storage, images []string) error {
+	keep := map[string]bool{}
+	for _, uuid := range images {
+		keep[uuid] = true
+	}
+
+	uuids, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, uuid := range uuids {
+		if keep[uuid] {
+			continue
+		}
+		err = s.Delete(uuid)
+		if err != nil && err != ErrImageNotFound {
+			return fmt.Errorf("Failed to remove %s: %v", uuid, err)
+		}
+		log.Printf("Removed %s which isn't in the backup", uuid)
+	}
+	return nil
+}
+
+// Replace the userdb_file with the one from the backup
+func restoreUserdb(reader io.Reader) error {
+	if len(configuration.UserdbFile) == 0 {
+		log.Printf("Skipping the user database in the backup (userdb_file isn't configured)")
+		return nil
+	}
+
+	var users []UserEntry
+	err := json.NewDecoder(reader).Decode(&users)
+	if err != nil {
+		return fmt.Errorf("Invalid user database in the backup: %v", err)
+	}
+	return saveUserdbFile(configuration.UserdbFile, users)
+}
+
+// The -backup command
+func runBackup(path string, since string) error {
+	var sinceTime time.Time
+	if len(since) > 0 {
+		var err error
+		sinceTime, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return fmt.Errorf("Invalid -since \"%s\" (must be RFC3339)", since)
+		}
+	}
+
+	s, err := openImageStorage(configuration)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".backup")
+	if err != nil {
+		return err
+	}
+	var w io.Writer = f
+	var zw *gzip.Writer
+	if isCompressedBackup(path) {
+		zw = gzip.NewWriter(f)
+		w = zw
+	}
+
+	started := time.Now().UTC()
+	count, err := writeBackup(s, w, sinceTime)
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	log.Printf("Wrote %d images to %s (use -since %s for the next incremental backup)",
+		count, path, started.Format(time.RFC3339))
+	return nil
+}
+
+// The -restore command
+func runRestore(path string) error {
+	s, err := openImageStorage(configuration)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if isCompressedBackup(path) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	count, err := readBackup(s, r)
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored %d images from %s", count, path)
+	return nil
+}
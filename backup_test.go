@@ -0,0 +1,71 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreIncrementalBackupDeletesImages(t *testing.T) {
+	setupTestStorage(t)
+	kept := "00000000-0000-0000-0000-000000000001"
+	deleted := "00000000-0000-0000-0000-000000000002"
+	addTestImage(t, kept, testManifest("kept"), "kept")
+	addTestImage(t, deleted, testManifest("deleted"), "deleted")
+
+	var full, incremental bytes.Buffer
+	_, err := writeBackup(storage, &full, time.Time{})
+	if err != nil {
+		t.Fatalf("Failed to write the full backup: %v", err)
+	}
+	err = storage.Delete(deleted)
+	if err == nil {
+		_, err = writeBackup(storage, &incremental, time.Now())
+	}
+	if err != nil {
+		t.Fatalf("Failed to write the incremental backup: %v", err)
+	}
+
+	// Restore both of the backups to an empty storage
+	setupTestStorage(t)
+	_, err = readBackup(storage, &full)
+	if err != nil {
+		t.Fatalf("Failed to restore the full backup: %v", err)
+	}
+	if exists, _ := storage.Exists(deleted); !exists {
+		t.Fatalf("Expected %s to be restored from the full backup", deleted)
+	}
+	_, err = readBackup(storage, &incremental)
+	if err != nil {
+		t.Fatalf("Failed to restore the incremental backup: %v", err)
+	}
+
+	if exists, _ := storage.Exists(kept); !exists {
+		t.Errorf("Expected %s to be kept", kept)
+	}
+	if exists, _ := storage.Exists(deleted); exists {
+		t.Errorf("Expected %s to be deleted by the incremental backup", deleted)
+	}
+}
+
+func TestRestoreBackupRejectsFileNames(t *testing.T) {
+	setupTestStorage(t)
+	uuid := "00000000-0000-0000-0000-000000000001"
+	for _, name := range []string{".", "..", "a\\b"} {
+		var archive bytes.Buffer
+		writer := tar.NewWriter(&archive)
+		index := `{"v": 1, "changed": ["` + uuid + `"]}`
+		manifest := `{"uuid": "` + uuid + `"}`
+		writeBundleEntry(writer, backupIndexName, int64(len(index)), time.Now(), strings.NewReader(index))
+		writeBundleEntry(writer, "images/"+uuid+"/manifest.json", int64(len(manifest)), time.Now(), strings.NewReader(manifest))
+		writeBundleEntry(writer, "images/"+uuid+"/"+name, 4, time.Now(), strings.NewReader("file"))
+		writer.Close()
+
+		_, err := readBackup(storage, &archive)
+		if err == nil || !strings.Contains(err.Error(), "unexpected file") {
+			t.Errorf("Expected the file name \"%s\" to be rejected, got %v", name, err)
+		}
+	}
+}
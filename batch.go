@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// The maximum number of operations in a batch
+const maxBatchOperations = 1000
+
+// The maximum size of the body of a batch request
+const maxBatchSize = 8 * 1024 * 1024
+
+/**
+ * An operation in a batch. The action is "delete" or one of the
+ * actions on an image (like "update" or "channel-add"), and the body
+ * is the body the action would get in POST /images/:uuid (like the
+ * fields to update).
+ */
+type batchOperation struct {
+	Uuid   string            `json:"uuid"`
+	Action string            `json:"action"`
+	Params map[string]string `json:"params"`
+	Body   json.RawMessage   `json:"body"`
+	// The ETag the manifest must match for update ("*" by default)
+	IfMatch string `json:"if_match"`
+}
+
+// Capture the response to an operation in the batch
+type batchResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *batchResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *batchResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *batchResponseWriter) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+/**
+ * Perform the operation with the handler used by the endpoint and
+ * return the result (with the status and the response of the
+ * endpoint).
+ */
+func runBatchOperation(r *http.Request, user *UserEntry, op batchOperation) map[string]interface{} {
+	result := map[string]interface{}{"uuid": op.Uuid, "action": op.Action}
+	fail := func(code int, content map[string]interface{}) map[string]interface{} {
+		result["status"] = code
+		result["error"] = content
+		return result
+	}
+
+	if !isValidUuid(op.Uuid) {
+		return fail(errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid uuid \"%s\"", op.Uuid)))
+	}
+
+	params := url.Values{}
+	for k, v := range op.Params {
+		params.Set(k, v)
+	}
+
+	sub := r.Clone(r.Context())
+	sub.Method = "POST"
+	sub.Body = ioutil.NopCloser(bytes.NewReader(op.Body))
+	sub.ContentLength = int64(len(op.Body))
+	if len(op.IfMatch) > 0 {
+		sub.Header.Set("If-Match", op.IfMatch)
+	} else {
+		sub.Header.Set("If-Match", "*")
+	}
+
+	var handler imagesHandler
+	switch op.Action {
+	case "":
+		return fail(errorResponse(CodeInvalidParameter, "action not specified"))
+	case "delete":
+		sub.Method = "DELETE"
+		handler = modifyImage(serverDeleteImage)
+	default:
+		params.Set("action", op.Action)
+		handler = serverImageAction
+	}
+	sub.URL.Path = "/images/" + op.Uuid
+	sub.URL.RawQuery = params.Encode()
+
+	w := &batchResponseWriter{header: http.Header{}}
+	func() {
+		defer lockImage(op.Uuid)()
+		handler(w, sub, params, user, op.Uuid)
+	}()
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	result["status"] = w.status
+	var content interface{}
+	if w.body.Len() > 0 && json.Unmarshal(w.body.Bytes(), &content) != nil {
+		content = w.body.String()
+	}
+	if w.status >= 400 {
+		result["error"] = content
+	} else if content != nil {
+		result["result"] = content
+	}
+	return result
+}
+
+/**
+ * Perform the operations in the batch in order. The batch continues
+ * after failed operations unless stop_on_error is set, and the
+ * response contains the result of each operation (the operations which
+ * wasn't performed is left out).
+ */
+func doServerBatchImages(r *http.Request, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	for k := range params {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBatchSize+1))
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+	if len(content) > maxBatchSize {
+		return errorResponse(CodePayloadTooLarge, fmt.Sprintf("The batch is too large (the limit is %d bytes)", maxBatchSize))
+	}
+
+	var batch struct {
+		Operations  []batchOperation `json:"operations"`
+		StopOnError bool             `json:"stop_on_error"`
+	}
+	err = json.Unmarshal(content, &batch)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Failed to decode body: %v", err))
+	}
+	if len(batch.Operations) == 0 {
+		return errorResponse(CodeInvalidParameter, "The batch must contain at least one operation")
+	}
+	if len(batch.Operations) > maxBatchOperations {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("The batch may contain at most %d operations", maxBatchOperations))
+	}
+
+	results := []interface{}{}
+	succeeded, failed := 0, 0
+	for _, op := range batch.Operations {
+		result := runBatchOperation(r, user, op)
+		results = append(results, result)
+		if result["status"].(int) >= 400 {
+			failed++
+			if batch.StopOnError {
+				break
+			}
+		} else {
+			succeeded++
+		}
+	}
+
+	return Success, map[string]interface{}{
+		"results":   results,
+		"succeeded": succeeded,
+		"failed":    failed,
+	}
+}
+
+/*
+BatchImages	POST /images/batch	Perform a list of operations (delete and actions) on images.
+*/
+func serverBatchImages(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	code, content := doServerBatchImages(r, params, user)
+	sendResponse(w, code, content)
+}
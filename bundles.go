@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/**
+ * A bundle is a tar archive with an image and its origin chain, used to
+ * move images to servers without network access to this one. The
+ * origins is stored before the images built on top of them, and the
+ * manifest of each image is stored before its files:
+ *
+ *     bundle.json                      {"v": 1, "images": [origin, ..., uuid]}
+ *     origin-uuid/manifest.json
+ *     origin-uuid/image.gz
+ *     uuid/manifest.json
+ *     uuid/image.gz
+ *     uuid/icon.png
+ */
+const bundleIndexName = "bundle.json"
+
+type bundleIndex struct {
+	V      int      `json:"v"`
+	Images []string `json:"images"`
+}
+
+// Write a file to the bundle
+func writeBundleEntry(writer *tar.Writer, name string, size int64, modTime time.Time, reader io.Reader) error {
+	err := writer.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err == nil {
+		_, err = io.CopyN(writer, reader, size)
+	}
+	return err
+}
+
+// Write the manifest and the files of the image to the bundle
+func writeBundleImage(writer *tar.Writer, m map[string]interface{}) error {
+	uuid, _ := m["uuid"].(string)
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeBundleEntry(writer, uuid+"/manifest.json", int64(len(manifest)), time.Now(), strings.NewReader(string(manifest)))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range referencedFiles(m) {
+		if name != "manifest.json" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		info, err := storage.StatFile(uuid, name)
+		if err == ErrImageNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		reader, err := storage.GetFile(uuid, name)
+		if err != nil {
+			return err
+		}
+		err = writeBundleEntry(writer, uuid+"/"+name, info.Size, info.ModTime, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ExportImageBundle	GET /images/:uuid/bundle	Get a tar archive with the image and its origin chain.
+*/
+func serverExportImageBundle(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	for k := range params {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		return
+	}
+
+	ancestry, err := imageAncestry(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to get the ancestry: %v", err))
+		return
+	}
+
+	// The origins is imported first
+	var index bundleIndex
+	index.V = 1
+	for i := len(ancestry) - 1; i >= 0; i-- {
+		index.Images = append(index.Images, ancestry[i]["uuid"].(string))
+	}
+	content, _ := json.Marshal(index)
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/x-tar")
+	h.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar\"", uuid))
+
+	writer := tar.NewWriter(w)
+	err = writeBundleEntry(writer, bundleIndexName, int64(len(content)), time.Now(), strings.NewReader(string(content)))
+	for i := len(ancestry) - 1; i >= 0 && err == nil; i-- {
+		err = writeBundleImage(writer, ancestry[i])
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		// The headers is already sent so all I can do is to log it
+		logRequestf(r, "Failed to send bundle for %s: %v", uuid, err)
+	}
+}
+
+// An image being imported from a bundle
+type bundleImage struct {
+	manifest map[string]interface{}
+	files    map[int]bool
+}
+
+// Get the index of the image file with the name in the manifest (-1 if it isn't an image file)
+func bundleFileIndex(m map[string]interface{}, name string) int {
+	for index := range getManifestFiles(m) {
+		if stringInSlice(name, imageFileNamesAt(index)) {
+			return index
+		}
+	}
+	return -1
+}
+
+/**
+ * Read the manifest of an image from the bundle and create the image
+ * (as unactivated until all of the files is received). Images which
+ * already exists is skipped.
+ *
+ * @return the image (nil if it is skipped)
+ */
+func importBundleManifest(reader io.Reader, uuid string, params url.Values) (*bundleImage, int, map[string]interface{}) {
+	var m map[string]interface{}
+	err := json.NewDecoder(io.LimitReader(reader, maxManifestSize())).Decode(&m)
+	if err != nil || m["uuid"] != uuid {
+		code, content := errorResponse(CodeInvalidParameter,
+			fmt.Sprintf("Invalid manifest for %s in the bundle", uuid))
+		return nil, code, content
+	}
+
+	if _, exists := index.get(uuid); exists {
+		return nil, Success, nil
+	}
+
+	if _, ok := m["channels"]; !ok && channelsEnabled() {
+		channel, err := getRequestedChannel(params)
+		if err != nil || channel == "*" {
+			code, content := errorResponse(CodeInvalidParameter,
+				fmt.Sprintf("Invalid channel \"%s\"", channel))
+			return nil, code, content
+		}
+		m["channels"] = []string{channel}
+	}
+
+	errs := validateManifest(m)
+	if len(errs) > 0 {
+		code, content := errs.response()
+		return nil, code, content
+	}
+	code, content := validateOrigin(m, nil, true)
+	if content != nil {
+		return nil, code, content
+	}
+
+	err = storage.Create(uuid)
+	if err != nil {
+		code, content := errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+		return nil, code, content
+	}
+
+	// The manifest is stored with the real state once the files is verified
+	pending := map[string]interface{}{}
+	for k, v := range m {
+		pending[k] = v
+	}
+	pending["state"] = StateUnactivated
+	err = storage.PutManifest(uuid, pending)
+	if err != nil {
+		storage.Delete(uuid)
+		code, content := errorResponse(CodeInternalError,
+			fmt.Sprintf("Failed to write manifest: %v", err))
+		return nil, code, content
+	}
+	return &bundleImage{manifest: m, files: map[int]bool{}}, Success, nil
+}
+
+// Store a file from the bundle and verify it against the manifest
+func importBundleFile(reader io.Reader, uuid string, name string, image *bundleImage) (int, map[string]interface{}) {
+	if !referencedFiles(image.manifest)[name] || name == "manifest.json" {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Unexpected file %s/%s in the bundle", uuid, name))
+	}
+
+	fileIndex := bundleFileIndex(image.manifest, name)
+	var source io.Reader = reader
+	var hasher *fileHasher
+	var limit int64
+	var limitErr error
+	if fileIndex != -1 {
+		limit, limitErr = uploadSizeLimit(uuid, image.manifest, fileIndex)
+		if limit >= 0 {
+			source = &sizeLimitReader{reader: source, remaining: limit, err: limitErr}
+		}
+		hasher = newFileHasher()
+		source = io.TeeReader(source, hasher)
+	}
+
+	size, err := storage.PutFile(uuid, name, source)
+	if limitErr != nil && err == limitErr {
+		return uploadLimitResponse(err, limit)
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store %s/%s: %v", uuid, name, err))
+	}
+
+	if hasher != nil {
+		declared := getDeclaredFileAt(image.manifest, fileIndex)
+		err = hasher.digests().verify(declared)
+		if expected, ok := getDeclaredFileSize(image.manifest, fileIndex); err == nil && ok && expected != size {
+			err = fmt.Errorf("Incorrect size. expected %d got %d", expected, size)
+		}
+		if err != nil {
+			return checksumError("%s/%s: %v", uuid, name, err)
+		}
+		image.files[fileIndex] = true
+	}
+	return Success, nil
+}
+
+// Store the manifest of the imported image with the state from the bundle
+func finishBundleImage(uuid string, image *bundleImage) (int, map[string]interface{}) {
+	m := image.manifest
+	for fileIndex := range getManifestFiles(m) {
+		if !image.files[fileIndex] {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("File %d of %s is missing in the bundle", fileIndex, uuid))
+		}
+	}
+
+	state := getImageState(m)
+	if state == StateActive {
+		code, content := checkActivationSignature(uuid, m)
+		if content != nil {
+			return code, content
+		}
+	}
+
+	err := storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageCreated, uuid)
+	if state == StateActive {
+		publishImageEvent(EventImageActivated, uuid)
+	}
+	return Success, nil
+}
+
+/**
+ * Import the images in the bundle in the body (see serverExportImageBundle).
+ * The images which already exists is skipped, and all of the imported
+ * images is removed again if the import fails.
+ *
+ * @return the HTTP code and the uuid of the imported and skipped images (or the error)
+ */
+func doServerImportBundle(r *http.Request, params url.Values) (int, map[string]interface{}) {
+	for k := range params {
+		switch k {
+		case "action", "channel":
+			break
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	code, content := checkUploadSpace()
+	if content != nil {
+		return code, content
+	}
+
+	images := map[string]*bundleImage{}
+	var order []string
+	skipped := []string{}
+	finished := 0
+	fail := func(code int, content map[string]interface{}) (int, map[string]interface{}) {
+		for i := len(order) - 1; i >= 0; i-- {
+			if i < finished {
+				removeCreatedImage(order[i])
+			} else {
+				storage.Delete(order[i])
+			}
+		}
+		return code, content
+	}
+
+	archive := tar.NewReader(r.Body)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid bundle: %v", err)))
+		}
+		if !header.FileInfo().Mode().IsRegular() || header.Name == bundleIndexName {
+			continue
+		}
+
+		parts := strings.Split(header.Name, "/")
+		if len(parts) != 2 || !isValidUuid(parts[0]) {
+			return fail(errorResponse(CodeInvalidParameter, fmt.Sprintf("Unexpected file %s in the bundle", header.Name)))
+		}
+		uuid, name := parts[0], parts[1]
+
+		if name == "manifest.json" {
+			if _, seen := images[uuid]; seen || stringInSlice(uuid, skipped) {
+				return fail(errorResponse(CodeInvalidParameter, fmt.Sprintf("The bundle contains %s more than once", uuid)))
+			}
+			image, code, content := importBundleManifest(archive, uuid, params)
+			if content != nil {
+				return fail(code, content)
+			}
+			if image == nil {
+				skipped = append(skipped, uuid)
+			} else {
+				images[uuid] = image
+				order = append(order, uuid)
+			}
+			continue
+		}
+
+		if stringInSlice(uuid, skipped) {
+			continue
+		}
+		image, ok := images[uuid]
+		if !ok {
+			return fail(errorResponse(CodeInvalidParameter, fmt.Sprintf("The manifest of %s must precede its files in the bundle", uuid)))
+		}
+		code, content := importBundleFile(archive, uuid, name, image)
+		if content != nil {
+			return fail(code, content)
+		}
+	}
+
+	for _, uuid := range order {
+		code, content := finishBundleImage(uuid, images[uuid])
+		if content != nil {
+			return fail(code, content)
+		}
+		finished++
+	}
+
+	if order == nil {
+		order = []string{}
+	}
+	return Success, map[string]interface{}{
+		"imported": order,
+		"skipped":  skipped,
+	}
+}
+
+func serverImportBundle(w http.ResponseWriter, r *http.Request, params url.Values) {
+	code, content := doServerImportBundle(r, params)
+	sendResponse(w, code, content)
+}
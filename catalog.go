@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/**
+ * A Catalog stores the manifests of the images in a database instead
+ * of a manifest.json file next to the image files. The files (and the
+ * icon) is still kept in the storage.
+ */
+type Catalog interface {
+	// Get the manifest of the image (ErrImageNotFound if missing)
+	Get(uuid string) (map[string]interface{}, error)
+
+	// Store the manifest of the image (replacing the current one)
+	Put(uuid string, manifest map[string]interface{}) error
+
+	// Remove the manifest of the image
+	Delete(uuid string) error
+
+	// List the uuid of all of the images in the catalog
+	List() ([]string, error)
+
+	// Flush and close the catalog
+	Close() error
+}
+
+/**
+ * Implemented by the catalogs which index the fields of the manifests
+ * (see catalogIndexedFields) so that the images may be found and
+ * counted without decoding all of the manifests.
+ */
+type queryCatalog interface {
+	// List the uuids of the images where all of the fields has the values
+	Find(fields map[string]string) ([]string, error)
+
+	// Count the images where all of the fields has the values
+	Count(fields map[string]string) (int, error)
+
+	// Count the images with each of the values of the field
+	CountBy(field string) (map[string]int, error)
+}
+
+// The configuration of the manifest catalog in the configuration file
+type CatalogConfig struct {
+	Type string `json:"type"`
+	// The database file (datadir/catalog.<type> by default)
+	Path string `json:"path"`
+}
+
+/**
+ * The registry of the available catalog types. Each entry opens the
+ * catalog for the provided configuration (like a SQLite database,
+ * which may be registered by builds vendoring the driver).
+ */
+var catalogTypes = map[string]func(config CatalogConfig) (Catalog, error){
+	"journal": newJournalCatalog,
+	"bolt":    newBoltCatalog,
+}
+
+// Register a new catalog type to the registry
+func RegisterCatalogType(name string, factory func(config CatalogConfig) (Catalog, error)) {
+	catalogTypes[name] = factory
+}
+
+// Get the path of the catalog database from the configuration
+func catalogPath(c Configuration) string {
+	if len(c.Catalog.Path) > 0 || len(c.Datadir) == 0 {
+		return c.Catalog.Path
+	}
+	return filepath.Join(c.Datadir, "catalog."+c.Catalog.Type)
+}
+
+func validateCatalog(c Configuration) error {
+	if _, ok := catalogTypes[c.Catalog.Type]; !ok {
+		return fmt.Errorf("Unknown catalog type \"%s\"", c.Catalog.Type)
+	}
+	if len(catalogPath(c)) == 0 {
+		return errors.New("The catalog path must be specified unless datadir is set")
+	}
+	return nil
+}
+
+// Open the catalog specified in the configuration
+func openCatalog(c Configuration) (Catalog, error) {
+	factory, ok := catalogTypes[c.Catalog.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown catalog type \"%s\"", c.Catalog.Type)
+	}
+	config := c.Catalog
+	config.Path = catalogPath(c)
+	return factory(config)
+}
+
+/**
+ * catalogStorage reads and writes the manifests in the catalog and
+ * everything else in the storage.
+ */
+type catalogStorage struct {
+	Storage
+	catalog Catalog
+}
+
+func newCatalogStorage(s Storage, catalog Catalog) (Storage, error) {
+	uuids, err := catalog.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(uuids) == 0 {
+		stored, err := s.List()
+		if err == nil && len(stored) > 0 {
+			log.Printf("The catalog is empty but the storage contains %d images (run imgapi -migrate-catalog)", len(stored))
+		}
+	}
+	return &catalogStorage{Storage: s, catalog: catalog}, nil
+}
+
+func (s *catalogStorage) GetManifest(uuid string) (map[string]interface{}, error) {
+	return s.catalog.Get(uuid)
+}
+
+func (s *catalogStorage) PutManifest(uuid string, manifest map[string]interface{}) error {
+	return s.catalog.Put(uuid, manifest)
+}
+
+// Get the catalog of the storage if it supports queries
+func storageQueryCatalog(s Storage) (queryCatalog, bool) {
+	for {
+		switch wrapper := s.(type) {
+		case *indexedStorage:
+			s = wrapper.Storage
+		case *catalogStorage:
+			q, ok := wrapper.catalog.(queryCatalog)
+			return q, ok
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Remove the manifest first so that the image is gone even if some files remain
+func (s *catalogStorage) Delete(uuid string) error {
+	err := s.catalog.Delete(uuid)
+	if err != nil && err != ErrImageNotFound {
+		return err
+	}
+	return s.Storage.Delete(uuid)
+}
+
+/**
+ * Copy the manifests from the storage (the manifest.json files) to the
+ * catalog. The manifest.json files is left in place so that the server
+ * may be started without the catalog again.
+ *
+ * @return the number of manifests copied
+ */
+func migrateToCatalog(s Storage, catalog Catalog) (int, error) {
+	uuids, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, uuid := range uuids {
+		m, err := s.GetManifest(uuid)
+		if err == ErrImageNotFound {
+			log.Printf("Skipping %s without a manifest", uuid)
+			continue
+		}
+		if err != nil {
+			return migrated, fmt.Errorf("Failed to read manifest for %s: %v", uuid, err)
+		}
+		err = catalog.Put(uuid, m)
+		if err != nil {
+			return migrated, fmt.Errorf("Failed to store manifest for %s: %v", uuid, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// The -migrate-catalog command
+func runCatalogMigration() error {
+	if len(configuration.Catalog.Type) == 0 {
+		return errors.New("No catalog is configured")
+	}
+	err := validateCatalog(configuration)
+	if err != nil {
+		return err
+	}
+
+	s, err := newStorage(configuration)
+	if err != nil {
+		return err
+	}
+	catalog, err := openCatalog(configuration)
+	if err != nil {
+		return err
+	}
+
+	migrated, err := migrateToCatalog(s, catalog)
+	if cerr := catalog.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Migrated %d manifests to the catalog", migrated)
+	return nil
+}
+
+/**
+ * The journal catalog keeps the manifests in memory and appends each
+ * change as a JSON record (one per line) to the journal file, which is
+ * synced before the change is visible. A partially written record at
+ * the end of the journal (after a crash) is discarded when the journal
+ * is loaded. The journal is compacted (rewritten with the current
+ * manifests) when it contains more than twice as many records as there
+ * is images.
+ */
+type journalCatalog struct {
+	sync.RWMutex
+	path      string
+	file      *os.File
+	manifests map[string][]byte
+	records   int
+}
+
+// A record in the journal (manifest is omitted when the image is deleted)
+type journalRecord struct {
+	Uuid     string          `json:"uuid"`
+	Manifest json.RawMessage `json:"manifest,omitempty"`
+}
+
+// The minimum number of records in the journal before it is compacted
+const journalCompactMinimum = 1000
+
+func newJournalCatalog(config CatalogConfig) (Catalog, error) {
+	c := &journalCatalog{path: config.Path, manifests: make(map[string][]byte)}
+	err := c.load()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load catalog %s: %v", c.path, err)
+	}
+
+	c.file, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Replay the journal (and truncate it after the last complete record)
+func (c *journalCatalog) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var offset int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record journalRecord
+		if json.Unmarshal(line, &record) != nil || !isValidUuid(record.Uuid) {
+			return fmt.Errorf("Invalid record at offset %d", offset)
+		}
+		if len(record.Manifest) > 0 {
+			c.manifests[record.Uuid] = []byte(record.Manifest)
+		} else {
+			delete(c.manifests, record.Uuid)
+		}
+		c.records++
+		offset += int64(len(line))
+	}
+
+	info, err := f.Stat()
+	if err == nil && info.Size() > offset {
+		log.Printf("Discarding incomplete record at the end of %s", c.path)
+		err = os.Truncate(c.path, offset)
+	}
+	return err
+}
+
+/**
+ * Append the record to the journal, wait for it to be written to disk
+ * and apply it to the manifests. The change is applied before the
+ * journal is compacted so that the compacted journal includes it.
+ */
+func (c *journalCatalog) append(record journalRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = c.file.Write(append(line, '\n'))
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(record.Manifest) > 0 {
+		c.manifests[record.Uuid] = []byte(record.Manifest)
+	} else {
+		delete(c.manifests, record.Uuid)
+	}
+	c.records++
+	if c.records > journalCompactMinimum && c.records > 2*len(c.manifests) {
+		err = c.compact()
+		if err != nil {
+			// The journal is still valid, just larger than needed
+			log.Printf("Failed to compact catalog %s: %v", c.path, err)
+		}
+	}
+	return nil
+}
+
+// Rewrite the journal with only the current manifests
+func (c *journalCatalog) compact() error {
+	f, err := ioutil.TempFile(filepath.Dir(c.path), ".catalog")
+	if err != nil {
+		return err
+	}
+
+	uuids := make([]string, 0, len(c.manifests))
+	for uuid := range c.manifests {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	writer := bufio.NewWriter(f)
+	for _, uuid := range uuids {
+		line, err := json.Marshal(journalRecord{Uuid: uuid, Manifest: c.manifests[uuid]})
+		if err == nil {
+			_, err = writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+
+	// Open the new journal before it replaces the old one so that we
+	// keep appending to the old one if it can't be opened
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path)
+		if err != nil {
+			file.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	c.file.Close()
+	c.file = file
+	c.records = len(uuids)
+	return nil
+}
+
+func (c *journalCatalog) Get(uuid string) (map[string]interface{}, error) {
+	c.RLock()
+	content, ok := c.manifests[uuid]
+	c.RUnlock()
+	if !ok {
+		return nil, ErrImageNotFound
+	}
+
+	// Each caller gets its own copy it may modify
+	var m map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	err := decoder.Decode(&m)
+	return m, err
+}
+
+func (c *journalCatalog) Put(uuid string, manifest map[string]interface{}) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	return c.append(journalRecord{Uuid: uuid, Manifest: content})
+}
+
+func (c *journalCatalog) Delete(uuid string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.manifests[uuid]; !ok {
+		return ErrImageNotFound
+	}
+	return c.append(journalRecord{Uuid: uuid})
+}
+
+func (c *journalCatalog) List() ([]string, error) {
+	c.RLock()
+	defer c.RUnlock()
+	uuids := make([]string, 0, len(c.manifests))
+	for uuid := range c.manifests {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+func (c *journalCatalog) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.file.Close()
+}
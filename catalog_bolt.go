@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The buckets in the bolt catalog
+var (
+	boltManifestBucket = []byte("manifests")
+	boltIndexBucket    = []byte("index")
+)
+
+/**
+ * The fields of the manifests indexed by the catalogs supporting
+ * queries (see queryCatalog). The state is the state as presented to
+ * the client (see getImageState).
+ */
+var catalogIndexedFields = []string{"owner", "state", "name", "os", "type", "public"}
+
+// Get the values of the indexed fields in the manifest (missing fields is skipped)
+func catalogIndexValues(m map[string]interface{}) map[string]string {
+	values := make(map[string]string)
+	for _, field := range catalogIndexedFields {
+		var value interface{} = m[field]
+		if field == "state" {
+			value = getImageState(m)
+		}
+		switch v := value.(type) {
+		case string:
+			if len(v) > 0 {
+				values[field] = v
+			}
+		case bool:
+			values[field] = fmt.Sprintf("%v", v)
+		}
+	}
+	return values
+}
+
+/**
+ * The bolt catalog stores the manifests in a bbolt database with an
+ * index of the fields in catalogIndexedFields. The index is a bucket
+ * with the keys "field\x00value\x00uuid", which is updated in the same
+ * transaction as the manifest so that the queries always match the
+ * stored manifests.
+ */
+type boltCatalog struct {
+	db *bolt.DB
+}
+
+func newBoltCatalog(config CatalogConfig) (Catalog, error) {
+	db, err := bolt.Open(config.Path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open catalog %s: %v", config.Path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltManifestBucket)
+		if err == nil {
+			_, err = tx.CreateBucketIfNotExists(boltIndexBucket)
+		}
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Failed to initialize catalog %s: %v", config.Path, err)
+	}
+	return &boltCatalog{db: db}, nil
+}
+
+func boltIndexKey(field string, value string, uuid string) []byte {
+	return []byte(field + "\x00" + value + "\x00" + uuid)
+}
+
+// Add (or remove) the index entries for the manifest
+func boltUpdateIndex(index *bolt.Bucket, uuid string, content []byte, add bool) error {
+	var m map[string]interface{}
+	err := json.Unmarshal(content, &m)
+	if err != nil {
+		return err
+	}
+
+	for field, value := range catalogIndexValues(m) {
+		key := boltIndexKey(field, value, uuid)
+		if add {
+			err = index.Put(key, []byte{})
+		} else {
+			err = index.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *boltCatalog) Get(uuid string) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		content := tx.Bucket(boltManifestBucket).Get([]byte(uuid))
+		if content == nil {
+			return ErrImageNotFound
+		}
+		return json.Unmarshal(content, &m)
+	})
+	return m, err
+}
+
+func (c *boltCatalog) Put(uuid string, manifest map[string]interface{}) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		manifests := tx.Bucket(boltManifestBucket)
+		index := tx.Bucket(boltIndexBucket)
+		if previous := manifests.Get([]byte(uuid)); previous != nil {
+			err := boltUpdateIndex(index, uuid, previous, false)
+			if err != nil {
+				return err
+			}
+		}
+		err := manifests.Put([]byte(uuid), content)
+		if err == nil {
+			err = boltUpdateIndex(index, uuid, content, true)
+		}
+		return err
+	})
+}
+
+func (c *boltCatalog) Delete(uuid string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		manifests := tx.Bucket(boltManifestBucket)
+		previous := manifests.Get([]byte(uuid))
+		if previous == nil {
+			return ErrImageNotFound
+		}
+		err := boltUpdateIndex(tx.Bucket(boltIndexBucket), uuid, previous, false)
+		if err == nil {
+			err = manifests.Delete([]byte(uuid))
+		}
+		return err
+	})
+}
+
+func (c *boltCatalog) List() ([]string, error) {
+	var uuids []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltManifestBucket).ForEach(func(key []byte, value []byte) error {
+			uuids = append(uuids, string(key))
+			return nil
+		})
+	})
+	return uuids, err
+}
+
+// Get the uuids with the value of the field from the index
+func boltFindField(index *bolt.Bucket, field string, value string) map[string]bool {
+	uuids := make(map[string]bool)
+	prefix := []byte(field + "\x00" + value + "\x00")
+	cursor := index.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		uuids[string(key[len(prefix):])] = true
+	}
+	return uuids
+}
+
+/**
+ * Find the images matching all of the fields (the fields must be in
+ * catalogIndexedFields). All of the images match if fields is empty.
+ *
+ * @return the uuids ordered by uuid
+ */
+func (c *boltCatalog) Find(fields map[string]string) ([]string, error) {
+	for field := range fields {
+		if !stringInSlice(field, catalogIndexedFields) {
+			return nil, fmt.Errorf("The field %s isn't indexed", field)
+		}
+	}
+	if len(fields) == 0 {
+		return c.List()
+	}
+
+	var uuids []string
+	err := c.db.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltIndexBucket)
+		var matches map[string]bool
+		for field, value := range fields {
+			found := boltFindField(index, field, value)
+			if matches != nil {
+				for uuid := range matches {
+					if !found[uuid] {
+						delete(matches, uuid)
+					}
+				}
+			} else {
+				matches = found
+			}
+		}
+		for uuid := range matches {
+			uuids = append(uuids, uuid)
+		}
+		return nil
+	})
+	sort.Strings(uuids)
+	return uuids, err
+}
+
+func (c *boltCatalog) Count(fields map[string]string) (int, error) {
+	if len(fields) == 0 {
+		count := 0
+		err := c.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket(boltManifestBucket).Stats().KeyN
+			return nil
+		})
+		return count, err
+	}
+	uuids, err := c.Find(fields)
+	return len(uuids), err
+}
+
+func (c *boltCatalog) CountBy(field string) (map[string]int, error) {
+	if !stringInSlice(field, catalogIndexedFields) {
+		return nil, fmt.Errorf("The field %s isn't indexed", field)
+	}
+
+	counts := make(map[string]int)
+	err := c.db.View(func(tx *bolt.Tx) error {
+		prefix := []byte(field + "\x00")
+		cursor := tx.Bucket(boltIndexBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			value := key[len(prefix):]
+			counts[string(value[:bytes.LastIndexByte(value, 0)])]++
+		}
+		return nil
+	})
+	return counts, err
+}
+
+func (c *boltCatalog) Close() error {
+	return c.db.Close()
+}
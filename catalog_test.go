@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalCatalogCompaction(t *testing.T) {
+	config := CatalogConfig{Path: filepath.Join(t.TempDir(), "catalog.journal")}
+	catalog, err := newJournalCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+
+	// The last update triggers the compaction
+	uuid := "00000000-0000-0000-0000-000000000001"
+	for i := 1; i <= journalCompactMinimum+1; i++ {
+		err = catalog.Put(uuid, map[string]interface{}{"version": fmt.Sprintf("%d", i)})
+		if err != nil {
+			t.Fatalf("Failed to store manifest: %v", err)
+		}
+	}
+	if records := catalog.(*journalCatalog).records; records != 1 {
+		t.Errorf("Expected 1 record after the compaction, got %d", records)
+	}
+
+	// The updates after the compaction goes to the compacted journal
+	other := "00000000-0000-0000-0000-000000000002"
+	err = catalog.Put(other, map[string]interface{}{"version": "1"})
+	if err != nil {
+		t.Fatalf("Failed to store manifest after the compaction: %v", err)
+	}
+	catalog.Close()
+
+	catalog, err = newJournalCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen catalog: %v", err)
+	}
+	defer catalog.Close()
+	m, err := catalog.Get(uuid)
+	expected := fmt.Sprintf("%d", journalCompactMinimum+1)
+	if err != nil || m["version"] != expected {
+		t.Errorf("Expected version %s after the compaction, got %v (%v)", expected, m["version"], err)
+	}
+	if _, err = catalog.Get(other); err != nil {
+		t.Errorf("Expected the image stored after the compaction, got %v", err)
+	}
+	if records := catalog.(*journalCatalog).records; records != 2 {
+		t.Errorf("Expected 2 records in the compacted journal, got %d", records)
+	}
+}
+
+func TestJournalCatalogFailedCompaction(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "catalog")
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := CatalogConfig{Path: filepath.Join(dir, "catalog.journal")}
+	opened, err := newJournalCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	catalog := opened.(*journalCatalog)
+	defer catalog.Close()
+
+	// The compaction can't create the new journal, but the updates
+	// should still be appended to the old one
+	uuid := "00000000-0000-0000-0000-000000000001"
+	catalog.path = filepath.Join(dir, "missing", "catalog.journal")
+	catalog.records = journalCompactMinimum
+	err = catalog.Put(uuid, map[string]interface{}{"version": "1"})
+	if err == nil {
+		err = catalog.Put(uuid, map[string]interface{}{"version": "2"})
+	}
+	if err != nil {
+		t.Fatalf("Failed to store manifest when the compaction fails: %v", err)
+	}
+
+	reopened, err := newJournalCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen catalog: %v", err)
+	}
+	defer reopened.Close()
+	m, err := reopened.Get(uuid)
+	if err != nil || m["version"] != "2" {
+		t.Errorf("Expected version 2 after the failed compaction, got %v (%v)", m["version"], err)
+	}
+}
+
+func TestBoltCatalogQueries(t *testing.T) {
+	config := CatalogConfig{Path: filepath.Join(t.TempDir(), "catalog.bolt")}
+	opened, err := newBoltCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to open catalog: %v", err)
+	}
+	catalog := opened.(*boltCatalog)
+
+	images := map[string]map[string]interface{}{
+		"00000000-0000-0000-0000-000000000001": {"owner": "alice", "state": StateActive, "public": true},
+		"00000000-0000-0000-0000-000000000002": {"owner": "alice", "state": StateUnactivated, "public": false},
+		"00000000-0000-0000-0000-000000000003": {"owner": "bob", "state": StateActive, "public": true},
+	}
+	for uuid, m := range images {
+		err = catalog.Put(uuid, m)
+		if err != nil {
+			t.Fatalf("Failed to store manifest: %v", err)
+		}
+	}
+
+	find := func(fields map[string]string) []string {
+		t.Helper()
+		uuids, err := catalog.Find(fields)
+		if err != nil {
+			t.Fatalf("Failed to query the catalog: %v", err)
+		}
+		return uuids
+	}
+	expect := func(fields map[string]string, expected ...string) {
+		t.Helper()
+		if uuids := find(fields); !reflect.DeepEqual(uuids, expected) {
+			t.Errorf("Expected %v for %v, got %v", expected, fields, uuids)
+		}
+	}
+
+	expect(map[string]string{"owner": "alice"},
+		"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002")
+	expect(map[string]string{"owner": "alice", "state": StateActive}, "00000000-0000-0000-0000-000000000001")
+	expect(map[string]string{"public": "true", "owner": "bob"}, "00000000-0000-0000-0000-000000000003")
+	if _, err := catalog.Find(map[string]string{"version": "1.0.0"}); err == nil {
+		t.Errorf("Expected an error for a field which isn't indexed")
+	}
+
+	// The index is updated with the manifest
+	err = catalog.Put("00000000-0000-0000-0000-000000000002", map[string]interface{}{"owner": "alice", "state": StateActive})
+	if err == nil {
+		err = catalog.Delete("00000000-0000-0000-0000-000000000003")
+	}
+	if err != nil {
+		t.Fatalf("Failed to update the catalog: %v", err)
+	}
+	expect(map[string]string{"state": StateActive},
+		"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002")
+	expect(map[string]string{"owner": "bob"})
+	catalog.Close()
+
+	// The counts is kept when the catalog is reopened
+	opened, err = newBoltCatalog(config)
+	if err != nil {
+		t.Fatalf("Failed to reopen catalog: %v", err)
+	}
+	defer opened.Close()
+	catalog = opened.(*boltCatalog)
+	total, err := catalog.Count(nil)
+	if err != nil || total != 2 {
+		t.Errorf("Expected 2 images, got %d (%v)", total, err)
+	}
+	states, err := catalog.CountBy("state")
+	if err != nil || !reflect.DeepEqual(states, map[string]int{StateActive: 2}) {
+		t.Errorf("Unexpected counts by state: %v (%v)", states, err)
+	}
+}
+
+func TestListImagesWithBoltCatalog(t *testing.T) {
+	setupTestCatalogStorage(t, "bolt")
+	mine := testManifest("mine")
+	mine["owner"] = "alice"
+	addTestImage(t, "00000000-0000-0000-0000-000000000001", mine, "")
+	unactivated := testManifest("mine")
+	unactivated["owner"] = "alice"
+	unactivated["state"] = StateUnactivated
+	addTestImage(t, "00000000-0000-0000-0000-000000000002", unactivated, "")
+	other := testManifest("other")
+	other["owner"] = "bob"
+	addTestImage(t, "00000000-0000-0000-0000-000000000003", other, "")
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"owner=alice", []string{"00000000-0000-0000-0000-000000000001"}},
+		{"owner=alice&state=all", []string{"00000000-0000-0000-0000-000000000001", "00000000-0000-0000-0000-000000000002"}},
+		{"name=~mi", []string{"00000000-0000-0000-0000-000000000001"}},
+		{"owner=carol", []string{}},
+	}
+	for _, test := range tests {
+		if uuids := listTestImages(t, test.query); !reflect.DeepEqual(uuids, test.expected) {
+			t.Errorf("GET /images?%s: expected %v, got %v", test.query, test.expected, uuids)
+		}
+	}
+
+	total, states := countImagesByState()
+	if total != 3 || states[StateActive] != 2 || states[StateUnactivated] != 1 {
+		t.Errorf("Unexpected counts: %d %v", total, states)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The number of events kept for the clients catching up
+const changeFeedSize = 1000
+
+// The longest time a long-poll request waits unless timeout is set
+const defaultChangesTimeout = 30
+
+// The upper limit for the timeout in a long-poll request
+const maxChangesTimeout = 300
+
+// The interval between the keep-alive comments in the event stream
+const changesKeepAlive = 15 * time.Second
+
+// An image event with the position in the change feed
+type changeEvent struct {
+	Id int64 `json:"id"`
+	ImageEvent
+
+	// The manifest when the event happened (used for the access checks)
+	manifest map[string]interface{}
+}
+
+/**
+ * The change feed keeps the latest image events in memory with an
+ * increasing id, so the clients may follow the changes with Server-Sent
+ * Events or long-polling and continue from the last event they saw.
+ * The ids start over when the server restarts.
+ */
+type changeFeed struct {
+	sync.Mutex
+	events []changeEvent
+	lastId int64
+	// Closed (and replaced) when a new event is added
+	notify chan struct{}
+}
+
+var changes = &changeFeed{notify: make(chan struct{})}
+
+// Start recording the image events in the change feed
+func startChangeFeed() {
+	subscribeImageEvents(changes.add)
+}
+
+func (c *changeFeed) add(event ImageEvent) {
+	c.Lock()
+	defer c.Unlock()
+
+	// The manifest is gone when the image is deleted, so use the manifest
+	// from the previous event for the image
+	m, ok := index.get(event.Uuid)
+	if !ok {
+		for i := len(c.events) - 1; i >= 0; i-- {
+			if c.events[i].Uuid == event.Uuid {
+				m = c.events[i].manifest
+				break
+			}
+		}
+	}
+
+	c.lastId++
+	c.events = append(c.events, changeEvent{Id: c.lastId, ImageEvent: event, manifest: m})
+	if len(c.events) > changeFeedSize {
+		c.events = c.events[len(c.events)-changeFeedSize:]
+	}
+
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+/**
+ * Get the events after the event with the id since
+ *
+ * @param since the id of the last event the client has seen
+ * @param user the authenticated user (nil if not authenticated)
+ * @return events the events the user may see
+ *         next the id to continue from
+ *         notify closed when there is new events
+ */
+func (c *changeFeed) since(since int64, user *UserEntry) (events []changeEvent, next int64, notify chan struct{}) {
+	c.Lock()
+	defer c.Unlock()
+
+	// The ids start over when the server restarts
+	if since > c.lastId {
+		since = 0
+	}
+
+	events = make([]changeEvent, 0)
+	for _, event := range c.events {
+		if event.Id <= since {
+			continue
+		}
+		// Only operators may see the events for unknown images
+		if event.manifest == nil && !isOperator(user) {
+			continue
+		}
+		if event.manifest != nil && !imageAccessible(event.manifest, user) {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	return events, c.lastId, c.notify
+}
+
+func (c *changeFeed) state() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	return map[string]interface{}{
+		"last_id":  c.lastId,
+		"buffered": len(c.events),
+	}
+}
+
+// Parse the position to continue from (the current position if empty)
+func parseChangesCursor(value string) (int64, error) {
+	if len(value) == 0 {
+		changes.Lock()
+		defer changes.Unlock()
+		return changes.lastId, nil
+	}
+
+	since, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || since < 0 {
+		return 0, fmt.Errorf("Invalid cursor: \"%s\"", value)
+	}
+	return since, nil
+}
+
+/**
+ * Wait for the events after since (or timeout) and return them as
+ * JSON with the id to continue from.
+ */
+func doServerLongPollChanges(r *http.Request, since int64, timeout int, user *UserEntry) (int, map[string]interface{}) {
+	events, next, notify := changes.since(since, user)
+	if len(events) == 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case <-notify:
+			events, next, _ = changes.since(since, user)
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+	}
+
+	return Success, map[string]interface{}{
+		"events": events,
+		"next":   next,
+	}
+}
+
+/**
+ * Stream the events as Server-Sent Events until the client disconnects
+ * (or the write timeout is reached). The id of each event may be used
+ * in the Last-Event-ID header to continue from it.
+ */
+func streamChanges(w http.ResponseWriter, r *http.Request, since int64, user *UserEntry) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, CodeInternalError, "Streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(Success)
+	flusher.Flush()
+
+	var deadline <-chan time.Time
+	if configuration.WriteTimeout > 0 {
+		timer := time.NewTimer(time.Duration(configuration.WriteTimeout)*time.Second - time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	keepAlive := time.NewTicker(changesKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		events, next, notify := changes.since(since, user)
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		since = next
+
+		select {
+		case <-notify:
+		case <-keepAlive.C:
+			_, err := fmt.Fprintf(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+/*
+ImageChanges	GET /images/changes	Follow the image events (Server-Sent Events or long-poll).
+*/
+func serverImageChanges(w http.ResponseWriter, r *http.Request) {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+	timingMark(w, "auth")
+
+	stream := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	cursor := r.Header.Get("Last-Event-ID")
+	timeout := defaultChangesTimeout
+	for k, v := range r.URL.Query() {
+		switch k {
+		case "since":
+			cursor = v[0]
+		case "timeout":
+			value, err := strconv.Atoi(v[0])
+			if err != nil || value < 0 || value > maxChangesTimeout {
+				sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid timeout: \"%s\" (0-%d)", v[0], maxChangesTimeout))
+				return
+			}
+			timeout = value
+		default:
+			sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+			return
+		}
+	}
+
+	since, err := parseChangesCursor(cursor)
+	if err != nil {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("%v", err))
+		return
+	}
+
+	if stream {
+		streamChanges(w, r, since, user)
+		return
+	}
+
+	// Respond before the server gives up on the request
+	if configuration.WriteTimeout > 0 && timeout >= configuration.WriteTimeout {
+		timeout = configuration.WriteTimeout - 1
+	}
+	code, content = doServerLongPollChanges(r, since, timeout, user)
+	sendResponse(w, code, content)
+}
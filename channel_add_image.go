@@ -1,12 +1,76 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 )
 
-func serverChannelAddImage(w http.ResponseWriter, r *http.Request) {
-	sendResponse(w, ResourceNotFound, map[string]interface{}{
-		"code":    "ResourceNotFound",
-		"message": "No support for adding images to channels",
-	})
+/**
+ * Add the image to the channel specified in the body of the request:
+ *
+ *     { "channel": "name" }
+ */
+func doServerChannelAddImage(uuid string, params url.Values, reader io.Reader) (int, map[string]interface{}) {
+	if !channelsEnabled() {
+		return errorResponse(CodeResourceNotFound, "No support for adding images to channels")
+	}
+
+	for k, _ := range params {
+		switch k {
+		case "action":
+			break
+		case "account":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+
+	var body map[string]interface{}
+	err = json.Unmarshal(content, &body)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Failed to decode body: %v", err))
+	}
+
+	channel, ok := body["channel"].(string)
+	if !ok {
+		return errorResponse(CodeInvalidParameter, "channel not specified")
+	}
+
+	_, ok = lookupChannel(channel)
+	if !ok {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Unknown channel \"%s\"", channel))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	channels := getManifestChannels(m)
+	if !stringInSlice(channel, channels) {
+		channels = append(channels, channel)
+	}
+	m["channels"] = channels
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	return Success, m
+}
+
+func serverChannelAddImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerChannelAddImage(uuid, params, r.Body)
+	sendResponse(w, code, content)
 }
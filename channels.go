@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+/**
+ * A channel is a named namespace of images. An image may be a member
+ * of multiple channels. Images in a private channel is only visible to
+ * authenticated users.
+ *
+ * The channels may form a release pipeline where the images is
+ * promoted from the channel in promote_from (see promote_image.go).
+ */
+type Channel struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+	Private     bool   `json:"private"`
+	// The channel the images is promoted from
+	PromoteFrom string `json:"promote_from"`
+	// The role required to promote images to the channel (operator or user)
+	PromoteRole string `json:"promote_role"`
+	// The promotions must be approved by another user
+	RequireApproval bool `json:"require_approval"`
+}
+
+// Verify that the names are unique and the promotions refer to other channels
+func validateChannels(channels []Channel) error {
+	names := map[string]bool{}
+	for _, channel := range channels {
+		if len(channel.Name) == 0 || channel.Name == "*" {
+			return fmt.Errorf("Invalid channel name \"%s\"", channel.Name)
+		}
+		if names[channel.Name] {
+			return fmt.Errorf("Channel \"%s\" is defined multiple times", channel.Name)
+		}
+		names[channel.Name] = true
+	}
+
+	for _, channel := range channels {
+		if len(channel.PromoteFrom) > 0 && (channel.PromoteFrom == channel.Name || !names[channel.PromoteFrom]) {
+			return fmt.Errorf("Invalid promote_from \"%s\" for channel %s", channel.PromoteFrom, channel.Name)
+		}
+		switch channel.PromoteRole {
+		case "", RoleOperator, RoleUser:
+		default:
+			return fmt.Errorf("Invalid promote_role \"%s\" for channel %s", channel.PromoteRole, channel.Name)
+		}
+	}
+	return nil
+}
+
+// The server only use channels if they're defined in the configuration
+func channelsEnabled() bool {
+	return len(currentConfiguration().Channels) > 0
+}
+
+func lookupChannel(name string) (channel Channel, ok bool) {
+	for _, channel = range currentConfiguration().Channels {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+	return channel, false
+}
+
+// Get the name of the channel to use when the client don't specify one
+func defaultChannel() string {
+	channels := currentConfiguration().Channels
+	for _, channel := range channels {
+		if channel.Default {
+			return channel.Name
+		}
+	}
+
+	if len(channels) > 0 {
+		return channels[0].Name
+	}
+	return ""
+}
+
+/**
+ * Get the channels the image is a member of. Images created before
+ * channels was enabled is treated as members of the default channel.
+ */
+func getManifestChannels(m map[string]interface{}) []string {
+	var channels []string
+
+	list, ok := m["channels"].([]interface{})
+	if ok {
+		for _, entry := range list {
+			name, ok := entry.(string)
+			if ok {
+				channels = append(channels, name)
+			}
+		}
+	} else if list, ok := m["channels"].([]string); ok {
+		channels = append(channels, list...)
+	}
+
+	if len(channels) == 0 {
+		channels = append(channels, defaultChannel())
+	}
+	return channels
+}
+
+// Check if the image is a member of the channel ("*" match all channels)
+func imageInChannel(m map[string]interface{}, channel string) bool {
+	if !channelsEnabled() || channel == "*" {
+		return true
+	}
+	return stringInSlice(channel, getManifestChannels(m))
+}
+
+// Check if the image should be visible for the user
+func imageVisible(m map[string]interface{}, authenticated bool) bool {
+	if authenticated || !channelsEnabled() {
+		return true
+	}
+
+	for _, name := range getManifestChannels(m) {
+		channel, ok := lookupChannel(name)
+		if ok && !channel.Private {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Get the channel requested by the client (or the default channel if
+ * not specified). "*" is used to match all channels.
+ */
+func getRequestedChannel(params url.Values) (string, error) {
+	channel := params.Get("channel")
+	if len(channel) == 0 {
+		return defaultChannel(), nil
+	}
+
+	if channel != "*" {
+		_, ok := lookupChannel(channel)
+		if !ok {
+			return channel, fmt.Errorf("Unknown channel \"%s\"", channel)
+		}
+	}
+	return channel, nil
+}
+
+/**
+ * Verify that the image is a member of the channel
+ * requested by the client and visible to the user. The channel
+ * parameter is removed from params so that the request handlers don't
+ * need to know about channels.
+ *
+ * If the server don't use channels params is left untouched so that
+ * the handlers may reject the channel parameter.
+ */
+func checkImageChannel(uuid string, params url.Values, authenticated bool) (int, map[string]interface{}) {
+	if !channelsEnabled() {
+		return Success, nil
+	}
+
+	channel, err := getRequestedChannel(params)
+	params.Del("channel")
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		if err == ErrImageNotFound {
+			return errorResponse(CodeResourceNotFound, "The image does not exist")
+		}
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+
+	if !imageInChannel(m, channel) || !imageVisible(m, authenticated) {
+		return errorResponse(CodeResourceNotFound, fmt.Sprintf("Image not found in channel \"%s\"", channel))
+	}
+
+	return Success, nil
+}
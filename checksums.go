@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+/**
+ * The digests stored for each file in the files list in the manifest
+ * (as hex strings). sha1 and sha256 is always computed, and sha512 if
+ * enabled in the configuration.
+ */
+type fileDigests struct {
+	Sha1   string
+	Sha256 string
+	Sha512 string
+}
+
+// fileHasher computes the digests of everything written to it
+type fileHasher struct {
+	io.Writer
+	sha1   hash.Hash
+	sha256 hash.Hash
+	sha512 hash.Hash
+}
+
+func newFileHasher() *fileHasher {
+	h := &fileHasher{sha1: sha1.New(), sha256: sha256.New()}
+	writers := []io.Writer{h.sha1, h.sha256}
+	if configuration.Sha512 {
+		h.sha512 = sha512.New()
+		writers = append(writers, h.sha512)
+	}
+	h.Writer = io.MultiWriter(writers...)
+	return h
+}
+
+func (h *fileHasher) digests() fileDigests {
+	sums := fileDigests{
+		Sha1:   hex.EncodeToString(h.sha1.Sum(nil)),
+		Sha256: hex.EncodeToString(h.sha256.Sum(nil)),
+	}
+	if h.sha512 != nil {
+		sums.Sha512 = hex.EncodeToString(h.sha512.Sum(nil))
+	}
+	return sums
+}
+
+// Add the digests to the entry in the files list
+func (d fileDigests) addTo(entry map[string]interface{}) {
+	entry["sha1"] = d.Sha1
+	entry["sha256"] = d.Sha256
+	if len(d.Sha512) > 0 {
+		entry["sha512"] = d.Sha512
+	}
+}
+
+/**
+ * Verify the digests against the expected digests (like the entry in
+ * the files list of the manifest). Only the digests present in both is
+ * compared.
+ *
+ * @return the error describing the first mismatch (nil if they match)
+ */
+func (d fileDigests) verify(expected map[string]interface{}) error {
+	for _, sum := range []struct {
+		name   string
+		label  string
+		actual string
+	}{
+		{"sha1", "SHA", d.Sha1},
+		{"sha256", "SHA256", d.Sha256},
+		{"sha512", "SHA512", d.Sha512},
+	} {
+		value, ok := expected[sum.name].(string)
+		if ok && len(sum.actual) > 0 && value != sum.actual {
+			return fmt.Errorf("Incorrect %s. expected \"%s\" got \"%s\"", sum.label, value, sum.actual)
+		}
+	}
+	return nil
+}
+
+/**
+ * Build the value of the Digest header (RFC 3230) from the digests in
+ * the entry in the files list ("" if there is none).
+ */
+func digestHeader(entry map[string]interface{}) string {
+	var values []string
+	for _, sum := range []struct{ name, algorithm string }{
+		{"sha512", "SHA-512"},
+		{"sha256", "SHA-256"},
+		{"sha1", "SHA"},
+	} {
+		value, _ := entry[sum.name].(string)
+		raw, err := hex.DecodeString(value)
+		if err == nil && len(raw) > 0 {
+			values = append(values, sum.algorithm+"="+base64.StdEncoding.EncodeToString(raw))
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+/**
+ * Utility function to get the SHA1 sum for a named file
+ *
+ * @param uuid the image the file belongs to
+ * @param name the name of the file to read
+ * @return sum The SHA1 sum of the file in ASCII
+ *         err The error object if something failed
+ */
+func GetSha1Sum(uuid string, name string) (sum string, err error) {
+	file, err := storage.GetFile(uuid, name)
+	if err != nil {
+		return sum, err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return sum, err
+	}
+
+	sum = fmt.Sprintf("%x", hasher.Sum(nil))
+	return sum, err
+}
@@ -0,0 +1,997 @@
+/**
+ * Package client is a client library for the IMGAPI server.
+ *
+ *     c := client.New("https://images.example.com")
+ *     c.SetBasicAuth("admin", "secret")
+ *     images, err := c.ListImages(url.Values{"os": {"smartos"}})
+ */
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Manifest is the image manifest as returned by the server
+type Manifest map[string]interface{}
+
+func (m Manifest) getString(key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func (m Manifest) Uuid() string {
+	return m.getString("uuid")
+}
+
+func (m Manifest) Name() string {
+	return m.getString("name")
+}
+
+func (m Manifest) Version() string {
+	return m.getString("version")
+}
+
+func (m Manifest) State() string {
+	return m.getString("state")
+}
+
+// Client is used to talk to an IMGAPI server
+type Client struct {
+	// The URL of the server (for instance "https://images.example.com")
+	Url string
+
+	// The client used to perform the requests (http.DefaultClient if nil)
+	HttpClient *http.Client
+
+	// The channel to use for the image requests (if the server use channels)
+	Channel string
+
+	// The account to use the /:account/images endpoints for (the uuid or
+	// the name of the account, empty to use /images)
+	Account string
+
+	// Validate the requests modifying the images without changing
+	// anything (the requests which doesn't support dry_run fails)
+	DryRun bool
+
+	username string
+	password string
+	token    string
+}
+
+// Create a new client for the server
+func New(url string) *Client {
+	return &Client{Url: strings.TrimRight(url, "/")}
+}
+
+// Use Basic Auth with the username and password
+func (c *Client) SetBasicAuth(username string, password string) {
+	c.username = username
+	c.password = password
+	c.token = ""
+}
+
+// Use the API token (see CreateToken)
+func (c *Client) SetToken(token string) {
+	c.token = token
+	c.username = ""
+	c.password = ""
+}
+
+/**
+ * Perform the request and return the response if the server returns
+ * a 2xx status code (the caller must close the body). Otherwise the
+ * error returned by the server is returned as an *Error.
+ */
+func (c *Client) do(method string, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	return c.doWithHeader(method, path, query, body, contentType, nil)
+}
+
+// Perform the request (see do) with the extra headers
+func (c *Client) doWithHeader(method string, path string, query url.Values, body io.Reader, contentType string, header http.Header) (*http.Response, error) {
+	if len(c.Channel) > 0 && strings.HasPrefix(path, "/images") {
+		q := url.Values{"channel": {c.Channel}}
+		for k, v := range query {
+			q[k] = v
+		}
+		query = q
+	}
+	if c.DryRun && method != "GET" && method != "HEAD" && strings.HasPrefix(path, "/images") {
+		q := url.Values{"dry_run": {"true"}}
+		for k, v := range query {
+			q[k] = v
+		}
+		query = q
+	}
+	if len(c.Account) > 0 && strings.HasPrefix(path, "/images") && !strings.HasPrefix(path, "/images/changes") {
+		path = "/" + url.PathEscape(c.Account) + path
+	}
+
+	u := c.Url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if len(c.username) > 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	httpClient := c.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, newError(resp)
+	}
+	return resp, nil
+}
+
+// Perform the request and decode the JSON response into result
+func (c *Client) doJson(method string, path string, query url.Values, body io.Reader, contentType string, result interface{}) error {
+	resp, err := c.do(method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Encode the value as JSON to be sent as the request body
+func jsonBody(value interface{}) (io.Reader, error) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(content), nil
+}
+
+func imagePath(uuid string) string {
+	return "/images/" + url.PathEscape(uuid)
+}
+
+// Check that the server is up
+func (c *Client) Ping() error {
+	return c.doJson("GET", "/ping", nil, nil, "", nil)
+}
+
+// The version and the capabilities of the server (see Version)
+type ServerVersion struct {
+	Version       string   `json:"version"`
+	Features      []string `json:"features"`
+	Actions       []string `json:"actions"`
+	CreateActions []string `json:"create_actions"`
+	Storage       string   `json:"storage"`
+	StorageTypes  []string `json:"storage_types"`
+	ExporterTypes []string `json:"exporter_types"`
+	CatalogTypes  []string `json:"catalog_types"`
+}
+
+func contains(list []string, name string) bool {
+	for _, entry := range list {
+		if entry == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the feature (like "channels") is enabled on the server
+func (v *ServerVersion) HasFeature(name string) bool {
+	return contains(v.Features, name)
+}
+
+// Check if the server implements the action on images (like "import-remote")
+func (v *ServerVersion) HasAction(name string) bool {
+	return contains(v.Actions, name) || contains(v.CreateActions, name)
+}
+
+// Get the version of the server and the features and actions it supports
+func (c *Client) Version() (*ServerVersion, error) {
+	var v ServerVersion
+	err := c.doJson("GET", "/version", nil, nil, "", &v)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+/**
+ * List the images matching the filters (see ListImages in the IMGAPI
+ * documentation). All of the pages is fetched unless the limit filter
+ * is used.
+ */
+func (c *Client) ListImages(filters url.Values) ([]Manifest, error) {
+	query := url.Values{}
+	for k, v := range filters {
+		query[k] = v
+	}
+
+	var images []Manifest
+	for {
+		resp, err := c.do("GET", "/images", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+
+		var page []Manifest
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, page...)
+
+		next := resp.Header.Get("X-Next-Marker")
+		if len(next) == 0 || len(filters.Get("limit")) > 0 {
+			return images, nil
+		}
+		query.Set("marker", next)
+	}
+}
+
+// Search the images (see "Search" in the README for the parameters)
+func (c *Client) SearchImages(params url.Values) ([]Manifest, error) {
+	var images []Manifest
+	err := c.doJson("GET", "/images/search", params, nil, "", &images)
+	return images, err
+}
+
+// Get the manifest for the image
+func (c *Client) GetImage(uuid string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("GET", imagePath(uuid), nil, nil, "", &m)
+	return m, err
+}
+
+// Get the image manifest and its ETag (see UpdateImageIfMatch)
+func (c *Client) GetImageEtag(uuid string) (Manifest, string, error) {
+	resp, err := c.do("GET", imagePath(uuid), nil, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var m Manifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	return m, resp.Header.Get("ETag"), err
+}
+
+// Download the image file and write it to w
+func (c *Client) GetImageFile(uuid string, w io.Writer) (int64, error) {
+	return c.GetImageFileAt(uuid, 0, w)
+}
+
+// Download the file with the index in the files list and write it to w
+func (c *Client) GetImageFileAt(uuid string, index int, w io.Writer) (int64, error) {
+	path := imagePath(uuid) + "/file"
+	if index > 0 {
+		path += "/" + strconv.Itoa(index)
+	}
+
+	resp, err := c.do("GET", path, nil, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// Download the image icon and write it to w (returns the content type)
+func (c *Client) GetImageIcon(uuid string, w io.Writer) (string, error) {
+	resp, err := c.do("GET", imagePath(uuid)+"/icon", nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return resp.Header.Get("Content-Type"), err
+}
+
+// Download a PNG thumbnail of the icon (size is 32, 64 or 128 pixels) and write it to w
+func (c *Client) GetImageIconThumbnail(uuid string, size int, w io.Writer) error {
+	query := url.Values{"size": {strconv.Itoa(size)}}
+	resp, err := c.do("GET", imagePath(uuid)+"/icon", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Create a new (unactivated) image from the manifest
+func (c *Client) CreateImage(manifest Manifest) (Manifest, error) {
+	body, err := jsonBody(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	err = c.doJson("POST", "/images", nil, body, "application/json", &m)
+	return m, err
+}
+
+// Create an (activated) image from the VM (operators only)
+func (c *Client) CreateImageFromVm(vm string, incremental bool, manifest Manifest) (Manifest, error) {
+	body, err := jsonBody(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("action", "create-from-vm")
+	query.Set("vm_uuid", vm)
+	if incremental {
+		query.Set("incremental", "true")
+	}
+
+	var m Manifest
+	err = c.doJson("POST", "/images", query, body, "application/json", &m)
+	return m, err
+}
+
+/**
+ * Upload the image file. compression is "gzip", "bzip2", "xz" or "none" (the
+ * server compress the file with gzip if empty), and the server verifies
+ * the file with sha1 (if specified).
+ */
+func (c *Client) AddImageFile(uuid string, reader io.Reader, compression string, sha1 string) (Manifest, error) {
+	return c.AddImageFileAt(uuid, 0, reader, compression, sha1)
+}
+
+// Upload the file with the index in the files list (see AddImageFile)
+func (c *Client) AddImageFileAt(uuid string, index int, reader io.Reader, compression string, sha1 string) (Manifest, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", strconv.Itoa(index))
+	}
+	if len(compression) > 0 {
+		query.Set("compression", compression)
+	}
+	if len(sha1) > 0 {
+		query.Set("sha1", sha1)
+	}
+
+	var m Manifest
+	err := c.doJson("PUT", imagePath(uuid)+"/file", query, reader, "application/octet-stream", &m)
+	return m, err
+}
+
+// The block checksums of an image file as returned by GetImageFileBlocks
+type FileBlocks struct {
+	BlockSize int   `json:"block_size"`
+	Size      int64 `json:"size"`
+	// The weak (4 bytes) and strong (16 bytes) checksum of each block
+	Blocks []byte `json:"blocks"`
+}
+
+// Get the block checksums of the file with the index (the base of a delta upload)
+func (c *Client) GetImageFileBlocks(uuid string, index int) (FileBlocks, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", strconv.Itoa(index))
+	}
+
+	var blocks FileBlocks
+	err := c.doJson("GET", imagePath(uuid)+"/blocks", query, nil, "", &blocks)
+	return blocks, err
+}
+
+/**
+ * Upload the file with the index as a delta against the file with
+ * baseIndex of the base image (which the server already has). The
+ * compression and sha1 is the compression and SHA-1 of the file
+ * rebuilt from the delta.
+ */
+func (c *Client) AddImageFileDelta(uuid string, index int, base string, baseIndex int, delta io.Reader, compression string, sha1 string) (Manifest, error) {
+	query := url.Values{"delta": {base}, "compression": {compression}}
+	if index > 0 {
+		query.Set("index", strconv.Itoa(index))
+	}
+	if baseIndex > 0 {
+		query.Set("delta_index", strconv.Itoa(baseIndex))
+	}
+	if len(sha1) > 0 {
+		query.Set("sha1", sha1)
+	}
+
+	var m Manifest
+	err := c.doJson("PUT", imagePath(uuid)+"/file", query, delta, "application/octet-stream", &m)
+	return m, err
+}
+
+// Upload the image icon (contentType is image/png, image/jpeg or image/gif)
+func (c *Client) AddImageIcon(uuid string, reader io.Reader, contentType string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("POST", imagePath(uuid)+"/icon", nil, reader, contentType, &m)
+	return m, err
+}
+
+// Perform the action on the image (with an optional JSON body)
+func (c *Client) imageAction(uuid string, action string, value interface{}) (Manifest, error) {
+	var body io.Reader
+	contentType := ""
+	if value != nil {
+		var err error
+		body, err = jsonBody(value)
+		if err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	}
+
+	var m Manifest
+	err := c.doJson("POST", imagePath(uuid), url.Values{"action": {action}}, body, contentType, &m)
+	return m, err
+}
+
+func (c *Client) ActivateImage(uuid string) (Manifest, error) {
+	return c.imageAction(uuid, "activate", nil)
+}
+
+func (c *Client) DisableImage(uuid string) (Manifest, error) {
+	return c.imageAction(uuid, "disable", nil)
+}
+
+func (c *Client) EnableImage(uuid string) (Manifest, error) {
+	return c.imageAction(uuid, "enable", nil)
+}
+
+/**
+ * Update the (mutable) fields in the manifest. The current ETag of the
+ * manifest is fetched and sent with the update, so the update fails
+ * with the code PreconditionFailed if the image is modified in between.
+ * Use GetImageEtag and UpdateImageIfMatch to detect the updates made
+ * since the manifest was read by the caller.
+ */
+func (c *Client) UpdateImage(uuid string, fields Manifest) (Manifest, error) {
+	_, etag, err := c.GetImageEtag(uuid)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := c.UpdateImageIfMatch(uuid, etag, fields)
+	return m, err
+}
+
+/**
+ * Update the (mutable) fields in the manifest if the manifest still has
+ * the ETag (from GetImageEtag or a previous update). The update fails
+ * with the code PreconditionFailed if the image was modified. Pass "*"
+ * as the etag to update the image regardless of other updates.
+ *
+ * @return the updated manifest and its new ETag
+ */
+func (c *Client) UpdateImageIfMatch(uuid string, etag string, fields Manifest) (Manifest, string, error) {
+	body, err := jsonBody(fields)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.doWithHeader("POST", imagePath(uuid), url.Values{"action": {"update"}}, body,
+		"application/json", http.Header{"If-Match": {etag}})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var m Manifest
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	return m, resp.Header.Get("ETag"), err
+}
+
+// Add the image to another channel
+func (c *Client) ChannelAddImage(uuid string, channel string) (Manifest, error) {
+	return c.imageAction(uuid, "channel-add", map[string]string{"channel": channel})
+}
+
+/**
+ * Promote the image to the channel (from the channel's promote_from
+ * channel). With keep the image stays in the channel it is promoted
+ * from. The approval (optional unless the channel requires it) must
+ * contain approved_by, and is recorded in the manifest with the other
+ * fields (like a ticket or comment).
+ */
+func (c *Client) PromoteImage(uuid string, channel string, keep bool, approval map[string]string) (Manifest, error) {
+	request := map[string]interface{}{"channel": channel, "copy": keep}
+	if approval != nil {
+		request["approval"] = approval
+	}
+	body, err := jsonBody(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The image may be in any channel before it is promoted
+	var m Manifest
+	query := url.Values{"action": {"promote"}, "channel": {"*"}}
+	err = c.doJson("POST", imagePath(uuid), query, body, "application/json", &m)
+	return m, err
+}
+
+/**
+ * Import the image from the complete manifest (operators only). The
+ * uuid, owner and published_at is preserved, but the image is stored
+ * unactivated until the file is uploaded and the image is activated.
+ */
+func (c *Client) ImportImage(manifest Manifest) (Manifest, error) {
+	body, err := jsonBody(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	query := url.Values{"action": {"import"}}
+	err = c.doJson("POST", imagePath(manifest.Uuid()), query, body, "application/json", &m)
+	return m, err
+}
+
+// Import the image (and its file and icon) from another IMGAPI server
+func (c *Client) ImportRemoteImage(uuid string, source string) (Manifest, error) {
+	var m Manifest
+	query := url.Values{"action": {"import-remote"}, "source": {source}}
+	err := c.doJson("POST", imagePath(uuid), query, nil, "", &m)
+	return m, err
+}
+
+// The result of ExportImage
+type ExportResult struct {
+	Target       string `json:"target"`
+	ManifestPath string `json:"manifest_path"`
+	ImagePath    string `json:"image_path"`
+	// The location of every file of the image (the first is ImagePath)
+	FilePaths []string `json:"file_paths"`
+}
+
+// Export the image to the export target (configured on the server)
+func (c *Client) ExportImage(uuid string, target string, path string) (ExportResult, error) {
+	var result ExportResult
+	query := url.Values{"action": {"export"}, "target": {target}}
+	if len(path) > 0 {
+		query.Set("path", path)
+	}
+	err := c.doJson("POST", imagePath(uuid), query, nil, "", &result)
+	return result, err
+}
+
+// Import the image repo:tag from a Docker registry (Docker Hub if registry is empty)
+func (c *Client) ImportDockerImage(repo string, tag string, registry string) (Manifest, error) {
+	query := url.Values{"action": {"import-docker"}, "repo": {repo}}
+	if len(tag) > 0 {
+		query.Set("tag", tag)
+	}
+	if len(registry) > 0 {
+		query.Set("registry", registry)
+	}
+
+	var m Manifest
+	err := c.doJson("POST", "/images", query, nil, "", &m)
+	return m, err
+}
+
+// Create a new (activated) image from the OVA (format may be raw, qcow2, zvol or empty)
+func (c *Client) ImportOva(reader io.Reader, format string, fields url.Values) (Manifest, error) {
+	query := url.Values{"action": {"import-ova"}}
+	for k, v := range fields {
+		query[k] = v
+	}
+	if len(format) > 0 {
+		query.Set("format", format)
+	}
+
+	var m Manifest
+	err := c.doJson("POST", "/images", query, reader, "application/x-tar", &m)
+	return m, err
+}
+
+// Download the image and its origin chain as a bundle and write it to w
+func (c *Client) ExportImageBundle(uuid string, w io.Writer) (int64, error) {
+	resp, err := c.do("GET", imagePath(uuid)+"/bundle", nil, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// The result of ImportImageBundle
+type BundleImport struct {
+	Imported []string `json:"imported"`
+	Skipped  []string `json:"skipped"`
+}
+
+// Import the images in the bundle (the images which already exists is skipped)
+func (c *Client) ImportImageBundle(reader io.Reader) (BundleImport, error) {
+	query := url.Values{"action": {"import-bundle"}}
+	var result BundleImport
+	err := c.doJson("POST", "/images", query, reader, "application/x-tar", &result)
+	return result, err
+}
+
+// Add the accounts to the image acl
+func (c *Client) AddImageAcl(uuid string, accounts []string) (Manifest, error) {
+	return c.imageAcl(uuid, "add", accounts)
+}
+
+// Remove the accounts from the image acl
+func (c *Client) RemoveImageAcl(uuid string, accounts []string) (Manifest, error) {
+	return c.imageAcl(uuid, "remove", accounts)
+}
+
+func (c *Client) imageAcl(uuid string, action string, accounts []string) (Manifest, error) {
+	body, err := jsonBody(accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	err = c.doJson("POST", imagePath(uuid)+"/acl", url.Values{"action": {action}}, body, "application/json", &m)
+	return m, err
+}
+
+// Delete the image (and its files)
+func (c *Client) DeleteImage(uuid string) error {
+	return c.doJson("DELETE", imagePath(uuid), nil, nil, "", nil)
+}
+
+// Delete the image and all of the images built on top of it
+func (c *Client) DeleteImageAndDependents(uuid string) error {
+	query := url.Values{"force": {"true"}}
+	return c.doJson("DELETE", imagePath(uuid), query, nil, "", nil)
+}
+
+// Get the origin chain of the image (the image first)
+func (c *Client) GetImageAncestry(uuid string) ([]Manifest, error) {
+	var ancestry []Manifest
+	err := c.doJson("GET", imagePath(uuid)+"/ancestry", nil, nil, "", &ancestry)
+	return ancestry, err
+}
+
+// Get the tags of the image
+func (c *Client) ListImageTags(uuid string) (map[string]interface{}, error) {
+	var tags map[string]interface{}
+	err := c.doJson("GET", imagePath(uuid)+"/tags", nil, nil, "", &tags)
+	return tags, err
+}
+
+// Set the tag of the image to the value (a string, number or boolean)
+func (c *Client) SetImageTag(uuid string, key string, value interface{}) (Manifest, error) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	err = c.doJson("PUT", imagePath(uuid)+"/tags/"+url.PathEscape(key), nil, bytes.NewReader(body), "application/json", &m)
+	return m, err
+}
+
+// Remove the tag from the image
+func (c *Client) DeleteImageTag(uuid string, key string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("DELETE", imagePath(uuid)+"/tags/"+url.PathEscape(key), nil, nil, "", &m)
+	return m, err
+}
+
+// An operation in a batch (see Batch)
+type BatchOperation struct {
+	Uuid string `json:"uuid"`
+	// "delete" or an action on the image (like "update" or "channel-add")
+	Action string            `json:"action"`
+	Params map[string]string `json:"params,omitempty"`
+	// The body of the action (like the fields to update)
+	Body interface{} `json:"body,omitempty"`
+	// The ETag the manifest must match for update ("*" by default)
+	IfMatch string `json:"if_match,omitempty"`
+}
+
+// The result of an operation in a batch
+type BatchResult struct {
+	Uuid   string `json:"uuid"`
+	Action string `json:"action"`
+	Status int    `json:"status"`
+	// The response of the operation (like the updated manifest)
+	Result interface{} `json:"result"`
+	// The error if the operation failed
+	Error *Error `json:"error"`
+}
+
+/**
+ * Perform the operations on the images in a single request. The
+ * result of each operation is returned (the operations after the
+ * first failure is skipped if stopOnError is set), and the error is
+ * only returned if the batch itself failed.
+ */
+func (c *Client) Batch(operations []BatchOperation, stopOnError bool) ([]BatchResult, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"operations":    operations,
+		"stop_on_error": stopOnError,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Results []BatchResult `json:"results"`
+	}
+	err = c.doJson("POST", "/images/batch", nil, bytes.NewReader(body), "application/json", &response)
+	if err == nil {
+		for i := range response.Results {
+			if e := response.Results[i].Error; e != nil {
+				e.StatusCode = response.Results[i].Status
+			}
+		}
+	}
+	return response.Results, err
+}
+
+// A previous revision of the manifest as returned by GetImageHistory and GetImageRevision
+type ManifestRevision struct {
+	Rev       int    `json:"rev"`
+	Time      string `json:"time"`
+	RequestId string `json:"request_id"`
+	// The manifest (only returned by GetImageRevision)
+	Manifest Manifest `json:"manifest"`
+	// The fields changed in the next revision ({ "from" : old, "to" : new })
+	Changes map[string]map[string]interface{} `json:"changes"`
+}
+
+/**
+ * Get the previous revisions of the manifest (without the manifests)
+ * and the number of the current revision.
+ */
+func (c *Client) GetImageHistory(uuid string) ([]ManifestRevision, int, error) {
+	var history struct {
+		Current   int                `json:"current"`
+		Revisions []ManifestRevision `json:"revisions"`
+	}
+	err := c.doJson("GET", imagePath(uuid)+"/history", nil, nil, "", &history)
+	return history.Revisions, history.Current, err
+}
+
+// Get a previous revision of the manifest
+func (c *Client) GetImageRevision(uuid string, rev int) (*ManifestRevision, error) {
+	var revision ManifestRevision
+	err := c.doJson("GET", imagePath(uuid)+"/history/"+strconv.Itoa(rev), nil, nil, "", &revision)
+	if err != nil {
+		return nil, err
+	}
+	return &revision, nil
+}
+
+// Restore the manifest fields from a previous revision (operators only)
+func (c *Client) RollbackImage(uuid string, rev int) (Manifest, error) {
+	var m Manifest
+	query := url.Values{"action": {"rollback"}, "rev": {strconv.Itoa(rev)}}
+	err := c.doJson("POST", imagePath(uuid), query, nil, "", &m)
+	return m, err
+}
+
+// The storage used by an owner as returned by GetUsage
+type OwnerUsage struct {
+	Owner  string `json:"owner"`
+	Images int    `json:"images"`
+	Bytes  int64  `json:"bytes"`
+	Quota  int64  `json:"quota"`
+}
+
+// Get the storage used by the owner (all owners if empty, operators only)
+func (c *Client) GetUsage(owner string) ([]OwnerUsage, error) {
+	query := url.Values{}
+	if len(owner) > 0 {
+		query.Set("owner", owner)
+	}
+	var result struct {
+		Owners []OwnerUsage `json:"owners"`
+	}
+	err := c.doJson("GET", "/usage", query, nil, "", &result)
+	return result.Owners, err
+}
+
+// An image in the trash as returned by ListTrash
+type TrashedImage struct {
+	Uuid      string   `json:"uuid"`
+	DeletedAt string   `json:"deleted_at"`
+	PurgeAt   string   `json:"purge_at"`
+	Manifest  Manifest `json:"manifest"`
+}
+
+// List the deleted images in the trash (operators only)
+func (c *Client) ListTrash() ([]TrashedImage, error) {
+	var images []TrashedImage
+	err := c.doJson("GET", "/trash", nil, nil, "", &images)
+	return images, err
+}
+
+// Restore the deleted image from the trash (operators only)
+func (c *Client) RestoreImage(uuid string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("POST", "/trash/"+url.PathEscape(uuid), url.Values{"action": {"restore"}}, nil, "", &m)
+	return m, err
+}
+
+// Remove the deleted image from the trash (operators only)
+func (c *Client) PurgeImage(uuid string) error {
+	return c.doJson("DELETE", "/trash/"+url.PathEscape(uuid), nil, nil, "", nil)
+}
+
+// The state of the maintenance mode as returned by GetMaintenance
+type Maintenance struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+	Since      string `json:"since"`
+	User       string `json:"user"`
+}
+
+// Get the state of the maintenance mode (operators only)
+func (c *Client) GetMaintenance() (Maintenance, error) {
+	var m Maintenance
+	err := c.doJson("GET", "/maintenance", nil, nil, "", &m)
+	return m, err
+}
+
+// Put the server in read-only maintenance mode (operators only)
+func (c *Client) EnableMaintenance(message string, retryAfter int) (Maintenance, error) {
+	var m Maintenance
+	body, err := json.Marshal(map[string]interface{}{
+		"message":     message,
+		"retry_after": retryAfter,
+	})
+	if err == nil {
+		err = c.doJson("PUT", "/maintenance", nil, bytes.NewReader(body), "application/json", &m)
+	}
+	return m, err
+}
+
+// Leave the maintenance mode (operators only)
+func (c *Client) DisableMaintenance() (Maintenance, error) {
+	var m Maintenance
+	err := c.doJson("DELETE", "/maintenance", nil, nil, "", &m)
+	return m, err
+}
+
+// Remove the image icon
+func (c *Client) DeleteImageIcon(uuid string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("DELETE", imagePath(uuid)+"/icon", nil, nil, "", &m)
+	return m, err
+}
+
+// The signature of an image as returned by GetImageSignature
+type Signature struct {
+	Signature string `json:"signature"`
+	Key       string `json:"key"`
+	Namespace string `json:"namespace"`
+	Valid     bool   `json:"valid"`
+	Trusted   bool   `json:"trusted"`
+	Error     string `json:"error"`
+}
+
+// Get the signature of the image (and if it is valid)
+func (c *Client) GetImageSignature(uuid string) (Signature, error) {
+	var signature Signature
+	err := c.doJson("GET", imagePath(uuid)+"/signature", nil, nil, "", &signature)
+	return signature, err
+}
+
+// Get the payload to sign (with ssh-keygen -Y sign -n imgapi)
+func (c *Client) GetImageSigningPayload(uuid string) ([]byte, error) {
+	resp, err := c.do("GET", imagePath(uuid)+"/signature/payload", nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Add the signature (as written by ssh-keygen -Y sign) to the image
+func (c *Client) AddImageSignature(uuid string, signature []byte) (Signature, error) {
+	var result Signature
+	err := c.doJson("PUT", imagePath(uuid)+"/signature", nil, bytes.NewReader(signature), "text/plain", &result)
+	return result, err
+}
+
+// An attachment of an image as returned by ListImageAttachments
+type Attachment struct {
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Sha256      string `json:"sha256"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// Get the attachments of the image (by name)
+func (c *Client) ListImageAttachments(uuid string) (map[string]Attachment, error) {
+	var attachments map[string]Attachment
+	err := c.doJson("GET", imagePath(uuid)+"/attachments", nil, nil, "", &attachments)
+	return attachments, err
+}
+
+// Download the attachment and write it to w (returns the content type)
+func (c *Client) GetImageAttachment(uuid string, name string, w io.Writer) (string, error) {
+	resp, err := c.do("GET", imagePath(uuid)+"/attachments/"+url.PathEscape(name), nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return resp.Header.Get("Content-Type"), err
+}
+
+// Upload (or replace) the attachment of the image (sha256 is optional)
+func (c *Client) PutImageAttachment(uuid string, name string, reader io.Reader, contentType string, sha256 string) (Manifest, error) {
+	var query url.Values
+	if len(sha256) > 0 {
+		query = url.Values{"sha256": {sha256}}
+	}
+	var m Manifest
+	err := c.doJson("PUT", imagePath(uuid)+"/attachments/"+url.PathEscape(name), query, reader, contentType, &m)
+	return m, err
+}
+
+// Remove the attachment from the image
+func (c *Client) DeleteImageAttachment(uuid string, name string) (Manifest, error) {
+	var m Manifest
+	err := c.doJson("DELETE", imagePath(uuid)+"/attachments/"+url.PathEscape(name), nil, nil, "", &m)
+	return m, err
+}
+
+// A channel as returned by ListChannels
+type Channel struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Default     bool   `json:"default"`
+}
+
+// List the channels (if the server use channels)
+func (c *Client) ListChannels() ([]Channel, error) {
+	var channels []Channel
+	err := c.doJson("GET", "/channels", nil, nil, "", &channels)
+	return channels, err
+}
+
+// A token as returned by CreateToken
+type Token struct {
+	Id    string `json:"id"`
+	Token string `json:"token"`
+	User  string `json:"user"`
+}
+
+// Create a new API token for the user (use SetToken to use it)
+func (c *Client) CreateToken() (Token, error) {
+	var token Token
+	err := c.doJson("POST", "/tokens", nil, nil, "", &token)
+	return token, err
+}
+
+// Revoke the API token
+func (c *Client) DeleteToken(id string) error {
+	return c.doJson("DELETE", "/tokens/"+url.PathEscape(id), nil, nil, "", nil)
+}
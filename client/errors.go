@@ -0,0 +1,63 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+// The error codes returned by the server (see the errorcodes package for all of them)
+const (
+	CodeInvalidParameter          = errorcodes.InvalidParameter
+	CodeValidationFailed          = errorcodes.ValidationFailed
+	CodeResourceNotFound          = errorcodes.ResourceNotFound
+	CodeImageUuidAlreadyExists    = errorcodes.ImageUuidAlreadyExists
+	CodeImageAlreadyActivated     = errorcodes.ImageAlreadyActivated
+	CodeNoActivationNoFile        = errorcodes.NoActivationNoFile
+	CodeNotImageOwner             = errorcodes.NotImageOwner
+	CodeOperatorOnly              = errorcodes.OperatorOnly
+	CodeUnauthorizedError         = errorcodes.UnauthorizedError
+	CodeNotAuthorizedError        = errorcodes.NotAuthorizedError
+	CodeAccountDoesNotExist       = errorcodes.AccountDoesNotExist
+	CodeChecksumError             = errorcodes.ChecksumError
+	CodeInsufficientServerVersion = errorcodes.InsufficientServerVersion
+	CodeInternalError             = errorcodes.InternalError
+	CodePreconditionFailed        = errorcodes.PreconditionFailed
+)
+
+/**
+ * Error is returned when the server fails the request. Code and
+ * Message is the error returned by the server (Code may be empty if
+ * the server didn't return an error object), and Errors lists the
+ * invalid fields for ValidationFailed. RequestId is the ID the server
+ * assigned to the request (include it when reporting problems).
+ */
+type Error = errorcodes.Error
+
+// Create the error from the response
+func newError(resp *http.Response) error {
+	content, _ := ioutil.ReadAll(resp.Body)
+	e := errorcodes.Parse(resp.StatusCode, content)
+	if len(e.RequestId) == 0 {
+		e.RequestId = resp.Header.Get("X-Request-Id")
+	}
+	return e
+}
+
+// Check if the error was returned with the error code from the server
+func HasCode(err error, code errorcodes.Code) bool {
+	return errorcodes.Is(err, code)
+}
+
+// Check if the error means that the resource does not exist
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusNotFound || e.Code == CodeResourceNotFound)
+}
+
+// Check if the error means that the credentials is missing or invalid
+func IsUnauthorized(err error) bool {
+	e, ok := err.(*Error)
+	return ok && (e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
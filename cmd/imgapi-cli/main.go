@@ -0,0 +1,513 @@
+/**
+ * imgapi-cli is a command line tool used to manage the images on an
+ * IMGAPI server.
+ *
+ *     imgapi-cli [options] command [arguments]
+ */
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/trondn/imgapi/client"
+)
+
+type command struct {
+	usage       string
+	description string
+	run         func(c *client.Client, args []string) error
+}
+
+var commands = map[string]command{
+	"list":          {"[field=value ...]", "List the images matching the filters", listImages},
+	"get":           {"uuid", "Print the image manifest", getImage},
+	"create":        {"-m manifest", "Create a new (unactivated) image", createImage},
+	"upload-file":   {"[-c compression] -f file uuid", "Upload the image file", uploadFile},
+	"attach":        {"[-t content-type] -f file uuid name", "Attach a file (like a scan report) to the image", attachFile},
+	"activate":      {"uuid", "Activate the image", activateImage},
+	"promote":       {"[-k] [-a approver] [-m comment] uuid channel", "Promote the image to the channel", promoteImage},
+	"import":        {"[-p] -m manifest -f file | -S source uuid", "Import an image", importImage},
+	"import-docker": {"[-r registry] repo[:tag]", "Import an image from a Docker registry", importDockerImage},
+	"import-ova":    {"[-F format] [-n name] [-v version] file.ova", "Create an image from an OVA", importOva},
+	"delete":        {"uuid", "Delete the image", deleteImage},
+	"export":        {"-t target [-p path] uuid", "Export the image to an export target", exportImage},
+	"export-bundle": {"-o file uuid", "Save the image and its origins as a bundle", exportBundle},
+	"import-bundle": {"file", "Import the images in a bundle", importBundle},
+	"version":       {"", "Print the version and the features of the server", printVersion},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: imgapi-cli [options] command [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "Options:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nCommands:\n")
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range []string{"list", "get", "create", "upload-file", "attach", "activate", "import", "import-docker", "import-ova", "delete", "export", "export-bundle", "import-bundle", "version"} {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].usage, commands[name].description)
+	}
+	w.Flush()
+}
+
+func main() {
+	server := flag.String("u", os.Getenv("IMGAPI_URL"), "The URL of the server ($IMGAPI_URL)")
+	user := flag.String("user", os.Getenv("IMGAPI_USER"), "The username ($IMGAPI_USER)")
+	password := flag.String("password", os.Getenv("IMGAPI_PASSWORD"), "The password ($IMGAPI_PASSWORD)")
+	token := flag.String("token", os.Getenv("IMGAPI_TOKEN"), "The API token ($IMGAPI_TOKEN)")
+	channel := flag.String("channel", "", "The channel to use")
+	dryRun := flag.Bool("n", false, "Validate the changes without performing them (dry run)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || len(*server) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command \"%s\"\n", flag.Arg(0))
+		usage()
+		os.Exit(1)
+	}
+
+	c := client.New(*server)
+	c.Channel = *channel
+	c.DryRun = *dryRun
+	if len(*token) > 0 {
+		c.SetToken(*token)
+	} else if len(*user) > 0 {
+		c.SetBasicAuth(*user, *password)
+	}
+
+	err := cmd.run(c, flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+func printJson(value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+// Get the single uuid argument of the command
+func uuidArgument(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected a single uuid argument")
+	}
+	return args[0], nil
+}
+
+func listImages(c *client.Client, args []string) error {
+	filters := url.Values{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid filter \"%s\" (expected field=value)", arg)
+		}
+		filters.Add(parts[0], parts[1])
+	}
+
+	images, err := c.ListImages(filters)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "UUID\tNAME\tVERSION\tOS\tSTATE\n")
+	for _, m := range images {
+		osName, _ := m["os"].(string)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Uuid(), m.Name(), m.Version(), osName, m.State())
+	}
+	return w.Flush()
+}
+
+func getImage(c *client.Client, args []string) error {
+	uuid, err := uuidArgument(args)
+	if err != nil {
+		return err
+	}
+
+	m, err := c.GetImage(uuid)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func readManifest(path string) (client.Manifest, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var m client.Manifest
+	err = json.Unmarshal(content, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return m, nil
+}
+
+func createImage(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	manifest := flags.String("m", "", "The manifest file")
+	flags.Parse(args)
+	if len(*manifest) == 0 || flags.NArg() != 0 {
+		return fmt.Errorf("usage: create -m manifest")
+	}
+
+	m, err := readManifest(*manifest)
+	if err != nil {
+		return err
+	}
+
+	m, err = c.CreateImage(m)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+// Get the compression used for the file from the file name
+func fileCompression(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".bz2"):
+		return "bzip2"
+	case strings.HasSuffix(path, ".xz"):
+		return "xz"
+	}
+	return "none"
+}
+
+// Upload the file (the server verifies the file with its SHA1)
+func upload(c *client.Client, uuid string, path string, compression string) (client.Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha1.New()
+	_, err = io.Copy(hash, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(compression) == 0 {
+		compression = fileCompression(path)
+	}
+	return c.AddImageFile(uuid, f, compression, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func uploadFile(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("upload-file", flag.ExitOnError)
+	file := flags.String("f", "", "The image file")
+	compression := flags.String("c", "", "The compression used for the file (gzip, bzip2, xz or none)")
+	flags.Parse(args)
+	if len(*file) == 0 || flags.NArg() != 1 {
+		return fmt.Errorf("usage: upload-file [-c compression] -f file uuid")
+	}
+
+	m, err := upload(c, flags.Arg(0), *file, *compression)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func attachFile(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("attach", flag.ExitOnError)
+	file := flags.String("f", "", "The file to attach")
+	contentType := flags.String("t", "", "The content type of the file (guessed from the extension by default)")
+	flags.Parse(args)
+	if len(*file) == 0 || flags.NArg() != 2 {
+		return fmt.Errorf("usage: attach [-t content-type] -f file uuid name")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(*contentType) == 0 {
+		*contentType = mime.TypeByExtension(filepath.Ext(*file))
+	}
+	m, err := c.PutImageAttachment(flags.Arg(0), flags.Arg(1), f, *contentType, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func activateImage(c *client.Client, args []string) error {
+	uuid, err := uuidArgument(args)
+	if err != nil {
+		return err
+	}
+
+	m, err := c.ActivateImage(uuid)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func promoteImage(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	keep := flags.Bool("k", false, "Keep the image in the channel it is promoted from")
+	approver := flags.String("a", "", "The user who approved the promotion")
+	comment := flags.String("m", "", "A comment recorded with the approval")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: promote [-k] [-a approver] [-m comment] uuid channel")
+	}
+
+	var approval map[string]string
+	if len(*approver) > 0 {
+		approval = map[string]string{"approved_by": *approver}
+		if len(*comment) > 0 {
+			approval["comment"] = *comment
+		}
+	}
+
+	m, err := c.PromoteImage(flags.Arg(0), flags.Arg(1), *keep, approval)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+/**
+ * Import the image from the manifest and file (create, upload the file
+ * and activate the image), or from another IMGAPI server.
+ */
+func importImage(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	manifest := flags.String("m", "", "The manifest file")
+	file := flags.String("f", "", "The image file")
+	source := flags.String("S", "", "The IMGAPI server to import the image from")
+	preserve := flags.Bool("p", false, "Preserve the uuid and published_at (operators only)")
+	flags.Parse(args)
+
+	if len(*source) > 0 {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: import -S source uuid")
+		}
+		err := requireAction(c, "import-remote")
+		if err != nil {
+			return err
+		}
+		m, err := c.ImportRemoteImage(flags.Arg(0), *source)
+		if err != nil {
+			return err
+		}
+		return printJson(m)
+	}
+
+	if len(*manifest) == 0 || len(*file) == 0 || flags.NArg() != 0 {
+		return fmt.Errorf("usage: import [-p] -m manifest -f file")
+	}
+
+	m, err := readManifest(*manifest)
+	if err != nil {
+		return err
+	}
+
+	if *preserve {
+		m, err = c.ImportImage(m)
+	} else {
+		// The server verifies the file against the files in the manifest
+		delete(m, "files")
+		delete(m, "state")
+		m, err = c.CreateImage(m)
+	}
+	if err != nil {
+		return err
+	}
+	if c.DryRun {
+		// The file can't be uploaded as the image isn't created
+		return printJson(m)
+	}
+
+	_, err = upload(c, m.Uuid(), *file, "")
+	if err == nil {
+		m, err = c.ActivateImage(m.Uuid())
+	}
+	if err != nil {
+		c.DeleteImage(m.Uuid())
+		return err
+	}
+	return printJson(m)
+}
+
+/**
+ * Fail unless the server implements the action. Servers without
+ * /version is assumed to implement it (the request fails if not).
+ */
+func requireAction(c *client.Client, action string) error {
+	v, err := c.Version()
+	if err != nil || v.HasAction(action) {
+		return nil
+	}
+	return fmt.Errorf("the server (version %s) does not support action=%s", v.Version, action)
+}
+
+func printVersion(c *client.Client, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: version")
+	}
+	v, err := c.Version()
+	if err != nil {
+		return err
+	}
+	return printJson(v)
+}
+
+func deleteImage(c *client.Client, args []string) error {
+	uuid, err := uuidArgument(args)
+	if err != nil {
+		return err
+	}
+	return c.DeleteImage(uuid)
+}
+
+func exportImage(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	target := flags.String("t", "", "The export target")
+	path := flags.String("p", "", "The directory in the export target")
+	flags.Parse(args)
+	if len(*target) == 0 || flags.NArg() != 1 {
+		return fmt.Errorf("usage: export -t target [-p path] uuid")
+	}
+
+	result, err := c.ExportImage(flags.Arg(0), *target, *path)
+	if err != nil {
+		return err
+	}
+	return printJson(result)
+}
+
+func importDockerImage(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("import-docker", flag.ExitOnError)
+	registry := flags.String("r", "", "The registry (Docker Hub by default)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-docker [-r registry] repo[:tag]")
+	}
+	repo, tag := flags.Arg(0), ""
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+
+	m, err := c.ImportDockerImage(repo, tag, *registry)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func importOva(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("import-ova", flag.ExitOnError)
+	format := flags.String("F", "", "The format of the disks (raw, qcow2 or zvol)")
+	name := flags.String("n", "", "The name of the image (from the OVF by default)")
+	version := flags.String("v", "", "The version of the image (from the OVF by default)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: import-ova [-F format] [-n name] [-v version] file.ova")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fields := url.Values{}
+	if len(*name) > 0 {
+		fields.Set("name", *name)
+	}
+	if len(*version) > 0 {
+		fields.Set("version", *version)
+	}
+	m, err := c.ImportOva(f, *format, fields)
+	if err != nil {
+		return err
+	}
+	return printJson(m)
+}
+
+func exportBundle(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("export-bundle", flag.ExitOnError)
+	output := flags.String("o", "", "The file to write the bundle to")
+	flags.Parse(args)
+	if len(*output) == 0 || flags.NArg() != 1 {
+		return fmt.Errorf("usage: export-bundle -o file uuid")
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	_, err = c.ExportImageBundle(flags.Arg(0), f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*output)
+	}
+	return err
+}
+
+func importBundle(c *client.Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import-bundle file")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	result, err := c.ImportImageBundle(f)
+	if err != nil {
+		return err
+	}
+	return printJson(result)
+}
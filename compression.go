@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The compressions of the image file the server knows about
+var compressions = []struct {
+	name      string
+	extension string
+	magic     []byte
+}{
+	{"bzip2", ".bz2", []byte("BZh")},
+	{"gzip", ".gz", []byte{0x1f, 0x8b}},
+	{"xz", ".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{"none", "", nil},
+}
+
+// Get the compression of the stored image file from its name
+func imageFileCompression(filename string) string {
+	for _, c := range compressions {
+		if len(c.extension) > 0 && strings.HasSuffix(filename, c.extension) {
+			return c.name
+		}
+	}
+	return "none"
+}
+
+// Detect the compression of the file from the magic bytes
+func detectCompression(header []byte) string {
+	for _, c := range compressions {
+		if c.magic != nil && bytes.HasPrefix(header, c.magic) {
+			return c.name
+		}
+	}
+	return "none"
+}
+
+/**
+ * Verify that the content provided by reader is compressed with the
+ * declared compression (by looking at the magic bytes).
+ *
+ * @param compression the declared compression
+ * @param reader the content of the file
+ * @return a reader returning the complete content (the magic bytes
+ *         is read from reader), or an error if the compression
+ *         don't match
+ */
+func verifyCompression(compression string, reader io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(reader)
+	header, _ := buffered.Peek(6)
+
+	detected := detectCompression(header)
+	if detected != compression {
+		return nil, fmt.Errorf("The file is compressed with %s (not %s)", detected, compression)
+	}
+	return buffered, nil
+}
+
+// Get a reader providing the uncompressed content
+func decompressReader(compression string, reader io.Reader) (io.Reader, error) {
+	switch compression {
+	case "none":
+		return reader, nil
+	case "gzip":
+		return gzip.NewReader(reader)
+	case "bzip2":
+		return bzip2.NewReader(reader), nil
+	}
+	return nil, fmt.Errorf("The server can't decompress %s", compression)
+}
+
+// Get a writer compressing the content written to w (the caller must close it)
+func compressWriter(compression string, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case "none":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("The server can't compress with %s", compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+/**
+ * Select the compression to send the image file with from the
+ * accept-compression parameter (a comma separated list in order of
+ * preference).
+ *
+ * @param stored the compression of the stored file
+ * @param accept the value of the accept-compression parameter
+ * @return the compression to use (the stored compression is used if
+ *         it is acceptable, otherwise the first compression the server
+ *         can transcode to)
+ */
+func selectCompression(stored string, accept string) (string, error) {
+	accepted := strings.Split(accept, ",")
+	for i := range accepted {
+		accepted[i] = strings.TrimSpace(accepted[i])
+	}
+
+	if stringInSlice(stored, accepted) {
+		return stored, nil
+	}
+
+	if stored == "xz" {
+		return "", fmt.Errorf("The server can't decompress xz")
+	}
+
+	for _, c := range accepted {
+		if c == "none" || c == "gzip" {
+			return c, nil
+		}
+	}
+	return "", fmt.Errorf("The server can't transcode %s to \"%s\"", stored, accept)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Generate a strong ETag from the content
+func contentEtag(content []byte) string {
+	sum := sha1.Sum(content)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// Count the number of bytes written
+type countingWriter struct {
+	io.Writer
+	bytes int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	n, err := c.Writer.Write(data)
+	c.bytes += int64(n)
+	return n, err
+}
+
+/**
+ * Generate the ETag (and get the size) of the content written by write
+ * without keeping the content in memory
+ */
+func streamEtag(write func(w io.Writer)) (string, int64) {
+	h := sha1.New()
+	counter := &countingWriter{Writer: h}
+	write(counter)
+	return "\"" + hex.EncodeToString(h.Sum(nil)) + "\"", counter.bytes
+}
+
+// Generate the ETag of the manifest (the same as the ETag sent by GetImage)
+func manifestEtag(m map[string]interface{}) string {
+	a, _ := encodeResponse(m, Success)
+	return contentEtag(a)
+}
+
+/**
+ * Check the If-Match header of a request modifying the resource (to
+ * prevent lost updates). The header is required unless
+ * if_match_optional is set in the configuration.
+ *
+ * @param etag the current ETag of the resource
+ * @return the error to send if the precondition fails (nil if it is OK)
+ */
+func checkIfMatch(r *http.Request, etag string) (int, map[string]interface{}) {
+	value := r.Header.Get("If-Match")
+	if len(value) == 0 {
+		if configuration.IfMatchOptional {
+			return Success, nil
+		}
+		return errorResponse(CodePreconditionRequired, "The If-Match header is required (use the ETag from GetImage)")
+	}
+	if !etagMatches(value, etag) {
+		return errorResponse(CodePreconditionFailed, "The image has been modified (get the image again and retry)")
+	}
+	return Success, nil
+}
+
+// Generate an ETag for a file without reading it
+func fileEtag(info FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size, info.ModTime.Unix())
+}
+
+// The suffix added to the ETag of the responses compressed with gzip
+const gzipEtagSuffix = "-gzip\""
+
+/**
+ * Get the ETag of the compressed response so that it doesn't share a
+ * strong validator with the uncompressed response
+ */
+func gzipEtag(etag string) string {
+	if !strings.HasPrefix(etag, "\"") || strings.HasSuffix(etag, gzipEtagSuffix) {
+		return etag
+	}
+	return strings.TrimSuffix(etag, "\"") + gzipEtagSuffix
+}
+
+// Check if the etag is present in the If-Match or If-None-Match header
+// (the ETag of the compressed response matches as well)
+func etagMatches(header string, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if strings.HasSuffix(value, gzipEtagSuffix) {
+			value = strings.TrimSuffix(value, gzipEtagSuffix) + "\""
+		}
+		if value == "*" || value == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Set the ETag and Last-Modified headers and check if the client
+ * already has the current version of the resource (If-None-Match and
+ * If-Modified-Since). 304 Not Modified is sent to the client if it does.
+ *
+ * @param w where to send the response
+ * @param r the request
+ * @param etag the ETag of the resource
+ * @param modtime the time the resource was modified (may be zero)
+ * @return true if 304 was sent to the client
+ */
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) bool {
+	h := w.Header()
+	h.Set("ETag", etag)
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" && len(r.Method) != 0 {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		notModified = etagMatches(inm, etag)
+	} else if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		notModified = err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+
+	if notModified {
+		h.Set("Server", "Norbye Public Images Repo")
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// Check if the Range header should be used (see If-Range)
+func rangeApplies(r *http.Request, etag string, modtime time.Time) bool {
+	value := r.Header.Get("If-Range")
+	if len(value) == 0 {
+		return true
+	}
+	if strings.HasPrefix(value, "\"") {
+		return value == etag
+	}
+	t, err := http.ParseTime(value)
+	return err == nil && modtime.Truncate(time.Second).Equal(t)
+}
+
+/**
+ * Send the JSON response with an ETag computed from the content (and
+ * 304 if the client already has it)
+ */
+func sendCachedResponse(w http.ResponseWriter, r *http.Request, code int, content map[string]interface{}) {
+	if code != Success || content == nil {
+		sendResponse(w, code, content)
+		return
+	}
+
+	a, code := encodeResponse(content, code)
+	if code == Success && checkNotModified(w, r, contentEtag(a), time.Time{}) {
+		return
+	}
+	writeResponse(w, code, a)
+}
@@ -1,13 +1,353 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
 type UserEntry struct {
 	Name     string `json:"name"`
-	Password string `json:"password"`
+	Password string `json:"password,omitempty"`
+	// The hashed password (see userdb.go) instead of password
+	PasswordHash string `json:"password_hash,omitempty"`
+	Keys         string `json:"keys,omitempty"`
+	Role         string `json:"role,omitempty"`
+	Uuid         string `json:"uuid,omitempty"`
 }
 
 type Configuration struct {
-	Datadir  string      `json:"datadir"`
-	Port     int         `json:"port"`
-	Hostname string      `json:"host"`
-	Userdb   []UserEntry `json:"userdb"`
+	Datadir           string                  `json:"datadir"`
+	Port              int                     `json:"port"`
+	ListenAddress     string                  `json:"listen_address"`
+	UnixSocket        string                  `json:"unix_socket"`
+	TrustedProxies    []string                `json:"trusted_proxies"`
+	Hostname          string                  `json:"host"`
+	Userdb            []UserEntry             `json:"userdb"`
+	UserdbFile        string                  `json:"userdb_file"`
+	Auth              AuthProviderConfig      `json:"auth"`
+	ServerTiming      bool                    `json:"server_timing"`
+	EnforceSize       bool                    `json:"enforce_file_size"`
+	Sha512            bool                    `json:"sha512"`
+	WarmCache         bool                    `json:"warm_cache"`
+	IndexWorkers      int                     `json:"index_workers"`
+	ManifestCacheSize int                     `json:"manifest_cache_size"`
+	Exporters         map[string]ExportTarget `json:"exporters"`
+	Channels          []Channel               `json:"channels"`
+	Storage           StorageConfig           `json:"storage"`
+	Catalog           CatalogConfig           `json:"catalog"`
+	CertFile          string                  `json:"cert_file"`
+	KeyFile           string                  `json:"key_file"`
+	RedirectPort      int                     `json:"redirect_port"`
+	TokenDb           string                  `json:"tokendb"`
+	AccessLog         AccessLogConfig         `json:"access_log"`
+	AuditLog          string                  `json:"audit_log"`
+	RateLimit         RateLimitConfig         `json:"rate_limit"`
+	WatchConfig       bool                    `json:"watch_config"`
+	VmSnapshot        VmSnapshotConfig        `json:"vm_snapshot"`
+	DiskConverter     DiskConverterConfig     `json:"disk_converter"`
+	OvaFormat         string                  `json:"ova_format"`
+	ConversionCache   ConversionCacheConfig   `json:"conversion_cache"`
+	MaxIconSize       int64                   `json:"max_icon_size"`
+	MaxManifestSize   int64                   `json:"max_manifest_size"`
+	MaxFileSize       int64                   `json:"max_file_size"`
+	MinFreeSpace      int64                   `json:"min_free_space"`
+	Quota             QuotaConfig             `json:"quota"`
+	Gc                GcConfig                `json:"gc"`
+	Trash             TrashConfig             `json:"trash"`
+	Retention         RetentionConfig         `json:"retention"`
+	Replication       []ReplicationTarget     `json:"replication"`
+	Mirror            MirrorConfig            `json:"mirror"`
+	Seed              SeedConfig              `json:"seed"`
+	Upstream          UpstreamConfig          `json:"upstream"`
+	Webhooks          []Webhook               `json:"webhooks"`
+	Notifications     []NotificationConfig    `json:"notifications"`
+	Cors              CorsConfig              `json:"cors"`
+	Gzip              GzipConfig              `json:"gzip"`
+	WebUi             bool                    `json:"web_ui"`
+	SwaggerUi         bool                    `json:"swagger_ui"`
+	IfMatchOptional   bool                    `json:"if_match_optional"`
+	PublicRead        bool                    `json:"public_read"`
+	DockerRegistry    bool                    `json:"docker_registry"`
+	Health            HealthConfig            `json:"health"`
+	Signing           SigningConfig           `json:"signing"`
+	Scan              ScanConfig              `json:"scan"`
+	Attachments       AttachmentsConfig       `json:"attachments"`
+
+	// Timeouts (in seconds, 0 means no timeout)
+	ReadTimeout       int `json:"read_timeout"`
+	ReadHeaderTimeout int `json:"read_header_timeout"`
+	WriteTimeout      int `json:"write_timeout"`
+	IdleTimeout       int `json:"idle_timeout"`
+	ShutdownTimeout   int `json:"shutdown_timeout"`
+	// The timeouts of the requests to the endpoints (by name)
+	RequestTimeouts map[string]int `json:"request_timeouts"`
+	// Seconds a download may go without progress (replaces write_timeout for the files)
+	SlowClientTimeout int `json:"slow_client_timeout"`
+	// Seconds to report not ready before shutting down
+	ShutdownDelay int `json:"shutdown_delay"`
+}
+
+// Verify that the port is a valid port number (0 is allowed if optional)
+func validatePort(name string, port int, optional bool) error {
+	if (optional && port == 0) || (port > 0 && port < 65536) {
+		return nil
+	}
+	return fmt.Errorf("%s must be between 1 and 65535 (not %d)", name, port)
+}
+
+// Verify that the server may create files in the directory
+func validateDirectoryWritable(dir string) error {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+/**
+ * Validate the configuration before the server is started so that
+ * errors in the configuration is reported up front rather than when
+ * the first request fails.
+ */
+func (c *Configuration) Validate() error {
+	err := validateListenAddress(*c)
+	if err == nil {
+		err = validatePort("redirect_port", c.RedirectPort, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(c.Userdb) == 0 && len(c.Auth.Type) == 0 {
+		return errors.New("userdb must contain at least one user")
+	}
+	for _, user := range c.Userdb {
+		if len(user.Name) == 0 {
+			return errors.New("All users in userdb must have a name")
+		}
+		if len(user.Password) == 0 && len(user.PasswordHash) == 0 && len(user.Keys) == 0 {
+			return fmt.Errorf("User %s must have a password or keys", user.Name)
+		}
+		err = validatePasswordHash(user)
+		if err != nil {
+			return err
+		}
+	}
+	err = validateUserRoles(c.Userdb)
+	if err != nil {
+		return err
+	}
+
+	if len(c.CertFile) > 0 != (len(c.KeyFile) > 0) {
+		return errors.New("Both cert_file and key_file must be specified to use TLS")
+	}
+
+	if storageType(*c) == "local" {
+		if len(c.Datadir) == 0 {
+			return errors.New("datadir must be specified")
+		}
+		err = validateDirectoryWritable(c.Datadir)
+		if err != nil {
+			return fmt.Errorf("datadir is not writable: %v", err)
+		}
+		if c.Storage.Layout < 0 || c.Storage.Layout > 2 {
+			return fmt.Errorf("The storage layout must be 1 or 2 (not %d)", c.Storage.Layout)
+		}
+		if c.Storage.Dedup && !hardLinksSupported {
+			return errors.New("The storage dedup is not supported on this platform")
+		}
+	} else if c.Storage.Dedup {
+		return errors.New("The storage dedup is only supported by the local storage")
+	}
+
+	err = validateChannels(c.Channels)
+	if err != nil {
+		return err
+	}
+
+	if len(c.Catalog.Type) > 0 {
+		err = validateCatalog(*c)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ManifestCacheSize < -1 {
+		return errors.New("manifest_cache_size must be -1 (disabled) or larger")
+	}
+
+	if c.IndexWorkers < 0 {
+		return errors.New("index_workers can't be negative")
+	}
+
+	if c.MaxIconSize < 0 {
+		return errors.New("max_icon_size can't be negative")
+	}
+
+	if c.MaxManifestSize < 0 || c.MaxFileSize < 0 {
+		return errors.New("max_manifest_size and max_file_size can't be negative")
+	}
+	if c.MinFreeSpace < 0 {
+		return errors.New("min_free_space can't be negative")
+	}
+
+	if c.Quota.Default < 0 {
+		return errors.New("The default quota can't be negative")
+	}
+	for owner, quota := range c.Quota.Owners {
+		if !isValidUuid(owner) || quota < 0 {
+			return fmt.Errorf("Invalid quota for owner \"%s\"", owner)
+		}
+	}
+
+	if len(c.Auth.Type) > 0 {
+		if c.Auth.CacheTtl < -1 {
+			return errors.New("The auth cache_ttl must be -1 (disabled) or larger")
+		}
+		_, err = newAuthProvider(c.Auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.VmSnapshot.Type) > 0 {
+		_, err = newVmSnapshotProvider(c.VmSnapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.DiskConverter.Type) > 0 {
+		_, err = newDiskConverter(c.DiskConverter)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.OvaFormat) > 0 && !stringInSlice(c.OvaFormat, []string{"raw", "qcow2", "zvol"}) {
+		return fmt.Errorf("ova_format must be raw, qcow2 or zvol (not \"%s\")", c.OvaFormat)
+	}
+
+	if len(c.ConversionCache.Dir) > 0 {
+		err = validateDirectoryWritable(c.ConversionCache.Dir)
+		if err != nil {
+			return fmt.Errorf("Can't use conversion_cache dir \"%s\": %v", c.ConversionCache.Dir, err)
+		}
+	}
+	if c.ConversionCache.MaxSize < 0 {
+		return errors.New("The conversion_cache max_size can't be negative")
+	}
+
+	if c.ReadTimeout < 0 || c.ReadHeaderTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 ||
+		c.ShutdownTimeout < 0 || c.ShutdownDelay < 0 || c.SlowClientTimeout < 0 {
+		return errors.New("The timeouts can't be negative")
+	}
+	for endpoint, timeout := range c.RequestTimeouts {
+		if timeout < 0 {
+			return fmt.Errorf("The request timeout for %s can't be negative", endpoint)
+		}
+	}
+
+	for _, target := range c.Replication {
+		if len(target.Name) == 0 || len(target.Url) == 0 {
+			return errors.New("All replication targets must have a name and url")
+		}
+	}
+
+	if c.Health.MinFreeSpace < 0 {
+		return errors.New("The health min_free_space can't be negative")
+	}
+
+	if c.Gc.Interval < 0 || c.Gc.UploadTtl < 0 {
+		return errors.New("The gc interval and upload_ttl can't be negative")
+	}
+
+	if c.Trash.Retention < 0 {
+		return errors.New("The trash retention can't be negative")
+	}
+
+	if c.Retention.Interval < 0 || c.Retention.KeepVersions < 0 || c.Retention.UnactivatedTtl < 0 {
+		return errors.New("The retention interval, keep_versions and unactivated_ttl can't be negative")
+	}
+
+	if c.Mirror.Interval < 0 {
+		return errors.New("The mirror interval can't be negative")
+	}
+
+	err = validateSeed(c.Seed)
+	if err != nil {
+		return err
+	}
+
+	err = validateUpstream(c.Upstream)
+	if err != nil {
+		return err
+	}
+
+	err = validateScan(c.Scan)
+	if err != nil {
+		return err
+	}
+
+	err = validateAttachments(c.Attachments)
+	if err != nil {
+		return err
+	}
+
+	limits := c.RateLimit
+	if limits.PerIp.Rate < 0 || limits.PerIp.Burst < 0 || limits.PerUser.Rate < 0 ||
+		limits.PerUser.Burst < 0 || limits.MaxUploads < 0 || limits.MaxDownloads < 0 {
+		return errors.New("The rate limits can't be negative")
+	}
+
+	for _, hook := range c.Webhooks {
+		if len(hook.Url) == 0 {
+			return errors.New("All webhooks must have an url")
+		}
+		for _, event := range hook.Events {
+			if !webhookEvents[event] {
+				return fmt.Errorf("Unknown webhook event: %s", event)
+			}
+		}
+	}
+
+	err = validateNotifications(c.Notifications)
+	if err != nil {
+		return err
+	}
+
+	if c.Signing.Require && len(c.Signing.TrustedKeys) == 0 {
+		return errors.New("signing requires trusted_keys to require signatures")
+	}
+	if len(c.Signing.TrustedKeys) > 0 {
+		_, err = loadTrustedKeys(c.Signing.TrustedKeys)
+		if err != nil {
+			return fmt.Errorf("Failed to load trusted_keys: %v", err)
+		}
+	}
+
+	err = validateCors(c.Cors)
+	if err != nil {
+		return err
+	}
+
+	err = validateGzip(c.Gzip)
+	if err != nil {
+		return err
+	}
+
+	_, err = parseTrustedProxies(c.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
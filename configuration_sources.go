@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The prefix of the environment variables overriding the configuration
+const configEnvPrefix = "IMGAPI_"
+
+/**
+ * The settings from the command line flags (by the name used in the
+ * configuration file). The flags override the environment variables,
+ * which override the configuration file.
+ */
+var configurationFlags = make(map[string]string)
+
+var errUnknownSetting = errors.New("Unknown setting")
+
+// Read and parse the configuration file (an empty configuration if it is optional and missing)
+func loadConfigurationFile(path string, optional bool) (Configuration, error) {
+	var config Configuration
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if optional && os.IsNotExist(err) {
+			return config, nil
+		}
+		return config, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("Failed to parse JSON: [%s]: %v", content, err)
+	}
+	return config, nil
+}
+
+/**
+ * Set the setting called name (as in the configuration file) from the
+ * string value. Only the top level settings with a string, number or
+ * boolean value may be set this way.
+ */
+func setConfigurationValue(config *Configuration, name string, value string) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != name {
+			continue
+		}
+
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: \"%s\"", name, value)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: \"%s\"", name, value)
+			}
+			field.SetBool(b)
+		default:
+			return fmt.Errorf("%s can't be set from a string", name)
+		}
+		return nil
+	}
+	return errUnknownSetting
+}
+
+/**
+ * Apply the IMGAPI_<SETTING> environment variables (like IMGAPI_PORT).
+ * The other IMGAPI_ variables (like IMGAPI_URL used by imgapi-cli) is
+ * ignored.
+ */
+func applyEnvironment(config *Configuration) error {
+	for _, variable := range os.Environ() {
+		pair := strings.SplitN(variable, "=", 2)
+		if len(pair) != 2 || !strings.HasPrefix(pair[0], configEnvPrefix) {
+			continue
+		}
+
+		name := strings.ToLower(strings.TrimPrefix(pair[0], configEnvPrefix))
+		err := setConfigurationValue(config, name, pair[1])
+		if err != nil && err != errUnknownSetting {
+			return fmt.Errorf("%s: %v", pair[0], err)
+		}
+	}
+	return nil
+}
+
+/**
+ * Load the configuration from the configuration file, the environment
+ * variables and the command line flags (in that order, so the flags
+ * take precedence).
+ *
+ * @param path the configuration file
+ * @param optional true if the file may be missing
+ * @return the configuration (not validated, see Configuration.Validate)
+ */
+func loadConfiguration(path string, optional bool) (Configuration, error) {
+	config, err := loadConfigurationFile(path, optional)
+	if err != nil {
+		return config, err
+	}
+
+	err = applyEnvironment(&config)
+	if err != nil {
+		return config, err
+	}
+
+	for name, value := range configurationFlags {
+		err = setConfigurationValue(&config, name, value)
+		if err != nil {
+			return config, fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+
+	err = mergeUserdbFile(&config)
+	if err != nil {
+		return config, err
+	}
+
+	// Store the API tokens next to the configuration file by default
+	if len(config.TokenDb) == 0 {
+		config.TokenDb = filepath.Join(filepath.Dir(path), "tokens.json")
+	}
+	return config, nil
+}
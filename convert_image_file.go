@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The formats GetImageFile may convert the disk images to
+var diskFormats = []string{"raw", "qcow2", "vmdk"}
+
+// The configuration of the cache of converted disk images in the configuration file
+type ConversionCacheConfig struct {
+	// The directory to keep the converted files in (empty disables the cache)
+	Dir string `json:"dir"`
+	// The maximum number of bytes in the cache (0 means no limit)
+	MaxSize int64 `json:"max_size"`
+}
+
+// Get the format of the disk images of the image ("" if unknown)
+func imageDiskFormat(m map[string]interface{}) string {
+	tags, _ := m["tags"].(map[string]interface{})
+	format, _ := tags[diskFormatTag].(string)
+	if !stringInSlice(format, diskFormats) {
+		return ""
+	}
+	return format
+}
+
+/**
+ * Get the name of the cached conversion of the file. The digest of the
+ * file is part of the name so that a new upload never use an old
+ * conversion.
+ */
+func conversionCacheName(uuid string, index int, declared map[string]interface{}, format string) string {
+	digest, _ := declared["sha256"].(string)
+	if len(digest) == 0 {
+		digest, _ = declared["sha1"].(string)
+	}
+	if len(digest) == 0 || len(configuration.ConversionCache.Dir) == 0 {
+		return ""
+	}
+	return filepath.Join(configuration.ConversionCache.Dir,
+		fmt.Sprintf("%s-%d-%s.%s", uuid, index, digest, format))
+}
+
+/**
+ * Remove the least recently used conversions until the cache is
+ * smaller than max_size.
+ */
+func trimConversionCache() {
+	if configuration.ConversionCache.MaxSize <= 0 {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(configuration.ConversionCache.Dir)
+	if err != nil {
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+
+	var size int64
+	for _, entry := range entries {
+		// Skip the conversions in progress
+		if strings.HasPrefix(entry.Name(), ".") || !entry.Mode().IsRegular() {
+			continue
+		}
+		size += entry.Size()
+		if size > configuration.ConversionCache.MaxSize {
+			os.Remove(filepath.Join(configuration.ConversionCache.Dir, entry.Name()))
+		}
+	}
+}
+
+/**
+ * Convert the stored file to format. The file is decompressed to a
+ * temporary file first since the converters work on files.
+ *
+ * @param dst the name of the file to create
+ * @return the error object if something failed
+ */
+func convertImageFile(uuid string, filename string, srcFormat string, dst string, format string) error {
+	converter, err := getDiskConverter()
+	if err != nil {
+		return err
+	}
+
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	source, err := decompressReader(imageFileCompression(filename), reader)
+	if err != nil {
+		return err
+	}
+	path, _, _, err := spoolImageFile(source)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	return converter.Convert(path, srcFormat, dst, format)
+}
+
+/**
+ * Send the image file converted to format. The conversion is kept in
+ * the conversion_cache (if configured), otherwise the file is converted
+ * for every request.
+ */
+func serveConvertedImageFile(w http.ResponseWriter, r *http.Request, uuid string, index int, filename string, m map[string]interface{}, format string) {
+	srcFormat := imageDiskFormat(m)
+	if len(srcFormat) == 0 {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("The disk format of the image is unknown (see the \"%s\" tag)", diskFormatTag))
+		return
+	}
+
+	path := conversionCacheName(uuid, index, getDeclaredFileAt(m, index), format)
+	cached := len(path) > 0
+	if cached {
+		now := time.Now()
+		if os.Chtimes(path, now, now) != nil {
+			cached = false
+		}
+	}
+
+	if !cached {
+		dir := configuration.ConversionCache.Dir
+		if len(path) == 0 {
+			dir = spoolDir()
+		}
+		f, err := ioutil.TempFile(dir, ".convert")
+		if err == nil {
+			f.Close()
+			defer os.Remove(f.Name())
+			err = convertImageFile(uuid, filename, srcFormat, f.Name(), format)
+		}
+		if err == errNoDiskConverter {
+			sendError(w, CodeNotAvailable, fmt.Sprintf("%v", err))
+			return
+		}
+		if err == nil && len(path) > 0 {
+			err = os.Rename(f.Name(), path)
+			trimConversionCache()
+		}
+		if err != nil {
+			sendError(w, CodeInternalError, fmt.Sprintf("Failed to convert file: %v", err))
+			return
+		}
+		if len(path) == 0 {
+			path = f.Name()
+		}
+	}
+
+	f, err := os.Open(path)
+	var info os.FileInfo
+	if err == nil {
+		defer f.Close()
+		info, err = f.Stat()
+	}
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read converted file: %v", err))
+		return
+	}
+	timingMark(w, "convert")
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Image-Compression", "none")
+	h.Set("X-Image-Format", format)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// Remove the cached conversions of the image (when it is deleted)
+func removeCachedConversions(uuid string) {
+	if len(configuration.ConversionCache.Dir) == 0 {
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(configuration.ConversionCache.Dir, uuid+"-*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		err = os.Remove(match)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove cached conversion %s: %v", match, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The methods allowed in cross-origin requests unless methods is set
+var defaultCorsMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+
+// The request headers allowed in cross-origin requests unless headers is set
+var defaultCorsHeaders = []string{"Authorization", "Content-Type", "Range",
+	"If-Match", "If-None-Match", "If-Modified-Since"}
+
+// The response headers the browser may read in cross-origin requests
+var corsExposedHeaders = []string{"ETag", "Last-Modified", "Content-Range",
+	"Content-Length", "Retry-After", "X-Request-Id", "X-Imgapi-Version",
+	"X-Imgapi-Features"}
+
+// The configuration of CORS in the configuration file
+type CorsConfig struct {
+	// The origins allowed to call the server ("*" allows all)
+	Origins []string `json:"origins"`
+	Methods []string `json:"methods"`
+	Headers []string `json:"headers"`
+	// Allow the browser to send the credentials (cookies and Authorization)
+	Credentials bool `json:"credentials"`
+	// Seconds the browser may cache the preflight response
+	MaxAge int `json:"max_age"`
+}
+
+// Verify that the origins is "*" or an origin like "https://console.example.com"
+func validateCors(c CorsConfig) error {
+	if c.MaxAge < 0 {
+		return errors.New("The cors max_age can't be negative")
+	}
+	for _, origin := range c.Origins {
+		if origin == "*" && c.Credentials {
+			// Any website could make authenticated calls to the server
+			return errors.New("The cors origins can't contain \"*\" when credentials is set")
+		}
+		if origin != "*" && !strings.Contains(origin, "://") {
+			return errors.New("The cors origins must be \"*\" or a scheme and host like \"https://console.example.com\"")
+		}
+	}
+	return nil
+}
+
+// Check if the origin is in the list of allowed origins
+func corsOriginAllowed(config CorsConfig, origin string) bool {
+	for _, allowed := range config.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func corsList(values []string, defaults []string) string {
+	if len(values) == 0 {
+		values = defaults
+	}
+	return strings.Join(values, ", ")
+}
+
+/**
+ * Wrap the handler to add the CORS headers to the responses for the
+ * allowed origins so that a web UI served from another origin may call
+ * the server. The preflight requests (OPTIONS with
+ * Access-Control-Request-Method) is answered without calling the
+ * handler. Nothing is changed unless cors is configured.
+ */
+func withCors(handler http.Handler) http.Handler {
+	// The origins may be changed when the configuration is reloaded
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := currentConfiguration().Cors
+		origin := r.Header.Get("Origin")
+		if len(config.Origins) == 0 || len(origin) == 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !corsOriginAllowed(config, origin) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		// The credentials is never allowed for the wildcard (see validateCors)
+		if stringInSlice("*", config.Origins) {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if config.Credentials && !stringInSlice("*", config.Origins) {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == "OPTIONS" && len(r.Header.Get("Access-Control-Request-Method")) > 0 {
+			h.Set("Access-Control-Allow-Methods", corsList(config.Methods, defaultCorsMethods))
+			h.Set("Access-Control-Allow-Headers", corsList(config.Headers, defaultCorsHeaders))
+			if config.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(config.MaxAge))
+			}
+			h.Set("Server", "Norbye Public Images Repo")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -2,13 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
 
 	"github.com/trondn/imgapi/contrib"
 )
@@ -20,149 +18,153 @@ func addDefaultValue(key string, value interface{}, manifest map[string]interfac
 	}
 }
 
-func doServerCreateImage(w http.ResponseWriter, r *http.Request, params url.Values, datadir string) (int, map[string]interface{}) {
-	content, err := ioutil.ReadAll(r.Body)
+// Decode the manifest in the body of the request
+func decodeManifestBody(r *http.Request) (map[string]interface{}, int, map[string]interface{}) {
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize()+1))
 
 	if err != nil {
-		log.Printf("Failed to read body: %e", err)
-		return InternalError, map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to read body: %v", err),
-		}
+		logRequestf(r, "Failed to read body: %v", err)
+		code, message := errorResponse(CodeInternalError,
+			fmt.Sprintf("Failed to read body: %v", err))
+		return nil, code, message
+	}
+
+	if int64(len(content)) > maxManifestSize() {
+		code, message := errorResponse(CodePayloadTooLarge,
+			fmt.Sprintf("The manifest is too large (the limit is %d bytes)", maxManifestSize()))
+		return nil, code, message
 	}
 
 	var m map[string]interface{}
 	err = json.Unmarshal(content, &m)
 	if err != nil {
-		log.Printf("Failed to parse payload: %e", err)
-		return InternalError, map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to decode body: %v", err),
-		}
-	}
-
-	mandatory := []string{
-		"name",
-		"version",
-		"type",
-		"os",
+		logRequestf(r, "Failed to parse payload: %v", err)
+		code, message := errorResponse(CodeInternalError,
+			fmt.Sprintf("Failed to decode body: %v", err))
+		return nil, code, message
 	}
+	return m, Success, nil
+}
 
-	for i := 0; i < len(mandatory); i++ {
-		_, present := m[mandatory[i]]
-		if !present {
-			return InvalidParameter, map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Mandatory key \"%s\" is not present", mandatory[i]),
-			}
+/**
+ * Add the fields maintained by the server to the manifest provided by
+ * the user and validate the manifest for a new image (without storing
+ * anything).
+ *
+ * @param m the manifest provided by the user
+ * @param params the parameters of the request
+ * @param user the user creating the image
+ * @return the HTTP code and the error (nil if the image may be created)
+ */
+func prepareImage(m map[string]interface{}, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	// The fields maintained by the server can't be specified by the client
+	var errs manifestErrors
+	for _, field := range []string{"state", "published_at", "icon", "channels", "promotions", "attachments"} {
+		if _, ok := m[field]; ok {
+			errs.add(field, "NotAllowed", "\"%s\" can't be specified when creating an image", field)
 		}
 	}
+	if len(errs) > 0 {
+		return errs.response()
+	}
 
-	// Ok, lets walk through the parameters given
-	for k, v := range m {
-		switch k {
-		case "owner":
-			fallthrough
-		case "name":
-			fallthrough
-		case "version":
-			fallthrough
-		case "description":
-			fallthrough
-		case "homepage":
-			fallthrough
-		case "eula":
-			fallthrough
-		case "disabled":
-			fallthrough
-		case "public":
-			break
-
-		case "type":
-			err = ManifestValidateType(v)
-			break
-
-		case "os":
-			err = ManifestValidateOs(v)
-			break
-
-		case "origin":
-			fallthrough
-		case "acl":
-			fallthrough
-		case "requirements":
-			fallthrough
-		case "users":
-			fallthrough
-		case "billing_tags":
-			fallthrough
-		case "traits":
-			fallthrough
-		case "tags":
-			fallthrough
-		case "generate_passwords":
-			fallthrough
-		case "inherited_directories":
-			fallthrough
-		case "nic_driver":
-			fallthrough
-		case "disk_driver":
-			fallthrough
-		case "cpu_type":
-			fallthrough
-		case "image_size":
-			break
-
-		default:
-			err = errors.New(fmt.Sprintf("Unknown parameter: %s", k))
+	if channelsEnabled() {
+		channel, err := getRequestedChannel(params)
+		if err != nil || channel == "*" {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid channel \"%s\"", channel))
 		}
+		m["channels"] = []string{channel}
+	}
 
-		if err != nil {
-			return InvalidParameter, map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("%v", err),
-			}
+	// Users may only create images they own themselves
+	if !isOperator(user) {
+		owner, ok := m["owner"]
+		if (ok && owner != user.Uuid) || len(user.Uuid) == 0 {
+			return errorResponse(CodeNotImageOwner, fmt.Sprintf("User %s may not create images for %v", user.Name, owner))
 		}
+		m["owner"] = user.Uuid
 	}
 
 	uuid, _ := contrib.NewUUID()
 	addDefaultValue("uuid", uuid, m)
-	addDefaultValue("state", "unactivated", m)
+	addDefaultValue("state", StateUnactivated, m)
 	addDefaultValue("disabled", false, m)
 	addDefaultValue("public", false, m)
 	addDefaultValue("v", 2, m)
 
-	// Validate that the uuid don't exists
-	path := datadir + "/" + uuid
+	errs = validateManifest(m)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+	return validateOrigin(m, user, false)
+}
+
+/**
+ * Create a new (unactivated) image from the manifest provided by the
+ * user. The fields maintained by the server is added to the manifest.
+ *
+ * @param m the manifest provided by the user
+ * @param params the parameters of the request
+ * @param user the user creating the image
+ * @return the HTTP code and the manifest of the new image (or the error)
+ */
+func createImage(m map[string]interface{}, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	code, content := prepareImage(m, params, user)
+	if content != nil {
+		return code, content
+	}
+	uuid := m["uuid"].(string)
 
-	err = os.Mkdir(path, 0777)
+	// Validate that the uuid don't exists
+	err := storage.Create(uuid)
 	if err != nil {
-		if os.IsExist(err) {
-			return ImageUuidAlreadyExists, map[string]interface{}{
-				"code":    "ImageUuidAlreadyExists",
-				"message": "Uuid already exists",
-			}
+		if err == ErrImageExists {
+			return errorResponse(CodeImageUuidAlreadyExists, "Uuid already exists")
 		}
 
-		return InternalError, map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Internal error: %v", err),
-		}
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
 	}
 
-	err = StoreManifest(path+"/manifest.json", m)
+	err = storage.PutManifest(uuid, m)
 	if err != nil {
-		_ = os.RemoveAll(path)
-		return InternalError, map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to write manifest: %v", err),
-		}
+		_ = storage.Delete(uuid)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageCreated, uuid)
+	return Success, m
+}
+
+func doServerCreateImage(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	m, code, content := decodeManifestBody(r)
+	if content != nil {
+		return code, content
+	}
+	if isDryRun(r) {
+		return dryRunCreateImage(m, params, user)
 	}
+	return createImage(m, params, user)
+}
 
+// Validate the new image like createImage without storing it
+func dryRunCreateImage(m map[string]interface{}, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	code, content := prepareImage(m, params, user)
+	if content == nil {
+		code, content = checkNewImageUuid(m["uuid"].(string))
+	}
+	if content == nil {
+		code, content = checkDeclaredFileSizes(m["uuid"].(string), m)
+	}
+	if content != nil {
+		return code, content
+	}
 	return Success, m
 }
 
-func serverCreateImage(w http.ResponseWriter, r *http.Request, params url.Values, datadir string) {
-	code, content := doServerCreateImage(w, r, params, datadir)
+func serverCreateImage(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry) {
+	code, content := doServerCreateImage(w, r, params, user)
+	if code == Success && !isDryRun(r) {
+		auditLogUuid(r, content["uuid"].(string))
+	}
 	sendResponse(w, code, content)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+/**
+ * Create a new (activated) image from an existing VM. The manifest is
+ * provided in the body (like CreateImage), and the image file is
+ * created by the configured VmSnapshotProvider (see vm_snapshot.go).
+ * The image is removed again if any of the steps fail.
+ */
+func doServerCreateImageFromVm(r *http.Request, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	var vm string
+	incremental := false
+	for k, v := range params {
+		switch k {
+		case "action", "channel":
+			break
+		case "vm_uuid":
+			vm = v[0]
+		case "incremental":
+			value, err := strconv.ParseBool(v[0])
+			if err != nil {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid value for incremental: \"%s\"", v[0]))
+			}
+			incremental = value
+		case "account":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	if !isValidUuid(vm) {
+		return errorResponse(CodeInvalidParameter, "vm_uuid parameter missing or invalid")
+	}
+
+	// The server can't verify who owns the VM
+	code, content := requireOperator(user)
+	if content != nil {
+		return code, content
+	}
+
+	provider, err := getVmSnapshotProvider()
+	if err != nil {
+		return errorResponse(CodeNotAvailable, fmt.Sprintf("%v", err))
+	}
+
+	m, code, content := decodeManifestBody(r)
+	if content != nil {
+		return code, content
+	}
+
+	snapshot, err := provider.Snapshot(vm, incremental)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to snapshot VM %s: %v", vm, err))
+	}
+	defer snapshot.Reader.Close()
+
+	for k, v := range snapshot.Manifest {
+		addDefaultValue(k, v, m)
+	}
+
+	code, m = createImage(m, params, user)
+	if code != Success {
+		return code, m
+	}
+	uuid := m["uuid"].(string)
+
+	code, content = addSnapshotFile(uuid, snapshot)
+	if code == Success {
+		code, content = activateCreatedImage(uuid)
+	}
+	if code != Success {
+		removeCreatedImage(uuid)
+	}
+	return code, content
+}
+
+/**
+ * Activate an image created by the server after the files is stored,
+ * and publish the activation.
+ *
+ * @param uuid the image to activate
+ * @return the HTTP code and the manifest of the image (or the error)
+ */
+func activateCreatedImage(uuid string) (int, map[string]interface{}) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	code, content := changeImageState(uuid, m, "activate")
+	if content != nil {
+		return code, content
+	}
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	publishImageEvent(EventImageActivated, uuid)
+	return Success, m
+}
+
+// Remove an image created by a request which failed
+func removeCreatedImage(uuid string) {
+	storage.Delete(uuid)
+	publishImageEvent(EventImageDeleted, uuid)
+}
+
+// Store the image file from the snapshot
+func addSnapshotFile(uuid string, snapshot *VmSnapshot) (int, map[string]interface{}) {
+	params := url.Values{}
+	params.Set("compression", snapshot.Compression)
+	code, content := doServerAddImageFile(uuid, params, snapshot.Reader)
+	if code != Success {
+		return code, content
+	}
+
+	// The file is only complete if the snapshot succeeded
+	err := snapshot.Reader.Close()
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to snapshot VM: %v", err))
+	}
+	return Success, nil
+}
+
+func serverCreateImageFromVm(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry) {
+	code, content := doServerCreateImageFromVm(r, params, user)
+	if code == Success {
+		auditLogUuid(r, content["uuid"].(string))
+	}
+	sendResponse(w, code, content)
+}
@@ -4,44 +4,84 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 )
 
-func doServerDeleteImage(path string, params url.Values) (int, map[string]interface{}) {
-	for k, _ := range params {
+/**
+ * Delete the image (and the images built on top of it if force is
+ * set). The dry runs returns the images which would be deleted.
+ */
+func doServerDeleteImage(uuid string, params url.Values, dryRun bool) (int, map[string]interface{}) {
+	force := false
+	for k, v := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+
+		case "force":
+			var err error
+			force, err = parseBoolParameter(k, v[0])
+			if err != nil {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
 			}
-			return InsufficientServerVersion, message
 
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	// The images built on top of the image is deleted first
+	dependents, code, content := checkDependentImages(uuid, force)
+	if content != nil {
+		return code, content
+	}
+	if dryRun {
+		deleted := []string{}
+		for _, entry := range dependents {
+			deleted = append(deleted, entry.uuid)
+		}
+		return Success, map[string]interface{}{
+			"deleted": append(deleted, uuid),
+			"trash":   trashEnabled(),
 		}
 	}
+	for _, entry := range dependents {
+		code, content = deleteImage(entry.uuid)
+		if content != nil {
+			return code, content
+		}
+	}
+
+	return deleteImage(uuid)
+}
 
-	_, err := os.Stat(path)
+// Remove the image (or move it to the trash) and everything kept for it
+func deleteImage(uuid string) (int, map[string]interface{}) {
+	// Keep the manifest for the subscribers of the event
+	m, _ := index.get(uuid)
+
+	var err error
+	if trashEnabled() {
+		err = moveToTrash(uuid)
+	} else {
+		err = storage.Delete(uuid)
+	}
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "The image does not exist",
+		if err == ErrImageNotFound {
+			return errorResponse(CodeResourceNotFound, "The image does not exist")
 		}
-		return ResourceNotFound, message
+
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to delete image: %v", err))
 	}
 
-	os.RemoveAll(path)
+	publishEvent(ImageEvent{Type: EventImageDeleted, Uuid: uuid, Manifest: m})
+	removePartialUpload(uuid)
+	removeCachedConversions(uuid)
 	return NoContent, nil
 }
 
-func serverDeleteImage(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerDeleteImage(path, params)
+func serverDeleteImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerDeleteImage(uuid, params, isDryRun(r))
 	sendResponse(w, code, content)
 }
@@ -4,85 +4,41 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"os"
 )
 
-func getIconFile(path string) (filename string, content_type string) {
-	// @todo loop this :-)
-	filename = path + "/icon.png"
-	_, err := os.Stat(filename)
-	if err == nil {
-		return filename, "image/png"
-	}
-
-	filename = path + "/icon.jpg"
-	_, err = os.Stat(filename)
-	if err == nil {
-		return filename, "image/jpg"
-	}
-
-	filename = path + "/icon.gif"
-	_, err = os.Stat(filename)
-	if err == nil {
-		return filename, "image/gif"
-	}
-
-	return "", ""
-}
-
-func doServerDeleteImageIcon(path string, params url.Values) (int, map[string]interface{}) {
+func doServerDeleteImageIcon(uuid string, params url.Values) (int, map[string]interface{}) {
 	for k, _ := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
-			}
-			return InsufficientServerVersion, message
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
 
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 		}
 	}
 
-	filename, _ := getIconFile(path)
+	filename, _ := getIconFile(uuid)
 	if len(filename) == 0 {
-		message := map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "No such image",
-		}
-		return ResourceNotFound, message
+		return errorResponse(CodeResourceNotFound, "No such image")
 	}
 
-	m, err := LoadManifest(path + "/manifest.json")
+	m, err := storage.GetManifest(uuid)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to load manifest: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
 	}
 	m["icon"] = false
-	err = StoreManifest(path+"/manifest.json", m)
+	err = storage.PutManifest(uuid, m)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store manifest: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest: %v", err))
 	}
 
-	os.Remove(filename)
+	storage.DeleteFile(uuid, filename)
 	return Success, m
 }
 
-func serverDeleteImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerDeleteImageIcon(path, params)
+func serverDeleteImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerDeleteImageIcon(uuid, params)
 	sendResponse(w, code, content)
 }
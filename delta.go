@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// The smallest (and largest) block size used in the block checksums
+const minDeltaBlockSize = 4 * 1024
+const maxDeltaBlockSize = 4 * 1024 * 1024
+
+// The block size is doubled until the file has fewer blocks than this
+const maxDeltaBlocks = 64 * 1024
+
+// The size of each block in the checksums: the weak checksum (4 bytes) and the first 16 bytes of the SHA-256
+const deltaBlockEntrySize = 20
+
+// The largest literal accepted in a delta
+const maxDeltaLiteral = 16 * 1024 * 1024
+
+// The number of images tried as the base when a file is replicated
+const maxDeltaCandidates = 3
+
+// The first line of a delta
+const deltaMagic = "IMGAPI-DELTA-1\n"
+
+/**
+ * The operations in a delta (after deltaMagic). A delta rebuilds a
+ * file from the blocks of the base file and the literal data which
+ * isn't found in the base file:
+ *
+ *     'C' offset (8 bytes) length (4 bytes)   copy from the base file
+ *     'L' length (4 bytes) data               the data as is
+ *     'E'                                     the end of the delta
+ *
+ * The numbers is big endian.
+ */
+const (
+	deltaOpCopy    = 'C'
+	deltaOpLiteral = 'L'
+	deltaOpEnd     = 'E'
+)
+
+var errInvalidDelta = errors.New("Invalid delta")
+
+/**
+ * The block checksums of a file (like rsync). The receiver of a file
+ * sends the checksums of a file it has (the base), and the sender looks
+ * for the blocks in the file to send with a rolling checksum so only
+ * the data not found in the base is sent (see writeDelta).
+ */
+type fileBlocks struct {
+	BlockSize int
+	Size      int64
+	Blocks    []byte
+}
+
+// Get the block size used for a file of the size
+func deltaBlockSize(size int64) int {
+	blockSize := minDeltaBlockSize
+	for size/int64(blockSize) > maxDeltaBlocks && blockSize < maxDeltaBlockSize {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+// The rsync weak checksum of the block (as the two 16 bits sums)
+func weakChecksum(block []byte) (a uint32, b uint32) {
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a, b
+}
+
+func weakDigest(a uint32, b uint32) uint32 {
+	return a&0xffff | b<<16
+}
+
+func strongChecksum(block []byte) []byte {
+	sum := sha256.Sum256(block)
+	return sum[:16]
+}
+
+/**
+ * Compute the checksums of the (complete) blocks of the file. The
+ * partial block at the end of the file isn't included.
+ */
+func computeFileBlocks(reader io.Reader, size int64) (*fileBlocks, error) {
+	blocks := &fileBlocks{BlockSize: deltaBlockSize(size), Size: size}
+	block := make([]byte, blocks.BlockSize)
+	reader = bufio.NewReaderSize(reader, 64*1024)
+	for {
+		_, err := io.ReadFull(reader, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var entry [deltaBlockEntrySize]byte
+		binary.BigEndian.PutUint32(entry[0:4], weakDigest(weakChecksum(block)))
+		copy(entry[4:], strongChecksum(block))
+		blocks.Blocks = append(blocks.Blocks, entry[:]...)
+	}
+}
+
+// Verify the block checksums received from another server
+func (f *fileBlocks) validate() error {
+	if f.BlockSize < minDeltaBlockSize || f.BlockSize > maxDeltaBlockSize ||
+		len(f.Blocks)%deltaBlockEntrySize != 0 ||
+		int64(len(f.Blocks)/deltaBlockEntrySize)*int64(f.BlockSize) > f.Size {
+		return errors.New("Invalid block checksums")
+	}
+	return nil
+}
+
+// Index the blocks by their weak checksum
+func (f *fileBlocks) index() map[uint32][]int {
+	index := make(map[uint32][]int)
+	for i := 0; i < len(f.Blocks)/deltaBlockEntrySize; i++ {
+		weak := binary.BigEndian.Uint32(f.Blocks[i*deltaBlockEntrySize:])
+		index[weak] = append(index[weak], i)
+	}
+	return index
+}
+
+// deltaWriter encodes the operations (merging adjacent copies)
+type deltaWriter struct {
+	w          io.Writer
+	copyOffset int64
+	copyLength int64
+	literal    int64
+	err        error
+}
+
+func (d *deltaWriter) write(data []byte) {
+	if d.err == nil {
+		_, d.err = d.w.Write(data)
+	}
+}
+
+func (d *deltaWriter) flushCopy() {
+	for d.copyLength > 0 {
+		length := d.copyLength
+		if length > 1<<30 {
+			length = 1 << 30
+		}
+		var op [13]byte
+		op[0] = deltaOpCopy
+		binary.BigEndian.PutUint64(op[1:9], uint64(d.copyOffset))
+		binary.BigEndian.PutUint32(op[9:13], uint32(length))
+		d.write(op[:])
+		d.copyOffset += length
+		d.copyLength -= length
+	}
+}
+
+func (d *deltaWriter) copyBlock(offset int64, length int64) {
+	if d.copyLength > 0 && d.copyOffset+d.copyLength == offset {
+		d.copyLength += length
+		return
+	}
+	d.flushCopy()
+	d.copyOffset, d.copyLength = offset, length
+}
+
+func (d *deltaWriter) writeLiteral(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	d.flushCopy()
+	var op [5]byte
+	op[0] = deltaOpLiteral
+	binary.BigEndian.PutUint32(op[1:5], uint32(len(data)))
+	d.write(op[:])
+	d.write(data)
+	d.literal += int64(len(data))
+}
+
+/**
+ * Write the delta rebuilding the content of reader from the base file
+ * with the block checksums. The blocks of the base is searched for at
+ * every offset with the rolling weak checksum, and the SHA-256 of the
+ * candidates is compared before a block is used.
+ *
+ * @return the number of bytes sent as literals
+ */
+func writeDelta(w io.Writer, reader io.Reader, blocks *fileBlocks) (int64, error) {
+	d := &deltaWriter{w: w}
+	if _, err := io.WriteString(w, deltaMagic); err != nil {
+		return 0, err
+	}
+
+	size := blocks.BlockSize
+	index := blocks.index()
+	buf := make([]byte, 0, 4*size)
+	pos, lit := 0, 0
+	eof := false
+	rolling := false
+	var a, b uint32
+
+	for d.err == nil {
+		// Keep at least one byte after the window (to roll) until the end of the file
+		if len(buf)-pos <= size && !eof {
+			d.writeLiteral(buf[lit:pos])
+			n := copy(buf, buf[pos:])
+			m, err := io.ReadFull(reader, buf[n:cap(buf)])
+			buf = buf[:n+m]
+			pos, lit = 0, 0
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return d.literal, err
+			}
+			continue
+		}
+		if len(buf)-pos < size {
+			break
+		}
+
+		window := buf[pos : pos+size]
+		if !rolling {
+			a, b = weakChecksum(window)
+			rolling = true
+		}
+		if candidates, ok := index[weakDigest(a, b)]; ok {
+			strong := strongChecksum(window)
+			found := -1
+			for _, i := range candidates {
+				if bytes.Equal(blocks.Blocks[i*deltaBlockEntrySize+4:(i+1)*deltaBlockEntrySize], strong) {
+					found = i
+					break
+				}
+			}
+			if found >= 0 {
+				d.writeLiteral(buf[lit:pos])
+				d.copyBlock(int64(found)*int64(size), int64(size))
+				pos += size
+				lit = pos
+				rolling = false
+				continue
+			}
+		}
+
+		if pos+size == len(buf) {
+			break
+		}
+		out, in := uint32(buf[pos]), uint32(buf[pos+size])
+		a = a - out + in
+		b = b - uint32(size)*out + a
+		pos++
+	}
+
+	d.writeLiteral(buf[lit:])
+	d.flushCopy()
+	d.write([]byte{deltaOpEnd})
+	return d.literal, d.err
+}
+
+/**
+ * Rebuild the file from the delta and the base file
+ *
+ * @param w where to write the file
+ * @param delta the delta (see writeDelta)
+ * @param base the base file the delta refers to
+ * @param baseSize the size of the base file
+ */
+func applyDelta(w io.Writer, delta io.Reader, base io.ReaderAt, baseSize int64) error {
+	reader := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != deltaMagic {
+		return errInvalidDelta
+	}
+
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return errInvalidDelta
+		}
+		switch op {
+		case deltaOpEnd:
+			return nil
+
+		case deltaOpCopy:
+			var offset uint64
+			var length uint32
+			if binary.Read(reader, binary.BigEndian, &offset) != nil ||
+				binary.Read(reader, binary.BigEndian, &length) != nil ||
+				offset > uint64(baseSize) || uint64(length) > uint64(baseSize)-offset {
+				return errInvalidDelta
+			}
+			_, err = io.Copy(w, io.NewSectionReader(base, int64(offset), int64(length)))
+
+		case deltaOpLiteral:
+			var length uint32
+			if binary.Read(reader, binary.BigEndian, &length) != nil || length > maxDeltaLiteral {
+				return errInvalidDelta
+			}
+			_, err = io.CopyN(w, reader, int64(length))
+			if err == io.EOF {
+				return errInvalidDelta
+			}
+
+		default:
+			return errInvalidDelta
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/**
+ * Open the base file of a delta upload for random access. The files
+ * which isn't stored as local files (like in S3) is copied to a
+ * temporary file.
+ *
+ * @return the file, its size and a function closing (and removing) it
+ */
+func openDeltaBase(uuid string, index int) (io.ReaderAt, int64, func(), error) {
+	filename, ok := getImageFileAt(uuid, index)
+	if !ok {
+		return nil, 0, nil, ErrImageNotFound
+	}
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	if f, ok := reader.(*os.File); ok {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+		return f, info.Size(), func() { f.Close() }, nil
+	}
+
+	defer reader.Close()
+	f, err := ioutil.TempFile(spoolDir(), spoolPrefix)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	size, err := io.Copy(f, reader)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, nil, err
+	}
+	return f, size, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+/**
+ * Check that the base of a delta upload may be used for the image. The
+ * base must be public or have the same owner as the image so that the
+ * delta can't be used to copy files the user can't read.
+ */
+func checkDeltaBase(uuid string, base string) (int, map[string]interface{}) {
+	if !isValidUuid(base) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid delta base \"%s\"", base))
+	}
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	b, err := storage.GetManifest(base)
+	if err == ErrImageNotFound {
+		return errorResponse(CodeResourceNotFound, fmt.Sprintf("The delta base %s does not exist", base))
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest for %s: %v", base, err))
+	}
+	if b["public"] != true && b["owner"] != m["owner"] {
+		return errorResponse(CodeNotAuthorizedError, fmt.Sprintf("The delta base %s is not available for %s", base, uuid))
+	}
+	return Success, nil
+}
+
+/*
+GetImageFileBlocks	GET /images/:uuid/blocks?index=N	Get the block checksums of the image file (for delta uploads).
+*/
+func serverGetImageFileBlocks(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	index := 0
+	for k, v := range params {
+		switch k {
+		case "index":
+			var err error
+			index, err = parseFileIndex(v[0])
+			if err != nil {
+				sendError(w, CodeInvalidParameter, fmt.Sprintf("%v", err))
+				return
+			}
+		case "account", "channel":
+			break
+		default:
+			sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+			return
+		}
+	}
+
+	filename, ok := getImageFileAt(uuid, index)
+	if !ok {
+		sendError(w, CodeResourceNotFound, fmt.Sprintf("Image %s does not have file %d", uuid, index))
+		return
+	}
+	info, err := storage.StatFile(uuid, filename)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s/%s: %v", uuid, filename, err))
+		return
+	}
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s/%s: %v", uuid, filename, err))
+		return
+	}
+	defer reader.Close()
+
+	blocks, err := computeFileBlocks(reader, info.Size)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s/%s: %v", uuid, filename, err))
+		return
+	}
+	sendResponse(w, Success, map[string]interface{}{
+		"block_size": blocks.BlockSize,
+		"size":       blocks.Size,
+		"blocks":     blocks.Blocks,
+	})
+}
+
+/**
+ * Get the images which is likely to share blocks with the image: the
+ * origin and the other versions of the image (the latest first).
+ */
+func deltaBaseCandidates(uuid string) []string {
+	m, ok := index.get(uuid)
+	if !ok {
+		return nil
+	}
+
+	var candidates []string
+	if origin, ok := m["origin"].(string); ok && isValidUuid(origin) {
+		candidates = append(candidates, origin)
+	}
+
+	var versions []indexEntry
+	for _, entry := range index.list() {
+		if entry.uuid != uuid && entry.uuid != m["origin"] && entry.manifest["name"] == m["name"] &&
+			entry.manifest["owner"] == m["owner"] && getImageState(entry.manifest) != StateUnactivated {
+			versions = append(versions, entry)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		a, _ := versions[i].manifest["published_at"].(string)
+		b, _ := versions[j].manifest["published_at"].(string)
+		return a > b
+	})
+	for _, entry := range versions {
+		candidates = append(candidates, entry.uuid)
+	}
+
+	if len(candidates) > maxDeltaCandidates {
+		candidates = candidates[:maxDeltaCandidates]
+	}
+	return candidates
+}
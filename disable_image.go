@@ -6,7 +6,7 @@ import (
 	"net/url"
 )
 
-func doServerDisableImage(path string, params url.Values) (int, map[string]interface{}) {
+func doServerDisableImage(uuid string, params url.Values) (int, map[string]interface{}) {
 	for k, _ := range params {
 		switch k {
 		case "action":
@@ -14,44 +14,33 @@ func doServerDisableImage(path string, params url.Values) (int, map[string]inter
 		case "account":
 			fallthrough
 		case "channel":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
-			}
-			return InsufficientServerVersion, message
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 		}
 	}
 
-	m, err := LoadManifest(path + "/manifest.json")
+	m, err := storage.GetManifest(uuid)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("The server failed to load manifest file: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	code, content := changeImageState(uuid, m, "disable")
+	if content != nil {
+		return code, content
 	}
 
-	m["disabled"] = true
-	err = StoreManifest(path+"/manifest.json", m)
+	err = storage.PutManifest(uuid, m)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to store manifest file: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
 	}
 
+	publishImageEvent(EventImageDisabled, uuid)
 	return Success, m
 }
 
-func serverDisableImage(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerDisableImage(path, params)
+func serverDisableImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerDisableImage(uuid, params)
 	sendResponse(w, code, content)
 
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+/**
+ * A DiskConverter knows how to convert a disk image from one format to
+ * another (used by import-ova). The server takes care of storing the
+ * converted disk.
+ */
+type DiskConverter interface {
+	/**
+	 * Convert the disk image
+	 *
+	 * @param src the name of the file to convert
+	 * @param srcFormat the format of src (raw, qcow2 or vmdk)
+	 * @param dst the name of the file to create
+	 * @param dstFormat the format to convert to (raw, qcow2 or vmdk)
+	 * @return err The error object if something failed
+	 */
+	Convert(src string, srcFormat string, dst string, dstFormat string) (err error)
+}
+
+// The configuration of the disk converter in the configuration file
+type DiskConverterConfig struct {
+	Type    string   `json:"type"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+/**
+ * The registry of the available disk converter types. Each entry
+ * creates a DiskConverter for the provided configuration.
+ */
+var diskConverterTypes = map[string]func(config DiskConverterConfig) (DiskConverter, error){
+	"command": newCommandDiskConverter,
+}
+
+// Register a new disk converter type to the registry
+func RegisterDiskConverterType(name string, factory func(config DiskConverterConfig) (DiskConverter, error)) {
+	diskConverterTypes[name] = factory
+}
+
+// Returned when disk conversion isn't configured
+var errNoDiskConverter = errors.New("The server is not configured to convert disk images")
+
+// Get the disk converter from the configuration
+func getDiskConverter() (DiskConverter, error) {
+	return newDiskConverter(configuration.DiskConverter)
+}
+
+// Create the disk converter from the configuration
+func newDiskConverter(config DiskConverterConfig) (DiskConverter, error) {
+	if len(config.Type) == 0 {
+		return nil, errNoDiskConverter
+	}
+
+	factory, ok := diskConverterTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown disk converter type \"%s\"", config.Type)
+	}
+
+	return factory(config)
+}
+
+/**
+ * The command converter runs an external command (qemu-img unless
+ * command is specified). The strings "{src}", "{src_format}", "{dst}"
+ * and "{dst_format}" in the arguments is replaced with the files and
+ * formats to convert.
+ */
+type commandDiskConverter struct {
+	command string
+	args    []string
+}
+
+var defaultDiskConverterArgs = []string{
+	"convert", "-f", "{src_format}", "-O", "{dst_format}", "{src}", "{dst}",
+}
+
+func newCommandDiskConverter(config DiskConverterConfig) (DiskConverter, error) {
+	converter := &commandDiskConverter{command: config.Command, args: config.Args}
+	if len(converter.command) == 0 {
+		converter.command = "qemu-img"
+		if len(converter.args) == 0 {
+			converter.args = defaultDiskConverterArgs
+		}
+	}
+	return converter, nil
+}
+
+func (c *commandDiskConverter) Convert(src string, srcFormat string, dst string, dstFormat string) error {
+	replacer := strings.NewReplacer(
+		"{src}", src,
+		"{src_format}", srcFormat,
+		"{dst}", dst,
+		"{dst_format}", dstFormat)
+
+	var args []string
+	for _, arg := range c.args {
+		args = append(args, replacer.Replace(arg))
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(c.command, args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v %s", c.command, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
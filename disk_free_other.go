@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+// The free space is not reported on this platform
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	return 0, 0, errDiskSpaceUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import "syscall"
+
+// Get the number of bytes available to the server and the size of the filesystem at path
+func diskSpace(path string) (free uint64, total uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), uint64(st.Blocks) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The media types used in the Docker Registry HTTP API v2
+const (
+	dockerManifestType = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerConfigType   = "application/vnd.docker.container.image.v1+json"
+	dockerLayerType    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	dockerLayerTarType = "application/vnd.docker.image.rootfs.diff.tar"
+	dockerApiVersion   = "registry/2.0"
+)
+
+// The name of the file the image configuration is stored as
+const dockerConfigFileName = "docker-config.json"
+
+/**
+ * The tags used on docker images. "docker:repo" is the repository
+ * (like "library/alpine") and "docker:tags" is the space separated list
+ * of the tags of the image (tag keys can't contain "." so each tag
+ * can't be a tag on its own).
+ */
+const (
+	dockerRepoTag         = "docker:repo"
+	dockerTagsTag         = "docker:tags"
+	dockerArchitectureTag = "docker:architecture"
+)
+
+func dockerRepo(m map[string]interface{}) string {
+	tags, _ := m["tags"].(map[string]interface{})
+	repo, _ := tags[dockerRepoTag].(string)
+	return repo
+}
+
+func dockerImageTags(m map[string]interface{}) []string {
+	tags, _ := m["tags"].(map[string]interface{})
+	value, _ := tags[dockerTagsTag].(string)
+	return strings.Fields(value)
+}
+
+/**
+ * Get the active docker images the user may read (for the repository
+ * unless repo is empty), the latest published image first. The layers
+ * of a docker image is the files of the image.
+ */
+func dockerImages(repo string, user *UserEntry) []indexEntry {
+	var images []indexEntry
+	for _, entry := range index.list() {
+		m := entry.manifest
+		if m["type"] != "docker" || getImageState(m) != StateActive ||
+			len(dockerRepo(m)) == 0 || !imageAccessible(m, user) {
+			continue
+		}
+		if len(repo) == 0 || dockerRepo(m) == repo {
+			images = append(images, entry)
+		}
+	}
+
+	sort.SliceStable(images, func(a, b int) bool {
+		pa, _ := images[a].manifest["published_at"].(string)
+		pb, _ := images[b].manifest["published_at"].(string)
+		return pa > pb
+	})
+	return images
+}
+
+// The image configuration as used by docker (only the fields the server generates)
+type dockerImageConfig struct {
+	Architecture string `json:"architecture"`
+	Os           string `json:"os"`
+	Created      string `json:"created,omitempty"`
+	Rootfs       struct {
+		Type    string   `json:"type"`
+		DiffIds []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// The generated configurations (by uuid) as computing the diff_ids is expensive
+var dockerConfigCache = struct {
+	sync.Mutex
+	configs map[string][]byte
+}{configs: make(map[string][]byte)}
+
+// Get the sha256 of the uncompressed layer
+func dockerDiffId(uuid string, index int, compression string) (string, error) {
+	filename, exists := getImageFileAt(uuid, index)
+	if !exists {
+		return "", fmt.Errorf("The layer %d is missing", index)
+	}
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	uncompressed, err := decompressReader(compression, reader)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, uncompressed)
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/**
+ * Get the image configuration. The configuration is stored as
+ * docker-config.json when the image is imported from a registry, and
+ * generated from the layers for the other images.
+ */
+func dockerConfig(uuid string, m map[string]interface{}) ([]byte, error) {
+	reader, err := storage.GetFile(uuid, dockerConfigFileName)
+	if err == nil {
+		defer reader.Close()
+		return ioutil.ReadAll(reader)
+	}
+	if err != ErrImageNotFound {
+		return nil, err
+	}
+
+	dockerConfigCache.Lock()
+	config, ok := dockerConfigCache.configs[uuid]
+	dockerConfigCache.Unlock()
+	if ok {
+		return config, nil
+	}
+
+	var generated dockerImageConfig
+	generated.Architecture = "amd64"
+	tags, _ := m["tags"].(map[string]interface{})
+	if arch, ok := tags[dockerArchitectureTag].(string); ok {
+		generated.Architecture = arch
+	}
+	generated.Os = "linux"
+	generated.Created, _ = m["published_at"].(string)
+	generated.Rootfs.Type = "layers"
+	generated.Rootfs.DiffIds = []string{}
+	for index, entry := range getManifestFiles(m) {
+		file, _ := entry.(map[string]interface{})
+		compression, _ := file["compression"].(string)
+		diffId, err := dockerDiffId(uuid, index, compression)
+		if err != nil {
+			return nil, err
+		}
+		generated.Rootfs.DiffIds = append(generated.Rootfs.DiffIds, diffId)
+	}
+
+	config, err = json.Marshal(generated)
+	if err != nil {
+		return nil, err
+	}
+	dockerConfigCache.Lock()
+	dockerConfigCache.configs[uuid] = config
+	dockerConfigCache.Unlock()
+	return config, nil
+}
+
+type dockerDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type dockerManifest struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	MediaType     string             `json:"mediaType"`
+	Config        dockerDescriptor   `json:"config"`
+	Layers        []dockerDescriptor `json:"layers"`
+}
+
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+/**
+ * Build the image manifest (schema 2) for the image. The layers must
+ * be compressed with gzip (or not compressed) and have the sha256 in
+ * the files list.
+ */
+func dockerImageManifest(uuid string, m map[string]interface{}) ([]byte, error) {
+	config, err := dockerConfig(uuid, m)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := dockerManifest{
+		SchemaVersion: 2,
+		MediaType:     dockerManifestType,
+		Config: dockerDescriptor{
+			MediaType: dockerConfigType,
+			Size:      int64(len(config)),
+			Digest:    sha256Digest(config),
+		},
+		Layers: []dockerDescriptor{},
+	}
+
+	for index, entry := range getManifestFiles(m) {
+		file, _ := entry.(map[string]interface{})
+		sum, _ := file["sha256"].(string)
+		size, _ := getDeclaredFileSize(m, index)
+		if len(sum) == 0 {
+			return nil, fmt.Errorf("The layer %d has no sha256", index)
+		}
+
+		var mediaType string
+		switch file["compression"] {
+		case "gzip":
+			mediaType = dockerLayerType
+		case "none":
+			mediaType = dockerLayerTarType
+		default:
+			return nil, fmt.Errorf("The layer %d is compressed with %v", index, file["compression"])
+		}
+		manifest.Layers = append(manifest.Layers, dockerDescriptor{
+			MediaType: mediaType,
+			Size:      size,
+			Digest:    "sha256:" + sum,
+		})
+	}
+
+	return json.MarshalIndent(manifest, "", "   ")
+}
+
+/**
+ * An error in the format of the Docker registry API, which the docker
+ * clients expects instead of the IMGAPI errors (see errorcodes.Send).
+ * The detail holds the request ID.
+ */
+type dockerError struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Detail  map[string]string `json:"detail,omitempty"`
+}
+
+/**
+ * Send the error with the code from the Docker registry API (like
+ * MANIFEST_UNKNOWN) with the HTTP status of the IMGAPI error code.
+ */
+func sendDockerError(w http.ResponseWriter, status ErrorCode, code string, message string) {
+	e := dockerError{Code: code, Message: message}
+	if id := w.Header().Get(requestIdHeader); len(id) > 0 {
+		e.Detail = map[string]string{"request_id": id}
+	}
+	body, _ := json.MarshalIndent(map[string][]dockerError{"errors": {e}}, "", "  ")
+	writeResponse(w, status.Status(), body)
+}
+
+/**
+ * Find the image for the reference, which is either a tag or the digest
+ * of the image manifest. "latest" is the latest published image unless
+ * an image is tagged with "latest".
+ */
+func findDockerImage(images []indexEntry, reference string) (entry indexEntry, manifest []byte, err error) {
+	if strings.HasPrefix(reference, "sha256:") {
+		for _, entry = range images {
+			manifest, err = dockerImageManifest(entry.uuid, entry.manifest)
+			if err == nil && sha256Digest(manifest) == reference {
+				return entry, manifest, nil
+			}
+		}
+		return entry, nil, nil
+	}
+
+	for _, entry = range images {
+		if stringInSlice(reference, dockerImageTags(entry.manifest)) {
+			manifest, err = dockerImageManifest(entry.uuid, entry.manifest)
+			return entry, manifest, err
+		}
+	}
+	if reference == "latest" && len(images) > 0 {
+		entry = images[0]
+		manifest, err = dockerImageManifest(entry.uuid, entry.manifest)
+		return entry, manifest, err
+	}
+	return entry, nil, nil
+}
+
+func serverDockerManifest(w http.ResponseWriter, r *http.Request, repo string, reference string, user *UserEntry) {
+	images := dockerImages(repo, user)
+	if len(images) == 0 {
+		sendDockerError(w, CodeResourceNotFound, "NAME_UNKNOWN", fmt.Sprintf("Unknown repository %s", repo))
+		return
+	}
+
+	_, manifest, err := findDockerImage(images, reference)
+	if err != nil {
+		sendDockerError(w, CodeInternalError, "UNKNOWN", fmt.Sprintf("%v", err))
+		return
+	}
+	if manifest == nil {
+		sendDockerError(w, CodeResourceNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("Unknown manifest %s", reference))
+		return
+	}
+
+	digest := sha256Digest(manifest)
+	h := w.Header()
+	h.Set("Docker-Content-Digest", digest)
+	if checkNotModified(w, r, "\""+digest+"\"", time.Time{}) {
+		return
+	}
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", dockerManifestType)
+	h.Set("Content-Length", strconv.Itoa(len(manifest)))
+	w.WriteHeader(Success)
+	w.Write(manifest)
+}
+
+func serverDockerBlob(w http.ResponseWriter, r *http.Request, repo string, digest string, user *UserEntry) {
+	for _, entry := range dockerImages(repo, user) {
+		for index, file := range getManifestFiles(entry.manifest) {
+			sum, _ := file.(map[string]interface{})["sha256"].(string)
+			if "sha256:"+sum != digest {
+				continue
+			}
+			filename, exists := getImageFileAt(entry.uuid, index)
+			if exists {
+				w.Header().Set("Docker-Content-Digest", digest)
+				serveFile(w, r, entry.uuid, filename, "application/octet-stream", "\""+digest+"\"")
+				return
+			}
+		}
+
+		config, err := dockerConfig(entry.uuid, entry.manifest)
+		if err == nil && sha256Digest(config) == digest {
+			h := w.Header()
+			h.Set("Docker-Content-Digest", digest)
+			h.Set("Server", "Norbye Public Images Repo")
+			h.Set("Content-Type", "application/octet-stream")
+			h.Set("Content-Length", strconv.Itoa(len(config)))
+			w.WriteHeader(Success)
+			w.Write(config)
+			return
+		}
+	}
+	sendDockerError(w, CodeResourceNotFound, "BLOB_UNKNOWN", fmt.Sprintf("Unknown blob %s", digest))
+}
+
+func serverDockerTags(w http.ResponseWriter, repo string, user *UserEntry) {
+	images := dockerImages(repo, user)
+	if len(images) == 0 {
+		sendDockerError(w, CodeResourceNotFound, "NAME_UNKNOWN", fmt.Sprintf("Unknown repository %s", repo))
+		return
+	}
+
+	tags := []string{}
+	for _, entry := range images {
+		for _, tag := range dockerImageTags(entry.manifest) {
+			if !stringInSlice(tag, tags) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	sendResponse(w, Success, map[string]interface{}{"name": repo, "tags": tags})
+}
+
+func serverDockerCatalog(w http.ResponseWriter, user *UserEntry) {
+	repositories := []string{}
+	for _, entry := range dockerImages("", user) {
+		if repo := dockerRepo(entry.manifest); !stringInSlice(repo, repositories) {
+			repositories = append(repositories, repo)
+		}
+	}
+	sort.Strings(repositories)
+	sendResponse(w, Success, map[string]interface{}{"repositories": repositories})
+}
+
+/*
+DockerRegistry	GET /v2/*	Read-only Docker Registry HTTP API v2 for the docker images.
+
+The supported endpoints is:
+
+	GET /v2/	Check that the server implements the API.
+	GET /v2/_catalog	List the repositories.
+	GET /v2/<name>/tags/list	List the tags in the repository.
+	GET /v2/<name>/manifests/<reference>	Get the image manifest for a tag or digest.
+	GET /v2/<name>/blobs/<digest>	Get the image configuration or a layer.
+*/
+func serverDockerRegistry(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	w.Header().Set("Docker-Distribution-API-Version", dockerApiVersion)
+
+	user, _, content := authenticateRequest(r)
+	if content != nil {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"imgapi\"")
+		sendDockerError(w, CodeUnauthorizedError, "UNAUTHORIZED", fmt.Sprintf("%v", content["message"]))
+		return
+	}
+	timingMark(w, "auth")
+
+	path := strings.Trim(vars["path"], "/")
+	if len(path) == 0 {
+		sendResponse(w, Success, map[string]interface{}{})
+		return
+	}
+	if path == "_catalog" {
+		serverDockerCatalog(w, user)
+		return
+	}
+	if strings.HasSuffix(path, "/tags/list") {
+		serverDockerTags(w, strings.TrimSuffix(path, "/tags/list"), user)
+		return
+	}
+
+	for _, resource := range []string{"/manifests/", "/blobs/"} {
+		i := strings.LastIndex(path, resource)
+		if i <= 0 {
+			continue
+		}
+		repo, reference := path[:i], path[i+len(resource):]
+		if resource == "/manifests/" {
+			serverDockerManifest(w, r, repo, reference, user)
+		} else {
+			serverDockerBlob(w, r, repo, reference, user)
+		}
+		return
+	}
+
+	sendDockerError(w, CodeResourceNotFound, "UNSUPPORTED", fmt.Sprintf("Unsupported endpoint /v2/%s", path))
+}
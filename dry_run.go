@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// The parameter requesting a dry run
+const dryRunParameter = "dry_run"
+
+// The header in the responses to dry runs
+const dryRunHeader = "X-Dry-Run"
+
+type dryRunKey struct{}
+
+// Check if the request is a dry run (nothing may be stored)
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := r.Context().Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+/**
+ * Remove the dry_run parameter from the parameters and mark the request
+ * as a dry run (see isDryRun) if it is true.
+ *
+ * @param allowed false if the endpoint doesn't support dry runs
+ * @return the request to pass on to the handler (or the error)
+ */
+func dryRunRequest(w http.ResponseWriter, r *http.Request, params url.Values, allowed bool) (*http.Request, int, map[string]interface{}) {
+	value, ok := params[dryRunParameter]
+	if !ok {
+		return r, Success, nil
+	}
+	delete(params, dryRunParameter)
+
+	dryRun, err := parseBoolParameter(dryRunParameter, value[0])
+	if err != nil {
+		code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+		return nil, code, content
+	}
+	if !dryRun {
+		return r, Success, nil
+	}
+	if !allowed {
+		code, content := errorResponse(CodeInvalidParameter, "The endpoint does not support dry_run")
+		return nil, code, content
+	}
+
+	w.Header().Set(dryRunHeader, "true")
+	return r.WithContext(context.WithValue(r.Context(), dryRunKey{}, true)), Success, nil
+}
+
+/**
+ * Verify that the files declared in the manifest of the new image may
+ * be uploaded without exceeding max_file_size, the quota of the owner
+ * or min_free_space (only used by the dry runs, as the uploads is
+ * checked when the files is stored).
+ */
+func checkDeclaredFileSizes(uuid string, m map[string]interface{}) (int, map[string]interface{}) {
+	for i := range getManifestFiles(m) {
+		size, ok := getDeclaredFileSize(m, i)
+		if !ok {
+			continue
+		}
+		limit, err := uploadSizeLimit(uuid, m, i)
+		if limit >= 0 && size > limit {
+			return uploadLimitResponse(err, limit)
+		}
+	}
+	return Success, nil
+}
+
+/**
+ * Verify that a new image may be stored with the uuid (the dry runs
+ * check this instead of reserving the uuid).
+ */
+func checkNewImageUuid(uuid string) (int, map[string]interface{}) {
+	exists, err := storage.Exists(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+	if exists {
+		return errorResponse(CodeImageUuidAlreadyExists, "Uuid already exists")
+	}
+	return Success, nil
+}
@@ -1,5 +1,13 @@
 package main
 
+import (
+	"net/http"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+// The HTTP status codes for the responses (and the errors)
+
 const (
 	Success                   = 200
 	NoContent                 = 204
@@ -27,5 +35,93 @@ const (
 	InvalidHeader             = 400
 	ServiceUnavailableError   = 503
 	UnauthorizedError         = 401
+	NotAuthorizedError        = 403
 	BadRequestError           = 400
+	ChecksumError             = 422
+	MethodNotAllowed          = 405
+	RequestThrottled          = 429
+	PayloadTooLarge           = 413
+	QuotaExceeded             = 403
+	InsufficientStorage       = 507
+	PreconditionFailed        = 412
+	PreconditionRequired      = 428
+)
+
+/**
+ * The error codes sent in the "code" field of the error responses (the
+ * errorcodes package maps them to the HTTP status, matching the
+ * constants above).
+ */
+type ErrorCode = errorcodes.Code
+
+const (
+	CodeValidationFailed          = errorcodes.ValidationFailed
+	CodeInvalidParameter          = errorcodes.InvalidParameter
+	CodeImageFilesImmutable       = errorcodes.ImageFilesImmutable
+	CodeImageAlreadyActivated     = errorcodes.ImageAlreadyActivated
+	CodeNoActivationNoFile        = errorcodes.NoActivationNoFile
+	CodeOperatorOnly              = errorcodes.OperatorOnly
+	CodeImageUuidAlreadyExists    = errorcodes.ImageUuidAlreadyExists
+	CodeUpload                    = errorcodes.Upload
+	CodeStorageIsDown             = errorcodes.StorageIsDown
+	CodeStorageUnsupported        = errorcodes.StorageUnsupported
+	CodeRemoteSourceError         = errorcodes.RemoteSourceError
+	CodeOwnerDoesNotExist         = errorcodes.OwnerDoesNotExist
+	CodeAccountDoesNotExist       = errorcodes.AccountDoesNotExist
+	CodeNotImageOwner             = errorcodes.NotImageOwner
+	CodeNotMantaPathOwner         = errorcodes.NotMantaPathOwner
+	CodeOriginDoesNotExist        = errorcodes.OriginDoesNotExist
+	CodeInsufficientServerVersion = errorcodes.InsufficientServerVersion
+	CodeImageHasDependentImages   = errorcodes.ImageHasDependentImages
+	CodeNotAvailable              = errorcodes.NotAvailable
+	CodeInternalError             = errorcodes.InternalError
+	CodeResourceNotFound          = errorcodes.ResourceNotFound
+	CodeInvalidHeader             = errorcodes.InvalidHeader
+	CodeServiceUnavailableError   = errorcodes.ServiceUnavailableError
+	CodeUnauthorizedError         = errorcodes.UnauthorizedError
+	CodeNotAuthorizedError        = errorcodes.NotAuthorizedError
+	CodeBadRequestError           = errorcodes.BadRequestError
+	CodeChecksumError             = errorcodes.ChecksumError
+	CodeMethodNotAllowed          = errorcodes.MethodNotAllowed
+	CodeRequestThrottled          = errorcodes.RequestThrottled
+	CodePayloadTooLarge           = errorcodes.PayloadTooLarge
+	CodeQuotaExceeded             = errorcodes.QuotaExceeded
+	CodeInsufficientStorage       = errorcodes.InsufficientStorage
+	CodePreconditionFailed        = errorcodes.PreconditionFailed
+	CodePreconditionRequired      = errorcodes.PreconditionRequired
 )
+
+/**
+ * Build the error response with the code and the message. Other fields
+ * (like the "errors" array for ValidationFailed) may be added to the
+ * map before it is sent.
+ *
+ * @return the HTTP status and the body to send with sendResponse
+ */
+func errorResponse(code ErrorCode, message string) (int, map[string]interface{}) {
+	return errorResponseFrom(errorcodes.New(code, message))
+}
+
+// Build the error response for the error (including the field errors)
+func errorResponseFrom(e *errorcodes.Error) (int, map[string]interface{}) {
+	content := map[string]interface{}{
+		"code":    string(e.Code),
+		"message": e.Message,
+	}
+	if len(e.Errors) > 0 {
+		content["errors"] = e.Errors
+	}
+	return e.Status(), content
+}
+
+// Send the error response with the code and the message
+func sendError(w http.ResponseWriter, code ErrorCode, message string) {
+	sendErrorFrom(w, errorcodes.New(code, message))
+}
+
+// Send the error response for the error (including the field errors)
+func sendErrorFrom(w http.ResponseWriter, e *errorcodes.Error) {
+	timingMark(w, "serialize")
+	w.Header().Set("Server", "Norbye Public Images Repo")
+	e.Send(w)
+}
@@ -0,0 +1,212 @@
+/**
+ * Package errorcodes is the errors returned by the IMGAPI server, shared
+ * by the server and the client library. The server sends the errors as
+ * a JSON object:
+ *
+ *     {"code": "ValidationFailed", "message": "...", "errors": [...]}
+ *
+ * with the HTTP status given by the code (as in the IMGAPI specification).
+ */
+package errorcodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// The header with the ID the server assigned to the request
+const RequestIdHeader = "X-Request-Id"
+
+// Code is the error code in the "code" field of the errors
+type Code string
+
+const (
+	ValidationFailed          Code = "ValidationFailed"
+	InvalidParameter          Code = "InvalidParameter"
+	ImageFilesImmutable       Code = "ImageFilesImmutable"
+	ImageAlreadyActivated     Code = "ImageAlreadyActivated"
+	NoActivationNoFile        Code = "NoActivationNoFile"
+	OperatorOnly              Code = "OperatorOnly"
+	ImageUuidAlreadyExists    Code = "ImageUuidAlreadyExists"
+	Upload                    Code = "Upload"
+	StorageIsDown             Code = "StorageIsDown"
+	StorageUnsupported        Code = "StorageUnsupported"
+	RemoteSourceError         Code = "RemoteSourceError"
+	OwnerDoesNotExist         Code = "OwnerDoesNotExist"
+	AccountDoesNotExist       Code = "AccountDoesNotExist"
+	NotImageOwner             Code = "NotImageOwner"
+	NotMantaPathOwner         Code = "NotMantaPathOwner"
+	OriginDoesNotExist        Code = "OriginDoesNotExist"
+	InsufficientServerVersion Code = "InsufficientServerVersion"
+	ImageHasDependentImages   Code = "ImageHasDependentImages"
+	NotAvailable              Code = "NotAvailable"
+	InternalError             Code = "InternalError"
+	ResourceNotFound          Code = "ResourceNotFound"
+	InvalidHeader             Code = "InvalidHeader"
+	ServiceUnavailableError   Code = "ServiceUnavailableError"
+	UnauthorizedError         Code = "UnauthorizedError"
+	NotAuthorizedError        Code = "NotAuthorizedError"
+	BadRequestError           Code = "BadRequestError"
+	ChecksumError             Code = "ChecksumError"
+	MethodNotAllowed          Code = "MethodNotAllowed"
+	RequestThrottled          Code = "RequestThrottled"
+	PayloadTooLarge           Code = "PayloadTooLarge"
+	QuotaExceeded             Code = "QuotaExceeded"
+	InsufficientStorage       Code = "InsufficientStorage"
+	PreconditionFailed        Code = "PreconditionFailed"
+	PreconditionRequired      Code = "PreconditionRequired"
+)
+
+// The HTTP status for each of the codes
+var statuses = map[Code]int{
+	ValidationFailed:          http.StatusUnprocessableEntity,
+	InvalidParameter:          http.StatusUnprocessableEntity,
+	ImageFilesImmutable:       http.StatusUnprocessableEntity,
+	ImageAlreadyActivated:     http.StatusUnprocessableEntity,
+	NoActivationNoFile:        http.StatusUnprocessableEntity,
+	OperatorOnly:              http.StatusForbidden,
+	ImageUuidAlreadyExists:    http.StatusConflict,
+	Upload:                    http.StatusBadRequest,
+	StorageIsDown:             http.StatusServiceUnavailable,
+	StorageUnsupported:        http.StatusServiceUnavailable,
+	RemoteSourceError:         http.StatusServiceUnavailable,
+	OwnerDoesNotExist:         http.StatusUnprocessableEntity,
+	AccountDoesNotExist:       http.StatusUnprocessableEntity,
+	NotImageOwner:             http.StatusUnprocessableEntity,
+	NotMantaPathOwner:         http.StatusUnprocessableEntity,
+	OriginDoesNotExist:        http.StatusUnprocessableEntity,
+	InsufficientServerVersion: http.StatusUnprocessableEntity,
+	ImageHasDependentImages:   http.StatusUnprocessableEntity,
+	NotAvailable:              http.StatusNotImplemented,
+	InternalError:             http.StatusInternalServerError,
+	ResourceNotFound:          http.StatusNotFound,
+	InvalidHeader:             http.StatusBadRequest,
+	ServiceUnavailableError:   http.StatusServiceUnavailable,
+	UnauthorizedError:         http.StatusUnauthorized,
+	NotAuthorizedError:        http.StatusForbidden,
+	BadRequestError:           http.StatusBadRequest,
+	ChecksumError:             http.StatusUnprocessableEntity,
+	MethodNotAllowed:          http.StatusMethodNotAllowed,
+	RequestThrottled:          http.StatusTooManyRequests,
+	PayloadTooLarge:           http.StatusRequestEntityTooLarge,
+	QuotaExceeded:             http.StatusForbidden,
+	InsufficientStorage:       http.StatusInsufficientStorage,
+	PreconditionFailed:        http.StatusPreconditionFailed,
+	PreconditionRequired:      http.StatusPreconditionRequired,
+}
+
+// Get the HTTP status the error code is sent with (500 for unknown codes)
+func (c Code) Status() int {
+	if status, ok := statuses[c]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Get all of the error codes (sorted)
+func Codes() []Code {
+	codes := make([]Code, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+/**
+ * FieldError is the error for one of the fields in a ValidationFailed
+ * error (Code is the reason, like "Missing" or "Invalid").
+ */
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error returned by the server
+type Error struct {
+	// The HTTP status of the response (not included in the JSON object)
+	StatusCode int          `json:"-"`
+	Code       Code         `json:"code"`
+	Message    string       `json:"message"`
+	Errors     []FieldError `json:"errors,omitempty"`
+	// The ID the server assigned to the request
+	RequestId string `json:"request_id,omitempty"`
+}
+
+// Create the error with the HTTP status for the code
+func New(code Code, message string) *Error {
+	return &Error{StatusCode: code.Status(), Code: code, Message: message}
+}
+
+// Create the error with the message formatted as fmt.Sprintf
+func Newf(code Code, format string, args ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, args...))
+}
+
+/**
+ * Send the error as the response with the HTTP status for the code.
+ * The fields is the field errors of a ValidationFailed error (nil for
+ * the other errors).
+ */
+func Send(w http.ResponseWriter, code Code, message string, fields []FieldError) {
+	e := New(code, message)
+	e.Errors = fields
+	e.Send(w)
+}
+
+/**
+ * Send the error as the response. The request ID is taken from the
+ * X-Request-Id header of the response unless it is set in the error.
+ */
+func (e *Error) Send(w http.ResponseWriter) {
+	if len(e.RequestId) == 0 {
+		e.RequestId = w.Header().Get(RequestIdHeader)
+	}
+	// The error only contains strings so it can't fail
+	body, _ := json.MarshalIndent(e, "", "  ")
+
+	h := w.Header()
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(e.Status())
+	w.Write(body)
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("imgapi: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("imgapi: %s: %s", e.Code, e.Message)
+}
+
+// Get the HTTP status to send the error with
+func (e *Error) Status() int {
+	if e.StatusCode != 0 {
+		return e.StatusCode
+	}
+	return e.Code.Status()
+}
+
+/**
+ * Parse the error in the body of a response with the HTTP status. The
+ * code is empty if the body isn't an error object (like the responses
+ * from a proxy in front of the server).
+ */
+func Parse(status int, body []byte) *Error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil {
+		e = &Error{}
+	}
+	e.StatusCode = status
+	return e
+}
+
+// Check if the error is an *Error with the code
+func Is(err error, code Code) bool {
+	e, ok := err.(*Error)
+	return ok && e.Code == code
+}
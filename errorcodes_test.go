@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+func TestSendErrorWithRequestId(t *testing.T) {
+	handler := withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		errorcodes.Send(w, CodeValidationFailed, "Invalid manifest", []errorcodes.FieldError{
+			{Field: "name", Code: "Missing", Message: "name is required"},
+		})
+	}))
+	request := httptest.NewRequest("POST", "/images", nil)
+	request.Header.Set(requestIdHeader, "test-request")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	if recorder.Code != ValidationFailed {
+		t.Errorf("Expected status %d, got %d", ValidationFailed, recorder.Code)
+	}
+	var e errorcodes.Error
+	err := json.Unmarshal(recorder.Body.Bytes(), &e)
+	if err != nil {
+		t.Fatalf("Failed to decode the error: %v", err)
+	}
+	if e.Code != CodeValidationFailed || e.RequestId != "test-request" ||
+		len(e.Errors) != 1 || e.Errors[0].Field != "name" {
+		t.Errorf("Unexpected error: %+v", e)
+	}
+}
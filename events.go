@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The events published when images change
+const (
+	EventImageCreated   = "image.created"
+	EventImageActivated = "image.activated"
+	EventImageUpdated   = "image.updated"
+	EventImageDisabled  = "image.disabled"
+	EventImageEnabled   = "image.enabled"
+	EventImageDeleted   = "image.deleted"
+	EventImagePromoted  = "image.promoted"
+	EventFileUploaded   = "file.uploaded"
+	// The upload of an image file failed
+	EventFileUploadFailed = "file.upload_failed"
+	// An upload was rejected as the owner exceeded the storage quota
+	EventQuotaExceeded = "quota.exceeded"
+	// The scanner found something in an uploaded file
+	EventFileInfected = "file.infected"
+)
+
+// An event describing a change to an image
+type ImageEvent struct {
+	Type string    `json:"type"`
+	Uuid string    `json:"uuid"`
+	Time time.Time `json:"time"`
+	// The reason for the failed uploads
+	Error string `json:"error,omitempty"`
+	// The manifest when the event happened (nil if unknown)
+	Manifest map[string]interface{} `json:"-"`
+}
+
+/**
+ * The subscribers receiving the image events. The subscribers is
+ * called synchronously by the request handler making the change so
+ * they must not block (queue the event and handle it in the
+ * background).
+ */
+var eventSubscribers struct {
+	sync.RWMutex
+	handlers []func(event ImageEvent)
+}
+
+// Register a function to be called for each image event
+func subscribeImageEvents(handler func(event ImageEvent)) {
+	eventSubscribers.Lock()
+	defer eventSubscribers.Unlock()
+	eventSubscribers.handlers = append(eventSubscribers.handlers, handler)
+}
+
+// Notify the subscribers that the image changed
+func publishImageEvent(eventType string, uuid string) {
+	m, _ := index.get(uuid)
+	publishEvent(ImageEvent{Type: eventType, Uuid: uuid, Manifest: m})
+}
+
+// Notify the subscribers about the event (the time is set to now)
+func publishEvent(event ImageEvent) {
+	event.Time = time.Now().UTC()
+
+	eventSubscribers.RLock()
+	defer eventSubscribers.RUnlock()
+	for _, handler := range eventSubscribers.handlers {
+		handler(event)
+	}
+}
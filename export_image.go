@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Get the extension to use for the exported image file
+func exportFileExtension(filename string) string {
+	if strings.HasSuffix(filename, ".bz2") {
+		return ".zfs.bz2"
+	}
+	if strings.HasSuffix(filename, ".gz") {
+		return ".zfs.gz"
+	}
+	if strings.HasSuffix(filename, ".xz") {
+		return ".zfs.xz"
+	}
+	return ".zfs"
+}
+
+/**
+ * Export the manifest and the image files to one of the configured
+ * export targets. The objects is stored as NAME-VERSION.imgmanifest
+ * and NAME-VERSION.zfs[.gz|.bz2|.xz] in the directory specified by the
+ * path parameter. The additional files of the image is stored as
+ * NAME-VERSION-1.zfs[.gz|.bz2|.xz], NAME-VERSION-2... and so on.
+ */
+func doServerExportImage(uuid string, params url.Values) (int, map[string]interface{}) {
+	var target string
+	var directory string
+	for k, v := range params {
+		switch k {
+		case "action":
+			break
+		case "target":
+			target = v[0]
+			break
+		case "path":
+			directory = v[0]
+			break
+		case "account":
+			fallthrough
+		case "channel":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	if len(target) == 0 {
+		return errorResponse(CodeInvalidParameter, "target parameter not specified")
+	}
+
+	exporter, err := getExporter(target)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	// Every file must be present so that the image isn't exported partially
+	count := len(getManifestFiles(m))
+	if count == 0 {
+		count = 1
+	}
+	filenames := make([]string, count)
+	for index := range filenames {
+		filename, exists := getImageFileAt(uuid, index)
+		if !exists {
+			return errorResponse(CodeResourceNotFound, fmt.Sprintf("No image file with index %d", index))
+		}
+		filenames[index] = filename
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to encode manifest: %v", err))
+	}
+
+	basename := fmt.Sprintf("%v-%v", m["name"], m["version"])
+	if len(directory) > 0 {
+		basename = strings.TrimRight(directory, "/") + "/" + basename
+	}
+
+	manifestLocation, err := exporter.Export(basename+".imgmanifest",
+		int64(len(manifest)), bytes.NewReader(manifest))
+	if err != nil {
+		return errorResponse(CodeStorageIsDown, fmt.Sprintf("Failed to export manifest: %v", err))
+	}
+
+	locations := make([]string, 0, len(filenames))
+	for index, filename := range filenames {
+		location, code, content := exportImageFile(exporter, uuid, filename,
+			exportFileName(basename, index, filename))
+		if content != nil {
+			return code, content
+		}
+		locations = append(locations, location)
+	}
+
+	return Success, map[string]interface{}{
+		"target":        target,
+		"manifest_path": manifestLocation,
+		"image_path":    locations[0],
+		"file_paths":    locations,
+	}
+}
+
+// Get the name of the exported file with the index (NAME-VERSION-1.zfs.gz, ...)
+func exportFileName(basename string, index int, filename string) string {
+	if index > 0 {
+		basename = fmt.Sprintf("%s-%d", basename, index)
+	}
+	return basename + exportFileExtension(filename)
+}
+
+// Export one of the stored files of the image and get its location in the target
+func exportImageFile(exporter Exporter, uuid string, filename string, name string) (string, int, map[string]interface{}) {
+	stat, err := storage.StatFile(uuid, filename)
+	if err != nil {
+		code, content := errorResponse(CodeInternalError, fmt.Sprintf("Failed to lookup image file: %v", err))
+		return "", code, content
+	}
+
+	f, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		code, content := errorResponse(CodeInternalError, fmt.Sprintf("Failed to open image file: %v", err))
+		return "", code, content
+	}
+	defer f.Close()
+
+	location, err := exporter.Export(name, stat.Size, f)
+	if err != nil {
+		code, content := errorResponse(CodeStorageIsDown, fmt.Sprintf("Failed to export image file: %v", err))
+		return "", code, content
+	}
+	return location, Success, nil
+}
+
+func serverExportImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerExportImage(uuid, params)
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+ * An Exporter knows how to store a named object (the manifest or the
+ * image file) at some destination
+ */
+type Exporter interface {
+	/**
+	 * Store the content provided by reader as name
+	 *
+	 * @param name the relative name of the object to store
+	 * @param size the number of bytes available in reader (or -1)
+	 * @param reader where to read the content from
+	 * @return location a description of where the object was stored
+	 *         err The error object if something failed
+	 */
+	Export(name string, size int64, reader io.Reader) (location string, err error)
+}
+
+// The configuration of an export target in the configuration file
+type ExportTarget struct {
+	Type     string            `json:"type"`
+	Path     string            `json:"path"`
+	Url      string            `json:"url"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	Headers  map[string]string `json:"headers"`
+}
+
+/**
+ * The registry of the available exporter types. Each entry creates an
+ * Exporter for the provided target configuration.
+ */
+var exporterTypes = map[string]func(target ExportTarget) (Exporter, error){
+	"local": newLocalExporter,
+	"http":  newHttpExporter,
+}
+
+// Register a new exporter type to the registry
+func RegisterExporterType(name string, factory func(target ExportTarget) (Exporter, error)) {
+	exporterTypes[name] = factory
+}
+
+// Look up the named export target from the configuration
+func getExporter(name string) (Exporter, error) {
+	target, ok := configuration.Exporters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown export target \"%s\"", name)
+	}
+
+	factory, ok := exporterTypes[target.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown exporter type \"%s\" for \"%s\"", target.Type, name)
+	}
+
+	return factory(target)
+}
+
+// The local exporter copies the objects to a directory on the server
+type localExporter struct {
+	root string
+}
+
+func newLocalExporter(target ExportTarget) (Exporter, error) {
+	if len(target.Path) == 0 {
+		return nil, fmt.Errorf("local exporter requires \"path\"")
+	}
+	return &localExporter{root: target.Path}, nil
+}
+
+func (e *localExporter) Export(name string, size int64, reader io.Reader) (string, error) {
+	filename := filepath.Join(e.root, filepath.Clean("/"+name))
+	err := os.MkdirAll(filepath.Dir(filename), 0777)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(f, reader)
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		os.Remove(filename)
+		return "", err
+	}
+
+	return filename, nil
+}
+
+/**
+ * The http exporter PUTs the objects below the configured URL. This
+ * may be used with WebDAV servers or S3 compatible object stores
+ * which accepts PUT (with the credentials provided as headers)
+ */
+type httpExporter struct {
+	target ExportTarget
+}
+
+func newHttpExporter(target ExportTarget) (Exporter, error) {
+	if len(target.Url) == 0 {
+		return nil, fmt.Errorf("http exporter requires \"url\"")
+	}
+	return &httpExporter{target: target}, nil
+}
+
+func (e *httpExporter) Export(name string, size int64, reader io.Reader) (string, error) {
+	location := strings.TrimRight(e.target.Url, "/") + "/" + strings.TrimLeft(name, "/")
+	req, err := http.NewRequest("PUT", location, reader)
+	if err != nil {
+		return "", err
+	}
+
+	req.ContentLength = size
+	for k, v := range e.target.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(e.target.Username) > 0 {
+		req.SetBasicAuth(e.target.Username, e.target.Password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("PUT %s returned %s", location, resp.Status)
+	}
+
+	return location, nil
+}
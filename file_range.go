@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errMultipleRanges = errors.New("Multiple ranges is not supported")
+
+/**
+ * Parse the Range header. Only a single range is supported
+ * ("bytes=start-end", "bytes=start-" and "bytes=-suffix").
+ *
+ * @param value the value of the Range header
+ * @param size the size of the file
+ * @return start the offset of the first byte to send
+ *         length the number of bytes to send
+ *         err errMultipleRanges if the client asked for multiple ranges,
+ *             otherwise the range is invalid or not satisfiable
+ */
+func parseRange(value string, size int64) (start int64, length int64, err error) {
+	if !strings.HasPrefix(value, "bytes=") {
+		return 0, 0, fmt.Errorf("Invalid range \"%s\"", value)
+	}
+	value = strings.TrimSpace(value[len("bytes="):])
+	if strings.Contains(value, ",") {
+		return 0, 0, errMultipleRanges
+	}
+
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("Invalid range \"%s\"", value)
+	}
+
+	if len(bounds[0]) == 0 {
+		// The last n bytes of the file
+		suffix, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, fmt.Errorf("Invalid range \"%s\"", value)
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err = strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("Invalid range \"%s\"", value)
+	}
+
+	end := size - 1
+	if len(bounds[1]) > 0 {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("Invalid range \"%s\"", value)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return start, end - start + 1, nil
+}
+
+/**
+ * Send the part of the file requested in the Range header with
+ * 206 Partial Content (so that clients may resume downloads). The file
+ * is streamed from the storage rather than read into memory.
+ */
+func serveFileRange(w http.ResponseWriter, r *http.Request, uuid string, name string, content_type string, info FileInfo) {
+	path := uuid + "/" + name
+	start, length, err := parseRange(r.Header.Get("Range"), info.Size)
+	code := http.StatusPartialContent
+	if err == errMultipleRanges {
+		// Ignore the header and send the entire file
+		start, length, code = 0, info.Size, Success
+	} else if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	if r.Method == "HEAD" {
+		h := w.Header()
+		h.Set("Server", "Norbye Public Images Repo")
+		h.Set("Content-Type", content_type)
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+		if code == http.StatusPartialContent {
+			h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size))
+		}
+		w.WriteHeader(code)
+		return
+	}
+
+	reader, err := storage.GetFile(uuid, name)
+	if err == nil {
+		defer reader.Close()
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, reader, start)
+		}
+	}
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s: %v", path, err))
+		return
+	}
+	timingMark(w, "storage")
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", content_type)
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	if code == http.StatusPartialContent {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, info.Size))
+	}
+	w.WriteHeader(code)
+
+	nw, err := copyToClient(w, r, reader, length)
+	if err != nil {
+		log.Printf("Failed to send %s: %v", path, err)
+	}
+	if nw != length {
+		log.Printf("Size of sent payload (%d) does not match expected (%d) fo %s", nw, length, path)
+	}
+}
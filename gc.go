@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default age of leftover temporary files before they are removed
+const defaultGcUploadTtl = 24 * 60 * 60
+
+// The configuration of the garbage collector in the configuration file
+type GcConfig struct {
+	// Seconds between each run (0 disables the garbage collector)
+	Interval int `json:"interval"`
+	// Seconds before leftover temporary files is removed
+	UploadTtl int `json:"upload_ttl"`
+	// Only log what would be removed
+	DryRun bool `json:"dry_run"`
+}
+
+/**
+ * The garbage collector removes the files nobody refers to:
+ *
+ *  - images without a manifest (seen in two runs in a row, so that
+ *    images being created isn't removed)
+ *  - files in the image which isn't the manifest, one of the files in
+ *    the manifest or the icon (older than the upload TTL)
+ *  - temporary upload files and partial uploads older than the
+ *    upload TTL
+ */
+type garbageCollector struct {
+	sync.Mutex
+	// The images without a manifest in the previous run
+	suspects map[string]bool
+	stats    gcStats
+	stop     chan struct{}
+}
+
+type gcStats struct {
+	Runs          int64     `json:"runs"`
+	LastRun       time.Time `json:"last_run"`
+	LastDuration  float64   `json:"last_duration"`
+	ImagesRemoved int64     `json:"images_removed"`
+	FilesRemoved  int64     `json:"files_removed"`
+	BytesRemoved  int64     `json:"bytes_removed"`
+	Errors        int64     `json:"errors"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+var gc = &garbageCollector{suspects: make(map[string]bool)}
+
+func gcUploadTtl() time.Duration {
+	if configuration.Gc.UploadTtl > 0 {
+		return time.Duration(configuration.Gc.UploadTtl) * time.Second
+	}
+	return defaultGcUploadTtl * time.Second
+}
+
+// Start running the garbage collector in the background (if enabled)
+func startGarbageCollector() {
+	if configuration.Gc.Interval <= 0 {
+		return
+	}
+
+	gc.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(time.Duration(configuration.Gc.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !inMaintenance() {
+					gc.run()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(gc.stop)
+}
+
+func stopGarbageCollector() {
+	if gc.stop != nil {
+		close(gc.stop)
+		gc.stop = nil
+	}
+}
+
+// Get the statistics (and configuration) for /state
+func (c *garbageCollector) state() map[string]interface{} {
+	c.Lock()
+	defer c.Unlock()
+	return map[string]interface{}{
+		"enabled":    configuration.Gc.Interval > 0,
+		"interval":   configuration.Gc.Interval,
+		"upload_ttl": int64(gcUploadTtl().Seconds()),
+		"dry_run":    configuration.Gc.DryRun,
+		"stats":      c.stats,
+	}
+}
+
+func (c *garbageCollector) fail(err error) {
+	log.Printf("gc: %v", err)
+	c.stats.Errors++
+	c.stats.LastError = fmt.Sprintf("%v", err)
+}
+
+// Remove the file (or just log it in dry-run mode)
+func (c *garbageCollector) remove(description string, size int64, remove func() error) bool {
+	if configuration.Gc.DryRun {
+		log.Printf("gc: would remove %s (%d bytes)", description, size)
+		return false
+	}
+
+	err := remove()
+	if err != nil {
+		c.fail(fmt.Errorf("Failed to remove %s: %v", description, err))
+		return false
+	}
+	log.Printf("gc: removed %s (%d bytes)", description, size)
+	return true
+}
+
+func (c *garbageCollector) removeFile(description string, size int64, remove func() error) {
+	if c.remove(description, size, remove) {
+		c.stats.FilesRemoved++
+		c.stats.BytesRemoved += size
+	}
+}
+
+// Run the garbage collector once
+func (c *garbageCollector) run() {
+	c.Lock()
+	defer c.Unlock()
+
+	start := time.Now()
+	uuids, err := storage.List()
+	if err != nil {
+		c.fail(fmt.Errorf("Failed to list images: %v", err))
+	}
+
+	suspects := make(map[string]bool)
+	for _, uuid := range uuids {
+		if c.collectImage(uuid) {
+			suspects[uuid] = true
+		}
+	}
+	c.suspects = suspects
+
+	c.collectTemporaryFiles(spoolDir(), spoolPrefix)
+	c.collectTemporaryFiles(partialUploadDir(), "")
+
+	c.stats.Runs++
+	c.stats.LastRun = start.UTC()
+	c.stats.LastDuration = time.Since(start).Seconds()
+}
+
+// Get the names of the files the manifest refers to
+func referencedFiles(m map[string]interface{}) map[string]bool {
+	names := map[string]bool{"manifest.json": true, signatureFileName: true, dockerConfigFileName: true,
+		historyFileName: true}
+	for index, entry := range getManifestFiles(m) {
+		file, _ := entry.(map[string]interface{})
+		compression, _ := file["compression"].(string)
+		names[imageFileNameAt(index, compression)] = true
+	}
+	if m["icon"] == true {
+		for _, t := range iconTypes {
+			names[t.filename] = true
+		}
+	}
+	for name := range getManifestAttachments(m) {
+		names[attachmentFileName(name)] = true
+	}
+	return names
+}
+
+/**
+ * Remove the files in the image nobody refers to
+ *
+ * @param uuid the image to check
+ * @return true if the image don't have a manifest
+ */
+func (c *garbageCollector) collectImage(uuid string) bool {
+	// Don't race with the requests modifying the image
+	defer lockImage(uuid)()
+
+	m, err := storage.GetManifest(uuid)
+	if err == ErrImageNotFound {
+		if c.suspects[uuid] && c.remove("image "+uuid+" without a manifest", 0, func() error {
+			return storage.Delete(uuid)
+		}) {
+			c.stats.ImagesRemoved++
+		}
+		return true
+	}
+	if err != nil {
+		c.fail(fmt.Errorf("Failed to load manifest for %s: %v", uuid, err))
+		return false
+	}
+
+	names, err := storage.ListFiles(uuid)
+	if err != nil {
+		c.fail(fmt.Errorf("Failed to list files for %s: %v", uuid, err))
+		return false
+	}
+
+	referenced := referencedFiles(m)
+	for _, name := range names {
+		if referenced[name] {
+			continue
+		}
+
+		info, err := storage.StatFile(uuid, name)
+		if err != nil || time.Since(info.ModTime) < gcUploadTtl() {
+			continue
+		}
+		c.removeFile(uuid+"/"+name, info.Size, func() error {
+			return storage.DeleteFile(uuid, name)
+		})
+	}
+	return false
+}
+
+// Remove the files in the directory starting with prefix older than the TTL
+func (c *garbageCollector) collectTemporaryFiles(dir string, prefix string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.fail(fmt.Errorf("Failed to list %s: %v", dir, err))
+		}
+		return
+	}
+
+	for _, info := range files {
+		if !info.Mode().IsRegular() || !strings.HasPrefix(info.Name(), prefix) ||
+			time.Since(info.ModTime()) < gcUploadTtl() {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		c.removeFile(path, info.Size(), func() error {
+			return os.Remove(path)
+		})
+	}
+}
@@ -1,45 +1,53 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 )
 
-func doServerGetImage(path string, params url.Values) (int, map[string]interface{}) {
+func doServerGetImage(uuid string, params url.Values) (int, map[string]interface{}) {
 	for k, _ := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
-			}
-			return InsufficientServerVersion, message
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
 
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 		}
 	}
 
-	m, err := LoadManifest(path + "/manifest.json")
+	m, err := storage.GetManifest(uuid)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to load manifest: %v", err),
-		}
-		return InternalError, message
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
 	}
 
 	return Success, m
 }
 
-func serverGetImage(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	code, content := doServerGetImage(path, params)
-	sendResponse(w, code, content)
+func serverGetImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	format, err := parseManifestFormat(params)
+	if err != nil {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("%v", err))
+		return
+	}
+
+	code, content := doServerGetImage(uuid, params)
+	timingMark(w, "storage")
+	if code != Success || content == nil {
+		sendResponse(w, code, content)
+		return
+	}
+	switch format {
+	case "yaml":
+		sendFormattedResponse(w, r, format, manifestToYaml(content))
+	case "ndjson":
+		a, _ := json.Marshal(content)
+		sendFormattedResponse(w, r, format, append(a, '\n'))
+	default:
+		sendCachedResponse(w, r, code, content)
+	}
 }
@@ -2,17 +2,48 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"strconv"
+	"strings"
 )
 
-func getImageFile(path string) (filename string, ok bool) {
-	ext := []string{".bz2", ".gz", ""}
+/**
+ * Get the name (without the extension) of the file with the index in
+ * the files array of the manifest
+ */
+func imageFilePrefix(index int) string {
+	if index == 0 {
+		return "image"
+	}
+	return fmt.Sprintf("image-%d", index)
+}
 
-	for i := 0; i < len(ext); i++ {
-		filename = path + "/image" + ext[i]
-		_, err := os.Stat(filename)
+/**
+ * Get the names used for the file with the index in the files array
+ * of the manifest. The first file is stored as image[.gz|.bz2|.xz] and
+ * the other files as image-index[.gz|.bz2|.xz].
+ */
+func imageFileNamesAt(index int) []string {
+	prefix := imageFilePrefix(index)
+
+	var names []string
+	for _, c := range compressions {
+		names = append(names, prefix+c.extension)
+	}
+	return names
+}
+
+func getImageFile(uuid string) (filename string, ok bool) {
+	return getImageFileAt(uuid, 0)
+}
+
+// Get the name of the stored file with the index (ok is false if missing)
+func getImageFileAt(uuid string, index int) (filename string, ok bool) {
+	for _, filename = range imageFileNamesAt(index) {
+		_, err := storage.StatFile(uuid, filename)
 		if err == nil {
 			return filename, true
 		}
@@ -21,34 +52,163 @@ func getImageFile(path string) (filename string, ok bool) {
 	return filename, false
 }
 
-func serverGetImageFile(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	for k, _ := range params {
+// Get the name suggested to the client for the stored file (uuid.gz, uuid-1.gz, ...)
+func imageFileDownloadName(uuid string, filename string) string {
+	return uuid + strings.TrimPrefix(filename, "image")
+}
+
+// Get the name of the file to store the image file in
+func imageFileName(compression string) string {
+	return imageFileNameAt(0, compression)
+}
+
+func imageFileNameAt(index int, compression string) string {
+	prefix := imageFilePrefix(index)
+
+	for _, c := range compressions {
+		if c.name == compression {
+			return prefix + c.extension
+		}
+	}
+	return prefix + ".gz"
+}
+
+// Parse the index parameter (the index in the files array)
+func parseFileIndex(value string) (int, error) {
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("Invalid file index \"%s\"", value)
+	}
+	return index, nil
+}
+
+/**
+ * Send the image file decompressed with the stored compression and
+ * compressed with the requested compression. The size (and SHA1) of
+ * the transcoded file isn't known up front, so the response is
+ * streamed without Content-Length and ETag.
+ */
+func serveTranscodedImageFile(w http.ResponseWriter, r *http.Request, uuid string, filename string, compression string) {
+	if r.Method == "HEAD" {
+		h := w.Header()
+		h.Set("Server", "Norbye Public Images Repo")
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("X-Image-Compression", compression)
+		w.WriteHeader(Success)
+		return
+	}
+
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file: %v", err))
+		return
+	}
+	defer reader.Close()
+
+	source, err := decompressReader(imageFileCompression(filename), reader)
+	var writer io.WriteCloser
+	if err == nil {
+		writer, err = compressWriter(compression, w)
+	}
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to transcode file: %v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("X-Image-Compression", compression)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		// The headers is already sent so all I can do is to log it
+		log.Printf("Failed to send transcoded %s/%s: %v", uuid, filename, err)
+	}
+}
+
+func serverGetImageFile(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	accept := ""
+	format := ""
+	index := 0
+	for k, v := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
-			sendResponse(w, InsufficientServerVersion, map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
-			})
+			sendError(w, CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
 			return
 
+		case "accept-compression":
+			accept = v[0]
+
+		case "format":
+			format = v[0]
+			if !stringInSlice(format, diskFormats) {
+				sendError(w, CodeInvalidParameter, "format may be raw, qcow2 or vmdk")
+				return
+			}
+
+		case "index":
+			var err error
+			index, err = parseFileIndex(v[0])
+			if err != nil {
+				sendError(w, CodeInvalidParameter, fmt.Sprintf("%v", err))
+				return
+			}
+
 		default:
-			sendResponse(w, InvalidParameter, map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			})
+			sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
 			return
 		}
 	}
 
-	filename, exists := getImageFile(path)
-	if exists {
-		serveFile(w, r, filename, "application/octet-stream")
-	} else {
-		sendResponse(w, ResourceNotFound, map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "No such image",
-		})
+	filename, exists := getImageFileAt(uuid, index)
+	if !exists {
+		sendError(w, CodeResourceNotFound, "No such image")
+		return
+	}
+
+	if len(format) > 0 {
+		m, err := storage.GetManifest(uuid)
+		if err != nil {
+			sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+			return
+		}
+		if imageDiskFormat(m) != format {
+			serveConvertedImageFile(w, r, uuid, index, filename, m, format)
+			return
+		}
+	}
+
+	compression := imageFileCompression(filename)
+	if len(accept) > 0 {
+		selected, err := selectCompression(compression, accept)
+		if err != nil {
+			sendError(w, CodeInvalidParameter, fmt.Sprintf("%v", err))
+			return
+		}
+		if selected != compression {
+			serveTranscodedImageFile(w, r, uuid, filename, selected)
+			return
+		}
+	}
+
+	// Use the SHA1 of the file as the ETag
+	etag := ""
+	m, err := storage.GetManifest(uuid)
+	if err == nil {
+		declared := getDeclaredFileAt(m, index)
+		if sha1sum, ok := declared["sha1"].(string); ok {
+			etag = "\"" + sha1sum + "\""
+		}
+		if digest := digestHeader(declared); len(digest) > 0 {
+			w.Header().Set("Digest", digest)
+		}
 	}
+	w.Header().Set("X-Image-Compression", compression)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", imageFileDownloadName(uuid, filename)))
+	serveFile(w, r, uuid, filename, "application/octet-stream", etag)
 }
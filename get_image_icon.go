@@ -6,64 +6,69 @@ import (
 	"net/url"
 )
 
-func doServerGetImageIcon(path string, params url.Values) (int, map[string]interface{}) {
-	for k, _ := range params {
+/**
+ * Verify the request for the icon. The size parameter selects a
+ * thumbnail of the icon (see icon_resize.go).
+ *
+ * @return size the size of the thumbnail (0 for the icon itself)
+ *         code, content the error to return to the client
+ */
+func doServerGetImageIcon(uuid string, params url.Values) (size int, code int, content map[string]interface{}) {
+	for k, v := range params {
 		switch k {
 		case "account":
 			fallthrough
 		case "channel":
-			message := map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "The server does not support \"account\" and \"channel\"",
+			code, content = errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+			return
+
+		case "size":
+			var err error
+			size, err = parseIconSize(v[0])
+			if err != nil {
+				code, content = errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+				return
 			}
-			return InsufficientServerVersion, message
 
 		default:
-			message := map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter: %s", k),
-			}
-			return InvalidParameter, message
+			code, content = errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+			return
 		}
 	}
 
-	m, err := LoadManifest(path + "/manifest.json")
+	m, err := storage.GetManifest(uuid)
 	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to load manifest: %v", err),
-		}
-		return InternalError, message
+		code, content = errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
 	}
 
 	icon, ok := m["icon"]
 	if !ok || icon == false {
-		message := map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "Image does not have an icon",
-		}
-		return ResourceNotFound, message
+		code, content = errorResponse(CodeResourceNotFound, "Image does not have an icon")
+		return
 	}
 
-	filename, _ := getIconFile(path)
+	filename, _ := getIconFile(uuid)
 	if len(filename) == 0 {
-		message := map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "No such image",
-		}
-		return ResourceNotFound, message
+		code, content = errorResponse(CodeResourceNotFound, "No such image")
+		return
 	}
 
-	return Success, nil
+	return size, Success, nil
 }
 
-func serverGetImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
+func serverGetImageIcon(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
 
-	code, content := doServerGetImageIcon(path, params)
-	if code == Success {
-		filename, content_type := getIconFile(path)
-		serveFile(w, r, filename, content_type)
-	} else {
+	size, code, content := doServerGetImageIcon(uuid, params)
+	if code != Success {
 		sendResponse(w, code, content)
+		return
+	}
+
+	filename, content_type := getIconFile(uuid)
+	if size > 0 {
+		serveIconThumbnail(w, r, uuid, filename, size)
+	} else {
+		serveFile(w, r, uuid, filename, content_type, "")
 	}
 }
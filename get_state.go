@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// The version of the server reported by /ping and /state
+const serverVersion = "1.0.0"
+
+// The time the server was started
+var serverStartTime = time.Now()
+
+// The number of requests currently being handled
+var inflightRequests int64
+
+// Wrap the handler to keep track of the requests in progress
+func withInflightCount(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inflightRequests, 1)
+		defer atomic.AddInt64(&inflightRequests, -1)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// A summary of the configuration (without passwords and keys)
+func configurationSummary() map[string]interface{} {
+	config := currentConfiguration()
+	var users []map[string]interface{}
+	for _, user := range config.Userdb {
+		users = append(users, map[string]interface{}{
+			"name": user.Name,
+			"role": userRole(&user),
+		})
+	}
+
+	var channels []string
+	for _, channel := range config.Channels {
+		channels = append(channels, channel.Name)
+	}
+
+	exporters := make(map[string]string)
+	for name, target := range config.Exporters {
+		exporters[name] = target.Type
+	}
+
+	var replication []string
+	for _, target := range config.Replication {
+		replication = append(replication, target.Name)
+	}
+
+	return map[string]interface{}{
+		"datadir":           config.Datadir,
+		"port":              listenPort(*config),
+		"unix_socket":       config.UnixSocket,
+		"host":              config.Hostname,
+		"tls":               tlsEnabled(),
+		"redirect_port":     config.RedirectPort,
+		"server_timing":     config.ServerTiming,
+		"enforce_file_size": config.EnforceSize,
+		"warm_cache":        config.WarmCache,
+		"users":             users,
+		"channels":          channels,
+		"exporters":         exporters,
+		"replication":       replication,
+		"mirror":            config.Mirror.Url,
+		"audit_log":         config.AuditLog,
+		"storage": map[string]interface{}{
+			"type":     storageType(configuration),
+			"bucket":   config.Storage.Bucket,
+			"endpoint": config.Storage.Endpoint,
+			"region":   config.Storage.Region,
+			"prefix":   config.Storage.Prefix,
+			"dedup":    config.Storage.Dedup,
+		},
+	}
+}
+
+// Count the images in each state (with the index of the catalog if it has one)
+func countImagesByState() (int, map[string]int) {
+	if catalog, ok := storageQueryCatalog(storage); ok {
+		total, err := catalog.Count(nil)
+		var states map[string]int
+		if err == nil {
+			states, err = catalog.CountBy("state")
+		}
+		if err == nil {
+			return total, states
+		}
+		log.Printf("Failed to count the images in the catalog: %v", err)
+	}
+
+	states := make(map[string]int)
+	entries := index.list()
+	for _, entry := range entries {
+		states[getImageState(entry.manifest)]++
+	}
+	return len(entries), states
+}
+
+func doServerGetState() (int, map[string]interface{}) {
+	total, states := countImagesByState()
+
+	// Verify that the storage backend responds
+	status := "ok"
+	_, err := storage.Exists("00000000-0000-0000-0000-000000000000")
+	if err != nil {
+		status = fmt.Sprintf("%v", err)
+	}
+
+	return Success, map[string]interface{}{
+		"version":       serverVersion,
+		"pid":           os.Getpid(),
+		"started":       serverStartTime.UTC().Format(time.RFC3339),
+		"uptime":        int64(time.Since(serverStartTime).Seconds()),
+		"configuration": configurationSummary(),
+		"images": map[string]interface{}{
+			"total":    total,
+			"by_state": states,
+			"scan":     indexScanState(),
+		},
+		"storage": map[string]interface{}{
+			"type":   storageType(configuration),
+			"status": status,
+			"dedup":  dedupState(),
+		},
+		"requests": map[string]interface{}{
+			"inflight":  atomic.LoadInt64(&inflightRequests),
+			"transfers": rateLimitState(),
+		},
+		"gc":            gc.state(),
+		"trash":         trashState(),
+		"retention":     retention.state(),
+		"maintenance":   maintenance.state(),
+		"usage":         usageState(),
+		"mirror":        mirrorState(),
+		"seed":          seedState(),
+		"upstreams":     upstreamState(),
+		"scan":          scanState(),
+		"webhooks":      webhooksState(),
+		"notifications": notificationsState(),
+		"changes":       changes.state(),
+	}
+}
+
+/*
+AdminGetState	GET /state	Dump internal server state (for dev/debugging)
+*/
+func serverGetState(w http.ResponseWriter, r *http.Request) {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+		return
+	}
+
+	code, content = requireOperator(user)
+	if content == nil {
+		code, content = doServerGetState()
+	}
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The default size of the smallest JSON response to compress
+const defaultGzipMinSize = 1024
+
+// The configuration of the compression of the JSON responses in the configuration file
+type GzipConfig struct {
+	Enabled bool `json:"enabled"`
+	// Responses smaller than min_size bytes is sent uncompressed
+	MinSize int `json:"min_size"`
+	// The gzip compression level (1-9, 0 use the default level)
+	Level int `json:"level"`
+}
+
+func validateGzip(config GzipConfig) error {
+	if config.MinSize < 0 {
+		return errors.New("The gzip min_size can't be negative")
+	}
+	if config.Level < 0 || config.Level > gzip.BestCompression {
+		return fmt.Errorf("The gzip level must be between 1 and 9 (not %d)", config.Level)
+	}
+	return nil
+}
+
+func gzipMinSize() int {
+	if configuration.Gzip.MinSize > 0 {
+		return configuration.Gzip.MinSize
+	}
+	return defaultGzipMinSize
+}
+
+func gzipLevel() int {
+	if configuration.Gzip.Level > 0 {
+		return configuration.Gzip.Level
+	}
+	return gzip.DefaultCompression
+}
+
+// Check if the client accepts gzip in the Accept-Encoding header
+func acceptsGzip(r *http.Request) bool {
+	for _, field := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding := strings.Split(field, ";")
+		name := strings.ToLower(strings.TrimSpace(coding[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		for _, param := range coding[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil || q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+/**
+ * gzipWriter compresses the JSON responses. The decision is made when
+ * the headers is written: only responses with the JSON content type
+ * (and a body of at least min_size bytes if the size is known) is
+ * compressed, so the image files (which is already compressed) and the
+ * event streams is sent as is. The ETag of the compressed responses
+ * gets the suffix -gzip (see gzipEtag).
+ */
+type gzipWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	writer      *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipWriter) compress(code int) bool {
+	h := g.Header()
+	if g.request.Method == "HEAD" || code < 200 || code == http.StatusNoContent ||
+		code == http.StatusNotModified || len(h.Get("Content-Encoding")) > 0 {
+		return false
+	}
+	if !strings.HasPrefix(h.Get("Content-Type"), "application/json") {
+		return false
+	}
+	h.Add("Vary", "Accept-Encoding")
+
+	size, err := strconv.Atoi(h.Get("Content-Length"))
+	return err != nil || size >= gzipMinSize()
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	h := g.Header()
+	if g.compress(code) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		if etag := h.Get("ETag"); len(etag) > 0 {
+			h.Set("ETag", gzipEtag(etag))
+		}
+		g.writer, _ = gzip.NewWriterLevel(g.ResponseWriter, gzipLevel())
+	} else if code == http.StatusNotModified {
+		// Send the ETag the client has if it is the compressed one
+		etag := gzipEtag(h.Get("ETag"))
+		if etag != h.Get("ETag") && strings.Contains(g.request.Header.Get("If-None-Match"), etag) {
+			h.Set("ETag", etag)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipWriter) Write(data []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.writer != nil {
+		return g.writer.Write(data)
+	}
+	return g.ResponseWriter.Write(data)
+}
+
+// Let http.ResponseController reach the connection (see timeouts.go)
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// Pass on io.ReaderFrom so that the files may be sent with sendfile
+func (g *gzipWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.writer != nil {
+		return io.Copy(g.writer, reader)
+	}
+	return readFrom(g.ResponseWriter, reader)
+}
+
+// Flush the response to the client (used by the event stream)
+func (g *gzipWriter) Flush() {
+	if g.writer != nil {
+		g.writer.Flush()
+	}
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Wrap the handler to compress the JSON responses if enabled (and accepted by the client)
+func withGzip(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !configuration.Gzip.Enabled || !acceptsGzip(r) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		writer := &gzipWriter{ResponseWriter: w, request: r}
+		defer func() {
+			if writer.writer != nil {
+				writer.writer.Close()
+			}
+		}()
+		handler.ServeHTTP(writer, r)
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package main
+
+import "os"
+
+// The link count of the files is not available on this platform
+const hardLinksSupported = false
+
+func fileLinks(info os.FileInfo) (links uint64, inode uint64, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// The deduplication (see storage_dedup.go) needs the link count of the files
+const hardLinksSupported = true
+
+// Get the number of hard links to the file and its inode
+func fileLinks(info os.FileInfo) (links uint64, inode uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint64(st.Nlink), uint64(st.Ino), true
+}
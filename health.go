@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The configuration of the health checks in the configuration file
+type HealthConfig struct {
+	// The minimum number of bytes free in datadir (0 means no check)
+	MinFreeSpace int64 `json:"min_free_space"`
+}
+
+var errDiskSpaceUnsupported = errors.New("The free space is not available on this platform")
+
+/**
+ * 1 when the server accepts requests, 0 while it is starting and after
+ * it started to shut down (so that a load balancer stops sending new
+ * requests before the server stops).
+ */
+var serverReady int32
+
+func setServerReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&serverReady, value)
+}
+
+func isServerReady() bool {
+	return atomic.LoadInt32(&serverReady) == 1
+}
+
+// Verify that the storage backend responds
+func checkStorageHealth() map[string]interface{} {
+	start := time.Now()
+	_, err := storage.Exists("00000000-0000-0000-0000-000000000000")
+	result := map[string]interface{}{
+		"type":    storageType(configuration),
+		"latency": float64(time.Since(start)) / float64(time.Millisecond),
+		"healthy": err == nil,
+	}
+	if err != nil {
+		result["error"] = fmt.Sprintf("%v", err)
+	}
+	return result
+}
+
+// Verify that there is at least min_free_space free in datadir (nil unless local storage)
+func checkDiskHealth() map[string]interface{} {
+	if storageType(configuration) != "local" {
+		return nil
+	}
+
+	free, total, err := diskSpace(configuration.Datadir)
+	if err != nil {
+		return map[string]interface{}{
+			"healthy": configuration.Health.MinFreeSpace == 0,
+			"error":   fmt.Sprintf("%v", err),
+		}
+	}
+
+	min := uint64(configuration.Health.MinFreeSpace)
+	return map[string]interface{}{
+		"free":           free,
+		"total":          total,
+		"min_free_space": min,
+		"healthy":        free >= min,
+	}
+}
+
+/**
+ * Verify that the index contains the same images as the storage. The
+ * index may be stale if other servers modify a shared storage (like
+ * S3), and it is only loaded when the server starts.
+ */
+func checkIndexHealth() map[string]interface{} {
+	indexed := len(index.list())
+	uuids, err := storage.List()
+	if err != nil {
+		return map[string]interface{}{
+			"images":  indexed,
+			"healthy": false,
+			"error":   fmt.Sprintf("%v", err),
+		}
+	}
+	return map[string]interface{}{
+		"images":  indexed,
+		"stored":  len(uuids),
+		"healthy": indexed == len(uuids),
+	}
+}
+
+func doServerHealth() (int, map[string]interface{}) {
+	checks := map[string]interface{}{
+		"storage": checkStorageHealth(),
+		"index":   checkIndexHealth(),
+	}
+	if disk := checkDiskHealth(); disk != nil {
+		checks["disk"] = disk
+	}
+
+	healthy := true
+	for _, check := range checks {
+		if !check.(map[string]interface{})["healthy"].(bool) {
+			healthy = false
+		}
+	}
+
+	code, status := Success, "ok"
+	if !healthy {
+		code, status = ServiceUnavailableError, "unhealthy"
+	}
+	return code, map[string]interface{}{
+		"status":  status,
+		"version": serverVersion,
+		"uptime":  int64(time.Since(serverStartTime).Seconds()),
+		"checks":  checks,
+	}
+}
+
+/*
+Health	GET /health	Check the storage, the free space and the index.
+*/
+func serverHealth(w http.ResponseWriter, r *http.Request) {
+	code, content := doServerHealth()
+	sendResponse(w, code, content)
+}
+
+/*
+Ready	GET /ready	Check if the server accepts requests (for load balancers).
+*/
+func serverReadiness(w http.ResponseWriter, r *http.Request) {
+	if !isServerReady() {
+		sendError(w, CodeServiceUnavailableError, "The server is not ready")
+		return
+	}
+	sendResponse(w, Success, map[string]interface{}{"ready": true})
+}
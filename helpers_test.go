@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Point the server at an empty datadir with the local storage and the index
+func setupTestStorage(t *testing.T) {
+	t.Helper()
+	setupTestCatalogStorage(t, "")
+}
+
+// Point the server at an empty datadir with the catalog type ("" for none)
+func setupTestCatalogStorage(t *testing.T, catalogType string) {
+	t.Helper()
+	configuration = Configuration{Datadir: t.TempDir(), Catalog: CatalogConfig{Type: catalogType}}
+	s, err := openImageStorage(configuration)
+	if err == nil {
+		if cs, ok := s.(*catalogStorage); ok {
+			t.Cleanup(func() { cs.catalog.Close() })
+		}
+		s, err = newIndexedStorage(s)
+	}
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	storage = s
+}
+
+// Create an image with the manifest (and the image file if content isn't empty)
+func addTestImage(t *testing.T, uuid string, m map[string]interface{}, content string) {
+	t.Helper()
+	m["uuid"] = uuid
+	err := storage.Create(uuid)
+	if err == nil {
+		err = storage.PutManifest(uuid, m)
+	}
+	if err == nil && len(content) > 0 {
+		_, err = storage.PutFile(uuid, imageFileName("gzip"), strings.NewReader(content))
+	}
+	if err != nil {
+		t.Fatalf("Failed to create image %s: %v", uuid, err)
+	}
+}
+
+// Build a manifest for an active public image with the files
+func testManifest(name string, files ...interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"v":       2,
+		"name":    name,
+		"version": "1.0.0",
+		"type":    "zone-dataset",
+		"os":      "smartos",
+		"public":  true,
+		"state":   StateActive,
+	}
+	if len(files) > 0 {
+		m["files"] = files
+	}
+	return m
+}
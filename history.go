@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// The name of the file the previous revisions of the manifest is stored in
+const historyFileName = "history.json"
+
+// The number of previous revisions kept for each image
+const maxManifestHistory = 100
+
+/**
+ * The fields which isn't changed by a rollback (they're changed by
+ * the other actions, not by UpdateImage).
+ */
+var rollbackProtectedFields = []string{"v", "uuid", "owner", "state", "disabled",
+	"activated", "published_at", "files", "channels", "icon", "attachments"}
+
+/**
+ * A previous revision of the manifest. The revisions is numbered from
+ * 1, and the current manifest is the revision after the last one in
+ * the history.
+ */
+type manifestRevision struct {
+	Rev int `json:"rev"`
+	// The time the revision was replaced
+	Time      string                 `json:"time"`
+	RequestId string                 `json:"request_id,omitempty"`
+	Manifest  map[string]interface{} `json:"manifest"`
+}
+
+// Load the history of the image (empty if the manifest was never updated)
+func loadManifestHistory(uuid string) ([]manifestRevision, error) {
+	history := []manifestRevision{}
+	reader, err := storage.GetFile(uuid, historyFileName)
+	if err == ErrImageNotFound {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err == nil {
+		err = json.Unmarshal(content, &history)
+	}
+	return history, err
+}
+
+/**
+ * Add the manifest to the history before it is replaced. The oldest
+ * revisions is removed when the history exceeds maxManifestHistory.
+ * The caller must hold the lock of the image.
+ */
+func addManifestRevision(uuid string, m map[string]interface{}, r *http.Request) error {
+	history, err := loadManifestHistory(uuid)
+	if err != nil {
+		return err
+	}
+
+	// Copy the manifest as the caller may modify it after this call
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	revision := manifestRevision{
+		Rev:       len(history) + 1,
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		RequestId: requestId(r),
+	}
+	if len(history) > 0 {
+		revision.Rev = history[len(history)-1].Rev + 1
+	}
+	err = json.Unmarshal(content, &revision.Manifest)
+	if err != nil {
+		return err
+	}
+
+	history = append(history, revision)
+	if len(history) > maxManifestHistory {
+		history = history[len(history)-maxManifestHistory:]
+	}
+	content, err = json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	_, err = storage.PutFile(uuid, historyFileName, bytes.NewReader(content))
+	return err
+}
+
+/**
+ * Get the fields which differ between the manifests as
+ * { "field" : { "from" : old, "to" : new } } (the value missing in one
+ * of the manifests is null).
+ */
+func manifestDiff(from map[string]interface{}, to map[string]interface{}) map[string]interface{} {
+	diff := map[string]interface{}{}
+	for k, v := range from {
+		if !reflect.DeepEqual(v, to[k]) {
+			diff[k] = map[string]interface{}{"from": v, "to": to[k]}
+		}
+	}
+	for k, v := range to {
+		if _, ok := from[k]; !ok {
+			diff[k] = map[string]interface{}{"from": nil, "to": v}
+		}
+	}
+	return diff
+}
+
+// Get the revision following the revision at index i (the current manifest after the last)
+func nextRevision(history []manifestRevision, i int, current map[string]interface{}) map[string]interface{} {
+	if i+1 < len(history) {
+		return history[i+1].Manifest
+	}
+	return current
+}
+
+// Get the revision from the rev parameter
+func findRevision(history []manifestRevision, params url.Values) (int, int, map[string]interface{}) {
+	rev, err := strconv.Atoi(params.Get("rev"))
+	if err != nil || rev < 1 {
+		code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid rev \"%s\"", params.Get("rev")))
+		return -1, code, content
+	}
+	for i, revision := range history {
+		if revision.Rev == rev {
+			return i, Success, nil
+		}
+	}
+	code, content := errorResponse(CodeResourceNotFound, fmt.Sprintf("Revision %d is not in the history", rev))
+	return -1, code, content
+}
+
+/**
+ * Get the previous revisions of the manifest with the changes made in
+ * the following revision (but without the manifests).
+ */
+func doServerGetImageHistory(uuid string) (int, map[string]interface{}) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	history, err := loadManifestHistory(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load history: %v", err))
+	}
+
+	revisions := []interface{}{}
+	for i, revision := range history {
+		entry := map[string]interface{}{
+			"rev":     revision.Rev,
+			"time":    revision.Time,
+			"changes": manifestDiff(revision.Manifest, nextRevision(history, i, m)),
+		}
+		if len(revision.RequestId) > 0 {
+			entry["request_id"] = revision.RequestId
+		}
+		revisions = append(revisions, entry)
+	}
+
+	current := 1
+	if len(history) > 0 {
+		current = history[len(history)-1].Rev + 1
+	}
+	return Success, map[string]interface{}{
+		"current":   current,
+		"revisions": revisions,
+	}
+}
+
+/*
+GetImageHistory	GET /images/:uuid/history	List the previous revisions of the image manifest.
+*/
+func serverGetImageHistory(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerGetImageHistory(uuid)
+	sendResponse(w, code, content)
+}
+
+func doServerGetImageRevision(uuid string, params url.Values) (int, map[string]interface{}) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	history, err := loadManifestHistory(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load history: %v", err))
+	}
+
+	i, code, content := findRevision(history, params)
+	if content != nil {
+		return code, content
+	}
+	revision := history[i]
+	content = map[string]interface{}{
+		"rev":      revision.Rev,
+		"time":     revision.Time,
+		"manifest": revision.Manifest,
+		"changes":  manifestDiff(revision.Manifest, nextRevision(history, i, m)),
+	}
+	if len(revision.RequestId) > 0 {
+		content["request_id"] = revision.RequestId
+	}
+	return Success, content
+}
+
+/*
+GetImageRevision	GET /images/:uuid/history/:rev	Get a previous revision of the image manifest.
+*/
+func serverGetImageRevision(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerGetImageRevision(uuid, params)
+	sendResponse(w, code, content)
+}
+
+/**
+ * Restore the fields of the manifest from the revision in the rev
+ * parameter. The fields changed by the other actions (like the state
+ * and the files) is kept, and the current manifest is added to the
+ * history so that the rollback may be undone.
+ */
+func doServerRollbackImage(uuid string, params url.Values, r *http.Request) (int, map[string]interface{}) {
+	for k := range params {
+		switch k {
+		case "action", "rev":
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+	history, err := loadManifestHistory(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load history: %v", err))
+	}
+	i, code, content := findRevision(history, params)
+	if content != nil {
+		return code, content
+	}
+
+	restored := map[string]interface{}{}
+	for k, v := range history[i].Manifest {
+		restored[k] = v
+	}
+	for _, k := range rollbackProtectedFields {
+		if v, ok := m[k]; ok {
+			restored[k] = v
+		} else {
+			delete(restored, k)
+		}
+	}
+
+	errs := validateManifest(restored)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+	if isDryRun(r) {
+		return Success, restored
+	}
+
+	err = addManifestRevision(uuid, m, r)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store history: %v", err))
+	}
+	err = storage.PutManifest(uuid, restored)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	publishImageEvent(EventImageUpdated, uuid)
+	return Success, restored
+}
+
+/*
+RollbackImage	POST /images/:uuid?action=rollback&rev=$rev	Restore the manifest fields from a previous revision (operators only).
+*/
+func serverRollbackImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerRollbackImage(uuid, params, r)
+	if code == Success {
+		w.Header().Set("ETag", manifestEtag(content))
+	}
+	sendResponse(w, code, content)
+}
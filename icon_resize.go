@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// The sizes (in pixels) of the thumbnails in GET /images/:uuid/icon?size=N
+var iconThumbnailSizes = []int{32, 64, 128}
+
+// The number of thumbnails kept in memory
+const iconThumbnailCacheSize = 1000
+
+type cachedThumbnail struct {
+	key       string
+	etag      string
+	thumbnail []byte
+}
+
+/**
+ * The thumbnails is generated on demand and kept in a LRU cache keyed
+ * by the image and the size. An entry is only used as long as the etag
+ * of the icon (the size and modification time) is unchanged so a new
+ * icon replaces the thumbnails.
+ */
+var thumbnailCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}{entries: make(map[string]*list.Element), lru: list.New()}
+
+// Parse the size parameter of GetImageIcon
+func parseIconSize(value string) (int, error) {
+	size, err := strconv.Atoi(value)
+	if err == nil {
+		for _, supported := range iconThumbnailSizes {
+			if size == supported {
+				return size, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("size must be one of %v", iconThumbnailSizes)
+}
+
+/**
+ * Scale the image to fit within size x size pixels (keeping the aspect
+ * ratio). Each pixel in the thumbnail is the average of the pixels it
+ * covers in the icon (or the nearest pixel when the icon is enlarged).
+ */
+func resizeIcon(src image.Image, size int) *image.RGBA {
+	bounds := src.Bounds()
+	sw, sh := bounds.Dx(), bounds.Dy()
+	dw, dh := size, size
+	if sw > sh {
+		dh = (sh*size + sw/2) / sw
+	} else if sh > sw {
+		dw = (sw*size + sh/2) / sh
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*sh/dh, (y+1)*sh/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*sw/dw, (x+1)*sw/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			// The colors is premultiplied with alpha so the transparent
+			// pixels don't bleed into the average
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8((r / n) >> 8)
+			dst.Pix[i+1] = uint8((g / n) >> 8)
+			dst.Pix[i+2] = uint8((b / n) >> 8)
+			dst.Pix[i+3] = uint8((a / n) >> 8)
+		}
+	}
+	return dst
+}
+
+// Get the thumbnail of the icon from the cache (or generate it)
+func iconThumbnail(uuid string, filename string, etag string, size int) ([]byte, error) {
+	key := fmt.Sprintf("%s/%d", uuid, size)
+
+	thumbnailCache.Lock()
+	if element, ok := thumbnailCache.entries[key]; ok {
+		entry := element.Value.(*cachedThumbnail)
+		if entry.etag == etag {
+			thumbnailCache.lru.MoveToFront(element)
+			thumbnailCache.Unlock()
+			return entry.thumbnail, nil
+		}
+	}
+	thumbnailCache.Unlock()
+
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		return nil, err
+	}
+	icon, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(icon))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode icon: %v", err)
+	}
+
+	var thumbnail bytes.Buffer
+	err = png.Encode(&thumbnail, resizeIcon(src, size))
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnailCache.Lock()
+	defer thumbnailCache.Unlock()
+	if element, ok := thumbnailCache.entries[key]; ok {
+		thumbnailCache.lru.Remove(element)
+	}
+	entry := &cachedThumbnail{key: key, etag: etag, thumbnail: thumbnail.Bytes()}
+	thumbnailCache.entries[key] = thumbnailCache.lru.PushFront(entry)
+	for thumbnailCache.lru.Len() > iconThumbnailCacheSize {
+		oldest := thumbnailCache.lru.Back()
+		thumbnailCache.lru.Remove(oldest)
+		delete(thumbnailCache.entries, oldest.Value.(*cachedThumbnail).key)
+	}
+	return entry.thumbnail, nil
+}
+
+// Send the thumbnail of the icon as PNG
+func serveIconThumbnail(w http.ResponseWriter, r *http.Request, uuid string, filename string, size int) {
+	info, err := storage.StatFile(uuid, filename)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s/%s: %v", uuid, filename, err))
+		return
+	}
+
+	etag := fmt.Sprintf("\"%x-%x-%d\"", info.Size, info.ModTime.Unix(), size)
+	if checkNotModified(w, r, etag, info.ModTime) {
+		return
+	}
+
+	thumbnail, err := iconThumbnail(uuid, filename, etag, size)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to resize icon: %v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "image/png")
+	h.Set("Content-Length", strconv.Itoa(len(thumbnail)))
+	w.WriteHeader(Success)
+	if r.Method != "HEAD" {
+		w.Write(thumbnail)
+	}
+}
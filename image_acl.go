@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+/**
+ * Read the list of account UUIDs provided in the body of the
+ * AddImageAcl and RemoveImageAcl requests
+ */
+func readAclBody(reader io.Reader) (accounts []string, code int, message map[string]interface{}) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		code, message = errorResponse(CodeInternalError,
+			fmt.Sprintf("Failed to read body: %v", err))
+		return accounts, code, message
+	}
+
+	err = json.Unmarshal(content, &accounts)
+	if err != nil {
+		code, message = errorResponse(CodeInvalidParameter,
+			fmt.Sprintf("Failed to decode body (expected an array of UUIDs): %v", err))
+		return accounts, code, message
+	}
+
+	for _, account := range accounts {
+		if !isValidUuid(account) {
+			code, message = errorResponse(CodeInvalidParameter,
+				fmt.Sprintf("Invalid account UUID: \"%s\"", account))
+			return accounts, code, message
+		}
+	}
+
+	return accounts, Success, nil
+}
+
+// Get the current acl from the manifest
+func getManifestAcl(m map[string]interface{}) []string {
+	var acl []string
+
+	list, ok := m["acl"].([]interface{})
+	if ok {
+		for _, entry := range list {
+			account, ok := entry.(string)
+			if ok {
+				acl = append(acl, account)
+			}
+		}
+	}
+
+	return acl
+}
+
+func doServerImageAcl(uuid string, params url.Values, reader io.Reader) (int, map[string]interface{}) {
+	var action string
+	for k, v := range params {
+		switch k {
+		case "action":
+			action = v[0]
+			break
+		case "account":
+			fallthrough
+		case "channel":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	if action != "add" && action != "remove" {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid action \"%s\"", action))
+	}
+
+	accounts, code, message := readAclBody(reader)
+	if message != nil {
+		return code, message
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	acl := getManifestAcl(m)
+	if action == "add" {
+		for _, account := range accounts {
+			if !stringInSlice(account, acl) {
+				acl = append(acl, account)
+			}
+		}
+	} else {
+		var remaining []string
+		for _, account := range acl {
+			if !stringInSlice(account, accounts) {
+				remaining = append(remaining, account)
+			}
+		}
+		acl = remaining
+	}
+
+	if len(acl) == 0 {
+		delete(m, "acl")
+	} else {
+		m["acl"] = acl
+	}
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	return Success, m
+}
+
+func serverImageAcl(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerImageAcl(uuid, params, r.Body)
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+/**
+ * An action is the handler for a value of the action parameter in
+ * POST /images/:uuid?action=name (or POST /images?action=name for the
+ * actions creating new images).
+ */
+type ImageAction struct {
+	// The name of the endpoint (as used in the IMGAPI documentation)
+	Endpoint string
+	// Only operators may perform the action
+	OperatorOnly bool
+	// The action creates the image (so the image doesn't need to exist)
+	Creates bool
+	// The action supports dry_run (see isDryRun)
+	DryRun bool
+	// The handler (nil if the action isn't implemented)
+	Handler imagesHandler
+}
+
+// Call the handler without the user
+func withoutUser(handler func(http.ResponseWriter, *http.Request, url.Values, string)) imagesHandler {
+	return func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+		handler(w, r, params, uuid)
+	}
+}
+
+// Call the handler without the uuid
+func withoutUuid(handler func(http.ResponseWriter, *http.Request, url.Values, *UserEntry)) imagesHandler {
+	return func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+		handler(w, r, params, user)
+	}
+}
+
+/*
+The actions on an image
+ActivateImage	POST /images/:uuid?action=activate	Activate the image.
+UpdateImage	POST /images/:uuid?action=update	Update image manifest fields. This is limited. Some fields are immutable.
+DisableImage	POST /images/:uuid?action=disable	Disable the image.
+EnableImage	POST /images/:uuid?action=enable	Enable the image.
+ExportImage	POST /images/:uuid?action=export	Exports an image to the specified Manta path.
+CopyRemoteImage	POST /images/$uuid?action=copy-remote&dc=us-west-1	NYI (IMGAPI-278) Copy one's own image from another DC in the same cloud.
+AdminImportRemoteImage	POST /images/$uuid?action=import-remote&source=$imgapi-url	Import an image from another IMGAPI
+AdminImportImage	POST /images/$uuid?action=import	Only for operators to import an image and maintain uuid and published_at.
+ChannelAddImage	POST /images/:uuid?action=channel-add	Add an existing image to another channel.
+PromoteImage	POST /images/:uuid?action=promote	Promote the image to the next channel (like dev to staging).
+RollbackImage	POST /images/:uuid?action=rollback&rev=$rev	Restore the manifest fields from a previous revision.
+*/
+var imageActions = map[string]ImageAction{
+	"activate":    {Endpoint: "ActivateImage", Handler: withoutUser(serverActivateImage)},
+	"update":      {Endpoint: "UpdateImage", DryRun: true, Handler: withoutUser(serverUpdateImage)},
+	"disable":     {Endpoint: "DisableImage", Handler: withoutUser(serverDisableImage)},
+	"enable":      {Endpoint: "EnableImage", Handler: withoutUser(serverEnableImage)},
+	"export":      {Endpoint: "ExportImage", Handler: withoutUser(serverExportImage)},
+	"channel-add": {Endpoint: "ChannelAddImage", Handler: withoutUser(serverChannelAddImage)},
+	"promote":     {Endpoint: "PromoteImage", Handler: serverPromoteImage},
+	"copy-remote": {Endpoint: "CopyRemoteImage"},
+	"rollback": {Endpoint: "RollbackImage", OperatorOnly: true, DryRun: true,
+		Handler: withoutUser(serverRollbackImage)},
+	"import-remote": {Endpoint: "AdminImportRemoteImage", OperatorOnly: true, Creates: true, DryRun: true,
+		Handler: withoutUser(serverImportRemoteImage)},
+	"import": {Endpoint: "AdminImportImage", OperatorOnly: true, Creates: true, DryRun: true,
+		Handler: withoutUser(serverImportImage)},
+}
+
+/*
+The actions creating new images
+CreateImageFromVm	POST /images?action=create-from-vm	Create a new (activated) image from an existing VM.
+AdminImportDockerImage	POST /images?action=import-docker&repo=$repo&tag=$tag	Import an image from a Docker registry.
+ImportOvaImage	POST /images?action=import-ova	Create a new (activated) image from an OVA.
+ImportImageBundle	POST /images?action=import-bundle	Import the images in a bundle (see ExportImageBundle).
+*/
+var createImageActions = map[string]ImageAction{
+	"create-from-vm": {Endpoint: "CreateImageFromVm", Handler: withoutUuid(serverCreateImageFromVm)},
+	"import-ova":     {Endpoint: "ImportOvaImage", Handler: withoutUuid(serverImportOva)},
+	"import-docker": {Endpoint: "AdminImportDockerImage", OperatorOnly: true,
+		Handler: func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+			serverImportDockerImage(w, r, params)
+		}},
+	"import-bundle": {Endpoint: "ImportImageBundle", OperatorOnly: true,
+		Handler: func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+			serverImportBundle(w, r, params)
+		}},
+}
+
+// Register a new action on the images (replacing the action with the same name)
+func RegisterImageAction(name string, action ImageAction) {
+	imageActions[name] = action
+}
+
+// Register a new action for POST /images (replacing the action with the same name)
+func RegisterCreateImageAction(name string, action ImageAction) {
+	createImageActions[name] = action
+}
+
+/**
+ * Call the handler for the action in the registry. Unknown actions
+ * fails with InvalidParameter while the actions which isn't
+ * implemented fails with InsufficientServerVersion.
+ *
+ * @param checkImage called to verify the image unless the action creates it
+ */
+func dispatchImageAction(actions map[string]ImageAction, name string,
+	checkImage func() (int, map[string]interface{}),
+	w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	action, ok := actions[name]
+	if ok && action.OperatorOnly {
+		code, content := requireOperator(user)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+	}
+
+	if checkImage != nil && !action.Creates {
+		code, content := checkImage()
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+	}
+
+	if !ok {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid action \"%s\"", name))
+		return
+	}
+	if isDryRun(r) && !action.DryRun {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("action=\"%s\" does not support dry_run", name))
+		return
+	}
+	if action.Handler == nil {
+		sendError(w, CodeInsufficientServerVersion, fmt.Sprintf("action=\"%s\" is not implemented", name))
+		return
+	}
+	action.Handler(w, r, params, user, uuid)
+}
+
+// Handle the actions on an image (POST /images/:uuid)
+func serverImageAction(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	checkImage := func() (int, map[string]interface{}) {
+		return checkImageModifiable(uuid, params, user)
+	}
+
+	action, ok := params["action"]
+	if !ok {
+		code, content := checkImage()
+		if content == nil {
+			code, content = errorResponse(CodeInvalidParameter, "action parameter not specified")
+		}
+		sendResponse(w, code, content)
+		return
+	}
+	dispatchImageAction(imageActions, action[0], checkImage, w, r, params, user, uuid)
+}
+
+/*
+Handle the POST requests to /images
+CreateImage	POST /images	Create a new (unactivated) image from a manifest.
+*/
+func serverImagesAction(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	action, ok := params["action"]
+	if !ok {
+		serverCreateImage(w, r, params, user)
+		return
+	}
+	dispatchImageAction(createImageActions, action[0], nil, w, r, params, user, uuid)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// The maximum size of an icon unless max_icon_size is set
+const defaultMaxIconSize = 128 * 1024
+
+// The icon formats the server accepts (and the name of the icon file)
+var iconTypes = []struct {
+	contentType string
+	filename    string
+}{
+	{"image/png", "icon.png"},
+	{"image/jpeg", "icon.jpg"},
+	{"image/gif", "icon.gif"},
+}
+
+func maxIconSize() int64 {
+	if size := currentConfiguration().MaxIconSize; size > 0 {
+		return size
+	}
+	return defaultMaxIconSize
+}
+
+// Get the name and content type of the icon for the image ("" if none)
+func getIconFile(uuid string) (filename string, content_type string) {
+	for _, t := range iconTypes {
+		_, err := storage.StatFile(uuid, t.filename)
+		if err == nil {
+			return t.filename, t.contentType
+		}
+	}
+	return "", ""
+}
+
+/**
+ * Read the icon and verify that it is a PNG, GIF or JPEG image (as
+ * detected from the content) within the size limit.
+ *
+ * @param content_type the Content-Type provided by the client (may be
+ *                     empty if the type should be detected)
+ * @param reader where to read the icon from
+ * @return icon the content of the icon
+ *         filename the name to store the icon as
+ *         code, message the error to return to the client
+ */
+func readIcon(content_type string, reader io.Reader) (icon []byte, filename string, code int, message map[string]interface{}) {
+	if content_type == "image/jpg" {
+		content_type = "image/jpeg"
+	}
+
+	limit := maxIconSize()
+	icon, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		code, message = errorResponse(CodeInternalError,
+			fmt.Sprintf("Failed to read icon: %v", err))
+		return nil, "", code, message
+	}
+	if int64(len(icon)) > limit {
+		code, message = errorResponse(CodeInvalidParameter,
+			fmt.Sprintf("The icon exceeds the maximum size of %d bytes", limit))
+		return nil, "", code, message
+	}
+
+	detected := http.DetectContentType(icon)
+	for _, t := range iconTypes {
+		if t.contentType != detected {
+			continue
+		}
+		if len(content_type) > 0 && content_type != detected {
+			code, message = errorResponse(CodeInvalidParameter,
+				fmt.Sprintf("The icon is %s (not %s)", detected, content_type))
+			return nil, "", code, message
+		}
+		return icon, t.filename, Success, nil
+	}
+
+	code, message = errorResponse(CodeInvalidParameter,
+		fmt.Sprintf("The icon must be a PNG, GIF or JPEG image (not %s)", detected))
+	return nil, "", code, message
+}
+
+// Store the icon and remove the icons of the other types
+func storeIcon(uuid string, filename string, icon []byte) error {
+	_, err := storage.PutFile(uuid, filename, bytes.NewReader(icon))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range iconTypes {
+		if t.filename != filename {
+			storage.DeleteFile(uuid, t.filename)
+		}
+	}
+	return nil
+}
+
+// Get the SHA1 of the icon
+func iconSha1(icon []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(icon))
+}
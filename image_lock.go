@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+)
+
+/**
+ * The requests modifying an image (update, activate, upload, delete
+ * etc) read the manifest, modify it and store it again. To avoid
+ * losing updates the modifications of an image is serialized by
+ * holding the lock for the uuid while the request is handled. Requests
+ * for other images don't block each other.
+ */
+type imageLock struct {
+	sync.Mutex
+	refs int
+}
+
+var imageLocks = struct {
+	sync.Mutex
+	locks map[string]*imageLock
+}{locks: make(map[string]*imageLock)}
+
+/**
+ * Lock the image
+ *
+ * @param uuid the image to lock
+ * @return the function to call to release the lock
+ */
+func lockImage(uuid string) func() {
+	imageLocks.Lock()
+	lock, ok := imageLocks.locks[uuid]
+	if !ok {
+		lock = &imageLock{}
+		imageLocks.locks[uuid] = lock
+	}
+	lock.refs++
+	imageLocks.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		imageLocks.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(imageLocks.locks, uuid)
+		}
+		imageLocks.Unlock()
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// The longest origin chain followed (to stop on loops in imported manifests)
+const maxOriginDepth = 100
+
+/**
+ * Verify that the origin of the new image (if any) is an existing
+ * image. New images must have an active origin the user may use, while
+ * imported images only need the origin to exist since it may still be
+ * activated.
+ */
+func validateOrigin(m map[string]interface{}, user *UserEntry, imported bool) (int, map[string]interface{}) {
+	origin, ok := m["origin"].(string)
+	if !ok {
+		return Success, nil
+	}
+
+	om, found := index.get(origin)
+	if !found || (!imported && !imageAccessible(om, user)) {
+		return errorResponse(CodeOriginDoesNotExist, fmt.Sprintf("The origin image %s does not exist", origin))
+	}
+	if !imported && getImageState(om) != StateActive {
+		return errorResponse(CodeOriginDoesNotExist, fmt.Sprintf("The origin image %s is not active", origin))
+	}
+	return Success, nil
+}
+
+// Get the images with the image as their origin (ordered by uuid)
+func dependentImages(uuid string) []indexEntry {
+	var dependents []indexEntry
+	for _, entry := range index.list() {
+		if entry.manifest["origin"] == uuid {
+			dependents = append(dependents, entry)
+		}
+	}
+	return dependents
+}
+
+/**
+ * Get all of the images depending on the image (directly or through
+ * other images), with the images furthest away from the image first so
+ * that they may be deleted in order.
+ */
+func allDependentImages(uuid string) []indexEntry {
+	var all []indexEntry
+	seen := map[string]bool{uuid: true}
+	queue := []string{uuid}
+	for len(queue) > 0 {
+		for _, entry := range dependentImages(queue[0]) {
+			if !seen[entry.uuid] {
+				seen[entry.uuid] = true
+				all = append(all, entry)
+				queue = append(queue, entry.uuid)
+			}
+		}
+		queue = queue[1:]
+	}
+
+	for i, j := 0, len(all)-1; i < j; i, j = i+1, j-1 {
+		all[i], all[j] = all[j], all[i]
+	}
+	return all
+}
+
+/**
+ * Check if the image may be deleted. Images other images depend on may
+ * only be deleted with force, which also deletes the dependent images
+ * (they must have the same owner as the image).
+ *
+ * @return the dependent images to delete first (or the error)
+ */
+func checkDependentImages(uuid string, force bool) ([]indexEntry, int, map[string]interface{}) {
+	dependents := allDependentImages(uuid)
+	if len(dependents) == 0 {
+		return nil, Success, nil
+	}
+
+	var uuids []string
+	for _, entry := range dependents {
+		uuids = append(uuids, entry.uuid)
+	}
+	sort.Strings(uuids)
+
+	if !force {
+		code, content := errorResponse(CodeImageHasDependentImages,
+			fmt.Sprintf("Image %s has dependent images (use force=true to delete them as well)", uuid))
+		content["images"] = uuids
+		return nil, code, content
+	}
+
+	m, _ := index.get(uuid)
+	for _, entry := range dependents {
+		if entry.manifest["owner"] != m["owner"] {
+			code, content := errorResponse(CodeImageHasDependentImages,
+				fmt.Sprintf("Image %s depends on %s and is owned by another account", entry.uuid, uuid))
+			content["images"] = uuids
+			return nil, code, content
+		}
+	}
+	return dependents, Success, nil
+}
+
+/**
+ * Get the origin chain of the image: the image itself followed by its
+ * origin, the origin of the origin and so on.
+ */
+func imageAncestry(uuid string) ([]map[string]interface{}, error) {
+	var ancestry []map[string]interface{}
+	seen := map[string]bool{}
+	for len(uuid) > 0 {
+		if seen[uuid] || len(ancestry) == maxOriginDepth {
+			return nil, fmt.Errorf("The origin chain of the image contains a loop")
+		}
+		seen[uuid] = true
+
+		m, err := storage.GetManifest(uuid)
+		if err == ErrImageNotFound && len(ancestry) > 0 {
+			return nil, fmt.Errorf("The origin image %s does not exist", uuid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ancestry = append(ancestry, m)
+		uuid, _ = m["origin"].(string)
+	}
+	return ancestry, nil
+}
+
+/*
+GetImageAncestry	GET /images/:uuid/ancestry	Get the origin chain of the image (the image first).
+*/
+func serverGetImageAncestry(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	for k := range params {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		return
+	}
+
+	ancestry, err := imageAncestry(uuid)
+	var content []byte
+	if err == nil {
+		content, err = json.MarshalIndent(ancestry, "", "  ")
+	}
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to get the ancestry: %v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(content)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+)
+
+/**
+ * The states of an image:
+ *
+ *     unactivated --activate--> active --disable--> disabled
+ *                                  ^                   |
+ *                                  +------enable-------+
+ *
+ * The image file may only be uploaded while the image is unactivated,
+ * and an image can't be activated before the file is uploaded. A
+ * disabled image has the state "disabled" and "disabled" set to true.
+ */
+const (
+	StateUnactivated = "unactivated"
+	StateActive      = "active"
+	StateDisabled    = "disabled"
+)
+
+// The fields which can't be changed after the image is activated
+var activatedImmutableFields = []string{"name", "version", "type", "os", "image_size"}
+
+// Get the state of the image
+func getImageState(m map[string]interface{}) string {
+	if m["disabled"] == true {
+		return StateDisabled
+	}
+	state, _ := m["state"].(string)
+	if state == "activated" {
+		// Older versions of the server used "activated" when enabling
+		return StateActive
+	}
+	return state
+}
+
+// Check if the image file may be replaced
+func imageFileMutable(m map[string]interface{}) bool {
+	return getImageState(m) == StateUnactivated
+}
+
+/**
+ * Move the image to the next state for the action (activate, disable
+ * or enable). The manifest is updated, but not stored.
+ *
+ * @param uuid the image
+ * @param m the manifest of the image
+ * @param action the action to perform
+ * @return the error to return to the client if the action is illegal
+ *         in the current state
+ */
+func changeImageState(uuid string, m map[string]interface{}, action string) (int, map[string]interface{}) {
+	state := getImageState(m)
+
+	switch action {
+	case "activate":
+		if state != StateUnactivated {
+			return errorResponse(CodeImageAlreadyActivated, fmt.Sprintf("Image is %s", state))
+		}
+
+		// Verify that I have the image file
+		if _, exists := getImageFile(uuid); !exists {
+			return errorResponse(CodeNoActivationNoFile, "The image file must be uploaded before the image is activated")
+		}
+		code, content := checkActivationSignature(uuid, m)
+		if content != nil {
+			return code, content
+		}
+		code, content = checkActivationScan(m)
+		if content != nil {
+			return code, content
+		}
+		m["state"] = StateActive
+		m["disabled"] = false
+
+	case "disable":
+		if state != StateActive && state != StateDisabled {
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("Can't disable an image which is %s", state))
+		}
+		m["state"] = StateDisabled
+		m["disabled"] = true
+
+	case "enable":
+		if state == StateActive {
+			return errorResponse(CodeImageAlreadyActivated, "Image already activated")
+		}
+		if state != StateDisabled {
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("Can't enable an image which is %s", state))
+		}
+		m["state"] = StateActive
+		m["disabled"] = false
+	}
+
+	return Success, nil
+}
@@ -1,61 +1,114 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
+	"time"
 )
 
 /**
- * I can't use http.ServeFile due to https://github.com/golang/go/issues/13892
- *
- * As a workaround I'm going to spool the entire file into memory and then
- * write it back.. This won't fly on a popular server, but ehh right now
- * I'm only serving myself ;-)
+ * Send the file of the image to the client. I can't use http.ServeFile
+ * due to https://github.com/golang/go/issues/13892 (and the file may
+ * live in s3), so the conditional requests and ranges is handled here
+ * and the file is streamed from storage.GetFile with copyToClient
+ * (which use sendfile for the local files) instead of being read into
+ * memory.
  */
-func serveFile(w http.ResponseWriter, r *http.Request, path string, content_type string) {
-	content, err := ioutil.ReadFile(path)
+func serveFile(w http.ResponseWriter, r *http.Request, uuid string, name string, content_type string, etag string) {
+	path := uuid + "/" + name
+	info, err := storage.StatFile(uuid, name)
 	if err != nil {
-		sendResponse(w, InternalError,
-			map[string]interface{}{
-				"code":    "InternalError",
-				"message": fmt.Sprintf("Failed to read file %s: %v", path, err),
-			})
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s: %v", path, err))
 		return
 	}
 
+	if len(etag) == 0 {
+		etag = fileEtag(info)
+	}
+	if checkNotModified(w, r, etag, info.ModTime) {
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(r.Header.Get("Range")) > 0 && rangeApplies(r, etag, info.ModTime) {
+		serveFileRange(w, r, uuid, name, content_type, info)
+		return
+	}
+
+	// HEAD only needs the headers so the file isn't read
+	if r.Method == "HEAD" {
+		h := w.Header()
+		h.Set("Server", "Norbye Public Images Repo")
+		h.Set("Content-Type", content_type)
+		h.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		w.WriteHeader(Success)
+		return
+	}
+
+	// Stream the file so that io.Copy may use sendfile for local files
+	reader, err := storage.GetFile(uuid, name)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to read file %s: %v", path, err))
+		return
+	}
+	defer reader.Close()
+	timingMark(w, "storage")
+
 	h := w.Header()
 	h.Set("Server", "Norbye Public Images Repo")
 	h.Set("Content-Type", content_type)
-	contentLength := len(content)
-	h.Set("Content-Length", strconv.Itoa(contentLength))
-	nw, err := w.Write(content)
+	h.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(Success)
+	nw, err := copyToClient(w, r, reader, info.Size)
 	if err != nil {
 		log.Printf("Failed to send %s: %v", path, err)
 	}
-	if nw != contentLength {
-		log.Printf("Size of sent payload (%d) does not match expected (%d) fo %s", nw, contentLength, path)
+	if nw != info.Size {
+		log.Printf("Size of sent payload (%d) does not match expected (%d) fo %s", nw, info.Size, path)
 	}
 }
 
-func sendResponse(w http.ResponseWriter, code int, content map[string]interface{}) {
-	h := w.Header()
-	h.Set("Server", "Norbye Public Images Repo")
+/**
+ * Copy the reader to the response writer wrapped by one of the
+ * middlewares. The http.ResponseWriter implements io.ReaderFrom so
+ * that files is sent with sendfile, which is lost unless the wrappers
+ * pass it on.
+ */
+func readFrom(w http.ResponseWriter, reader io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(reader)
+	}
+	return io.Copy(w, reader)
+}
 
+func sendResponse(w http.ResponseWriter, code int, content map[string]interface{}) {
 	if content == nil {
+		w.Header().Set("Server", "Norbye Public Images Repo")
 		w.WriteHeader(code)
 		return
 	}
 
-	h.Set("Content-Type", "application/json; charset=utf-8")
+	// Let the client refer to the failed request in bug reports
+	if _, ok := content["code"]; ok && code >= 400 {
+		if id := w.Header().Get(requestIdHeader); len(id) > 0 {
+			content["request_id"] = id
+		}
+	}
+	a, code := encodeResponse(content, code)
+	writeResponse(w, code, a)
+}
 
+// Convert the response to JSON (the code is InternalError if it fails)
+func encodeResponse(content map[string]interface{}, code int) ([]byte, int) {
 	a, err := json.MarshalIndent(content, "", "  ")
 	if err != nil {
 		log.Printf("Failed to convert response to JSON: %v",
@@ -66,375 +119,467 @@ func sendResponse(w http.ResponseWriter, code int, content map[string]interface{
 		}, "", "")
 		code = InternalError
 	}
+	return a, code
+}
 
+func writeResponse(w http.ResponseWriter, code int, a []byte) {
+	timingMark(w, "serialize")
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(a)))
 	w.WriteHeader(code)
 	w.Write(a)
 }
 
-/**
- * Split up the /images/:uuid/file URL
- */
-func splitImagesUrl(url string) (uuid string, file string, err error) {
-	if strings.Index(url, "/images/") != 0 {
-		return uuid, file, errors.New("Invalid url")
-	}
-
-	// pick out the uuid
-	uuid = url[8:] // everything after "/images/"
-	if len(uuid) == 0 {
-		return uuid, file, errors.New("Invalid url")
-	}
-
-	index := strings.Index(uuid, "/")
-	file = ""
-	if index != -1 {
-		file = uuid[index:]
-		uuid = uuid[0:index]
-	}
-
-	return uuid, file, nil
-}
-
 /*
 Name	Endpoint	Notes
 ListImages	GET /images	List available images.
 GetImage	GET /images/:uuid	Get a particular image manifest.
 GetImageFile	GET /images/:uuid/file	Get the file for this image.
+GetImageFile	GET /images/:uuid/file/:index	Get another file for this image.
 GetImageIcon	GET /images/:uuid/icon	Get the image icon file.
+HEAD	HEAD /images, /images/:uuid, /images/:uuid/file[/:index] and /images/:uuid/icon	The headers of the GET request without the body.
+AddImageFile	PUT /images/:uuid/file?index=N	Upload the image file (or another file).
+AddImageFile	PUT /images/:uuid/file?delta=UUID	Upload the image file as a delta against the file of another image.
+GetImageFileBlocks	GET /images/:uuid/blocks?index=N	Get the block checksums of the image file (for delta uploads).
+AddImageIcon	POST /images/:uuid/icon	Add the image icon.
+AddImageAcl	POST /images/:uuid/acl?action=add	Add account UUIDs to the image ACL.
+RemoveImageAcl	POST /images/:uuid/acl?action=remove	Remove account UUIDs from the image ACL.
+DeleteImage	DELETE /images/:uuid	Delete an image (and its file).
+DeleteImageIcon	DELETE /images/:uuid/icon	Remove the image icon.
+GetImageSignature	GET /images/:uuid/signature	Get the signature of the image.
+AddImageSignature	PUT /images/:uuid/signature	Add the signature of the image.
+DeleteImageSignature	DELETE /images/:uuid/signature	Remove the signature of the image.
+ListImageAttachments	GET /images/:uuid/attachments	Get the attachments of the image.
+GetImageAttachment	GET /images/:uuid/attachments/:name	Get an attachment of the image.
+PutImageAttachment	PUT /images/:uuid/attachments/:name	Add (or replace) an attachment of the image.
+DeleteImageAttachment	DELETE /images/:uuid/attachments/:name	Remove an attachment from the image.
 */
 
-// Handle all GET request made to /images
-func doHandleGetImages(w http.ResponseWriter, r *http.Request, params url.Values) {
-	if r.URL.Path == "/images" {
-		serverListImages(configuration.Datadir, w, r)
-		return
+// The handlers for the requests to "/images*"
+type imagesHandler func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string)
+
+/**
+ * Authenticate the request and parse the query before calling the
+ * handler.
+ *
+ * All operations that modify data _DO_ requre that the user
+ * provides a username and password, and that the user isn't
+ * read-only (see roles.go). The modifications of an image are
+ * serialized.
+ *
+ * @param modify true if the handler modifies data
+ * @param handler the handler to call
+ */
+func imagesRoute(modify bool, handler imagesHandler) routeHandler {
+	return newImagesRoute(modify, false, handler)
+}
+
+// The route for a handler modifying data which supports dry_run (see isDryRun)
+func dryRunImagesRoute(handler imagesHandler) routeHandler {
+	return newImagesRoute(true, true, handler)
+}
+
+// The handlers which only need to know the user (nil if anonymous)
+type userHandler func(w http.ResponseWriter, r *http.Request, user *UserEntry)
+
+// Authenticate the request before calling the handler
+func userRoute(handler userHandler) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, vars routeVars) {
+		user, code, content := authenticateRequest(r)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+		timingMark(w, "auth")
+		handler(w, r, user)
 	}
+}
 
-	uuid, file, err := splitImagesUrl(r.URL.Path)
-	if err != nil {
-		sendResponse(w, InvalidParameter,
-			map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("%v", err),
-			})
-		return
+func newImagesRoute(modify bool, dryRun bool, handler imagesHandler) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, vars routeVars) {
+		user, code, content := authenticateRequest(r)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+		timingMark(w, "auth")
+
+		parameters, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			sendError(w, CodeInternalError, "Failed to parse query")
+			return
+		}
+
+		if account, ok := vars["account"]; ok {
+			user, code, content = accountScopedUser(user, account)
+			if content != nil {
+				sendResponse(w, code, content)
+				return
+			}
+		}
+
+		// The other variables in the path is passed on as parameters
+		for k, v := range vars {
+			if k != "uuid" && k != "account" {
+				parameters.Set(k, v)
+			}
+		}
+
+		r, code, content = dryRunRequest(w, r, parameters, dryRun)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+
+		uuid := vars["uuid"]
+		if modify {
+			if user == nil {
+				w.WriteHeader(UnauthorizedError)
+				return
+			}
+
+			code, content = checkWriteAccess(user)
+			if content != nil {
+				sendResponse(w, code, content)
+				return
+			}
+
+			if len(uuid) > 0 {
+				defer lockImage(uuid)()
+			}
+		}
+
+		handler(w, r, parameters, user, uuid)
 	}
+}
 
-	// check if the resource exists
-	filename := configuration.Datadir + "/" + uuid
-	_, err = os.Stat(filename)
+// Check that the image exists in the storage
+func checkImageExists(uuid string) (int, map[string]interface{}) {
+	exists, err := storage.Exists(uuid)
 	if err != nil {
-		sendResponse(w, ResourceNotFound,
-			map[string]interface{}{
-				"code":    "ResourceNotFound",
-				"message": fmt.Sprintf("Failed to locate %s: %v", filename, err),
-			})
-		return
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to locate %s: %v", uuid, err))
 	}
-
-	// Ok, everything should be OK.. go do it!
-	if len(file) == 0 {
-		serverGetImage(w, r, params, filename)
-		return
+	if !exists {
+		return errorResponse(CodeResourceNotFound, fmt.Sprintf("Failed to locate %s", uuid))
 	}
+	return Success, nil
+}
 
-	if file == "/icon" {
-		serverGetImageIcon(w, r, params, filename)
-		return
+/**
+ * Check that the image exists and that the user may read it. Private
+ * images is only available to the owner and the acl (and operators).
+ */
+func checkImageReadable(uuid string, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	code, content := checkImageExists(uuid)
+	if content == nil {
+		code, content = checkImageChannel(uuid, params, user != nil)
 	}
-
-	if file == "/file" {
-		serverGetImageFile(w, r, params, filename)
-		return
+	if content != nil {
+		return code, content
 	}
 
-	sendResponse(w, ResourceNotFound,
-		map[string]interface{}{
-			"code":    "ResourceNotFound",
-			"message": "Requested resource does not exist",
-		})
+	m, err := storage.GetManifest(uuid)
+	if err != nil || !imageAccessible(m, user) {
+		return errorResponse(CodeResourceNotFound, fmt.Sprintf("Failed to locate %s", uuid))
+	}
+	return Success, nil
 }
 
-/*
-Handle all DELETE request made to /images
-DeleteImage	DELETE /images/:uuid	Delete an image (and its file).
-DeleteImageIcon	DELETE /images/:uuid/icon	Remove the image icon.
-*/
-func doHandleDeleteImages(w http.ResponseWriter, r *http.Request, params url.Values) {
-	uuid, file, err := splitImagesUrl(r.URL.Path)
-	if err != nil {
-		sendResponse(w, InvalidParameter,
-			map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": "Failed to decode URL",
-			})
-		return
+// Check that the image exists and that the user may modify it
+func checkImageModifiable(uuid string, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	code, content := checkImageExists(uuid)
+	if content == nil {
+		code, content = checkImageChannel(uuid, params, true)
 	}
+	if content == nil {
+		code, content = checkImageOwner(uuid, user)
+	}
+	return code, content
+}
 
-	path := configuration.Datadir + "/" + uuid
-	if len(file) > 0 {
-		if file == "/icon" {
-			serverDeleteImageIcon(w, r, params, path)
-		} else {
-			sendResponse(w, ResourceNotFound,
-				map[string]interface{}{
-					"code":    "ResourceNotFound",
-					"message": "Resource does not exists",
-				})
+// Call the handler if the user may read the image
+func readImage(handler func(http.ResponseWriter, *http.Request, url.Values, string)) imagesHandler {
+	return func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+		code, content := checkImageReadable(uuid, params, user)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
 		}
-	} else {
-		serverDeleteImage(w, r, params, path)
+		handler(w, r, params, uuid)
 	}
 }
 
-// Handle all POST request made to /images
-/*
-CreateImage	POST /images	Create a new (unactivated) image from a manifest.
-
-ActivateImage	POST /images/:uuid?action=activate	Activate the image.
-UpdateImage	POST /images/:uuid?action=update	Update image manifest fields. This is limited. Some fields are immutable.
-DisableImage	POST /images/:uuid?action=disable	Disable the image.
-EnableImage	POST /images/:uuid?action=enable	Enable the image.
-ExportImage	POST /images/:uuid?action=export	Exports an image to the specified Manta path.
-CopyRemoteImage	POST /images/$uuid?action=copy-remote&dc=us-west-1	NYI (IMGAPI-278) Copy one's own image from another DC in the same cloud.
-AdminImportRemoteImage	POST /images/$uuid?action=import-remote&source=$imgapi-url	Import an image from another IMGAPI
-AdminImportImage	POST /images/$uuid?action=import	Only for operators to import an image and maintain uuid and published_at.
-ChannelAddImage	POST /images/:uuid?action=channel-add	Add an existing image to another channel.
-
-
-
-AddImageAcl	POST /images/:uuid/acl?action=add	Add account UUIDs to the image ACL.
-RemoveImageAcl	POST /images/:uuid/acl?action=remove	Remove account UUIDs from the image ACL.
+// Call the handler if the user may modify the image
+func modifyImage(handler func(http.ResponseWriter, *http.Request, url.Values, string)) imagesHandler {
+	return func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+		code, content := checkImageModifiable(uuid, params, user)
+		if content != nil {
+			sendResponse(w, code, content)
+			return
+		}
+		handler(w, r, params, uuid)
+	}
+}
 
-AddImageIcon	POST /images/:uuid/icon	Add the image icon.
+/**
+ * Add the routes for the images below the prefix ("" for /images and
+ * "/:account" for the account scoped /:account/images)
+ */
+func addImageRoutes(rt *router, prefix string) {
+	listImages := imagesRoute(false, func(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+		serverListImages(w, r, user)
+	})
+	rt.handle("ListImages", "GET", prefix+"/images", listImages)
+	rt.handle("ListImages", "HEAD", prefix+"/images", listImages)
+	rt.handle("CreateImage", "POST", prefix+"/images",
+		dryRunImagesRoute(serverImagesAction))
+	rt.handle("BatchImages", "POST", prefix+"/images/batch", dryRunImagesRoute(serverBatchImages))
+	rt.handle("SearchImages", "GET", prefix+"/images/search", imagesRoute(false, serverSearchImages))
+	rt.handle("GetImage", "GET", prefix+"/images/:uuid", imagesRoute(false, readImage(serverGetImage)))
+	rt.handle("GetImage", "HEAD", prefix+"/images/:uuid", imagesRoute(false, readImage(serverGetImage)))
+	rt.handle("ImageAction", "POST", prefix+"/images/:uuid", dryRunImagesRoute(serverImageAction))
+	rt.handle("DeleteImage", "DELETE", prefix+"/images/:uuid", dryRunImagesRoute(modifyImage(serverDeleteImage)))
+	rt.handle("GetImageFile", "GET", prefix+"/images/:uuid/file", imagesRoute(false, readImage(serverGetImageFile)))
+	rt.handle("GetImageFile", "HEAD", prefix+"/images/:uuid/file", imagesRoute(false, readImage(serverGetImageFile)))
+	rt.handle("AddImageFile", "PUT", prefix+"/images/:uuid/file", imagesRoute(true, modifyImage(serverAddImageFile)))
+	rt.handle("GetImageFile", "GET", prefix+"/images/:uuid/file/:index", imagesRoute(false, readImage(serverGetImageFile)))
+	rt.handle("GetImageFile", "HEAD", prefix+"/images/:uuid/file/:index", imagesRoute(false, readImage(serverGetImageFile)))
+	rt.handle("GetImageFileBlocks", "GET", prefix+"/images/:uuid/blocks", imagesRoute(false, readImage(serverGetImageFileBlocks)))
+	rt.handle("GetImageIcon", "GET", prefix+"/images/:uuid/icon", imagesRoute(false, readImage(serverGetImageIcon)))
+	rt.handle("GetImageIcon", "HEAD", prefix+"/images/:uuid/icon", imagesRoute(false, readImage(serverGetImageIcon)))
+	rt.handle("AddImageIcon", "POST", prefix+"/images/:uuid/icon", imagesRoute(true, modifyImage(serverAddImageIcon)))
+	rt.handle("DeleteImageIcon", "DELETE", prefix+"/images/:uuid/icon", imagesRoute(true, modifyImage(serverDeleteImageIcon)))
+	rt.handle("ImageAcl", "POST", prefix+"/images/:uuid/acl", imagesRoute(true, modifyImage(serverImageAcl)))
+	rt.handle("ListImageTags", "GET", prefix+"/images/:uuid/tags", imagesRoute(false, readImage(serverListImageTags)))
+	rt.handle("GetImageTag", "GET", prefix+"/images/:uuid/tags/:key", imagesRoute(false, readImage(serverGetImageTag)))
+	rt.handle("PutImageTag", "PUT", prefix+"/images/:uuid/tags/:key", imagesRoute(true, modifyImage(serverPutImageTag)))
+	rt.handle("DeleteImageTag", "DELETE", prefix+"/images/:uuid/tags/:key", imagesRoute(true, modifyImage(serverDeleteImageTag)))
+	rt.handle("GetImageAncestry", "GET", prefix+"/images/:uuid/ancestry", imagesRoute(false, readImage(serverGetImageAncestry)))
+	rt.handle("GetImageHistory", "GET", prefix+"/images/:uuid/history", imagesRoute(false, readImage(serverGetImageHistory)))
+	rt.handle("GetImageRevision", "GET", prefix+"/images/:uuid/history/:rev", imagesRoute(false, readImage(serverGetImageRevision)))
+	rt.handle("ExportImageBundle", "GET", prefix+"/images/:uuid/bundle", imagesRoute(false, readImage(serverExportImageBundle)))
+	rt.handle("GetImageSignature", "GET", prefix+"/images/:uuid/signature", imagesRoute(false, readImage(serverGetImageSignature)))
+	rt.handle("AddImageSignature", "PUT", prefix+"/images/:uuid/signature", imagesRoute(true, modifyImage(serverAddImageSignature)))
+	rt.handle("DeleteImageSignature", "DELETE", prefix+"/images/:uuid/signature", imagesRoute(true, modifyImage(serverDeleteImageSignature)))
+	rt.handle("GetImageSigningPayload", "GET", prefix+"/images/:uuid/signature/payload", imagesRoute(false, readImage(serverGetImageSigningPayload)))
+	rt.handle("ListImageAttachments", "GET", prefix+"/images/:uuid/attachments", imagesRoute(false, readImage(serverListImageAttachments)))
+	rt.handle("GetImageAttachment", "GET", prefix+"/images/:uuid/attachments/:name", imagesRoute(false, readImage(serverGetImageAttachment)))
+	rt.handle("GetImageAttachment", "HEAD", prefix+"/images/:uuid/attachments/:name", imagesRoute(false, readImage(serverGetImageAttachment)))
+	rt.handle("PutImageAttachment", "PUT", prefix+"/images/:uuid/attachments/:name", imagesRoute(true, modifyImage(serverPutImageAttachment)))
+	rt.handle("DeleteImageAttachment", "DELETE", prefix+"/images/:uuid/attachments/:name", imagesRoute(true, modifyImage(serverDeleteImageAttachment)))
+}
 
-CreateImageFromVm	POST /images?action=create-from-vm	Create a new (activated) image from an existing VM.
+// Build the routes for all of the endpoints
+func newImageRouter() *router {
+	rt := newRouter()
+	rt.handle("ImageChanges", "GET", "/images/changes", routeFunc(serverImageChanges))
+	addImageRoutes(rt, "")
+
+	rt.handle("ListChannels", "GET", "/channels", userRoute(serverListChannels))
+	rt.handle("Ping", "GET", "/ping", routeFunc(serverPing))
+	rt.handle("Version", "GET", "/version", routeFunc(serverGetVersion))
+	rt.handle("Health", "GET", "/health", routeFunc(serverHealth))
+	rt.handle("Ready", "GET", "/ready", routeFunc(serverReadiness))
+	rt.handle("CreateToken", "POST", "/tokens", serverCreateToken)
+	rt.handle("DeleteToken", "DELETE", "/tokens/:id", serverDeleteToken)
+	rt.handle("Metrics", "GET", "/metrics", routeFunc(serverMetricsHandler))
+	rt.handle("AdminGetState", "GET", "/state", routeFunc(serverGetState))
+	rt.handle("AdminGetReplication", "GET", "/replication", routeFunc(serverGetReplication))
+	rt.handle("AdminGetAudit", "GET", "/audit", routeFunc(serverGetAudit))
+	rt.handle("GetUsage", "GET", "/usage", routeFunc(serverGetUsage))
+	rt.handle("AdminListTrash", "GET", "/trash", serverListTrash)
+	rt.handle("AdminRestoreImage", "POST", "/trash/:uuid", serverRestoreImage)
+	rt.handle("AdminPurgeImage", "DELETE", "/trash/:uuid", serverPurgeImage)
+	rt.handle("AdminGetMaintenance", "GET", "/maintenance", routeFunc(serverGetMaintenance))
+	rt.handle("AdminEnableMaintenance", "PUT", "/maintenance", routeFunc(serverEnableMaintenance))
+	rt.handle("AdminDisableMaintenance", "DELETE", "/maintenance", routeFunc(serverDisableMaintenance))
+	if configuration.DockerRegistry {
+		for _, method := range []string{"GET", "HEAD"} {
+			rt.handle("DockerRegistry", method, "/v2", serverDockerRegistry)
+			rt.handle("DockerRegistry", method, "/v2/*path", serverDockerRegistry)
+		}
+	}
+	rt.handle("Docs", "GET", "/docs", routeFunc(serverDocs))
+	if configuration.SwaggerUi {
+		rt.handle("DocsUI", "GET", "/docs/ui", routeFunc(serverDocsUi))
+	}
+	if configuration.WebUi {
+		rt.handle("WebUI", "GET", "/ui", routeFunc(serverWebUi))
+	}
+	// Last so that it doesn't shadow the other routes (like /v2/images)
+	addImageRoutes(rt, "/:account")
+	return rt
+}
 
+/*
+AdminGetState	GET /state	Dump internal server state (for dev/debugging)
+ListChannels	GET /channels	List image channels (if the server uses channels).
+Ping	GET /ping	Ping if the server is up.
 */
-func doHandlePostImages(w http.ResponseWriter, r *http.Request, params url.Values) {
-	if "/images" == r.URL.Path {
-		serverCreateImage(w, r, params, configuration.Datadir)
-		return
-	}
 
-	uuid, file, err := splitImagesUrl(r.URL.Path)
-	if err != nil {
-		sendResponse(w, InvalidParameter,
-			map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": "Failed to decode URL",
-			})
-		return
+// The running server (used to shut it down)
+var imageServer *http.Server
+
+// Build the server with the handlers and the timeouts from the configuration
+func newImageServer() *http.Server {
+	imageRouter = newImageRouter()
+	handler := withServerTiming(imageRouter.ServeHTTP)
+
+	return &http.Server{
+		Addr:              listenAddress(configuration),
+		Handler:           withProxyHeaders(withRequestId(withVersionHeaders(withAccessLog(withCors(withAuditLog(withMetrics(withMaintenance(withGzip(withInflightCount(withRequestTimeout(withRateLimit(handler)))))))))))),
+		ReadTimeout:       time.Duration(configuration.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(configuration.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(configuration.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(configuration.IdleTimeout) * time.Second,
 	}
+}
 
-	path := configuration.Datadir + "/" + uuid
-	_, err = os.Stat(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			sendResponse(w, ResourceNotFound,
-				map[string]interface{}{
-					"code":    "ResourceNotFound",
-					"message": "Failed to locate resource",
-				})
-		} else {
-			sendResponse(w, InternalError,
-				map[string]interface{}{
-					"code":    "InternalError",
-					"message": fmt.Sprintf("Failed to locate resource %v", err),
-				})
-		}
-		return
+/**
+ * Stop accepting new connections and wait for the requests in progress
+ * (like uploads) to complete, or until the context expires.
+ */
+func shutdownImageServer(ctx context.Context) error {
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
 	}
+	return imageServer.Shutdown(ctx)
+}
 
-	switch file {
-	case "/icon":
-		serverAddImageIcon(w, r, params, path)
-		return
+/**
+ * Shut down the server gracefully on SIGINT and SIGTERM. The server
+ * reports that it isn't ready (see /ready) for shutdown_delay seconds
+ * before it stops accepting new connections so that the load balancers
+ * may stop sending requests to it.
+ */
+func shutdownOnSignal() <-chan error {
+	done := make(chan error, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		setServerReady(false)
+		if configuration.ShutdownDelay > 0 {
+			log.Printf("Received %v, shutting down in %d seconds", sig, configuration.ShutdownDelay)
+			time.Sleep(time.Duration(configuration.ShutdownDelay) * time.Second)
+		}
+		log.Printf("Shutting down after %v, waiting for requests in progress to complete", sig)
+
+		ctx := context.Background()
+		if configuration.ShutdownTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx,
+				time.Duration(configuration.ShutdownTimeout)*time.Second)
+			defer cancel()
+		}
+		done <- shutdownImageServer(ctx)
+	}()
+	return done
+}
 
-	case "/acl":
-		sendResponse(w, InsufficientServerVersion,
-			map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "acl is not implemented",
-			})
-		break
-
-	case "": // the path just contains the UUID and optional parameters
-		action, ok := params["action"]
-		if ok {
-			switch action[0] {
-			case "activate":
-				serverActivateImage(w, r, params, path)
-				break
-			case "update":
-				serverUpdateImage(w, r, params, path)
-				break
-			case "disable":
-				serverDisableImage(w, r, params, path)
-				break
-			case "enable":
-				serverEnableImage(w, r, params, path)
-				break
-
-			case "export":
-				fallthrough
-			case "copy-remote":
-				fallthrough
-			case "import-remote":
-				fallthrough
-			case "import":
-				fallthrough
-			case "channel-add":
-				// Not implemented yet
-				sendResponse(w, InsufficientServerVersion,
-					map[string]interface{}{
-						"code":    "InsufficientServerVersion",
-						"message": fmt.Sprintf("action=\"%s\" is not implemented", action[0]),
-					})
-				break
-
-			default:
-				sendResponse(w, InvalidParameter,
-					map[string]interface{}{
-						"code":    "InvalidParameter",
-						"message": fmt.Sprintf("Invalid action \"%s\"", action[0]),
-					})
-			}
-		} else {
-			sendResponse(w, InvalidParameter,
-				map[string]interface{}{
-					"code":    "InvalidParameter",
-					"message": "action parameter not specified",
-				})
+// Create the storage backend with the catalog (if configured)
+func openImageStorage(config Configuration) (Storage, error) {
+	s, err := newStorage(config)
+	if err == nil && len(config.Catalog.Type) > 0 {
+		var catalog Catalog
+		catalog, err = openCatalog(config)
+		if err == nil {
+			s, err = newCatalogStorage(s, catalog)
 		}
-		return
-	default:
-		// The request was for an invalid resource
-		sendResponse(w, ResourceNotFound,
-			map[string]interface{}{
-				"code":    "ResourceNotFound",
-				"message": "Invalid URL specified",
-			})
-		return
 	}
+	return s, err
 }
 
-/*
- * Handle all PUT request made to /images
- *  AddImageFile	PUT /images/:uuid/file	Upload the image file.
+/**
+ * Open the storage, load the index and warm the manifest cache (if
+ * enabled) before the server accepts any requests.
  */
-func doHandlePutImages(w http.ResponseWriter, r *http.Request, params url.Values) {
-	uuid, file, err := splitImagesUrl(r.URL.Path)
-	if err != nil || file != "/file" {
-		sendResponse(w, InvalidParameter,
-			map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": "Failed to decode URL",
-			})
-		return
+func initImageStorage() error {
+	var err error
+	storage, err = openImageStorage(configuration)
+	if err == nil {
+		storage, err = newIndexedStorage(storage)
+	}
+	if err == nil {
+		trash, err = newTrashStorage(configuration)
+	}
+	if err != nil {
+		return err
 	}
 
-	path := configuration.Datadir + "/" + uuid
-	serverAddImageFile(w, r, params, path)
+	if configuration.WarmCache {
+		warmManifestCache()
+	}
+	return nil
 }
 
 /**
- * Handle all of the requests to "/images*" and dispatch the
- * request to the correct handler function.
+ * Start the server and serve requests until the server is shut down
+ * (see shutdownOnSignal).
  *
- * All operations that modify data _DO_ requre that the user
- * provides a username and password. (currently all users
- * have access to all commands)
+ * @return the error if the server failed to start (or shut down)
  */
-func doHandleImages(w http.ResponseWriter, r *http.Request) {
-	authenticated := false
-
-	username, password, ok := r.BasicAuth()
-	if ok {
-		found := false
-		for i := 0; i < len(configuration.Userdb); i++ {
-			entry := configuration.Userdb[i]
-			if username != entry.Name {
-				continue
-			}
-
-			found = true
-			if password != entry.Password {
-				log.Printf("Invalid username password combo for %s", username)
-				sendResponse(w, UnauthorizedError,
-					map[string]interface{}{
-						"code":    "UnauthorizedError",
-						"message": "Invalid username/password combination",
-					})
+func startImageServer() error {
+	err := configuration.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
 
-				return
-			}
-		}
+	err = initImageStorage()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize storage: %v", err)
+	}
 
-		if !found {
-			log.Printf("User %s does not exists", username)
-			sendResponse(w, AccountDoesNotExist,
-				map[string]interface{}{
-					"code":    "AccountDoesNotExist",
-					"message": fmt.Sprintf("User %s does not exist", username),
-				})
-			return
-		}
+	err = openAccessLog()
+	if err != nil {
+		return fmt.Errorf("Failed to open access log: %v", err)
+	}
 
-		authenticated = true
+	scanner, err = newScanner(configuration.Scan)
+	if err != nil {
+		return fmt.Errorf("Failed to initialize scanner: %v", err)
 	}
 
-	parameters, err := url.ParseQuery(r.URL.RawQuery)
+	err = openAuditLog()
 	if err != nil {
-		sendResponse(w, InternalError,
-			map[string]interface{}{
-				"code":    "InternalError",
-				"message": "Failed to parse query",
-			})
-		return
+		return fmt.Errorf("Failed to open audit log: %v", err)
 	}
-	if len(r.Method) == 0 || r.Method == "GET" {
-		doHandleGetImages(w, r, parameters)
-	} else if r.Method == "DELETE" {
-		if authenticated {
-			doHandleDeleteImages(w, r, parameters)
-		} else {
-			w.WriteHeader(UnauthorizedError)
-		}
-	} else if r.Method == "POST" {
-		if authenticated {
-			doHandlePostImages(w, r, parameters)
-		} else {
-			w.WriteHeader(UnauthorizedError)
-		}
-	} else if r.Method == "PUT" {
-		if authenticated {
-			doHandlePutImages(w, r, parameters)
-		} else {
-			w.WriteHeader(UnauthorizedError)
-		}
+	err = initAuthProvider()
+	if err != nil {
+		return fmt.Errorf("Failed to initialize authentication provider: %v", err)
 	}
-}
-
-/*
-AdminGetState	GET /state	Dump internal server state (for dev/debugging)
-ListChannels	GET /channels	List image channels (if the server uses channels).
-Ping	GET /ping	Ping if the server is up.
-*/
-
-func startImageServer() {
-	_, err := os.Stat(configuration.Datadir)
-	if err != nil && os.IsNotExist(err) {
-		err = os.MkdirAll(configuration.Datadir, 0777)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to create %s: %v",
-				configuration.Datadir, err))
-		}
+	initRateLimits()
+	reloadOnSignal()
+	toggleMaintenanceOnSignal()
+	watchConfigurationFile()
+
+	startGarbageCollector()
+	defer stopGarbageCollector()
+	startTrashPurger()
+	defer stopTrashPurger()
+	startRetention()
+	defer stopRetention()
+	startReplication()
+	startMirror()
+	startSeed()
+	startWebhooks()
+	startNotifications()
+	startChangeFeed()
+
+	imageServer = newImageServer()
+	done := shutdownOnSignal()
+	setServerReady(true)
+	err = listenAndServe(imageServer)
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("Failed to start server: %v", err)
 	}
 
-	http.HandleFunc("/images", doHandleImages)
-	http.HandleFunc("/images/", doHandleImages)
-	http.HandleFunc("/channels", serverListChannels)
-	http.HandleFunc("/ping", serverPing)
-	http.ListenAndServe(":"+strconv.Itoa(configuration.Port), nil)
+	err = <-done
+	if err != nil {
+		return fmt.Errorf("Failed to shut down server: %v", err)
+	}
+	log.Printf("Server stopped")
+	return nil
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/trondn/imgapi/contrib"
+)
+
+// The registry used by import-docker unless registry is specified
+const defaultDockerRegistry = "https://registry-1.docker.io"
+
+// The timeout for the requests to the registry (not the layer downloads)
+const dockerRegistryTimeout = 30 * time.Second
+
+// The media types of the manifests the server may import
+const (
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociManifestType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType           = "application/vnd.oci.image.index.v1+json"
+)
+
+// The compression of each of the layer media types the server may import
+var dockerLayerCompressions = map[string]string{
+	dockerLayerType:    "gzip",
+	dockerLayerTarType: "none",
+	"application/vnd.oci.image.layer.v1.tar+gzip":               "gzip",
+	"application/vnd.oci.image.layer.v1.tar":                    "none",
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip": "gzip",
+}
+
+var dockerRepoRegexp = regexp.MustCompile("^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$")
+var dockerTagRegexp = regexp.MustCompile("^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$")
+
+/**
+ * A client for the Docker Registry HTTP API v2 supporting the
+ * anonymous token authentication used by Docker Hub (and most other
+ * registries).
+ */
+type dockerRegistryClient struct {
+	registry string
+	repo     string
+	token    string
+	client   *http.Client
+}
+
+// Get an anonymous token as requested in the WWW-Authenticate header
+func (c *dockerRegistryClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("Unsupported authentication \"%s\"", challenge)
+	}
+	params := parseSignatureParameters(strings.TrimPrefix(challenge, "Bearer "))
+	if len(params["realm"]) == 0 {
+		return errors.New("The registry did not provide a token realm")
+	}
+
+	query := url.Values{}
+	if len(params["service"]) > 0 {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+c.repo+":pull")
+	resp, err := c.client.Get(params["realm"] + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("The token request returned %s", resp.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	c.token = result.Token
+	if len(c.token) == 0 {
+		c.token = result.AccessToken
+	}
+	return nil
+}
+
+/**
+ * Perform a GET request to the path below /v2/<repo>/ in the registry
+ *
+ * @param path the resource (like "manifests/latest")
+ * @param accept the media types to accept
+ * @param timeout false for the layer downloads which may take a while
+ * @return the response (the caller must close the body)
+ */
+func (c *dockerRegistryClient) get(path string, accept []string, timeout bool) (*http.Response, error) {
+	client := c.client
+	if !timeout {
+		client = http.DefaultClient
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("GET", c.registry+"/v2/"+c.repo+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		if len(c.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, fmt.Errorf("GET %s returned %s", req.URL, resp.Status)
+		}
+		err = c.authenticate(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Fetch the (small) blob and verify the digest
+func (c *dockerRegistryClient) getBlob(digest string) ([]byte, error) {
+	resp, err := c.get("blobs/"+digest, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize()+1))
+	if err != nil {
+		return nil, err
+	}
+	if sha256Digest(content) != digest {
+		return nil, fmt.Errorf("Incorrect digest for %s", digest)
+	}
+	return content, nil
+}
+
+// The fields of an image manifest or index used by the server
+type dockerRegistryManifest struct {
+	MediaType string             `json:"mediaType"`
+	Config    dockerDescriptor   `json:"config"`
+	Layers    []dockerDescriptor `json:"layers"`
+	Manifests []struct {
+		dockerDescriptor
+		Platform struct {
+			Architecture string `json:"architecture"`
+			Os           string `json:"os"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+/**
+ * Get the image manifest for the reference (a tag or digest). The
+ * manifest for the platform (like "linux/amd64") is selected if the
+ * reference is a manifest list.
+ */
+func (c *dockerRegistryClient) getManifest(reference string, platform string) (*dockerRegistryManifest, error) {
+	accept := []string{dockerManifestType, dockerManifestListType, ociManifestType, ociIndexType}
+	for depth := 0; depth < 2; depth++ {
+		resp, err := c.get("manifests/"+reference, accept, true)
+		if err != nil {
+			return nil, err
+		}
+		var manifest dockerRegistryManifest
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize())).Decode(&manifest)
+		mediaType := resp.Header.Get("Content-Type")
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode the manifest: %v", err)
+		}
+		if len(manifest.MediaType) > 0 {
+			mediaType = manifest.MediaType
+		}
+
+		if mediaType != dockerManifestListType && mediaType != ociIndexType {
+			return &manifest, nil
+		}
+
+		reference = ""
+		for _, m := range manifest.Manifests {
+			p := m.Platform.Os + "/" + m.Platform.Architecture
+			if p == platform || p+"/"+m.Platform.Variant == platform {
+				reference = m.Digest
+				break
+			}
+		}
+		if len(reference) == 0 {
+			return nil, fmt.Errorf("The image is not available for %s", platform)
+		}
+	}
+	return nil, errors.New("Nested manifest lists is not supported")
+}
+
+/**
+ * Download the layer and store it as the file with the index in the
+ * image.
+ *
+ * @return the entry for the files list in the manifest
+ */
+func (c *dockerRegistryClient) fetchLayer(uuid string, index int, layer dockerDescriptor) (map[string]interface{}, error) {
+	compression, ok := dockerLayerCompressions[layer.MediaType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported layer type %s", layer.MediaType)
+	}
+
+	resp, err := c.get("blobs/"+layer.Digest, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	hasher := newFileHasher()
+	size, err := storage.PutFile(uuid, imageFileNameAt(index, compression), io.TeeReader(resp.Body, hasher))
+	if err != nil {
+		return nil, err
+	}
+
+	sums := hasher.digests()
+	if "sha256:"+sums.Sha256 != layer.Digest {
+		return nil, fmt.Errorf("Incorrect digest for layer %s", layer.Digest)
+	}
+	if layer.Size > 0 && size != layer.Size {
+		return nil, fmt.Errorf("Incorrect size for layer %s. expected %d got %d", layer.Digest, layer.Size, size)
+	}
+
+	entry := map[string]interface{}{
+		"compression": compression,
+		"size":        size,
+	}
+	sums.addTo(entry)
+	return entry, nil
+}
+
+func dockerImportError(format string, args ...interface{}) (int, map[string]interface{}) {
+	return errorResponse(CodeRemoteSourceError, fmt.Sprintf(format, args...))
+}
+
+/**
+ * Import an image from a Docker registry. The layers is stored as the
+ * files of the image and the image configuration as docker-config.json,
+ * so that the image may be pulled from the registry gateway (see
+ * docker_registry.go). The image is activated when all of the layers
+ * is downloaded.
+ */
+func doServerImportDockerImage(params url.Values) (int, map[string]interface{}) {
+	registry := defaultDockerRegistry
+	repo := ""
+	tag := "latest"
+	platform := "linux/amd64"
+	public := false
+	for k, v := range params {
+		switch k {
+		case "action":
+			break
+		case "repo":
+			repo = v[0]
+		case "tag":
+			tag = v[0]
+		case "registry":
+			registry = strings.TrimRight(v[0], "/")
+		case "platform":
+			platform = v[0]
+		case "public":
+			var err error
+			public, err = parseBoolParameter(k, v[0])
+			if err != nil {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+			}
+		case "channel":
+			if !channelsEnabled() {
+				return errorResponse(CodeInsufficientServerVersion, "The server does not support \"channel\"")
+			}
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	// Docker Hub keeps the official images in "library"
+	if registry == defaultDockerRegistry && !strings.Contains(repo, "/") {
+		repo = "library/" + repo
+	}
+	if !dockerRepoRegexp.MatchString(repo) || !dockerTagRegexp.MatchString(tag) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid docker image \"%s:%s\"", repo, tag))
+	}
+
+	uuid, _ := contrib.NewUUID()
+	m := map[string]interface{}{
+		"v":            2,
+		"uuid":         uuid,
+		"name":         repo,
+		"version":      tag,
+		"type":         "docker",
+		"os":           "linux",
+		"state":        StateActive,
+		"disabled":     false,
+		"public":       public,
+		"icon":         false,
+		"published_at": time.Now().UTC().Format(time.RFC3339),
+		"tags": map[string]interface{}{
+			dockerRepoTag: repo,
+			dockerTagsTag: tag,
+		},
+	}
+	if channelsEnabled() {
+		channel, err := getRequestedChannel(params)
+		if err != nil || channel == "*" {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid channel \"%s\"", channel))
+		}
+		m["channels"] = []string{channel}
+	}
+
+	errs := validateManifest(m)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+
+	c := &dockerRegistryClient{
+		registry: registry,
+		repo:     repo,
+		client:   &http.Client{Timeout: dockerRegistryTimeout},
+	}
+	manifest, err := c.getManifest(tag, platform)
+	if err != nil {
+		return dockerImportError("Failed to fetch the manifest for %s:%s: %v", repo, tag, err)
+	}
+	config, err := c.getBlob(manifest.Config.Digest)
+	if err != nil {
+		return dockerImportError("Failed to fetch the image configuration: %v", err)
+	}
+	var imageConfig dockerImageConfig
+	if json.Unmarshal(config, &imageConfig) == nil && len(imageConfig.Architecture) > 0 {
+		m["tags"].(map[string]interface{})[dockerArchitectureTag] = imageConfig.Architecture
+	}
+
+	err = storage.Create(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+
+	_, err = storage.PutFile(uuid, dockerConfigFileName, bytes.NewReader(config))
+	if err != nil {
+		storage.Delete(uuid)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store the image configuration: %v", err))
+	}
+
+	var files []interface{}
+	for index, layer := range manifest.Layers {
+		entry, err := c.fetchLayer(uuid, index, layer)
+		if err != nil {
+			storage.Delete(uuid)
+			return dockerImportError("Failed to fetch layer %d: %v", index, err)
+		}
+		files = append(files, entry)
+	}
+	m["files"] = files
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		storage.Delete(uuid)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageActivated, uuid)
+	return Success, m
+}
+
+func serverImportDockerImage(w http.ResponseWriter, r *http.Request, params url.Values) {
+	code, content := doServerImportDockerImage(params)
+	if code == Success {
+		auditLogUuid(r, content["uuid"].(string))
+	}
+	sendResponse(w, code, content)
+}
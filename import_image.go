@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+/**
+ * Import an image from a complete manifest (like a manifest dump from
+ * another repository). Unlike CreateImage the uuid, owner and
+ * published_at in the manifest is preserved.
+ *
+ * The image file (and icon) isn't part of the manifest, so the image
+ * is stored unactivated without an icon. The file is verified against
+ * the files entry in the manifest when it is uploaded with
+ * AddImageFile, and the operator activates the image afterwards.
+ */
+func doServerImportImage(r *http.Request, params url.Values, uuid string) (int, map[string]interface{}) {
+	for k, _ := range params {
+		switch k {
+		case "action":
+			break
+		case "channel":
+			if !channelsEnabled() {
+				return errorResponse(CodeInsufficientServerVersion, "The server does not support \"channel\"")
+			}
+		case "account":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	m, code, content := decodeManifestBody(r)
+	if content != nil {
+		return code, content
+	}
+
+	if id, ok := m["uuid"]; ok && id != uuid {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("The uuid in the manifest (%v) don't match %s", id, uuid))
+	}
+	m["uuid"] = uuid
+
+	if _, ok := m["channels"]; !ok && channelsEnabled() {
+		channel, err := getRequestedChannel(params)
+		if err != nil || channel == "*" {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid channel \"%s\"", channel))
+		}
+		m["channels"] = []string{channel}
+	}
+
+	m["state"] = StateUnactivated
+	m["disabled"] = false
+	m["icon"] = false
+	delete(m, "attachments")
+	addDefaultValue("public", false, m)
+	addDefaultValue("v", 2, m)
+
+	errs := validateManifest(m)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+
+	code, content = validateOrigin(m, nil, true)
+	if content != nil {
+		return code, content
+	}
+	if isDryRun(r) {
+		code, content = checkNewImageUuid(uuid)
+		if content != nil {
+			return code, content
+		}
+		return Success, m
+	}
+
+	err := storage.Create(uuid)
+	if err != nil {
+		if err == ErrImageExists {
+			return errorResponse(CodeImageUuidAlreadyExists, "Uuid already exists")
+		}
+
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		storage.Delete(uuid)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageCreated, uuid)
+	return Success, m
+}
+
+func serverImportImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerImportImage(r, params, uuid)
+	sendResponse(w, code, content)
+}
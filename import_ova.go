@@ -0,0 +1,459 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The format of the disks created by import-ova unless ova_format is set
+const defaultOvaFormat = "zvol"
+
+// The tag holding the format of the disk images in the files (raw, qcow2 or vmdk)
+const diskFormatTag = "disk_format"
+
+// The largest OVF descriptor (and OVF manifest) accepted
+const maxOvfSize = 1024 * 1024
+
+var (
+	ovfCapacityUnitsRegexp = regexp.MustCompile(`^byte\s*\*\s*2\^(\d+)$`)
+	ovfManifestRegexp      = regexp.MustCompile(`^(SHA1|SHA256|SHA512)\s*\((.+)\)\s*=\s*([0-9a-fA-F]+)$`)
+	ovfVersionRegexp       = regexp.MustCompile("[^a-zA-Z0-9._-]+")
+)
+
+// The names used in the OVF operating system section for Linux
+var ovfLinuxNames = []string{
+	"linux", "ubuntu", "debian", "centos", "rhel", "redhat", "red hat",
+	"fedora", "suse", "sles", "oracle", "alma", "rocky", "coreos",
+	"photon", "alpine", "asianux",
+}
+
+// The parts of the OVF descriptor used to build the manifest
+type ovfEnvelope struct {
+	Files  []ovfFile        `xml:"References>File"`
+	Disks  []ovfDisk        `xml:"DiskSection>Disk"`
+	System ovfVirtualSystem `xml:"VirtualSystem"`
+}
+
+type ovfFile struct {
+	Id          string `xml:"id,attr"`
+	Href        string `xml:"href,attr"`
+	Compression string `xml:"compression,attr"`
+}
+
+type ovfDisk struct {
+	FileRef  string `xml:"fileRef,attr"`
+	Capacity string `xml:"capacity,attr"`
+	Units    string `xml:"capacityAllocationUnits,attr"`
+	Format   string `xml:"format,attr"`
+}
+
+type ovfVirtualSystem struct {
+	Id              string `xml:"id,attr"`
+	Name            string `xml:"Name"`
+	OperatingSystem struct {
+		OsType      string `xml:"osType,attr"`
+		Description string `xml:"Description"`
+	} `xml:"OperatingSystemSection"`
+	Product    string `xml:"ProductSection>Product"`
+	Version    string `xml:"ProductSection>Version"`
+	Annotation string `xml:"AnnotationSection>Annotation"`
+}
+
+// Get the capacity of the disk in bytes (0 if unknown)
+func (d ovfDisk) capacityBytes() int64 {
+	capacity, err := strconv.ParseInt(d.Capacity, 10, 64)
+	if err != nil || capacity < 0 {
+		return 0
+	}
+	if len(d.Units) == 0 || d.Units == "byte" {
+		return capacity
+	}
+	match := ovfCapacityUnitsRegexp.FindStringSubmatch(strings.TrimSpace(d.Units))
+	if match == nil {
+		return 0
+	}
+	shift, _ := strconv.Atoi(match[1])
+	if shift >= 63 {
+		return 0
+	}
+	return capacity << uint(shift)
+}
+
+// Get the format of the disk (from the format URI or the file extension)
+func (d ovfDisk) diskFormat(href string) (string, error) {
+	format := strings.ToLower(d.Format + " " + filepath.Ext(href))
+	switch {
+	case strings.Contains(format, "vmdk"):
+		return "vmdk", nil
+	case strings.Contains(format, "qcow"):
+		return "qcow2", nil
+	case strings.Contains(format, "raw"), strings.HasSuffix(format, ".img"):
+		return "raw", nil
+	}
+	return "", fmt.Errorf("Unknown format of disk \"%s\"", href)
+}
+
+// Map the OVF operating system section to the os in the manifest ("" if unknown)
+func (s ovfVirtualSystem) os() string {
+	osType := strings.ToLower(s.OperatingSystem.OsType)
+	description := strings.ToLower(osType + " " + s.OperatingSystem.Description)
+	switch {
+	case strings.HasPrefix(osType, "win"), strings.Contains(description, "windows"):
+		return "windows"
+	case strings.Contains(description, "bsd"):
+		return "bsd"
+	case strings.Contains(description, "smartos"):
+		return "smartos"
+	}
+	for _, name := range ovfLinuxNames {
+		if strings.Contains(description, name) {
+			return "linux"
+		}
+	}
+	return ""
+}
+
+// The files in an OVA is stored at the top level of the archive
+func isOvaFileName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\")
+}
+
+/**
+ * Extract the OVA (a tar archive) to dir. The digests listed in the
+ * OVF manifest (.mf) is verified if the OVA contains one.
+ *
+ * @param reader the OVA
+ * @param dir the directory to extract the disks to
+ * @return descriptor the OVF descriptor
+ *         err The error object if something failed
+ */
+func extractOva(reader io.Reader, dir string) (descriptor []byte, err error) {
+	var manifest []byte
+	sums := map[string]map[string]hash.Hash{}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OVA: %v", err)
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if !isOvaFileName(header.Name) {
+			return nil, fmt.Errorf("Invalid file name \"%s\" in the OVA", header.Name)
+		}
+
+		hashers := map[string]hash.Hash{
+			"SHA1":   sha1.New(),
+			"SHA256": sha256.New(),
+			"SHA512": sha512.New(),
+		}
+		var writers []io.Writer
+		for _, h := range hashers {
+			writers = append(writers, h)
+		}
+
+		switch strings.ToLower(filepath.Ext(header.Name)) {
+		case ".ovf", ".mf":
+			content, err := ioutil.ReadAll(io.LimitReader(archive, maxOvfSize+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(content) > maxOvfSize {
+				return nil, fmt.Errorf("\"%s\" is too large", header.Name)
+			}
+			if strings.HasSuffix(strings.ToLower(header.Name), ".mf") {
+				manifest = content
+				continue
+			}
+			if descriptor != nil {
+				return nil, errors.New("The OVA contains more than one OVF descriptor")
+			}
+			descriptor = content
+			io.MultiWriter(writers...).Write(content)
+
+		default:
+			f, err := os.OpenFile(filepath.Join(dir, header.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(io.MultiWriter(append(writers, f)...), archive)
+			if err == nil {
+				err = f.Close()
+			} else {
+				f.Close()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		sums[header.Name] = hashers
+	}
+
+	if descriptor == nil {
+		return nil, errors.New("The OVA doesn't contain an OVF descriptor")
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		match := ovfManifestRegexp.FindStringSubmatch(line)
+		if match == nil {
+			return nil, fmt.Errorf("Invalid line in the OVF manifest: \"%s\"", line)
+		}
+		hashers, ok := sums[match[2]]
+		if !ok {
+			return nil, fmt.Errorf("\"%s\" listed in the OVF manifest is missing", match[2])
+		}
+		if hex.EncodeToString(hashers[match[1]].Sum(nil)) != strings.ToLower(match[3]) {
+			return nil, fmt.Errorf("%s mismatch for \"%s\"", match[1], match[2])
+		}
+	}
+
+	return descriptor, nil
+}
+
+// A disk from the OVA converted to the format to store
+type ovaDisk struct {
+	path     string
+	capacity int64
+}
+
+/**
+ * Convert the disks referred from the OVF descriptor (in the order of
+ * the disk section) to format.
+ */
+func convertOvaDisks(converter DiskConverter, envelope *ovfEnvelope, dir string, format string) ([]ovaDisk, error) {
+	files := map[string]ovfFile{}
+	for _, file := range envelope.Files {
+		files[file.Id] = file
+	}
+
+	var disks []ovaDisk
+	for index, disk := range envelope.Disks {
+		file, ok := files[disk.FileRef]
+		if !ok {
+			// Disks without a file is created empty when deployed
+			continue
+		}
+		if !isOvaFileName(file.Href) {
+			return nil, fmt.Errorf("Invalid file reference \"%s\"", file.Href)
+		}
+		if len(file.Compression) > 0 && file.Compression != "identity" {
+			return nil, fmt.Errorf("Compressed disks (\"%s\") is not supported", file.Href)
+		}
+		srcFormat, err := disk.diskFormat(file.Href)
+		if err != nil {
+			return nil, err
+		}
+
+		src := filepath.Join(dir, file.Href)
+		if _, err := os.Stat(src); err != nil {
+			return nil, fmt.Errorf("The disk \"%s\" is missing in the OVA", file.Href)
+		}
+		dst := filepath.Join(dir, fmt.Sprintf(".disk-%d.%s", index, format))
+		err = converter.Convert(src, srcFormat, dst, format)
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(src)
+		disks = append(disks, ovaDisk{path: dst, capacity: disk.capacityBytes()})
+	}
+
+	if len(disks) == 0 {
+		return nil, errors.New("The OVA doesn't contain any disks")
+	}
+	return disks, nil
+}
+
+// Build the manifest from the OVF descriptor (the parameters takes precedence)
+func ovaManifest(envelope *ovfEnvelope, params url.Values, format string) (map[string]interface{}, error) {
+	system := envelope.System
+	name := strings.TrimSpace(system.Product)
+	if len(name) == 0 {
+		name = strings.TrimSpace(system.Name)
+	}
+	if len(name) == 0 {
+		name = system.Id
+	}
+	version := strings.Trim(ovfVersionRegexp.ReplaceAllString(strings.TrimSpace(system.Version), "-"), "-")
+
+	m := map[string]interface{}{}
+	for k, v := range map[string]string{
+		"name":        name,
+		"version":     version,
+		"os":          system.os(),
+		"description": strings.TrimSpace(system.Annotation),
+	} {
+		if value := params.Get(k); len(value) > 0 {
+			v = value
+		}
+		if len(v) > 512 {
+			v = v[:512]
+		}
+		if len(v) > 0 {
+			m[k] = v
+		}
+	}
+
+	if value, ok := params["public"]; ok {
+		public, err := parseBoolParameter("public", value[0])
+		if err != nil {
+			return nil, err
+		}
+		m["public"] = public
+	}
+
+	diskFormat := format
+	m["type"] = "other"
+	if format == "zvol" {
+		diskFormat = "raw"
+		m["type"] = "zvol"
+	}
+	m["tags"] = map[string]interface{}{diskFormatTag: diskFormat}
+	return m, nil
+}
+
+/**
+ * Create a new (activated) image from an OVA provided in the body. The
+ * manifest is built from the OVF descriptor, and the disks is converted
+ * to the format specified with format (or ova_format) by the configured
+ * DiskConverter (see disk_converter.go). The image is removed again if
+ * any of the steps fail.
+ */
+func doServerImportOva(r *http.Request, params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	format := configuration.OvaFormat
+	if len(format) == 0 {
+		format = defaultOvaFormat
+	}
+	for k, v := range params {
+		switch k {
+		case "action", "channel", "name", "version", "os", "description", "public":
+			break
+		case "format":
+			format = v[0]
+		case "account":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+	if !stringInSlice(format, []string{"raw", "qcow2", "zvol"}) {
+		return errorResponse(CodeInvalidParameter, "format may be raw, qcow2 or zvol")
+	}
+	if code, content := checkUploadSpace(); content != nil {
+		return code, content
+	}
+
+	converter, err := getDiskConverter()
+	if err != nil {
+		return errorResponse(CodeNotAvailable, fmt.Sprintf("%v", err))
+	}
+
+	dir, err := ioutil.TempDir(spoolDir(), ".ova")
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+	defer os.RemoveAll(dir)
+
+	var source io.Reader = r.Body
+	maxFileSize := currentConfiguration().MaxFileSize
+	if maxFileSize > 0 {
+		source = &sizeLimitReader{reader: source, remaining: maxFileSize, err: errFileTooLarge}
+	}
+	descriptor, err := extractOva(source, dir)
+	if err == errFileTooLarge {
+		return uploadLimitResponse(err, maxFileSize)
+	}
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	var envelope ovfEnvelope
+	err = xml.Unmarshal(descriptor, &envelope)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid OVF descriptor: %v", err))
+	}
+
+	m, err := ovaManifest(&envelope, params, format)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	diskFormat := m["tags"].(map[string]interface{})[diskFormatTag].(string)
+	disks, err := convertOvaDisks(converter, &envelope, dir, diskFormat)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to convert the OVA: %v", err))
+	}
+	if format == "zvol" && disks[0].capacity > 0 {
+		m["image_size"] = float64((disks[0].capacity + 1024*1024 - 1) / (1024 * 1024))
+	}
+
+	code, m := createImage(m, params, user)
+	if code != Success {
+		return code, m
+	}
+	uuid := m["uuid"].(string)
+
+	for index, disk := range disks {
+		code, m = addOvaDisk(uuid, index, disk.path)
+		if code != Success {
+			removeCreatedImage(uuid)
+			return code, m
+		}
+	}
+
+	code, m = activateCreatedImage(uuid)
+	if code != Success {
+		removeCreatedImage(uuid)
+	}
+	return code, m
+}
+
+// Store the converted disk as the file at index
+func addOvaDisk(uuid string, index int, path string) (int, map[string]interface{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+	defer f.Close()
+
+	params := url.Values{}
+	params.Set("compression", "none")
+	params.Set("index", strconv.Itoa(index))
+	return doServerAddImageFile(uuid, params, f)
+}
+
+func serverImportOva(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry) {
+	code, content := doServerImportOva(r, params, user)
+	if code == Success {
+		auditLogUuid(r, content["uuid"].(string))
+	}
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+/**
+ * Perform a GET request to the remote IMGAPI server. The transient
+ * failures is retried and the host is protected by a circuit breaker
+ * (see upstream.go).
+ *
+ * @param url the resource to fetch
+ * @return the response object (the caller must close the body)
+ */
+func remoteGet(url string) (*http.Response, error) {
+	resp, err := upstreamClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// Include the error from the remote server (if it is an IMGAPI error)
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		if e := errorcodes.Parse(resp.StatusCode, content); len(e.Code) > 0 {
+			return nil, fmt.Errorf("GET %s returned %s: %s: %s", url, resp.Status, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	return resp, nil
+}
+
+func doFetchRemoteFile(source string, uuid string, m map[string]interface{}) (int, map[string]interface{}) {
+	files, ok := m["files"].([]interface{})
+	if !ok || len(files) == 0 {
+		return errorResponse(CodeValidationFailed, "The remote manifest does not contain any files")
+	}
+
+	entry, ok := files[0].(map[string]interface{})
+	if !ok {
+		return errorResponse(CodeValidationFailed, "Invalid files entry in the remote manifest")
+	}
+	compression, _ := entry["compression"].(string)
+	expectedsize, sizeok := getDeclaredFileSize(m, 0)
+
+	resp, err := remoteGet(source + "/file")
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to fetch image file: %v", err))
+	}
+	defer resp.Body.Close()
+
+	hasher := newFileHasher()
+	size, err := storage.PutFile(uuid, imageFileName(compression),
+		io.TeeReader(resp.Body, hasher))
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to download image file: %v", err))
+	}
+
+	sums := hasher.digests()
+	err = sums.verify(entry)
+	if err != nil {
+		return errorResponse(CodeValidationFailed, fmt.Sprintf("%v", err))
+	}
+
+	if sizeok && size != expectedsize {
+		return errorResponse(CodeValidationFailed, fmt.Sprintf("Incorrect size. expected %d got %d", expectedsize, size))
+	}
+
+	// Store the digests the remote server didn't provide
+	sums.addTo(entry)
+	return Success, nil
+}
+
+func doFetchRemoteIcon(source string, uuid string) (int, map[string]interface{}) {
+	resp, err := remoteGet(source + "/icon")
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to fetch icon: %v", err))
+	}
+	defer resp.Body.Close()
+
+	icon, filename, _, message := readIcon("", resp.Body)
+	if message != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Invalid icon: %v", message["message"]))
+	}
+
+	err = storeIcon(uuid, filename, icon)
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to download icon: %v", err))
+	}
+
+	return Success, nil
+}
+
+/**
+ * Import an image from another IMGAPI server. The manifest is stored
+ * as provided by the remote server (so uuid and published_at is
+ * preserved), and the image file is verified against the sha1 and
+ * size in the remote manifest. The dry runs only fetch the manifest.
+ */
+func doServerImportRemoteImage(uuid string, params url.Values, dryRun bool) (int, map[string]interface{}) {
+	var source string
+	for k, v := range params {
+		switch k {
+		case "action":
+			break
+		case "source":
+			source = strings.TrimRight(v[0], "/")
+			break
+		case "account":
+			fallthrough
+		case "channel":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	if len(source) == 0 {
+		return errorResponse(CodeInvalidParameter, "source parameter not specified")
+	}
+
+	if !isValidUuid(uuid) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid UUID: \"%s\"", uuid))
+	}
+
+	source = source + "/images/" + uuid
+	resp, err := remoteGet(source)
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to fetch manifest: %v", err))
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to read manifest: %v", err))
+	}
+
+	var m map[string]interface{}
+	err = json.Unmarshal(content, &m)
+	if err != nil {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("Failed to decode manifest: %v", err))
+	}
+
+	if m["uuid"] != uuid {
+		return errorResponse(CodeRemoteSourceError, fmt.Sprintf("The remote server returned the manifest for %v", m["uuid"]))
+	}
+
+	if dryRun {
+		code, content := checkNewImageUuid(uuid)
+		if content == nil {
+			code, content = checkDeclaredFileSizes(uuid, m)
+		}
+		if content != nil {
+			return code, content
+		}
+		return Success, m
+	}
+
+	err = storage.Create(uuid)
+	if err != nil {
+		if err == ErrImageExists {
+			return errorResponse(CodeImageUuidAlreadyExists, "Uuid already exists")
+		}
+
+		return errorResponse(CodeInternalError, fmt.Sprintf("Internal error: %v", err))
+	}
+
+	code, message := doFetchRemoteFile(source, uuid, m)
+	if message != nil {
+		storage.Delete(uuid)
+		return code, message
+	}
+
+	if m["icon"] == true {
+		code, message = doFetchRemoteIcon(source, uuid)
+		if message != nil {
+			storage.Delete(uuid)
+			return code, message
+		}
+	}
+
+	code, message = doFetchRemoteAttachments(source, uuid, m)
+	if message != nil {
+		storage.Delete(uuid)
+		return code, message
+	}
+
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		storage.Delete(uuid)
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write manifest: %v", err))
+	}
+
+	publishImageEvent(EventImageActivated, uuid)
+	return Success, m
+}
+
+func serverImportRemoteImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerImportRemoteImage(uuid, params, isDryRun(r))
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The default number of manifests loaded in parallel when the server starts
+const defaultIndexWorkers = 16
+
+// The directory (or prefix) in the storage the corrupt images is moved to
+const quarantineDirName = ".quarantine"
+
+// Seconds between each progress message while the manifests is loaded
+const indexProgressInterval = 5 * time.Second
+
+/**
+ * The storage backends which may move an image out of the way
+ * implements quarantineStorage. The image is moved to .quarantine in
+ * the datadir (or the prefix) so that it isn't listed (or removed by
+ * the garbage collector) but may be repaired and moved back by hand.
+ */
+type quarantineStorage interface {
+	Quarantine(uuid string) error
+}
+
+type quarantinedImage struct {
+	Uuid  string `json:"uuid"`
+	Error string `json:"error"`
+	// If the image was moved to the quarantine (or just skipped)
+	Moved bool `json:"moved"`
+}
+
+// The progress (and result) of the last scan of the manifests
+type indexScan struct {
+	sync.Mutex
+	Running     bool               `json:"running"`
+	Workers     int                `json:"workers"`
+	Total       int64              `json:"total"`
+	Loaded      int64              `json:"loaded"`
+	Started     time.Time          `json:"started"`
+	Duration    float64            `json:"duration"`
+	Quarantined []quarantinedImage `json:"quarantined"`
+}
+
+var scan = &indexScan{}
+
+func indexWorkers() int {
+	if configuration.IndexWorkers > 0 {
+		return configuration.IndexWorkers
+	}
+	return defaultIndexWorkers
+}
+
+// Get the progress of the scan for /state
+func indexScanState() map[string]interface{} {
+	scan.Lock()
+	defer scan.Unlock()
+	return map[string]interface{}{
+		"running":     scan.Running,
+		"workers":     scan.Workers,
+		"total":       atomic.LoadInt64(&scan.Total),
+		"loaded":      atomic.LoadInt64(&scan.Loaded),
+		"started":     scan.Started,
+		"duration":    scan.Duration,
+		"quarantined": scan.Quarantined,
+	}
+}
+
+/**
+ * Check that the stored manifest is usable. This is less strict than
+ * validateManifest as the manifests written by older versions of the
+ * server may not pass the current validation.
+ */
+func checkStoredManifest(uuid string, m map[string]interface{}) error {
+	if id, _ := m["uuid"].(string); id != uuid {
+		return fmt.Errorf("The manifest has uuid \"%v\"", m["uuid"])
+	}
+	for _, field := range []string{"name", "version"} {
+		if s, ok := m[field].(string); !ok || len(s) == 0 {
+			return fmt.Errorf("The manifest is missing \"%s\"", field)
+		}
+	}
+	return nil
+}
+
+// Check if the manifest failed to load because it isn't valid JSON
+func isCorruptManifest(err error) bool {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	return errors.As(err, &syntaxError) || errors.As(err, &typeError) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Move the corrupt image out of the way (if the storage supports it)
+func (i *indexScan) quarantine(s Storage, uuid string, cause error) {
+	image := quarantinedImage{Uuid: uuid, Error: cause.Error()}
+	if q, ok := s.(quarantineStorage); ok {
+		err := q.Quarantine(uuid)
+		if err != nil {
+			log.Printf("Failed to quarantine %s: %v", uuid, err)
+		} else {
+			image.Moved = true
+		}
+	}
+	if image.Moved {
+		log.Printf("Moved %s to the quarantine: %v", uuid, cause)
+	} else {
+		log.Printf("Skipping %s: %v", uuid, cause)
+	}
+
+	i.Lock()
+	i.Quarantined = append(i.Quarantined, image)
+	i.Unlock()
+}
+
+// Log the progress until done is closed
+func (i *indexScan) reportProgress(done chan struct{}) {
+	ticker := time.NewTicker(indexProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("Indexed %d of %d manifests", atomic.LoadInt64(&i.Loaded), atomic.LoadInt64(&i.Total))
+		case <-done:
+			return
+		}
+	}
+}
+
+/**
+ * Load all of the manifests in the storage with a pool of workers.
+ * The images with a corrupt manifest is moved to the quarantine rather
+ * than failing the startup, while the images where the manifest failed
+ * to load for other reasons (and images without a manifest) is just
+ * skipped.
+ */
+func (i *indexScan) run(s Storage) (map[string]map[string]interface{}, error) {
+	i.Lock()
+	i.Running = true
+	i.Workers = indexWorkers()
+	i.Started = time.Now().UTC()
+	i.Quarantined = []quarantinedImage{}
+	atomic.StoreInt64(&i.Loaded, 0)
+	atomic.StoreInt64(&i.Total, 0)
+	i.Unlock()
+
+	start := time.Now()
+	defer func() {
+		i.Lock()
+		i.Running = false
+		i.Duration = time.Since(start).Seconds()
+		i.Unlock()
+	}()
+
+	uuids, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&i.Total, int64(len(uuids)))
+
+	done := make(chan struct{})
+	defer close(done)
+	go i.reportProgress(done)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	manifests := make(map[string]map[string]interface{}, len(uuids))
+	work := make(chan string)
+	for n := 0; n < i.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uuid := range work {
+				m, err := s.GetManifest(uuid)
+				if err == nil {
+					err = checkStoredManifest(uuid, m)
+					if err != nil {
+						i.quarantine(s, uuid, err)
+					}
+				} else if isCorruptManifest(err) {
+					i.quarantine(s, uuid, err)
+				} else if err != ErrImageNotFound {
+					log.Printf("Failed to load manifest for %s: %v", uuid, err)
+				}
+				if err == nil {
+					lock.Lock()
+					manifests[uuid] = m
+					lock.Unlock()
+				}
+				atomic.AddInt64(&i.Loaded, 1)
+			}
+		}()
+	}
+
+	for _, uuid := range uuids {
+		work <- uuid
+	}
+	close(work)
+	wg.Wait()
+
+	return manifests, nil
+}
@@ -1,12 +1,41 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 )
 
-func serverListChannels(w http.ResponseWriter, r *http.Request) {
-	sendResponse(w, ResourceNotFound, map[string]interface{}{
-		"code":    "ResourceNotFound",
-		"message": "/channels does not exist",
-	})
+func serverListChannels(w http.ResponseWriter, r *http.Request, user *UserEntry) {
+	if !channelsEnabled() {
+		sendError(w, CodeResourceNotFound, "/channels does not exist")
+		return
+	}
+
+	channels := []map[string]interface{}{}
+	for _, channel := range currentConfiguration().Channels {
+		if channel.Private && user == nil {
+			continue
+		}
+
+		entry := map[string]interface{}{
+			"name":        channel.Name,
+			"description": channel.Description,
+		}
+		if channel.Name == defaultChannel() {
+			entry["default"] = true
+		}
+		channels = append(channels, entry)
+	}
+
+	content, err := json.MarshalIndent(channels, "", "  ")
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to encode channels: %v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(content)
 }
@@ -1,25 +1,53 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-func doServerListImages(path string, w http.ResponseWriter, r *http.Request) (int, map[string]interface{}) {
-	parameters, err := url.ParseQuery(r.URL.RawQuery)
-	if err != nil {
-		message := map[string]interface{}{
-			"code":    "InternalError",
-			"message": fmt.Sprintf("Failed to parse query parameters: %v", err),
-		}
-		return InternalError, message
+// A filter returns true if the manifest should be included in the result
+type imageFilter func(uuid string, m map[string]interface{}) bool
+
+// Match the value in the manifest with the value requested. A value
+// starting with "~" is a substring match.
+func matchString(value interface{}, requested string) bool {
+	str, ok := value.(string)
+	if !ok {
+		return false
 	}
 
+	if strings.HasPrefix(requested, "~") {
+		return strings.Contains(str, requested[1:])
+	}
+	return str == requested
+}
+
+// Parse the value of a boolean query parameter ("true" or "false")
+func parseBoolParameter(key string, value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		return false, fmt.Errorf("Invalid value for \"%s\": \"%s\"", key, value)
+	}
+}
+
+/**
+ * Build the list of filters to apply from the query parameters
+ *
+ * @param parameters the query parameters
+ * @param user the authenticated user (nil if not authenticated)
+ * @return filters the filters to apply
+ *         err The error object if an invalid parameter was provided
+ */
+func buildImageFilters(parameters url.Values, user *UserEntry) (filters []imageFilter, err error) {
 	keys := []string{
 		"account",
 		"channel",
@@ -33,76 +61,325 @@ func doServerListImages(path string, w http.ResponseWriter, r *http.Request) (in
 		"billing_tag",
 		"limit",
 		"marker",
+		"sort",
+		"hasFile",
+		"latest",
 	}
 
-	for k, _ := range parameters {
-		if !stringInSlice(k, keys) {
-			message := map[string]interface{}{
-				"code":    "InternalError",
-				"message": fmt.Sprintf("Invalid key \"%s\"", k),
+	for k, v := range parameters {
+		value := v[0]
+		switch {
+		case !stringInSlice(k, keys) && !strings.HasPrefix(k, "tag."):
+			return nil, fmt.Errorf("Invalid key \"%s\"", k)
+
+		case k == "name" || k == "version" || k == "os" || k == "type" || k == "owner":
+			key := k
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				return matchString(m[key], value)
+			})
+
+		case k == "public":
+			public, err := parseBoolParameter(k, value)
+			if err != nil {
+				return nil, err
 			}
-			return InternalError, message
-		}
-	}
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				return m["public"] == public
+			})
 
-	// Build up the filter, iterate the spool and generate the restult
+		case k == "account":
+			// The images owned by the account, public images and
+			// the images shared with the account
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				return m["owner"] == value || m["public"] == true ||
+					stringInSlice(value, getManifestAcl(m))
+			})
 
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
+		case k == "billing_tag":
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				tags, _ := m["billing_tags"].([]interface{})
+				for _, tag := range tags {
+					if tag == value {
+						return true
+					}
+				}
+				return false
+			})
 
-	first := true
-	dir, _ := ioutil.ReadDir(path)
-	for i := 0; i < len(dir); i++ {
-		fileinfo := dir[i]
-		if !fileinfo.IsDir() {
-			log.Printf("Skipping %s (not a directory)", fileinfo.Name())
-			continue
+		case k == "latest":
+			// Applied to the matching images by latestImages
+			_, err := parseBoolParameter(k, value)
+			if err != nil {
+				return nil, err
+			}
+
+		case k == "hasFile":
+			hasFile, err := parseBoolParameter(k, value)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				return imageHasFile(uuid, m) == hasFile
+			})
+
+		case strings.HasPrefix(k, "tag."):
+			tag := k[4:]
+			filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+				tags, _ := m["tags"].(map[string]interface{})
+				entry, ok := tags[tag]
+				return ok && fmt.Sprintf("%v", entry) == value
+			})
 		}
+	}
 
-		manifest, err := LoadManifest(path + "/" + fileinfo.Name() + "/manifest.json")
-		if err != nil {
-			log.Printf("Failed to load manifest %s: %e", manifest, err)
-			continue
+	// Only active images is listed unless the client ask for a
+	// specific state. hasFile lists all states so that clients may
+	// locate manifests that still miss their image file
+	state := parameters.Get("state")
+	if len(state) == 0 {
+		state = StateActive
+		if _, ok := parameters["hasFile"]; ok {
+			state = "all"
 		}
+	}
+	if state != "all" {
+		filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+			return getImageState(m) == state
+		})
+	}
+
+	channel, err := getRequestedChannel(parameters)
+	if err != nil {
+		return nil, err
+	}
+	filters = append(filters, func(uuid string, m map[string]interface{}) bool {
+		return imageInChannel(m, channel) && imageVisible(m, user != nil) &&
+			imageAccessible(m, user)
+	})
+
+	return filters, nil
+}
 
-		state, ok := manifest["state"]
+/**
+ * Pick the newest image with each name. The versions is compared with
+ * compareVersions (so "1.10" is newer than "1.9"), and the image
+ * published last is picked if they have the same version. The entries
+ * is still ordered by uuid.
+ */
+func latestImages(entries []indexEntry) []indexEntry {
+	newest := make(map[string]int)
+	var latest []indexEntry
+	for _, entry := range entries {
+		name, _ := entry.manifest["name"].(string)
+		i, ok := newest[name]
 		if !ok {
-			log.Printf("No state in manifest for: %s", path+"/"+fileinfo.Name()+"/manifest.json")
+			newest[name] = len(latest)
+			latest = append(latest, entry)
 			continue
 		}
 
-		include := false
+		version, _ := entry.manifest["version"].(string)
+		current, _ := latest[i].manifest["version"].(string)
+		c := compareVersions(version, current)
+		if c == 0 {
+			published, _ := entry.manifest["published_at"].(string)
+			currentPublished, _ := latest[i].manifest["published_at"].(string)
+			if published > currentPublished {
+				c = 1
+			}
+		}
+		if c > 0 {
+			latest[i] = entry
+		}
+	}
+
+	sort.Slice(latest, func(a, b int) bool {
+		return latest[a].uuid < latest[b].uuid
+	})
+	return latest
+}
+
+// The maximum number of images to return in a single page
+const maxListLimit = 1000
+
+// The key used to order the images in the listing
+func imageSortKey(entry indexEntry, order string) string {
+	if order == "published_at" {
+		published, _ := entry.manifest["published_at"].(string)
+		return published + "/" + entry.uuid
+	}
+	return entry.uuid
+}
 
-		// @todo add filter!!
-		if state == "active" {
-			include = true
+/**
+ * Order the images and pick out the requested page. The images is
+ * ordered by uuid (or by published_at if requested), and the page
+ * starts after the image specified by marker.
+ *
+ * @return page the images in the requested page
+ *         next the marker to use for the next page ("" if this is the last)
+ *         err The error object if an invalid parameter was provided
+ */
+func getImagePage(entries []indexEntry, parameters url.Values) (page []indexEntry, next string, err error) {
+	order := parameters.Get("sort")
+	switch order {
+	case "":
+		order = "uuid"
+	case "uuid":
+	case "published_at":
+		sort.SliceStable(entries, func(a, b int) bool {
+			return imageSortKey(entries[a], order) < imageSortKey(entries[b], order)
+		})
+	default:
+		return nil, "", fmt.Errorf("Invalid value for \"sort\": \"%s\"", order)
+	}
+
+	limit := -1
+	if value := parameters.Get("limit"); len(value) > 0 {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			return nil, "", fmt.Errorf("limit must be between 1 and %d", maxListLimit)
 		}
+	}
 
-		// @TODO check if it match the filter, for now lets assume no filter is provided
-		if include {
-			if first {
-				first = false
-			} else {
-				buffer.WriteString(",")
+	start := 0
+	if marker := parameters.Get("marker"); len(marker) > 0 {
+		markerKey := marker
+		if order == "published_at" {
+			m, ok := index.get(marker)
+			if !ok {
+				return nil, "", fmt.Errorf("Unknown marker \"%s\"", marker)
 			}
+			markerKey = imageSortKey(indexEntry{marker, m}, order)
+		}
 
-			a, _ := json.MarshalIndent(manifest, "  ", "  ")
-			buffer.Write(a)
+		start = sort.Search(len(entries), func(i int) bool {
+			return imageSortKey(entries[i], order) > markerKey
+		})
+	}
+
+	page = entries[start:]
+	if limit != -1 && len(page) > limit {
+		page = page[:limit]
+		next = page[limit-1].uuid
+	}
+	return page, next, nil
+}
+
+// Build the URL for the next page of the listing
+func nextPageUrl(r *http.Request, marker string) string {
+	parameters := r.URL.Query()
+	parameters.Set("marker", marker)
+	return r.URL.Path + "?" + parameters.Encode()
+}
+
+func doServerListImages(w http.ResponseWriter, r *http.Request, user *UserEntry) (int, map[string]interface{}) {
+	parameters, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to parse query parameters: %v", err))
+	}
+
+	format, err := parseManifestFormat(parameters)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	filters, err := buildImageFilters(parameters, user)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	var matches []indexEntry
+	for _, entry := range listImageCandidates(parameters) {
+		include := true
+		for _, filter := range filters {
+			if !filter(entry.uuid, entry.manifest) {
+				include = false
+				break
+			}
+		}
+
+		if include {
+			matches = append(matches, entry)
 		}
 	}
-	buffer.WriteString("]")
 
-	h := w.Header()
-	h.Set("Server", "Norbye Public Images Repo")
-	h.Set("Content-Type", "application/json; charset=utf-8")
-	w.Write(buffer.Bytes())
+	if parameters.Get("latest") == "true" {
+		matches = latestImages(matches)
+	}
 
+	page, next, err := getImagePage(matches, parameters)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+	}
+
+	if len(next) > 0 {
+		h := w.Header()
+		h.Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextPageUrl(r, next)))
+		h.Set("X-Next-Marker", next)
+	}
+
+	sendManifestList(w, r, format, page)
 	return Success, nil
+}
+
+/**
+ * Get the images which may match the query parameters. The images is
+ * looked up in the index of the catalog (if it has one) by the fields
+ * requested with an exact value, and the filters is applied to the
+ * returned images as usual.
+ */
+func listImageCandidates(parameters url.Values) []indexEntry {
+	catalog, ok := storageQueryCatalog(storage)
+	if !ok {
+		return index.list()
+	}
+
+	fields := make(map[string]string)
+	for _, key := range []string{"owner", "name", "os", "type", "public"} {
+		if value := parameters.Get(key); len(value) > 0 && !strings.HasPrefix(value, "~") {
+			fields[key] = value
+		}
+	}
+	// The same default state as buildImageFilters
+	state := parameters.Get("state")
+	if len(state) == 0 {
+		if _, ok := parameters["hasFile"]; !ok {
+			state = StateActive
+		}
+	}
+	if len(state) > 0 && state != "all" {
+		fields["state"] = state
+	}
+
+	uuids, err := catalog.Find(fields)
+	if err != nil {
+		log.Printf("Failed to query the catalog: %v", err)
+		return index.list()
+	}
+	entries := make([]indexEntry, 0, len(uuids))
+	for _, uuid := range uuids {
+		if m, ok := index.get(uuid); ok {
+			entries = append(entries, indexEntry{uuid, m})
+		}
+	}
+	return entries
+}
+
+// imageHasFile checks if the manifest lists a file and that the file
+// is present in the storage
+func imageHasFile(uuid string, manifest map[string]interface{}) bool {
+	files, ok := manifest["files"].([]interface{})
+	if !ok || len(files) == 0 {
+		return false
+	}
 
+	_, exists := getImageFile(uuid)
+	return exists
 }
 
-func serverListImages(path string, w http.ResponseWriter, r *http.Request) {
-	code, content := doServerListImages(path, w, r)
+func serverListImages(w http.ResponseWriter, r *http.Request, user *UserEntry) {
+	code, content := doServerListImages(w, r, user)
 	if content != nil {
 		sendResponse(w, code, content)
 	}
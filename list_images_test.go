@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"testing"
+)
+
+// List the images with the query (as an operator) and return the uuids in the response
+func listTestImages(t *testing.T, query string) []string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	serverListImages(w, httptest.NewRequest("GET", "/images?"+query, nil), &UserEntry{Name: "admin"})
+	if w.Code != Success {
+		t.Fatalf("GET /images?%s returned %d: %s", query, w.Code, w.Body.String())
+	}
+
+	var manifests []map[string]interface{}
+	err := json.Unmarshal(w.Body.Bytes(), &manifests)
+	if err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	uuids := []string{}
+	for _, m := range manifests {
+		uuids = append(uuids, m["uuid"].(string))
+	}
+	sort.Strings(uuids)
+	return uuids
+}
+
+func TestListImagesHasFile(t *testing.T) {
+	setupTestStorage(t)
+
+	file := map[string]interface{}{"compression": "gzip", "size": 5}
+	complete := "00000000-0000-0000-0000-000000000001"
+	addTestImage(t, complete, testManifest("complete", file), "image")
+	// Created but the file isn't uploaded yet
+	manifestOnly := "00000000-0000-0000-0000-000000000002"
+	unactivated := testManifest("manifest-only")
+	unactivated["state"] = StateUnactivated
+	addTestImage(t, manifestOnly, unactivated, "")
+	// The manifest lists a file which is missing in the storage
+	missing := "00000000-0000-0000-0000-000000000003"
+	addTestImage(t, missing, testManifest("missing", file), "")
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		{"hasFile=true", []string{complete}},
+		{"hasFile=false", []string{manifestOnly, missing}},
+		{"hasFile=false&state=unactivated", []string{manifestOnly}},
+		{"", []string{complete, missing}},
+	} {
+		uuids := listTestImages(t, test.query)
+		if len(uuids) != len(test.expected) {
+			t.Errorf("%s: expected %v got %v", test.query, test.expected, uuids)
+			continue
+		}
+		for i := range uuids {
+			if uuids[i] != test.expected[i] {
+				t.Errorf("%s: expected %v got %v", test.query, test.expected, uuids)
+				break
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	serverListImages(w, httptest.NewRequest("GET", "/images?hasFile=maybe", nil), nil)
+	if w.Code != InvalidParameter {
+		t.Errorf("hasFile=maybe returned %d", w.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+/**
+ * Get the address to listen to for TCP connections. listen_address may
+ * be a host:port, or just the host (or IP address) to use with port.
+ * The server listens on all interfaces unless listen_address is set.
+ */
+func listenAddress(config Configuration) string {
+	if len(config.ListenAddress) == 0 {
+		return ":" + strconv.Itoa(config.Port)
+	}
+	_, _, err := net.SplitHostPort(config.ListenAddress)
+	if err == nil {
+		return config.ListenAddress
+	}
+	return net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.Port))
+}
+
+// Get the port the server listens to (0 when using a Unix domain socket)
+func listenPort(config Configuration) int {
+	if len(config.UnixSocket) > 0 {
+		return 0
+	}
+	_, port, _ := net.SplitHostPort(listenAddress(config))
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// Verify the port (or listen_address) unless the server listens on a Unix domain socket
+func validateListenAddress(config Configuration) error {
+	if len(config.UnixSocket) > 0 {
+		if len(config.ListenAddress) > 0 {
+			return fmt.Errorf("listen_address and unix_socket can't both be specified")
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(listenAddress(config))
+	if err != nil {
+		return fmt.Errorf("Invalid listen_address \"%s\": %v", config.ListenAddress, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("Invalid port in listen_address \"%s\"", config.ListenAddress)
+	}
+	return validatePort("port", n, false)
+}
+
+/**
+ * Open the listener for the server. The stale socket left behind if
+ * the server wasn't shut down cleanly is removed before listening on
+ * a Unix domain socket (but other files is left alone).
+ */
+func openListener(config Configuration) (net.Listener, error) {
+	if len(config.UnixSocket) == 0 {
+		return net.Listen("tcp", listenAddress(config))
+	}
+
+	info, err := os.Lstat(config.UnixSocket)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", config.UnixSocket)
+		}
+		os.Remove(config.UnixSocket)
+	}
+	return net.Listen("unix", config.UnixSocket)
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"os/user"
+	"strings"
 )
 
 var configuration Configuration
@@ -15,7 +17,7 @@ var configuration Configuration
 func main() {
 	usr, err := user.Current()
 	if err != nil {
-		log.Fatal("Failed to get information about current user: %v",
+		log.Fatalf("Failed to get information about current user: %v",
 			err)
 	}
 	// Set up default values
@@ -24,26 +26,114 @@ func main() {
 
 	flag.BoolVar(&server_mode, "s", false, "Server mode")
 	flag.StringVar(&configfile, "c", configfile, "Configuration file")
+	flag.Int("port", 0, "The port to listen on (overrides the configuration)")
+	flag.String("host", "", "The host name of the server (overrides the configuration)")
+	flag.String("datadir", "", "The data directory (overrides the configuration)")
+	passwd := flag.String("passwd", "", "Add or update the user in userdb_file (the password is read from standard input)")
+	role := flag.String("role", "", "The role of the user (with -passwd)")
+	uuid := flag.String("uuid", "", "The account uuid of the user (with -passwd)")
+	migrateCatalog := flag.Bool("migrate-catalog", false, "Copy the manifests from the storage to the catalog")
+	backup := flag.String("backup", "", "Write a backup of the images and the user database to the file")
+	since := flag.String("since", "", "Only back up the images changed after the time (RFC3339, with -backup)")
+	restore := flag.String("restore", "", "Restore the images and the user database from the backup")
 	flag.Parse()
 
+	// The default configuration file is optional (the settings may be
+	// provided in the environment)
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "c":
+			configurationFileRequired = true
+		case "s", "passwd", "role", "uuid", "migrate-catalog", "backup", "since", "restore":
+			break
+		default:
+			configurationFlags[f.Name] = f.Value.String()
+		}
+	})
+
 	if len(flag.Args()) != 0 {
 		fmt.Println("Usage: imgapi [arguments]")
 		os.Exit(1)
 	}
 
-	content, err := ioutil.ReadFile(configfile)
+	configurationFile = configfile
+	configuration, err = loadConfiguration(configfile, !configurationFileRequired)
 	if err != nil {
-		log.Printf("Failed to read %s: %v", configfile, err)
+		log.Print(err)
 		os.Exit(1)
 	}
-	err = json.Unmarshal(content, &configuration)
-	if err != nil {
-		log.Fatalf("Failed to parse JSON: [%s]: %e", content, err)
+
+	if len(*passwd) > 0 {
+		err = updateUserPassword(UserEntry{Name: *passwd, Role: *role, Uuid: *uuid})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *migrateCatalog {
+		err = runCatalogMigration()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(*backup) > 0 {
+		err = runBackup(*backup, *since)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if len(*restore) > 0 {
+		err = runRestore(*restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
 	if server_mode {
-		startImageServer()
+		err = startImageServer()
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		log.Fatal("Client API is not implemented")
 	}
 }
+
+// Read the password from standard input and store the user with the hashed password
+func updateUserPassword(user UserEntry) error {
+	if len(configuration.UserdbFile) == 0 {
+		return errors.New("userdb_file must be specified to use -passwd")
+	}
+	if len(user.Role) > 0 {
+		err := validateUserRoles([]UserEntry{user})
+		if err != nil {
+			return err
+		}
+	}
+	if len(user.Uuid) > 0 && !isValidUuid(user.Uuid) {
+		return fmt.Errorf("Invalid uuid \"%s\"", user.Uuid)
+	}
+
+	fmt.Fprintf(os.Stderr, "Password for %s: ", user.Name)
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	user.Password = strings.TrimRight(password, "\r\n")
+	if len(user.Password) == 0 {
+		return errors.New("The password can't be empty")
+	}
+
+	err = setUserdbPassword(configuration.UserdbFile, user)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Updated %s in %s\n", user.Name, configuration.UserdbFile)
+	return nil
+}
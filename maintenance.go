@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The default message sent to the clients in maintenance mode
+const defaultMaintenanceMessage = "The server is in maintenance mode (read-only)"
+
+// The default number of seconds in the Retry-After header in maintenance mode
+const defaultMaintenanceRetryAfter = 300
+
+// The routes which may be used in maintenance mode (in addition to GET and HEAD)
+var maintenanceRoutes = map[string]bool{
+	"AdminEnableMaintenance":  true,
+	"AdminDisableMaintenance": true,
+	"CreateToken":             true,
+	"DeleteToken":             true,
+}
+
+/**
+ * In maintenance mode the server is read-only: the images may still be
+ * listed and downloaded, but the requests which may modify the images
+ * gets 503 with the message and a Retry-After header, and the
+ * background jobs modifying the storage (gc, trash, retention and
+ * mirror) is paused. It is useful while the storage is migrated.
+ */
+type maintenanceMode struct {
+	sync.Mutex
+	Enabled    bool      `json:"enabled"`
+	Message    string    `json:"message,omitempty"`
+	RetryAfter int       `json:"retry_after,omitempty"`
+	Since      time.Time `json:"since,omitempty"`
+	User       string    `json:"user,omitempty"`
+}
+
+var maintenance = &maintenanceMode{}
+
+// Check if the server is in maintenance mode
+func inMaintenance() bool {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	return maintenance.Enabled
+}
+
+func (m *maintenanceMode) enable(user string, message string, retryAfter int) {
+	if len(message) == 0 {
+		message = defaultMaintenanceMessage
+	}
+	if retryAfter <= 0 {
+		retryAfter = defaultMaintenanceRetryAfter
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.Enabled = true
+	m.Message = message
+	m.RetryAfter = retryAfter
+	m.Since = time.Now().UTC()
+	m.User = user
+	log.Printf("Maintenance mode enabled by %s: %s", user, message)
+}
+
+func (m *maintenanceMode) disable(user string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.Enabled {
+		log.Printf("Maintenance mode disabled by %s", user)
+	}
+	m.Enabled = false
+	m.Message = ""
+	m.RetryAfter = 0
+	m.Since = time.Time{}
+	m.User = ""
+}
+
+// Get the state of the maintenance mode (for /maintenance and /state)
+func (m *maintenanceMode) state() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+	state := map[string]interface{}{"enabled": m.Enabled}
+	if m.Enabled {
+		state["message"] = m.Message
+		state["retry_after"] = m.RetryAfter
+		state["since"] = m.Since
+		state["user"] = m.User
+	}
+	return state
+}
+
+// Reject the requests which may modify the images in maintenance mode
+func withMaintenance(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isMutatingRequest(r) || maintenanceRoutes[imageRouter.routeName(r)] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		maintenance.Lock()
+		enabled, message, retryAfter := maintenance.Enabled, maintenance.Message, maintenance.RetryAfter
+		maintenance.Unlock()
+		if !enabled {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		sendError(w, CodeServiceUnavailableError, message)
+	})
+}
+
+// Authenticate the request to /maintenance (operators only)
+func maintenanceRequest(w http.ResponseWriter, r *http.Request) *UserEntry {
+	user, code, content := authenticateRequest(r)
+	if content == nil && user == nil {
+		code, content = errorResponse(CodeUnauthorizedError, "Authentication is required")
+	}
+	if content == nil {
+		code, content = requireOperator(user)
+	}
+	if content != nil {
+		sendResponse(w, code, content)
+		return nil
+	}
+	return user
+}
+
+/*
+AdminGetMaintenance	GET /maintenance	Get the state of the maintenance mode.
+*/
+func serverGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if maintenanceRequest(w, r) != nil {
+		sendResponse(w, Success, maintenance.state())
+	}
+}
+
+/*
+AdminEnableMaintenance	PUT /maintenance	Put the server in read-only maintenance mode (body: message and retry_after).
+*/
+func serverEnableMaintenance(w http.ResponseWriter, r *http.Request) {
+	user := maintenanceRequest(w, r)
+	if user == nil {
+		return
+	}
+
+	var request struct {
+		Message    string `json:"message"`
+		RetryAfter int    `json:"retry_after"`
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err == nil && len(body) > 0 {
+		err = json.Unmarshal(body, &request)
+	}
+	if err == nil && request.RetryAfter < 0 {
+		err = fmt.Errorf("retry_after can't be negative")
+	}
+	if err != nil {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+
+	maintenance.enable(user.Name, request.Message, request.RetryAfter)
+	sendResponse(w, Success, maintenance.state())
+}
+
+/*
+AdminDisableMaintenance	DELETE /maintenance	Leave the maintenance mode.
+*/
+func serverDisableMaintenance(w http.ResponseWriter, r *http.Request) {
+	user := maintenanceRequest(w, r)
+	if user == nil {
+		return
+	}
+	maintenance.disable(user.Name)
+	sendResponse(w, Success, maintenance.state())
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Toggle the maintenance mode when the server receives SIGUSR1
+func toggleMaintenanceOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			if inMaintenance() {
+				maintenance.disable("SIGUSR1")
+			} else {
+				maintenance.enable("SIGUSR1", "", 0)
+			}
+		}
+	}()
+}
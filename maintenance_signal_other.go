@@ -0,0 +1,8 @@
+//go:build windows
+// +build windows
+
+package main
+
+// There is no SIGUSR1 on this platform (use /maintenance instead)
+func toggleMaintenanceOnSignal() {
+}
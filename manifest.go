@@ -5,9 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 )
 
 func LoadManifest(path string) (manifest map[string]interface{}, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return manifest, err
+	}
+
+	manifest, ok := cacheLookupManifest(path, info)
+	if ok {
+		return manifest, nil
+	}
+
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		return manifest, err
@@ -18,6 +30,7 @@ func LoadManifest(path string) (manifest map[string]interface{}, err error) {
 		return manifest, err
 	}
 
+	cacheStoreManifest(path, info, manifest)
 	return manifest, nil
 }
 
@@ -27,11 +40,49 @@ func StoreManifest(path string, manifest map[string]interface{}) (err error) {
 		return err
 	}
 
-	err = ioutil.WriteFile(path, content, 0644)
+	// Write the new manifest to a temporary file and rename it
+	// into place so that readers never see a partial manifest. The
+	// temporary file is unique so that concurrent writers don't
+	// overwrite each others temporary file.
+	f, err := ioutil.TempFile(filepath.Dir(path), ".manifest")
+	if err != nil {
+		forgetManifest(path)
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
 	if err != nil {
+		os.Remove(f.Name())
+		forgetManifest(path)
 		return err
 	}
 
+	info, err := os.Stat(path)
+	if err != nil {
+		forgetManifest(path)
+		return nil
+	}
+
+	// Cache the decoded version so that the types match what
+	// LoadManifest would have returned when reading the file
+	var decoded map[string]interface{}
+	if json.Unmarshal(content, &decoded) == nil {
+		cacheStoreManifest(path, info, decoded)
+	} else {
+		forgetManifest(path)
+	}
+
 	return nil
 }
 
@@ -44,7 +95,7 @@ func ManifestValidateType(value interface{}) error {
 		return errors.New("Invalid type for \"type\"")
 	}
 
-	legal := []string{"zone-dataset", "lx-dataset", "zvol", "other"}
+	legal := []string{"zone-dataset", "lx-dataset", "zvol", "docker", "other"}
 	if !stringInSlice(value.(string), legal) {
 		return errors.New(fmt.Sprintf("Invalid value specified for \"type\": \"%v\"", value))
 	}
@@ -78,7 +129,7 @@ func ManifestValidateCompression(value interface{}) error {
 		return errors.New("Invalid type for \"compression\"")
 	}
 
-	legal := []string{"bzip2", "gzip", "none"}
+	legal := []string{"bzip2", "gzip", "xz", "none"}
 	if !stringInSlice(value.(string), legal) {
 		return errors.New(fmt.Sprintf("Invalid value specified for \"compression\": \"%v\"", value))
 	}
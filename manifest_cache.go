@@ -0,0 +1,168 @@
+package main
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The default number of manifests kept in the cache
+const defaultManifestCacheSize = 10000
+
+type cachedManifest struct {
+	path     string
+	modtime  time.Time
+	size     int64
+	manifest map[string]interface{}
+}
+
+/**
+ * A read-through cache of the manifests keyed by the path of the
+ * manifest file (datadir/.../uuid/manifest.json). An entry is only used
+ * as long as the modification time and size of the file on disk match
+ * the cached entry so that manifests modified outside the server gets
+ * picked up, and the entries is removed when the server modifies (or
+ * deletes) the manifest. The least recently used entries is evicted
+ * when the cache holds more than manifest_cache_size manifests.
+ */
+var manifestCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   manifestCacheStats
+}{entries: make(map[string]*list.Element), lru: list.New()}
+
+type manifestCacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+func manifestCacheSize() int {
+	if configuration.ManifestCacheSize != 0 {
+		return configuration.ManifestCacheSize
+	}
+	return defaultManifestCacheSize
+}
+
+// Get the number of cached manifests and the hit/miss counters
+func manifestCacheState() (int, manifestCacheStats) {
+	manifestCache.Lock()
+	defer manifestCache.Unlock()
+	return manifestCache.lru.Len(), manifestCache.stats
+}
+
+// Deep copy of a decoded JSON value so the callers may modify their copy
+func copyJsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			ret[key] = copyJsonValue(val)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, val := range v {
+			ret[i] = copyJsonValue(val)
+		}
+		return ret
+	case []map[string]interface{}:
+		ret := make([]interface{}, len(v))
+		for i, val := range v {
+			ret[i] = copyJsonValue(val)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+func cacheLookupManifest(path string, info os.FileInfo) (map[string]interface{}, bool) {
+	manifestCache.Lock()
+	element, ok := manifestCache.entries[path]
+	var entry *cachedManifest
+	if ok {
+		entry = element.Value.(*cachedManifest)
+		ok = entry.modtime.Equal(info.ModTime()) && entry.size == info.Size()
+	}
+	if ok {
+		manifestCache.lru.MoveToFront(element)
+		manifestCache.stats.Hits++
+	} else {
+		manifestCache.stats.Misses++
+	}
+	manifestCache.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	return copyJsonValue(entry.manifest).(map[string]interface{}), true
+}
+
+func cacheStoreManifest(path string, info os.FileInfo, manifest map[string]interface{}) {
+	max := manifestCacheSize()
+	if max < 0 {
+		return
+	}
+
+	entry := &cachedManifest{
+		path:     path,
+		modtime:  info.ModTime(),
+		size:     info.Size(),
+		manifest: copyJsonValue(manifest).(map[string]interface{}),
+	}
+
+	manifestCache.Lock()
+	defer manifestCache.Unlock()
+	if element, ok := manifestCache.entries[path]; ok {
+		element.Value = entry
+		manifestCache.lru.MoveToFront(element)
+		return
+	}
+	manifestCache.entries[path] = manifestCache.lru.PushFront(entry)
+	for manifestCache.lru.Len() > max {
+		oldest := manifestCache.lru.Back()
+		manifestCache.lru.Remove(oldest)
+		delete(manifestCache.entries, oldest.Value.(*cachedManifest).path)
+		manifestCache.stats.Evictions++
+	}
+}
+
+// Remove the manifest stored in path from the cache
+func forgetManifest(path string) {
+	manifestCache.Lock()
+	if element, ok := manifestCache.entries[path]; ok {
+		manifestCache.lru.Remove(element)
+		delete(manifestCache.entries, path)
+	}
+	manifestCache.Unlock()
+}
+
+/**
+ * Walk all of the images in the storage and load the manifests into
+ * the cache so that the first requests after a restart don't have to
+ * hit the disk.
+ */
+func warmManifestCache() {
+	start := time.Now()
+	uuids, err := storage.List()
+	if err != nil {
+		log.Printf("Failed to warm manifest cache: %v", err)
+		return
+	}
+
+	count := 0
+	for _, uuid := range uuids {
+		_, err := storage.GetManifest(uuid)
+		if err != nil {
+			log.Printf("Failed to load manifest for %s: %v", uuid, err)
+			continue
+		}
+		count++
+	}
+
+	log.Printf("Loaded %d manifests into the cache in %v", count, time.Since(start))
+}
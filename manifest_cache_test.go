@@ -0,0 +1,86 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+)
+
+func resetManifestCache() {
+	manifestCache.Lock()
+	manifestCache.entries = make(map[string]*list.Element)
+	manifestCache.lru = list.New()
+	manifestCache.stats = manifestCacheStats{}
+	manifestCache.Unlock()
+}
+
+func TestWarmManifestCacheOnStartup(t *testing.T) {
+	setupTestStorage(t)
+	var uuids []string
+	for i := 1; i <= 3; i++ {
+		uuid := fmt.Sprintf("00000000-0000-0000-0000-00000000000%d", i)
+		addTestImage(t, uuid, testManifest("warm"), "")
+		uuids = append(uuids, uuid)
+	}
+
+	// Start as if the server was restarted with an empty cache
+	resetManifestCache()
+	t.Cleanup(resetManifestCache)
+	configuration.WarmCache = true
+	err := initImageStorage()
+	if err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	count, before := manifestCacheState()
+	if count != len(uuids) {
+		t.Fatalf("Expected %d cached manifests after startup, got %d", len(uuids), count)
+	}
+
+	for _, uuid := range uuids {
+		_, err := storage.GetManifest(uuid)
+		if err != nil {
+			t.Fatalf("Failed to get manifest for %s: %v", uuid, err)
+		}
+	}
+	_, after := manifestCacheState()
+	if after.Misses != before.Misses || after.Hits != before.Hits+int64(len(uuids)) {
+		t.Errorf("Expected %d cache hits and no misses, got %d hits and %d misses",
+			len(uuids), after.Hits-before.Hits, after.Misses-before.Misses)
+	}
+}
+
+func TestDeleteForgetsManifest(t *testing.T) {
+	setupTestStorage(t)
+	local, err := newLocalStorage(configuration)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	storage = local
+	resetManifestCache()
+	t.Cleanup(resetManifestCache)
+
+	deleted := "00000000-0000-0000-0000-000000000001"
+	quarantined := "00000000-0000-0000-0000-000000000002"
+	for _, uuid := range []string{deleted, quarantined} {
+		addTestImage(t, uuid, testManifest("forget"), "")
+		_, err := storage.GetManifest(uuid)
+		if err != nil {
+			t.Fatalf("Failed to get manifest for %s: %v", uuid, err)
+		}
+	}
+	if count, _ := manifestCacheState(); count != 2 {
+		t.Fatalf("Expected 2 cached manifests, got %d", count)
+	}
+
+	err = local.Delete(deleted)
+	if err == nil {
+		err = local.(quarantineStorage).Quarantine(quarantined)
+	}
+	if err != nil {
+		t.Fatalf("Failed to remove the images: %v", err)
+	}
+	if count, _ := manifestCacheState(); count != 0 {
+		t.Errorf("Expected the manifests to be removed from the cache, got %d", count)
+	}
+}
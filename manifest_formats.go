@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * The formats the manifests may be sent in by ListImages and GetImage
+ * (with the format parameter) and the content type of each format.
+ * ndjson sends one manifest per line for the streaming consumers.
+ */
+var manifestFormats = map[string]string{
+	"json":   "application/json; charset=utf-8",
+	"yaml":   "application/yaml; charset=utf-8",
+	"ndjson": "application/x-ndjson; charset=utf-8",
+}
+
+// The number of manifests written between each flush of the listings
+const listFlushInterval = 100
+
+// Remove the format parameter from the parameters (json if not specified)
+func parseManifestFormat(params url.Values) (string, error) {
+	format := params.Get("format")
+	params.Del("format")
+	if len(format) == 0 {
+		return "json", nil
+	}
+	if _, ok := manifestFormats[format]; !ok {
+		return "", fmt.Errorf("Invalid format \"%s\" (must be json, yaml or ndjson)", format)
+	}
+	return format, nil
+}
+
+// The strings which may be written without quotes in YAML
+var yamlPlainRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_./-]*$")
+
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "y", "n":
+		return strconv.Quote(s)
+	}
+	if yamlPlainRegexp.MatchString(s) {
+		return s
+	}
+	// YAML double quoted strings use the same escapes as JSON
+	a, _ := json.Marshal(s)
+	return string(a)
+}
+
+func yamlScalar(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return yamlString(v)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	default:
+		a, _ := json.Marshal(v)
+		return string(a)
+	}
+}
+
+/**
+ * Write the decoded JSON value as YAML (in block style) with the
+ * indentation. Empty objects and arrays is written in flow style as
+ * {} and [].
+ */
+func writeYaml(buffer *bytes.Buffer, value interface{}, indent int) {
+	prefix := strings.Repeat(" ", indent)
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			buffer.WriteString(prefix + yamlString(key) + ":")
+			writeYamlValue(buffer, v[key], indent+2)
+		}
+
+	case []interface{}:
+		for _, item := range v {
+			var nested bytes.Buffer
+			writeYaml(&nested, item, indent+2)
+			buffer.WriteString(prefix + "- ")
+			buffer.Write(nested.Bytes()[indent+2:])
+		}
+
+	default:
+		buffer.WriteString(prefix + yamlScalar(v) + "\n")
+	}
+}
+
+// Write the value of a key (on the same line if it is a scalar)
+func writeYamlValue(buffer *bytes.Buffer, value interface{}, indent int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) > 0 {
+			buffer.WriteString("\n")
+			writeYaml(buffer, v, indent)
+			return
+		}
+	case []interface{}:
+		if len(v) > 0 {
+			buffer.WriteString("\n")
+			writeYaml(buffer, v, indent)
+			return
+		}
+	}
+	buffer.WriteString(" " + yamlScalar(value) + "\n")
+}
+
+// Convert the manifest to YAML
+func manifestToYaml(m map[string]interface{}) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("---\n")
+	writeYaml(&buffer, m, 0)
+	return buffer.Bytes()
+}
+
+// Send the formatted manifests with an ETag computed from the content
+func sendFormattedResponse(w http.ResponseWriter, r *http.Request, format string, content []byte) {
+	if checkNotModified(w, r, contentEtag(content), time.Time{}) {
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", manifestFormats[format])
+	h.Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(Success)
+	w.Write(content)
+}
+
+/**
+ * Write the manifests in the format to w. The manifests is converted
+ * one by one (and the response flushed regularly if flusher is set) so
+ * that the memory used doesn't depend on the number of manifests.
+ */
+func writeManifests(w io.Writer, format string, entries []indexEntry, flusher http.Flusher) error {
+	var err error
+	switch format {
+	case "json":
+		_, err = io.WriteString(w, "[")
+	case "yaml":
+		_, err = io.WriteString(w, "---\n")
+		if err == nil && len(entries) == 0 {
+			_, err = io.WriteString(w, "[]\n")
+		}
+	}
+
+	for i := 0; i < len(entries) && err == nil; i++ {
+		var buffer bytes.Buffer
+		switch format {
+		case "json":
+			if i > 0 {
+				buffer.WriteString(",")
+			}
+			a, _ := json.MarshalIndent(entries[i].manifest, "  ", "  ")
+			buffer.Write(a)
+		case "yaml":
+			writeYaml(&buffer, []interface{}{entries[i].manifest}, 0)
+		case "ndjson":
+			a, _ := json.Marshal(entries[i].manifest)
+			buffer.Write(append(a, '\n'))
+		}
+		_, err = w.Write(buffer.Bytes())
+		if flusher != nil && (i+1)%listFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+
+	if err == nil && format == "json" {
+		_, err = io.WriteString(w, "]")
+	}
+	return err
+}
+
+/**
+ * Send the manifests in the format without building the entire
+ * response in memory. The manifests is converted twice: first to get
+ * the ETag and the size of the response, and then to send them.
+ */
+func sendManifestList(w http.ResponseWriter, r *http.Request, format string, entries []indexEntry) {
+	etag, size := streamEtag(func(writer io.Writer) {
+		writeManifests(writer, format, entries, nil)
+	})
+	timingMark(w, "storage")
+	if checkNotModified(w, r, etag, time.Time{}) {
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", manifestFormats[format])
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(Success)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	err := writeManifests(w, format, entries, flusher)
+	if err != nil {
+		// The headers is already sent so all I can do is to log it
+		log.Printf("Failed to send the list of images: %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+ * The manifest index keeps all of the manifests in memory so that
+ * ListImages don't have to read every manifest from the storage for
+ * each request. The index is loaded when the server starts and kept in
+ * sync by the indexedStorage wrapper.
+ */
+type manifestIndex struct {
+	sync.RWMutex
+	manifests map[string]map[string]interface{}
+}
+
+var index = &manifestIndex{manifests: make(map[string]map[string]interface{})}
+
+// Load all of the manifests from the storage into the index
+func (i *manifestIndex) load(s Storage) error {
+	start := time.Now()
+	manifests, err := scan.run(s)
+	if err != nil {
+		return err
+	}
+
+	i.Lock()
+	i.manifests = manifests
+	i.Unlock()
+
+	log.Printf("Indexed %d manifests in %v", len(manifests), time.Since(start))
+	return nil
+}
+
+/**
+ * Add the manifest to the index. The manifest is converted through
+ * JSON so that the index contain the same types as it would have got
+ * by reading the manifest from the storage.
+ */
+func (i *manifestIndex) put(uuid string, m map[string]interface{}) {
+	content, err := json.Marshal(m)
+	if err == nil {
+		m = nil
+		err = json.Unmarshal(content, &m)
+	}
+	if err != nil {
+		log.Printf("Failed to index manifest for %s: %v", uuid, err)
+		i.remove(uuid)
+		return
+	}
+
+	i.Lock()
+	i.manifests[uuid] = m
+	i.Unlock()
+}
+
+func (i *manifestIndex) remove(uuid string) {
+	i.Lock()
+	delete(i.manifests, uuid)
+	i.Unlock()
+}
+
+// Get the manifest for uuid from the index (must not be modified)
+func (i *manifestIndex) get(uuid string) (map[string]interface{}, bool) {
+	i.RLock()
+	m, ok := i.manifests[uuid]
+	i.RUnlock()
+	return m, ok
+}
+
+type indexEntry struct {
+	uuid     string
+	manifest map[string]interface{}
+}
+
+/**
+ * Get all of the manifests in the index ordered by uuid. The
+ * manifests are shared with the index and must not be modified.
+ */
+func (i *manifestIndex) list() []indexEntry {
+	i.RLock()
+	entries := make([]indexEntry, 0, len(i.manifests))
+	for uuid, m := range i.manifests {
+		entries = append(entries, indexEntry{uuid, m})
+	}
+	i.RUnlock()
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].uuid < entries[b].uuid
+	})
+	return entries
+}
+
+// indexedStorage keeps the index in sync with the changes to the storage
+type indexedStorage struct {
+	Storage
+}
+
+func newIndexedStorage(s Storage) (Storage, error) {
+	err := index.load(s)
+	if err != nil {
+		return nil, err
+	}
+	return &indexedStorage{s}, nil
+}
+
+func (s *indexedStorage) PutManifest(uuid string, manifest map[string]interface{}) error {
+	err := s.Storage.PutManifest(uuid, manifest)
+	if err == nil {
+		index.put(uuid, manifest)
+	}
+	return err
+}
+
+func (s *indexedStorage) Delete(uuid string) error {
+	err := s.Storage.Delete(uuid)
+	index.remove(uuid)
+	return err
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+// The maximum size of a manifest (encoded as JSON) unless max_manifest_size is set
+const defaultMaxManifestSize = 64 * 1024
+
+func maxManifestSize() int64 {
+	if size := currentConfiguration().MaxManifestSize; size > 0 {
+		return size
+	}
+	return defaultMaxManifestSize
+}
+
+var (
+	versionRegexp = regexp.MustCompile("^[a-zA-Z0-9._-]+$")
+	sha1Regexp    = regexp.MustCompile("^[0-9a-f]{40}$")
+	sha256Regexp  = regexp.MustCompile("^[0-9a-f]{64}$")
+	sha512Regexp  = regexp.MustCompile("^[0-9a-f]{128}$")
+)
+
+// The fields the server maintains (they can't be updated by the client)
+var immutableManifestFields = []string{
+	"v", "uuid", "owner", "state", "disabled", "published_at",
+	"files", "icon", "origin", "channels", "promotions", "attachments",
+}
+
+/**
+ * manifestErrors collects the validation errors for the fields in the
+ * manifest. They're returned to the client in the "errors" array in
+ * the ValidationFailed error.
+ */
+type manifestErrors []errorcodes.FieldError
+
+func (e *manifestErrors) add(field string, code string, format string, args ...interface{}) {
+	*e = append(*e, errorcodes.FieldError{
+		Field:   field,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (e manifestErrors) response() (int, map[string]interface{}) {
+	sort.SliceStable(e, func(i, j int) bool {
+		return e[i].Field < e[j].Field
+	})
+
+	message := "Invalid manifest"
+	if len(e) == 1 {
+		message = e[0].Message
+	}
+	err := errorcodes.New(errorcodes.ValidationFailed, message)
+	err.Errors = e
+	return errorResponseFrom(err)
+}
+
+func validateString(errs *manifestErrors, field string, value interface{}, max int) (string, bool) {
+	s, ok := value.(string)
+	if !ok {
+		errs.add(field, "Invalid", "\"%s\" must be a string", field)
+		return "", false
+	}
+	if len(s) == 0 || len(s) > max {
+		errs.add(field, "Invalid", "\"%s\" must be between 1 and %d characters", field, max)
+		return "", false
+	}
+	return s, true
+}
+
+func validateUuid(errs *manifestErrors, field string, value interface{}) {
+	s, ok := value.(string)
+	if !ok || !isValidUuid(s) {
+		errs.add(field, "Invalid", "\"%s\" must be a UUID", field)
+	}
+}
+
+func validateBool(errs *manifestErrors, field string, value interface{}) {
+	if _, ok := value.(bool); !ok {
+		errs.add(field, "Invalid", "\"%s\" must be a boolean", field)
+	}
+}
+
+func validateStringArray(errs *manifestErrors, field string, value interface{}, uuids bool) {
+	if values, ok := value.([]string); ok {
+		list := make([]interface{}, len(values))
+		for i, s := range values {
+			list[i] = s
+		}
+		value = list
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		errs.add(field, "Invalid", "\"%s\" must be an array of strings", field)
+		return
+	}
+	for _, entry := range list {
+		s, ok := entry.(string)
+		if !ok || (uuids && !isValidUuid(s)) {
+			if uuids {
+				errs.add(field, "Invalid", "\"%s\" must be an array of UUIDs", field)
+			} else {
+				errs.add(field, "Invalid", "\"%s\" must be an array of strings", field)
+			}
+			return
+		}
+	}
+}
+
+func validateObject(errs *manifestErrors, field string, value interface{}) (map[string]interface{}, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		errs.add(field, "Invalid", "\"%s\" must be an object", field)
+	}
+	return object, ok
+}
+
+// Tag keys may not be empty, contain "." or start with "$", and the
+// values must be strings, numbers or booleans
+func validateTags(errs *manifestErrors, value interface{}) {
+	tags, ok := validateObject(errs, "tags", value)
+	if !ok {
+		return
+	}
+	for key, tag := range tags {
+		if len(key) == 0 || len(key) > 128 || strings.Contains(key, ".") || strings.HasPrefix(key, "$") {
+			errs.add("tags", "Invalid", "Invalid tag key \"%s\"", key)
+			continue
+		}
+		switch tag.(type) {
+		case string, float64, bool:
+		default:
+			errs.add("tags", "Invalid", "The value of tag \"%s\" must be a string, number or boolean", key)
+		}
+	}
+}
+
+func validateFiles(errs *manifestErrors, value interface{}) {
+	files, ok := value.([]interface{})
+	if !ok {
+		errs.add("files", "Invalid", "\"files\" must be an array")
+		return
+	}
+	for _, entry := range files {
+		file, ok := entry.(map[string]interface{})
+		if !ok {
+			errs.add("files", "Invalid", "\"files\" must be an array of objects")
+			return
+		}
+		for _, digest := range []struct {
+			name string
+			re   *regexp.Regexp
+		}{{"sha1", sha1Regexp}, {"sha256", sha256Regexp}, {"sha512", sha512Regexp}} {
+			if sum, ok := file[digest.name]; ok {
+				s, _ := sum.(string)
+				if !digest.re.MatchString(s) {
+					errs.add("files", "Invalid", "Invalid %s \"%v\"", digest.name, sum)
+				}
+			}
+		}
+		if size, ok := file["size"]; ok {
+			n, ok := size.(float64)
+			if !ok || n < 0 {
+				errs.add("files", "Invalid", "Invalid size \"%v\"", size)
+			}
+		}
+		if compression, ok := file["compression"]; ok {
+			err := ManifestValidateCompression(compression)
+			if err != nil {
+				errs.add("files", "Invalid", "%v", err)
+			}
+		}
+	}
+}
+
+/**
+ * Validate the manifest according to the IMGAPI manifest specification
+ *
+ * @param m the manifest to validate
+ * @return the errors found in the manifest (empty if it is valid)
+ */
+func validateManifest(m map[string]interface{}) manifestErrors {
+	var errs manifestErrors
+
+	for _, field := range []string{"uuid", "name", "version", "type", "os"} {
+		if _, ok := m[field]; !ok {
+			errs.add(field, "Missing", "Mandatory key \"%s\" is not present", field)
+		}
+	}
+
+	for k, v := range m {
+		switch k {
+		case "v":
+			if _, ok := v.(float64); !ok {
+				if _, ok := v.(int); !ok {
+					errs.add(k, "Invalid", "\"v\" must be a number")
+				}
+			}
+		case "uuid", "owner", "origin":
+			validateUuid(&errs, k, v)
+		case "name":
+			validateString(&errs, k, v, 512)
+		case "version":
+			s, ok := validateString(&errs, k, v, 128)
+			if ok && !versionRegexp.MatchString(s) {
+				errs.add(k, "Invalid", "\"version\" may only contain letters, digits, \".\", \"_\" and \"-\"")
+			}
+		case "description":
+			validateString(&errs, k, v, 512)
+		case "homepage", "eula":
+			s, ok := validateString(&errs, k, v, 512)
+			if ok && !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+				errs.add(k, "Invalid", "\"%s\" must be a http or https URL", k)
+			}
+		case "type":
+			if err := ManifestValidateType(v); err != nil {
+				errs.add(k, "Invalid", "%v", err)
+			}
+		case "os":
+			if err := ManifestValidateOs(v); err != nil {
+				errs.add(k, "Invalid", "%v", err)
+			}
+		case "state":
+			s, _ := v.(string)
+			if !stringInSlice(s, []string{"active", "unactivated", "disabled", "creating", "failed"}) {
+				errs.add(k, "Invalid", "Invalid value specified for \"state\": \"%v\"", v)
+			}
+		case "published_at":
+			s, _ := v.(string)
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs.add(k, "Invalid", "\"published_at\" must be an ISO 8601 timestamp")
+			}
+		case "expires_at":
+			s, _ := v.(string)
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				errs.add(k, "Invalid", "\"expires_at\" must be an ISO 8601 timestamp")
+			}
+		case "public", "disabled", "icon", "generate_passwords":
+			validateBool(&errs, k, v)
+		case "acl":
+			validateStringArray(&errs, k, v, true)
+		case "billing_tags", "inherited_directories", "channels":
+			validateStringArray(&errs, k, v, false)
+		case "tags":
+			validateTags(&errs, v)
+		case "requirements", "traits":
+			validateObject(&errs, k, v)
+		case "promotions":
+			list, ok := v.([]interface{})
+			if !ok {
+				errs.add(k, "Invalid", "\"promotions\" must be an array of objects")
+				break
+			}
+			for _, entry := range list {
+				if _, ok := entry.(map[string]interface{}); !ok {
+					errs.add(k, "Invalid", "\"promotions\" must be an array of objects")
+					break
+				}
+			}
+		case "users":
+			list, ok := v.([]interface{})
+			if !ok {
+				errs.add(k, "Invalid", "\"users\" must be an array of objects")
+				break
+			}
+			for _, entry := range list {
+				user, ok := entry.(map[string]interface{})
+				if _, named := user["name"].(string); !ok || !named {
+					errs.add(k, "Invalid", "\"users\" must be an array of objects with a name")
+					break
+				}
+			}
+		case "nic_driver", "disk_driver", "cpu_type":
+			validateString(&errs, k, v, 64)
+		case "image_size":
+			n, ok := v.(float64)
+			if !ok || n <= 0 {
+				errs.add(k, "Invalid", "\"image_size\" must be a positive number")
+			}
+		case "files":
+			validateFiles(&errs, v)
+		case "attachments":
+			validateManifestAttachments(&errs, v)
+		default:
+			errs.add(k, "Unknown", "Unknown parameter: %s", k)
+		}
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil || int64(len(content)) > maxManifestSize() {
+		errs.add("", "TooLarge", "The manifest must be smaller than %d bytes", maxManifestSize())
+	}
+
+	return errs
+}
+
+// Validate that the update don't try to change an immutable field
+func validateManifestUpdate(update map[string]interface{}, activated bool) manifestErrors {
+	var errs manifestErrors
+	for k := range update {
+		if stringInSlice(k, immutableManifestFields) {
+			errs.add(k, "Immutable", "\"%s\" may not be updated", k)
+		} else if activated && stringInSlice(k, activatedImmutableFields) {
+			errs.add(k, "Immutable", "\"%s\" may not be updated after the image is activated", k)
+		}
+	}
+	return errs
+}
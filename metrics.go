@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The buckets (in seconds) used for the request latency histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type requestKey struct {
+	endpoint string
+	method   string
+	code     int
+}
+
+type latencyHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+/**
+ * The metrics collected by the server. They're exported at /metrics in
+ * the Prometheus text format.
+ */
+type serverMetrics struct {
+	sync.Mutex
+	requests   map[requestKey]uint64
+	latencies  map[string]*latencyHistogram
+	uploaded   map[string]uint64
+	downloaded map[string]uint64
+}
+
+var metrics = serverMetrics{
+	requests:   make(map[requestKey]uint64),
+	latencies:  make(map[string]*latencyHistogram),
+	uploaded:   make(map[string]uint64),
+	downloaded: make(map[string]uint64),
+}
+
+func (s *serverMetrics) record(endpoint string, method string, code int, duration time.Duration, received int64, sent int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.requests[requestKey{endpoint, method, code}]++
+
+	histogram, ok := s.latencies[endpoint]
+	if !ok {
+		histogram = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+		s.latencies[endpoint] = histogram
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.sum += seconds
+	histogram.count++
+
+	s.uploaded[endpoint] += uint64(received)
+	s.downloaded[endpoint] += uint64(sent)
+}
+
+// Get the name of the endpoint (as used in the IMGAPI documentation)
+func endpointName(r *http.Request) string {
+	if imageRouter == nil {
+		return "Unknown"
+	}
+
+	name := imageRouter.routeName(r)
+	switch name {
+	case "":
+		return "Unknown"
+	case "CreateImage":
+		action, ok := createImageActions[r.URL.Query().Get("action")]
+		if ok {
+			return action.Endpoint
+		}
+	case "ImageAction":
+		action, ok := imageActions[r.URL.Query().Get("action")]
+		if ok {
+			return action.Endpoint
+		}
+	}
+	return name
+}
+
+/**
+ * metricsWriter wraps the http.ResponseWriter to record the status
+ * code and the number of bytes sent to the client.
+ */
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (m *metricsWriter) WriteHeader(code int) {
+	if m.status == 0 {
+		m.status = code
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *metricsWriter) Write(data []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(data)
+	m.bytes += int64(n)
+	return n, err
+}
+
+// Let http.ResponseController reach the connection (see timeouts.go)
+func (m *metricsWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// Pass on io.ReaderFrom so that the files may be sent with sendfile
+func (m *metricsWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := readFrom(m.ResponseWriter, reader)
+	m.bytes += n
+	return n, err
+}
+
+// Flush the response to the client (used by the event stream)
+func (m *metricsWriter) Flush() {
+	if flusher, ok := m.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Count the number of bytes read from the request body
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (c *countingReader) Read(data []byte) (int, error) {
+	n, err := c.ReadCloser.Read(data)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// Wrap the handler to collect the request metrics
+func withMetrics(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		writer := &metricsWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+
+		handler.ServeHTTP(writer, r)
+
+		if writer.status == 0 {
+			writer.status = http.StatusOK
+		}
+		metrics.record(endpointName(r), r.Method, writer.status,
+			time.Since(start), body.bytes, writer.bytes)
+	})
+}
+
+// Get the number of bytes used by the files in the directory
+func directorySize(dir string) (size int64, err error) {
+	// The deduplicated files is hard links, which is only counted once
+	seen := make(map[uint64]bool)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if links, inode, ok := fileLinks(info); ok && links > 1 {
+			if seen[inode] {
+				return nil
+			}
+			seen[inode] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (s *serverMetrics) write(buffer *bytes.Buffer) {
+	s.Lock()
+	defer s.Unlock()
+
+	buffer.WriteString("# HELP imgapi_requests_total The number of requests handled.\n")
+	buffer.WriteString("# TYPE imgapi_requests_total counter\n")
+	var keys []requestKey
+	for key := range s.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	for _, key := range keys {
+		fmt.Fprintf(buffer, "imgapi_requests_total{endpoint=%q,method=%q,code=\"%d\"} %d\n",
+			key.endpoint, key.method, key.code, s.requests[key])
+	}
+
+	var endpoints []string
+	for endpoint := range s.latencies {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	buffer.WriteString("# HELP imgapi_request_duration_seconds The time spent handling requests.\n")
+	buffer.WriteString("# TYPE imgapi_request_duration_seconds histogram\n")
+	for _, endpoint := range endpoints {
+		histogram := s.latencies[endpoint]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(buffer, "imgapi_request_duration_seconds_bucket{endpoint=%q,le=\"%g\"} %d\n",
+				endpoint, bound, histogram.buckets[i])
+		}
+		fmt.Fprintf(buffer, "imgapi_request_duration_seconds_bucket{endpoint=%q,le=\"+Inf\"} %d\n",
+			endpoint, histogram.count)
+		fmt.Fprintf(buffer, "imgapi_request_duration_seconds_sum{endpoint=%q} %g\n", endpoint, histogram.sum)
+		fmt.Fprintf(buffer, "imgapi_request_duration_seconds_count{endpoint=%q} %d\n", endpoint, histogram.count)
+	}
+
+	buffer.WriteString("# HELP imgapi_upload_bytes_total The number of bytes received from the clients.\n")
+	buffer.WriteString("# TYPE imgapi_upload_bytes_total counter\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(buffer, "imgapi_upload_bytes_total{endpoint=%q} %d\n", endpoint, s.uploaded[endpoint])
+	}
+
+	buffer.WriteString("# HELP imgapi_download_bytes_total The number of bytes sent to the clients.\n")
+	buffer.WriteString("# TYPE imgapi_download_bytes_total counter\n")
+	for _, endpoint := range endpoints {
+		fmt.Fprintf(buffer, "imgapi_download_bytes_total{endpoint=%q} %d\n", endpoint, s.downloaded[endpoint])
+	}
+}
+
+/*
+Metrics	GET /metrics	Server metrics in the Prometheus text format.
+*/
+func serverMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+	metrics.write(&buffer)
+
+	states := make(map[string]int)
+	for _, entry := range index.list() {
+		states[getImageState(entry.manifest)]++
+	}
+	var names []string
+	for state := range states {
+		names = append(names, state)
+	}
+	sort.Strings(names)
+
+	buffer.WriteString("# HELP imgapi_images The number of images by state.\n")
+	buffer.WriteString("# TYPE imgapi_images gauge\n")
+	for _, state := range names {
+		fmt.Fprintf(&buffer, "imgapi_images{state=%q} %d\n", state, states[state])
+	}
+
+	entries, cache := manifestCacheState()
+	buffer.WriteString("# HELP imgapi_manifest_cache_entries The number of manifests in the cache.\n")
+	buffer.WriteString("# TYPE imgapi_manifest_cache_entries gauge\n")
+	fmt.Fprintf(&buffer, "imgapi_manifest_cache_entries %d\n", entries)
+	buffer.WriteString("# HELP imgapi_manifest_cache_hits_total The number of manifests read from the cache.\n")
+	buffer.WriteString("# TYPE imgapi_manifest_cache_hits_total counter\n")
+	fmt.Fprintf(&buffer, "imgapi_manifest_cache_hits_total %d\n", cache.Hits)
+	buffer.WriteString("# HELP imgapi_manifest_cache_misses_total The number of manifests read from the storage.\n")
+	buffer.WriteString("# TYPE imgapi_manifest_cache_misses_total counter\n")
+	fmt.Fprintf(&buffer, "imgapi_manifest_cache_misses_total %d\n", cache.Misses)
+	buffer.WriteString("# HELP imgapi_manifest_cache_evictions_total The number of manifests evicted from the cache.\n")
+	buffer.WriteString("# TYPE imgapi_manifest_cache_evictions_total counter\n")
+	fmt.Fprintf(&buffer, "imgapi_manifest_cache_evictions_total %d\n", cache.Evictions)
+
+	if storageType(configuration) == "local" {
+		size, err := directorySize(configuration.Datadir)
+		if err == nil {
+			buffer.WriteString("# HELP imgapi_datadir_bytes The number of bytes used in the data directory.\n")
+			buffer.WriteString("# TYPE imgapi_datadir_bytes gauge\n")
+			fmt.Fprintf(&buffer, "imgapi_datadir_bytes %d\n", size)
+		}
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buffer.Bytes())
+}
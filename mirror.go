@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trondn/imgapi/client"
+)
+
+// The seconds between the synchronizations unless interval is set
+const defaultMirrorInterval = 60 * 60
+
+// The tag set on the images imported from the upstream server
+const mirrorSourceTag = "imgapi_mirror"
+
+// The tag set on the mirrored images which is removed upstream
+const mirrorRemovedTag = "imgapi_mirror_removed"
+
+// The configuration of mirror mode in the configuration file
+type MirrorConfig struct {
+	// The upstream IMGAPI server (like https://images.smartos.org)
+	Url string `json:"url"`
+	// Seconds between the synchronizations
+	Interval int `json:"interval"`
+	// The ListImages filters used to select the images to mirror
+	Filter map[string]string `json:"filter"`
+}
+
+/**
+ * In mirror mode the server periodically lists the images on the
+ * upstream server and imports the new images (see import_remote_image.go)
+ * and updates the manifests of the images changed upstream. The images
+ * removed upstream is kept, but tagged with imgapi_mirror_removed.
+ */
+type mirror struct {
+	sync.Mutex
+	client   *client.Client
+	lastRun  time.Time
+	imported int64
+	updated  int64
+	removed  int64
+	errors   int64
+	lastErr  string
+}
+
+var imageMirror *mirror
+
+func mirrorInterval() time.Duration {
+	if configuration.Mirror.Interval > 0 {
+		return time.Duration(configuration.Mirror.Interval) * time.Second
+	}
+	return defaultMirrorInterval * time.Second
+}
+
+// Start synchronizing with the upstream server (if configured)
+func startMirror() {
+	if len(configuration.Mirror.Url) == 0 {
+		return
+	}
+
+	imageMirror = &mirror{client: client.New(configuration.Mirror.Url)}
+	imageMirror.client.HttpClient = upstreamClient
+	go func() {
+		for {
+			if !inMaintenance() {
+				imageMirror.synchronize()
+			}
+			time.Sleep(mirrorInterval())
+		}
+	}()
+}
+
+func (m *mirror) fail(err error) {
+	log.Printf("mirror: %v", err)
+	m.errors++
+	m.lastErr = fmt.Sprintf("%v", err)
+}
+
+// Synchronize the local images with the upstream server once
+func (m *mirror) synchronize() {
+	m.Lock()
+	defer m.Unlock()
+	m.lastRun = time.Now().UTC()
+
+	filter := url.Values{}
+	for k, v := range configuration.Mirror.Filter {
+		filter.Set(k, v)
+	}
+
+	images, err := m.client.ListImages(filter)
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to list upstream images: %v", err))
+		return
+	}
+
+	upstream := make(map[string]bool)
+	for _, image := range images {
+		uuid := image.Uuid()
+		if !isValidUuid(uuid) {
+			continue
+		}
+		upstream[uuid] = true
+		m.synchronizeImage(uuid, image)
+	}
+
+	// Tag the mirrored images which is removed upstream
+	for _, entry := range index.list() {
+		tags, _ := entry.manifest["tags"].(map[string]interface{})
+		if tags[mirrorSourceTag] != configuration.Mirror.Url || upstream[entry.uuid] {
+			continue
+		}
+		if _, removed := tags[mirrorRemovedTag]; removed {
+			continue
+		}
+		m.markRemoved(entry.uuid)
+	}
+}
+
+// Add the tags used by the mirror to the upstream manifest
+func mirrorManifest(image client.Manifest) map[string]interface{} {
+	return taggedManifest(image, mirrorSourceTag, configuration.Mirror.Url)
+}
+
+// Copy the upstream manifest with the tag set to the upstream server
+func taggedManifest(image client.Manifest, tag string, source string) map[string]interface{} {
+	manifest := make(map[string]interface{})
+	for k, v := range image {
+		manifest[k] = v
+	}
+
+	tags := make(map[string]interface{})
+	if upstream, ok := image["tags"].(map[string]interface{}); ok {
+		for k, v := range upstream {
+			tags[k] = v
+		}
+	}
+	tags[tag] = source
+	manifest["tags"] = tags
+	return manifest
+}
+
+// Compare the manifests as JSON (which is independent of the types used)
+func manifestsEqual(a map[string]interface{}, b map[string]interface{}) bool {
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+// Import the image if it is new, or update the manifest if it changed
+func (m *mirror) synchronizeImage(uuid string, image client.Manifest) {
+	defer lockImage(uuid)()
+
+	local, err := storage.GetManifest(uuid)
+	if err == ErrImageNotFound {
+		m.importImage(uuid)
+		return
+	}
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to load manifest for %s: %v", uuid, err))
+		return
+	}
+
+	// Leave the local images alone
+	tags, _ := local["tags"].(map[string]interface{})
+	if tags[mirrorSourceTag] != configuration.Mirror.Url {
+		return
+	}
+
+	manifest := mirrorManifest(image)
+	if manifestsEqual(local, manifest) {
+		return
+	}
+
+	// The file of an activated image can't change, so replace the image
+	if !manifestsEqual(map[string]interface{}{"files": local["files"]},
+		map[string]interface{}{"files": manifest["files"]}) {
+		log.Printf("mirror: the files of %s changed upstream", uuid)
+		err = storage.Delete(uuid)
+		if err != nil {
+			m.fail(fmt.Errorf("Failed to delete %s: %v", uuid, err))
+			return
+		}
+		publishImageEvent(EventImageDeleted, uuid)
+		m.importImage(uuid)
+		return
+	}
+
+	// The attachments may change upstream (the removed ones is collected by the gc)
+	if !manifestsEqual(map[string]interface{}{"attachments": local["attachments"]},
+		map[string]interface{}{"attachments": manifest["attachments"]}) {
+		_, content := doFetchRemoteAttachments(strings.TrimRight(configuration.Mirror.Url, "/")+"/images/"+uuid, uuid, manifest)
+		if content != nil {
+			m.fail(fmt.Errorf("Failed to update the attachments of %s: %v", uuid, content["message"]))
+			return
+		}
+	}
+
+	err = storage.PutManifest(uuid, manifest)
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to update %s: %v", uuid, err))
+		return
+	}
+	log.Printf("mirror: updated %s", uuid)
+	publishImageEvent(EventImageUpdated, uuid)
+	m.updated++
+}
+
+// Import the image from the upstream server (the caller holds the image lock)
+func (m *mirror) importImage(uuid string) {
+	code, content := doServerImportRemoteImage(uuid, url.Values{"source": {configuration.Mirror.Url}}, false)
+	if code != Success {
+		m.fail(fmt.Errorf("Failed to import %s: %v", uuid, content["message"]))
+		return
+	}
+	err := storage.PutManifest(uuid, mirrorManifest(content))
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to tag %s: %v", uuid, err))
+		return
+	}
+	log.Printf("mirror: imported %s", uuid)
+	m.imported++
+}
+
+// Tag the image as removed upstream
+func (m *mirror) markRemoved(uuid string) {
+	defer lockImage(uuid)()
+
+	manifest, err := storage.GetManifest(uuid)
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to load manifest for %s: %v", uuid, err))
+		return
+	}
+
+	tags, _ := manifest["tags"].(map[string]interface{})
+	tags[mirrorRemovedTag] = time.Now().UTC().Format(time.RFC3339)
+	err = storage.PutManifest(uuid, manifest)
+	if err != nil {
+		m.fail(fmt.Errorf("Failed to tag %s: %v", uuid, err))
+		return
+	}
+	log.Printf("mirror: %s is removed upstream", uuid)
+	publishImageEvent(EventImageUpdated, uuid)
+	m.removed++
+}
+
+// Get the status of the mirror for /state
+func mirrorState() map[string]interface{} {
+	if imageMirror == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	imageMirror.Lock()
+	defer imageMirror.Unlock()
+	return map[string]interface{}{
+		"enabled":    true,
+		"url":        configuration.Mirror.Url,
+		"interval":   int64(mirrorInterval().Seconds()),
+		"last_run":   imageMirror.lastRun,
+		"imported":   imageMirror.imported,
+		"updated":    imageMirror.updated,
+		"removed":    imageMirror.removed,
+		"errors":     imageMirror.errors,
+		"last_error": imageMirror.lastErr,
+	}
+}
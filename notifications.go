@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// The message sent unless the notification has a template
+const defaultNotificationTemplate = "{{.Type}} {{.Uuid}}{{with .Manifest.name}} ({{.}} {{$.Manifest.version}}){{end}}{{with .Error}}: {{.}}{{end}}"
+
+// The subject of the emails unless the notification has a subject
+const defaultNotificationSubject = "[imgapi] {{.Type}} {{.Uuid}}"
+
+/**
+ * A Notifier delivers the notifications about the image events to
+ * people (by email, in a chat and so on).
+ */
+type Notifier interface {
+	/**
+	 * Send the notification
+	 *
+	 * @param subject the subject of the notification (from the subject template)
+	 * @param message the message (from the template)
+	 * @param event the event the notification is about
+	 */
+	Notify(subject string, message string, event ImageEvent) error
+}
+
+// The configuration of a notification in the configuration file
+type NotificationConfig struct {
+	Type string `json:"type"`
+	// The event types to notify about (all events if empty)
+	Events []string `json:"events"`
+	// The templates (text/template) for the subject and the message
+	Subject  string `json:"subject"`
+	Template string `json:"template"`
+	// The Slack incoming webhook or the URL for the generic webhook
+	Url     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// The SMTP server (host:port) and the sender and recipients of the emails
+	Server   string   `json:"server"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// The number of attempts before giving up (5 by default)
+	MaxAttempts int `json:"max_attempts"`
+}
+
+/**
+ * The registry of the available notification types. Each entry creates
+ * a Notifier for the provided configuration.
+ */
+var notifierTypes = map[string]func(config NotificationConfig) (Notifier, error){
+	"smtp":    newSmtpNotifier,
+	"slack":   newSlackNotifier,
+	"webhook": newWebhookNotifier,
+}
+
+// Register a new notification type to the registry
+func RegisterNotifierType(name string, factory func(config NotificationConfig) (Notifier, error)) {
+	notifierTypes[name] = factory
+}
+
+/**
+ * The sender for one notification. Like the webhooks the events is
+ * delivered in the order they happened by a background worker, and a
+ * failed delivery is retried with exponential backoff until
+ * max_attempts is reached.
+ */
+type notificationSender struct {
+	config   NotificationConfig
+	notifier Notifier
+	events   map[string]bool
+	subject  *template.Template
+	message  *template.Template
+	queue    chan ImageEvent
+
+	sync.Mutex
+	sent      int64
+	failed    int64
+	dropped   int64
+	lastError string
+}
+
+var notificationSenders []*notificationSender
+
+// Create the sender (and verify the configuration of the notification)
+func newNotificationSender(config NotificationConfig) (*notificationSender, error) {
+	factory, ok := notifierTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown notification type \"%s\"", config.Type)
+	}
+	for _, event := range config.Events {
+		if !webhookEvents[event] {
+			return nil, fmt.Errorf("Unknown notification event: %s", event)
+		}
+	}
+
+	s := &notificationSender{
+		config: config,
+		events: make(map[string]bool),
+		queue:  make(chan ImageEvent, webhookQueueSize),
+	}
+	for _, event := range config.Events {
+		s.events[event] = true
+	}
+	if s.config.MaxAttempts <= 0 {
+		s.config.MaxAttempts = defaultWebhookMaxAttempts
+	}
+	if len(s.config.Subject) == 0 {
+		s.config.Subject = defaultNotificationSubject
+	}
+	if len(s.config.Template) == 0 {
+		s.config.Template = defaultNotificationTemplate
+	}
+
+	var err error
+	s.subject, err = template.New("subject").Parse(s.config.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid notification subject: %v", err)
+	}
+	s.message, err = template.New("message").Parse(s.config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid notification template: %v", err)
+	}
+
+	s.notifier, err = factory(s.config)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Verify the configuration of the notifications
+func validateNotifications(notifications []NotificationConfig) error {
+	for _, config := range notifications {
+		_, err := newNotificationSender(config)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start the senders for the configured notifications
+func startNotifications() {
+	for _, config := range configuration.Notifications {
+		s, err := newNotificationSender(config)
+		if err != nil {
+			log.Printf("Ignoring %s notification: %v", config.Type, err)
+			continue
+		}
+		notificationSenders = append(notificationSenders, s)
+		go s.run()
+	}
+
+	if len(notificationSenders) > 0 {
+		subscribeImageEvents(queueNotification)
+	}
+}
+
+func queueNotification(event ImageEvent) {
+	for _, s := range notificationSenders {
+		if len(s.events) > 0 && !s.events[event.Type] {
+			continue
+		}
+
+		select {
+		case s.queue <- event:
+		default:
+			log.Printf("Dropping %s %s for %s notification (queue full)", event.Type, event.Uuid, s.config.Type)
+			s.Lock()
+			s.dropped++
+			s.Unlock()
+		}
+	}
+}
+
+/**
+ * Get the data for the templates. The fields of the manifest is
+ * available in .Manifest (like {{.Manifest.name}}), and the fields of
+ * the event as .Type, .Uuid, .Time and .Error.
+ */
+func notificationData(event ImageEvent) map[string]interface{} {
+	m := event.Manifest
+	if m == nil {
+		m = map[string]interface{}{"uuid": event.Uuid}
+	}
+	return map[string]interface{}{
+		"Type":     event.Type,
+		"Uuid":     event.Uuid,
+		"Time":     event.Time.Format(time.RFC3339),
+		"Error":    event.Error,
+		"Host":     configuration.Hostname,
+		"Manifest": m,
+	}
+}
+
+// Render the subject and message for the event
+func (s *notificationSender) render(event ImageEvent) (string, string, error) {
+	data := notificationData(event)
+
+	var subject, message bytes.Buffer
+	err := s.subject.Execute(&subject, data)
+	if err == nil {
+		err = s.message.Execute(&message, data)
+	}
+	return strings.TrimSpace(subject.String()), message.String(), err
+}
+
+func (s *notificationSender) run() {
+	for event := range s.queue {
+		subject, message, err := s.render(event)
+		if err != nil {
+			log.Printf("Failed to render %s notification for %s: %v", s.config.Type, event.Type, err)
+			s.Lock()
+			s.failed++
+			s.lastError = fmt.Sprintf("%v", err)
+			s.Unlock()
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			err = s.notifier.Notify(subject, message, event)
+			if err == nil {
+				s.Lock()
+				s.sent++
+				s.Unlock()
+				break
+			}
+
+			s.Lock()
+			s.lastError = fmt.Sprintf("%v", err)
+			s.Unlock()
+			if attempt >= s.config.MaxAttempts {
+				log.Printf("Giving up sending %s notification for %s %s: %v", s.config.Type, event.Type, event.Uuid, err)
+				s.Lock()
+				s.failed++
+				s.Unlock()
+				break
+			}
+
+			backoff := replicationBackoff(attempt)
+			log.Printf("Failed to send %s notification for %s %s (retry in %v): %v", s.config.Type, event.Type, event.Uuid, backoff, err)
+			time.Sleep(backoff)
+		}
+	}
+}
+
+func (s *notificationSender) status() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	return map[string]interface{}{
+		"type":       s.config.Type,
+		"pending":    len(s.queue),
+		"sent":       s.sent,
+		"failed":     s.failed,
+		"dropped":    s.dropped,
+		"last_error": s.lastError,
+	}
+}
+
+// Get the status of the notifications for /state
+func notificationsState() []interface{} {
+	state := make([]interface{}, 0, len(notificationSenders))
+	for _, s := range notificationSenders {
+		state = append(state, s.status())
+	}
+	return state
+}
+
+// The smtp notifier sends the notifications as emails
+type smtpNotifier struct {
+	config NotificationConfig
+}
+
+func newSmtpNotifier(config NotificationConfig) (Notifier, error) {
+	if len(config.Server) == 0 || len(config.From) == 0 || len(config.To) == 0 {
+		return nil, fmt.Errorf("smtp notification requires \"server\", \"from\" and \"to\"")
+	}
+	return &smtpNotifier{config: config}, nil
+}
+
+func (n *smtpNotifier) Notify(subject string, message string, event ImageEvent) error {
+	var auth smtp.Auth
+	if len(n.config.Username) > 0 {
+		host := n.config.Server
+		if i := strings.LastIndex(host, ":"); i != -1 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", n.config.Username, n.config.Password, host)
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.config.To, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", strings.ReplaceAll(subject, "\n", " "))
+	fmt.Fprintf(&body, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+	body.WriteString("\r\n")
+
+	return smtp.SendMail(n.config.Server, auth, n.config.From, n.config.To, body.Bytes())
+}
+
+/**
+ * The http notifier POSTs the notifications as JSON. The slack type
+ * sends the message as the text of a Slack incoming webhook, while the
+ * generic webhook gets the event with the subject and message.
+ */
+type httpNotifier struct {
+	config NotificationConfig
+	client *http.Client
+	slack  bool
+}
+
+func newSlackNotifier(config NotificationConfig) (Notifier, error) {
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("slack notification requires \"url\"")
+	}
+	return &httpNotifier{config: config, client: &http.Client{Timeout: webhookTimeout}, slack: true}, nil
+}
+
+func newWebhookNotifier(config NotificationConfig) (Notifier, error) {
+	if len(config.Url) == 0 {
+		return nil, fmt.Errorf("webhook notification requires \"url\"")
+	}
+	return &httpNotifier{config: config, client: &http.Client{Timeout: webhookTimeout}}, nil
+}
+
+func (n *httpNotifier) Notify(subject string, message string, event ImageEvent) error {
+	content := map[string]interface{}{"text": message}
+	if !n.slack {
+		content = map[string]interface{}{
+			"type":    event.Type,
+			"uuid":    event.Uuid,
+			"time":    event.Time,
+			"subject": subject,
+			"message": message,
+		}
+		if len(event.Error) > 0 {
+			content["error"] = event.Error
+		}
+	}
+	payload, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", n.config.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s returned %s", n.config.Url, resp.Status)
+	}
+	return nil
+}
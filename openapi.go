@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+// The description of an endpoint in the OpenAPI document
+type endpointDoc struct {
+	Summary string
+	// The query parameters (name and description)
+	Params [][2]string
+	// The response body: "manifest", "manifests", "binary", "text", "html",
+	// "none" (204 No Content) or "" (JSON)
+	Response string
+}
+
+/**
+ * The documentation of the endpoints by the name used in the router.
+ * The paths, methods, actions and error codes in the OpenAPI document
+ * is generated from the router and the registries, so only the
+ * descriptions is kept here. The routes without an entry is logged
+ * when the document is built.
+ */
+var endpointDocs = map[string]endpointDoc{
+	"ListImages": {Summary: "List available images.", Response: "manifests",
+		Params: [][2]string{
+			{"name", "Only images with the name (prefix with ~ for a substring match)"},
+			{"version", "Only images with the version"},
+			{"owner", "Only images owned by the account"},
+			{"state", "active (default), unactivated, disabled or all"},
+			{"os", "Only images with the os"},
+			{"type", "Only images with the type"},
+			{"public", "Only public (true) or private (false) images"},
+			{"channel", "The channel (* for all channels)"},
+			{"limit", "The maximum number of images to return"},
+			{"marker", "Return the images after the image with the uuid"},
+			{"format", "json (default), yaml or ndjson (one manifest per line, streamed)"},
+		}},
+	"CreateImage": {Summary: "Create a new (unactivated) image from a manifest, or perform one of the actions creating images.", Response: "manifest",
+		Params: [][2]string{{"dry_run", "Validate the request without changing anything"}}},
+	"ImageChanges": {Summary: "Follow the image events (Server-Sent Events or long-poll).",
+		Params: [][2]string{
+			{"since", "The id of the last event seen"},
+			{"timeout", "Seconds to wait for events"},
+		}},
+	"SearchImages": {Summary: "Search the images with free text, tag expressions and version ranges.",
+		Params: [][2]string{
+			{"q", "The free text query"},
+			{"query", "The tag expression"},
+			{"version", "The version range"},
+			{"sort", "relevance, name, published_at, uuid or version"},
+			{"limit", "The maximum number of images to return"},
+			{"offset", "The number of images to skip"},
+		}},
+	"GetImage": {Summary: "Get a particular image manifest.", Response: "manifest",
+		Params: [][2]string{{"format", "json (default), yaml or ndjson"}}},
+	"BatchImages": {Summary: "Perform a list of operations (delete and actions) on images with the result of each operation.",
+		Params: [][2]string{{"dry_run", "Validate the operations without changing anything"}}},
+	"ImageAction":  {Summary: "Perform an action on the image.", Response: "manifest", Params: [][2]string{{"dry_run", "Validate the request without changing anything"}}},
+	"DeleteImage":  {Summary: "Delete an image (and its file).", Response: "none", Params: [][2]string{{"force", "Delete the images depending on the image as well"}, {"dry_run", "Validate the request without changing anything"}}},
+	"GetImageFile": {Summary: "Get the file for this image.", Response: "binary"},
+	"AddImageFile": {Summary: "Upload the image file (or another file).", Response: "manifest",
+		Params: [][2]string{
+			{"index", "The index of the file in the files array"},
+			{"compression", "gzip, bzip2, xz or none"},
+			{"sha1", "The expected SHA-1 of the file"},
+			{"sha256", "The expected SHA-256 of the file"},
+			{"sha512", "The expected SHA-512 of the file"},
+			{"storage", "The storage to use"},
+			{"delta", "The body is a delta against the file of this image (see GetImageFileBlocks)"},
+			{"delta_index", "The index of the file of the delta image"},
+		}},
+	"GetImageFileBlocks": {Summary: "Get the block checksums of the image file (for delta uploads).",
+		Params: [][2]string{{"index", "The index of the file in the files array"}}},
+	"GetImageIcon": {Summary: "Get the image icon file.", Response: "binary",
+		Params: [][2]string{{"size", "Get a PNG thumbnail of the icon (32, 64 or 128 pixels)"}}},
+	"AddImageIcon":           {Summary: "Add the image icon.", Response: "manifest"},
+	"DeleteImageIcon":        {Summary: "Remove the image icon.", Response: "manifest"},
+	"ImageAcl":               {Summary: "Add (action=add) or remove (action=remove) account UUIDs in the image ACL.", Response: "manifest", Params: [][2]string{{"action", "add or remove"}}},
+	"GetImageAncestry":       {Summary: "Get the origin chain of the image (the image first).", Response: "manifests"},
+	"ListImageTags":          {Summary: "Get the tags of the image."},
+	"GetImageTag":            {Summary: "Get the value of a tag of the image."},
+	"PutImageTag":            {Summary: "Set a tag of the image (the body is the JSON value).", Response: "manifest"},
+	"DeleteImageTag":         {Summary: "Remove a tag from the image.", Response: "manifest"},
+	"GetImageHistory":        {Summary: "List the previous revisions of the image manifest."},
+	"GetImageRevision":       {Summary: "Get a previous revision of the image manifest."},
+	"ExportImageBundle":      {Summary: "Get a tar archive with the image and its origin chain.", Response: "binary"},
+	"GetImageSignature":      {Summary: "Get the signature of the image."},
+	"AddImageSignature":      {Summary: "Add (or replace) the signature of the image."},
+	"DeleteImageSignature":   {Summary: "Remove the signature of the image.", Response: "none"},
+	"GetImageSigningPayload": {Summary: "Get the payload to sign for the image."},
+	"ListImageAttachments":   {Summary: "Get the attachments of the image (the content type, size and SHA-256 by name)."},
+	"GetImageAttachment":     {Summary: "Get an attachment of the image.", Response: "binary"},
+	"PutImageAttachment":     {Summary: "Add (or replace) an attachment of the image (like a vulnerability report) with the Content-Type of the attachment.", Response: "manifest", Params: [][2]string{{"sha256", "The expected SHA-256 of the attachment"}}},
+	"DeleteImageAttachment":  {Summary: "Remove an attachment from the image.", Response: "manifest"},
+	"ListChannels":           {Summary: "List image channels (if the server uses channels)."},
+	"Ping":                   {Summary: "Ping if the server is up."},
+	"Version":                {Summary: "Get the version of the server and the supported features, actions and storage types."},
+	"Health":                 {Summary: "Check the storage, the free space and the index."},
+	"Ready":                  {Summary: "Check if the server accepts requests (for load balancers)."},
+	"CreateToken":            {Summary: "Create a new API token for the authenticated user."},
+	"DeleteToken":            {Summary: "Revoke the API token.", Response: "none"},
+	"Metrics":                {Summary: "Server metrics in the Prometheus text format.", Response: "text"},
+	"AdminGetState":          {Summary: "Dump internal server state (for dev/debugging)."},
+	"AdminGetReplication":    {Summary: "Get the status of the replication to the downstream servers."},
+	"AdminGetAudit": {Summary: "Search the audit log of the requests modifying the images.",
+		Params: [][2]string{
+			{"user", "Only requests by the user"},
+			{"since", "Only requests after the time (RFC3339)"},
+			{"until", "Only requests before the time (RFC3339)"},
+			{"limit", "The maximum number of entries to return"},
+		}},
+	"GetUsage":                {Summary: "Get the number of images and bytes stored by each owner.", Params: [][2]string{{"owner", "Only the usage of the account (operators only)"}}},
+	"AdminListTrash":          {Summary: "List the deleted images in the trash."},
+	"AdminRestoreImage":       {Summary: "Restore the deleted image from the trash.", Response: "manifest", Params: [][2]string{{"action", "restore"}}},
+	"AdminPurgeImage":         {Summary: "Remove the deleted image from the trash.", Response: "none"},
+	"AdminGetMaintenance":     {Summary: "Get the state of the maintenance mode."},
+	"AdminEnableMaintenance":  {Summary: "Put the server in read-only maintenance mode (with the message and retry_after in the body)."},
+	"AdminDisableMaintenance": {Summary: "Leave the maintenance mode."},
+	"DockerRegistry":          {Summary: "Read-only Docker Registry HTTP API v2 for the docker images."},
+	"WebUI":                   {Summary: "The web UI.", Response: "html"},
+	"Docs":                    {Summary: "Get the OpenAPI specification of the API."},
+	"DocsUI":                  {Summary: "Browse the OpenAPI specification with Swagger UI.", Response: "html"},
+}
+
+// Convert "/images/:uuid/file" into "/images/{uuid}/file"
+func openApiPath(segments []string) string {
+	parts := make([]string, len(segments))
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segment = "{" + segment[1:] + "}"
+		}
+		parts[i] = segment
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// Get the content of the successful response for the endpoint
+func openApiResponse(doc endpointDoc) map[string]interface{} {
+	var content map[string]interface{}
+	switch doc.Response {
+	case "manifest":
+		content = map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaRef("Manifest")}}
+	case "manifests":
+		content = map[string]interface{}{"application/json": map[string]interface{}{
+			"schema": map[string]interface{}{"type": "array", "items": schemaRef("Manifest")},
+		}}
+	case "binary":
+		content = map[string]interface{}{"application/octet-stream": map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "format": "binary"},
+		}}
+	case "text":
+		content = map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	case "html":
+		content = map[string]interface{}{"text/html": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	default:
+		content = map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}}}
+	}
+	return map[string]interface{}{"description": "Success", "content": content}
+}
+
+/**
+ * Describe the actions in the registry (for the action parameter of
+ * POST /images and POST /images/:uuid)
+ *
+ * @return the names of the actions and the description of them
+ */
+func openApiActions(actions map[string]ImageAction) ([]string, string) {
+	var names []string
+	for name := range actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"The action to perform:"}
+	for _, name := range names {
+		action := actions[name]
+		line := fmt.Sprintf("- `%s` (%s)", name, action.Endpoint)
+		if action.OperatorOnly {
+			line += " operators only"
+		}
+		if action.Handler == nil {
+			line += " not implemented"
+		}
+		lines = append(lines, line)
+	}
+	return names, strings.Join(lines, "\n")
+}
+
+// Get the parameters of the operation (the path variables and the query parameters)
+func openApiParameters(rt *route, doc endpointDoc) []interface{} {
+	params := []interface{}{}
+	for _, segment := range rt.segments {
+		if !strings.HasPrefix(segment, ":") && !strings.HasPrefix(segment, "*") {
+			continue
+		}
+		schema := map[string]interface{}{"type": "string"}
+		if segment == ":uuid" {
+			schema["format"] = "uuid"
+		}
+		params = append(params, map[string]interface{}{
+			"name": segment[1:], "in": "path", "required": true, "schema": schema,
+		})
+	}
+
+	for _, p := range doc.Params {
+		params = append(params, map[string]interface{}{
+			"name": p[0], "in": "query", "description": p[1],
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+
+	var actions map[string]ImageAction
+	switch rt.name {
+	case "CreateImage":
+		actions = createImageActions
+	case "ImageAction":
+		actions = imageActions
+	}
+	if actions != nil {
+		names, description := openApiActions(actions)
+		params = append(params, map[string]interface{}{
+			"name": "action", "in": "query", "description": description,
+			"required": rt.name == "ImageAction",
+			"schema":   map[string]interface{}{"type": "string", "enum": names},
+		})
+	}
+	return params
+}
+
+// The schemas of the manifests and the errors
+func openApiSchemas() map[string]interface{} {
+	codes := []string{}
+	for _, code := range errorcodes.Codes() {
+		codes = append(codes, string(code))
+	}
+	str := map[string]interface{}{"type": "string"}
+	uuid := map[string]interface{}{"type": "string", "format": "uuid"}
+	return map[string]interface{}{
+		"File": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"sha1":        str,
+				"size":        map[string]interface{}{"type": "integer"},
+				"compression": map[string]interface{}{"type": "string", "enum": []string{"gzip", "bzip2", "xz", "none"}},
+			},
+		},
+		"Manifest": map[string]interface{}{
+			"type":                 "object",
+			"required":             []string{"name", "version", "type", "os"},
+			"additionalProperties": true,
+			"properties": map[string]interface{}{
+				"v":            map[string]interface{}{"type": "integer"},
+				"uuid":         uuid,
+				"owner":        uuid,
+				"name":         str,
+				"version":      str,
+				"description":  str,
+				"homepage":     str,
+				"eula":         str,
+				"icon":         map[string]interface{}{"type": "boolean"},
+				"state":        map[string]interface{}{"type": "string", "enum": []string{"active", "unactivated", "disabled", "creating", "failed"}},
+				"disabled":     map[string]interface{}{"type": "boolean"},
+				"public":       map[string]interface{}{"type": "boolean"},
+				"published_at": map[string]interface{}{"type": "string", "format": "date-time"},
+				"type":         str,
+				"os":           str,
+				"origin":       uuid,
+				"files":        map[string]interface{}{"type": "array", "items": schemaRef("File")},
+				"acl":          map[string]interface{}{"type": "array", "items": uuid},
+				"requirements": map[string]interface{}{"type": "object"},
+				"tags":         map[string]interface{}{"type": "object"},
+				"attachments":  map[string]interface{}{"type": "object"},
+				"channels":     map[string]interface{}{"type": "array", "items": str},
+			},
+		},
+		"FieldError": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"field":   str,
+				"code":    str,
+				"message": str,
+			},
+		},
+		"Error": map[string]interface{}{
+			"type":     "object",
+			"required": []string{"code", "message"},
+			"properties": map[string]interface{}{
+				"code":       map[string]interface{}{"type": "string", "enum": codes},
+				"message":    str,
+				"errors":     map[string]interface{}{"type": "array", "items": schemaRef("FieldError")},
+				"request_id": str,
+			},
+		},
+	}
+}
+
+/**
+ * Build the OpenAPI 3 document for the routes of the router. The
+ * document is generated from the routes (and the action registries)
+ * so it always describe the endpoints of the running server.
+ */
+func buildOpenApi(router *router) map[string]interface{} {
+	paths := map[string]interface{}{}
+	operationIds := map[string]int{}
+	for _, rt := range router.routes {
+		doc, ok := endpointDocs[rt.name]
+		if !ok {
+			log.Printf("openapi: No documentation for the endpoint %s", rt.name)
+			doc = endpointDoc{Summary: rt.name}
+		}
+
+		path := openApiPath(rt.segments)
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		method := strings.ToLower(rt.method)
+		if _, ok := item[method]; ok {
+			continue
+		}
+
+		responses := map[string]interface{}{
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef("Error")},
+				},
+			},
+		}
+		if rt.method == "HEAD" {
+			responses[strconv.Itoa(Success)] = map[string]interface{}{"description": "Success (the headers of GET without the body)"}
+		} else if doc.Response == "none" {
+			responses[strconv.Itoa(NoContent)] = map[string]interface{}{"description": "Success"}
+		} else {
+			responses[strconv.Itoa(Success)] = openApiResponse(doc)
+		}
+
+		// The operation ids must be unique (some endpoints has more than one route)
+		operationId := rt.name
+		if rt.method == "HEAD" {
+			operationId = "Head" + strings.TrimPrefix(rt.name, "Get")
+		}
+		operationIds[operationId]++
+		if n := operationIds[operationId]; n > 1 {
+			operationId += strconv.Itoa(n)
+		}
+		item[method] = map[string]interface{}{
+			"operationId": operationId,
+			"summary":     doc.Summary,
+			"parameters":  openApiParameters(rt, doc),
+			"responses":   responses,
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "IMGAPI",
+			"version": serverVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": openApiSchemas(),
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":  map[string]interface{}{"type": "http", "scheme": "basic"},
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{},
+			map[string]interface{}{"basicAuth": []string{}},
+			map[string]interface{}{"bearerAuth": []string{}},
+		},
+	}
+}
+
+/*
+Docs	GET /docs	Get the OpenAPI specification of the API.
+*/
+func serverDocs(w http.ResponseWriter, r *http.Request) {
+	doc := buildOpenApi(imageRouter)
+	doc["servers"] = []interface{}{map[string]interface{}{"url": requestBaseUrl(r)}}
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to build the specification: %v", err))
+		return
+	}
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+// The base URL of the Swagger UI files used by /docs/ui
+const swaggerUiUrl = "https://unpkg.com/swagger-ui-dist@5"
+
+const swaggerUiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>IMGAPI</title>
+<link rel="stylesheet" href="` + swaggerUiUrl + `/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="` + swaggerUiUrl + `/swagger-ui-bundle.js"></script>
+<script>
+SwaggerUIBundle({ url: "../docs", dom_id: "#swagger-ui" });
+</script>
+</body>
+</html>
+`
+
+/*
+DocsUI	GET /docs/ui	Browse the OpenAPI specification with Swagger UI (if swagger_ui is enabled).
+*/
+func serverDocsUi(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(swaggerUiPage)))
+	h.Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline' https://unpkg.com; style-src https://unpkg.com; img-src 'self' data:")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(swaggerUiPage))
+}
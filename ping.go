@@ -9,10 +9,7 @@ import (
 
 func doServerPing(w http.ResponseWriter, r *http.Request) (int, map[string]interface{}) {
 	if len(r.Method) > 0 && r.Method != "GET" {
-		return BadRequestError, map[string]interface{}{
-			"code":    "BadRequestError",
-			"message": fmt.Sprintf("Illegal method %s", r.Method),
-		}
+		return errorResponse(CodeBadRequestError, fmt.Sprintf("Illegal method %s", r.Method))
 	}
 
 	parameters, err := url.ParseQuery(r.URL.RawQuery)
@@ -28,10 +25,7 @@ func doServerPing(w http.ResponseWriter, r *http.Request) (int, map[string]inter
 
 	for k, v := range parameters {
 		if len(v) != 0 { // don't allow the same param to occur multiple times
-			return InsufficientServerVersion, map[string]interface{}{
-				"code":    "InsufficientServerVersion",
-				"message": "param may only occur once",
-			}
+			return errorResponse(CodeInsufficientServerVersion, "param may only occur once")
 		}
 		switch k {
 		case "error":
@@ -41,10 +35,7 @@ func doServerPing(w http.ResponseWriter, r *http.Request) (int, map[string]inter
 			message = v[0]
 			break
 		default:
-			return InvalidParameter, map[string]interface{}{
-				"code":    "InvalidParameter",
-				"message": fmt.Sprintf("Invalid parameter \"%s\"", k),
-			}
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter \"%s\"", k))
 		}
 	}
 
@@ -57,7 +48,7 @@ func doServerPing(w http.ResponseWriter, r *http.Request) (int, map[string]inter
 	} else {
 		pong = map[string]interface{}{
 			"ping":    message,
-			"version": "1.0.0",
+			"version": serverVersion,
 			"pid":     os.Getpid(),
 			"imgapi":  true,
 		}
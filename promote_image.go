@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The promotions of the image (in the order they happened)
+func getManifestPromotions(m map[string]interface{}) []interface{} {
+	promotions, _ := m["promotions"].([]interface{})
+	return promotions
+}
+
+/**
+ * Get the approval in the body of the promote request. The approval is
+ * optional (unless the channel has require_approval), but it must name
+ * the user who approved the promotion. The other fields (like a ticket
+ * or a comment) is recorded as is.
+ */
+func getPromotionApproval(body map[string]interface{}) (map[string]interface{}, error) {
+	value, ok := body["approval"]
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	approval, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("approval must be an object")
+	}
+	for k, v := range approval {
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("approval.%s must be a string", k)
+		}
+	}
+	if by, _ := approval["approved_by"].(string); len(by) == 0 {
+		return nil, fmt.Errorf("approval.approved_by not specified")
+	}
+	return approval, nil
+}
+
+/**
+ * Promote the image to the channel specified in the body of the
+ * request. The image is moved from the channel's promote_from channel
+ * (or copied with "copy" set to true), and the promotion (and the
+ * approval) is recorded in "promotions" in the manifest:
+ *
+ *     { "channel": "staging", "copy": false,
+ *       "approval": { "approved_by": "name", "comment": "..." } }
+ */
+func doServerPromoteImage(r *http.Request, uuid string, params url.Values, user *UserEntry, reader io.Reader) (int, map[string]interface{}) {
+	if !channelsEnabled() {
+		return errorResponse(CodeResourceNotFound, "No support for promoting images")
+	}
+
+	for k := range params {
+		switch k {
+		case "action":
+			break
+		case "account":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+
+	var body map[string]interface{}
+	err = json.Unmarshal(content, &body)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Failed to decode body: %v", err))
+	}
+
+	name, ok := body["channel"].(string)
+	if !ok {
+		return errorResponse(CodeInvalidParameter, "channel not specified")
+	}
+	channel, ok := lookupChannel(name)
+	if !ok {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Unknown channel \"%s\"", name))
+	}
+	if len(channel.PromoteFrom) == 0 {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Images can't be promoted to channel \"%s\"", name))
+	}
+	keep, ok := body["copy"].(bool)
+	if _, present := body["copy"]; present && !ok {
+		return errorResponse(CodeInvalidParameter, "copy must be a boolean")
+	}
+
+	if channel.PromoteRole == RoleOperator && !isOperator(user) {
+		return errorResponse(CodeNotAuthorizedError, fmt.Sprintf("Only operators may promote images to channel \"%s\"", name))
+	}
+
+	approval, err := getPromotionApproval(body)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid approval: %v", err))
+	}
+	if channel.RequireApproval {
+		if approval == nil {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Promoting images to channel \"%s\" requires approval", name))
+		}
+		if approval["approved_by"] == user.Name {
+			return errorResponse(CodeNotAuthorizedError, fmt.Sprintf("User %s may not approve their own promotion", user.Name))
+		}
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	if getImageState(m) != StateActive {
+		return errorResponse(CodeInvalidParameter, "Only active images may be promoted")
+	}
+	channels := getManifestChannels(m)
+	if !stringInSlice(channel.PromoteFrom, channels) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("The image is not in channel \"%s\"", channel.PromoteFrom))
+	}
+	if stringInSlice(name, channels) {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("The image is already in channel \"%s\"", name))
+	}
+
+	previous := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		previous[k] = v
+	}
+
+	updated := []string{}
+	for _, entry := range channels {
+		if entry != channel.PromoteFrom || keep {
+			updated = append(updated, entry)
+		}
+	}
+	m["channels"] = append(updated, name)
+
+	promotion := map[string]interface{}{
+		"from": channel.PromoteFrom,
+		"to":   name,
+		"user": user.Name,
+		"time": time.Now().UTC().Format(time.RFC3339),
+	}
+	if keep {
+		promotion["copy"] = true
+	}
+	if approval != nil {
+		promotion["approval"] = approval
+	}
+	m["promotions"] = append(append([]interface{}{}, getManifestPromotions(m)...), promotion)
+
+	err = addManifestRevision(uuid, previous, r)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store history: %v", err))
+	}
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	publishImageEvent(EventImagePromoted, uuid)
+	return Success, m
+}
+
+func serverPromoteImage(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	code, content := doServerPromoteImage(r, uuid, params, user, r.Body)
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/**
+ * Parse the trusted proxies in the configuration. Each entry is an IP
+ * address or a network in CIDR notation (like "10.0.0.0/8").
+ */
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted proxy \"%s\"", proxy)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			proxy = fmt.Sprintf("%s/%d", proxy, bits)
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy \"%s\"", proxy)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func isTrustedProxy(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Get the address of the client from X-Forwarded-For. The addresses is
+ * checked from the right so that the client can't spoof the address by
+ * sending its own X-Forwarded-For; the first address which isn't a
+ * trusted proxy is the client.
+ */
+func forwardedFor(networks []*net.IPNet, header string) string {
+	addrs := strings.Split(header, ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(addrs[i])
+		if i == 0 || !isTrustedProxy(networks, addr) {
+			if net.ParseIP(addr) == nil {
+				return ""
+			}
+			return addr
+		}
+	}
+	return ""
+}
+
+/**
+ * Wrap the handler to use the X-Forwarded-For, X-Forwarded-Proto and
+ * X-Forwarded-Host headers in requests from the trusted proxies, so
+ * that the logs, the rate limits and the URLs generated by the server
+ * use the address of the client and the scheme and host the client
+ * used. The headers from other clients is ignored.
+ */
+func withProxyHeaders(handler http.Handler) http.Handler {
+	networks, _ := parseTrustedProxies(configuration.TrustedProxies)
+	if len(networks) == 0 {
+		return handler
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrustedProxy(networks, remoteIp(r)) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		if header := r.Header.Get("X-Forwarded-For"); len(header) > 0 {
+			if addr := forwardedFor(networks, header); len(addr) > 0 {
+				r.RemoteAddr = addr
+			}
+		}
+		switch proto := strings.ToLower(r.Header.Get("X-Forwarded-Proto")); proto {
+		case "http", "https":
+			r.URL.Scheme = proto
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); len(host) > 0 {
+			r.Host = strings.TrimSpace(strings.Split(host, ",")[0])
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// Get the scheme the client used (as reported by the trusted proxy)
+func requestScheme(r *http.Request) string {
+	if len(r.URL.Scheme) > 0 {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// Get the URL of the server as seen by the client (like "https://images.example.com")
+func requestBaseUrl(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// The configuration of the storage quotas in the configuration file
+type QuotaConfig struct {
+	// The number of bytes each owner may store (0 means no limit)
+	Default int64 `json:"default"`
+	// The quota for specific owners (overrides default)
+	Owners map[string]int64 `json:"owners"`
+}
+
+var errFileTooLarge = errors.New("The image file is too large")
+var errQuotaExceeded = errors.New("The storage quota for the owner is exceeded")
+var errInsufficientStorage = errors.New("The server is running out of disk space")
+
+/**
+ * Get the number of bytes which may be stored before the free space in
+ * datadir drops below min_free_space.
+ *
+ * @return the number of bytes (false if there is no limit)
+ */
+func uploadFreeSpace() (int64, bool) {
+	min := configuration.MinFreeSpace
+	if min == 0 || storageType(configuration) != "local" {
+		return 0, false
+	}
+	free, _, err := diskSpace(configuration.Datadir)
+	if err != nil {
+		return 0, false
+	}
+	if int64(free) < min {
+		return 0, true
+	}
+	return int64(free) - min, true
+}
+
+// Verify that there is free space for new uploads
+func checkUploadSpace() (int, map[string]interface{}) {
+	if free, ok := uploadFreeSpace(); ok && free == 0 {
+		return uploadLimitResponse(errInsufficientStorage, 0)
+	}
+	return Success, nil
+}
+
+// The quotas is only checked if a default or owner quota is configured
+func quotaEnabled() bool {
+	config := currentConfiguration().Quota
+	return config.Default > 0 || len(config.Owners) > 0
+}
+
+// Get the quota for the owner (0 if there is no limit)
+func ownerQuota(owner string) int64 {
+	config := currentConfiguration().Quota
+	if quota, ok := config.Owners[owner]; ok {
+		return quota
+	}
+	return config.Default
+}
+
+// Get the images of the owner (with the index of the catalog if it has one)
+func ownerImages(owner string) []indexEntry {
+	var entries []indexEntry
+	if catalog, ok := storageQueryCatalog(storage); ok {
+		uuids, err := catalog.Find(map[string]string{"owner": owner})
+		if err == nil {
+			for _, uuid := range uuids {
+				if m, ok := index.get(uuid); ok {
+					entries = append(entries, indexEntry{uuid, m})
+				}
+			}
+			return entries
+		}
+		log.Printf("Failed to query the catalog: %v", err)
+	}
+
+	for _, entry := range index.list() {
+		if entry.manifest["owner"] == owner {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+/**
+ * Get the number of bytes used by the image files of the owner
+ *
+ * @param owner the owner to get the usage for
+ * @param uuid the image with the file being replaced
+ * @param fileIndex the index of the file being replaced (not counted)
+ */
+func ownerUsage(owner string, uuid string, fileIndex int) int64 {
+	var usage int64
+	for _, entry := range ownerImages(owner) {
+		for i := range getManifestFiles(entry.manifest) {
+			if entry.uuid == uuid && i == fileIndex {
+				continue
+			}
+			size, _ := getDeclaredFileSize(entry.manifest, i)
+			usage += size
+		}
+	}
+	return usage
+}
+
+/**
+ * Get the maximum size of the file to store at the index of the image.
+ * The quota is checked against the files already stored, so
+ * concurrent uploads by the same owner may exceed it slightly.
+ *
+ * @param uuid the image receiving the file
+ * @param m the manifest of the image
+ * @param index the index of the file
+ * @return limit the maximum number of bytes (-1 if there is no limit)
+ *         err the error to report if the file exceeds the limit
+ */
+func uploadSizeLimit(uuid string, m map[string]interface{}, index int) (limit int64, err error) {
+	limit, err = -1, errFileTooLarge
+	if size := currentConfiguration().MaxFileSize; size > 0 {
+		limit = size
+	}
+
+	// The images without an owner is only limited by max_file_size
+	owner, _ := m["owner"].(string)
+	quota := ownerQuota(owner)
+	if quota > 0 && len(owner) > 0 {
+		remaining := quota - ownerUsage(owner, uuid, index)
+		if remaining < 0 {
+			remaining = 0
+		}
+		if limit == -1 || remaining < limit {
+			limit, err = remaining, errQuotaExceeded
+		}
+	}
+
+	// Leave min_free_space free on the disk
+	if free, ok := uploadFreeSpace(); ok && (limit == -1 || free < limit) {
+		limit, err = free, errInsufficientStorage
+	}
+	return limit, err
+}
+
+/**
+ * sizeLimitReader fails with err when more than remaining bytes is read
+ * from the reader.
+ */
+type sizeLimitReader struct {
+	reader    io.Reader
+	remaining int64
+	err       error
+}
+
+func (s *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > s.remaining+1 {
+		p = p[:s.remaining+1]
+	}
+	n, err := s.reader.Read(p)
+	if int64(n) > s.remaining {
+		return 0, s.err
+	}
+	s.remaining -= int64(n)
+	return n, err
+}
+
+// Get the response for a file exceeding the limit
+func uploadLimitResponse(err error, limit int64) (int, map[string]interface{}) {
+	if err == errInsufficientStorage {
+		return errorResponse(CodeInsufficientStorage, fmt.Sprintf("%v (%d bytes available)", err, limit))
+	}
+	if err == errQuotaExceeded {
+		return errorResponse(CodeQuotaExceeded, fmt.Sprintf("%v (%d bytes available)", err, limit))
+	}
+	return errorResponse(CodePayloadTooLarge, fmt.Sprintf("%v (the limit is %d bytes)", err, limit))
+}
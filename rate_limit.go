@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The delay suggested to the clients when all of the transfer slots is in use
+const transferRetryAfter = 5
+
+// The interval between removing the idle buckets
+const rateLimitCleanupInterval = time.Minute
+
+// A rate limit in the configuration file
+type RateLimit struct {
+	// The number of requests per second (0 means no limit)
+	Rate float64 `json:"rate"`
+	// The number of requests allowed in a burst (defaults to rate)
+	Burst float64 `json:"burst"`
+}
+
+// The configuration of the rate limits in the configuration file
+type RateLimitConfig struct {
+	PerIp   RateLimit `json:"per_ip"`
+	PerUser RateLimit `json:"per_user"`
+	// The maximum number of concurrent uploads and downloads (0 means no limit)
+	MaxUploads   int `json:"max_uploads"`
+	MaxDownloads int `json:"max_downloads"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/**
+ * A token bucket rate limiter for each key (the client IP address or
+ * the user name). The bucket for a key is filled with rate tokens per
+ * second up to burst, and each request takes a token.
+ */
+type rateLimiter struct {
+	sync.Mutex
+	rate        float64
+	burst       float64
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	burst := limit.Burst
+	if burst < 1 {
+		burst = math.Max(limit.Rate, 1)
+	}
+	return &rateLimiter{
+		rate:        limit.Rate,
+		burst:       burst,
+		buckets:     make(map[string]*tokenBucket),
+		lastCleanup: time.Now(),
+	}
+}
+
+/**
+ * Take a token for the key
+ *
+ * @param key the client IP address or user name
+ * @return ok true if the request is allowed
+ *         retry the time until the next token is available
+ */
+func (l *rateLimiter) allow(key string) (ok bool, retry time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastCleanup) > rateLimitCleanupInterval {
+		l.cleanup(now)
+	}
+
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+// Remove the buckets which is full again (the same as a new bucket)
+func (l *rateLimiter) cleanup(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastCleanup = now
+}
+
+type rateLimits struct {
+	ip   *rateLimiter
+	user *rateLimiter
+
+	// The slots for the concurrent uploads and downloads (nil if unlimited)
+	uploads   chan struct{}
+	downloads chan struct{}
+}
+
+// The limits from the configuration (replaced when the configuration is reloaded)
+var activeRateLimits = &rateLimits{}
+var rateLimitsLock sync.RWMutex
+
+func currentRateLimits() *rateLimits {
+	rateLimitsLock.RLock()
+	defer rateLimitsLock.RUnlock()
+	return activeRateLimits
+}
+
+// Set up the rate limits from the configuration
+func initRateLimits() {
+	config := currentConfiguration().RateLimit
+	limits := &rateLimits{
+		ip:   newRateLimiter(config.PerIp),
+		user: newRateLimiter(config.PerUser),
+	}
+	if config.MaxUploads > 0 {
+		limits.uploads = make(chan struct{}, config.MaxUploads)
+	}
+	if config.MaxDownloads > 0 {
+		limits.downloads = make(chan struct{}, config.MaxDownloads)
+	}
+
+	rateLimitsLock.Lock()
+	activeRateLimits = limits
+	rateLimitsLock.Unlock()
+}
+
+// Get the number of seconds to put in the Retry-After header
+func retryAfterSeconds(retry time.Duration) int {
+	return int(math.Ceil(retry.Seconds()))
+}
+
+func sendThrottled(w http.ResponseWriter, seconds int, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	sendError(w, CodeRequestThrottled, message)
+}
+
+type rateLimitKey struct{}
+
+/**
+ * Apply the rate limit for the authenticated user (called when the user
+ * is authenticated). The Retry-After header is set on the response if
+ * the user is throttled.
+ *
+ * @return the response to send if the user is throttled (nil if not)
+ */
+func rateLimitUser(r *http.Request, user *UserEntry) map[string]interface{} {
+	limiter := currentRateLimits().user
+	if limiter == nil || user == nil {
+		return nil
+	}
+
+	ok, retry := limiter.allow(user.Name)
+	if ok {
+		return nil
+	}
+
+	if header, found := r.Context().Value(rateLimitKey{}).(http.Header); found {
+		header.Set("Retry-After", strconv.Itoa(retryAfterSeconds(retry)))
+	}
+	_, content := errorResponse(CodeRequestThrottled, fmt.Sprintf("Too many requests for user %s", user.Name))
+	return content
+}
+
+// Take a slot for the transfer (the returned function releases it)
+func acquireTransferSlot(slots chan struct{}) (func(), bool) {
+	if slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
+
+// Wrap the handler to apply the rate limits and the transfer limits
+func withRateLimit(handler http.Handler) http.Handler {
+	// The limits may be changed when the configuration is reloaded
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limits := currentRateLimits()
+		if limits.ip != nil {
+			ok, retry := limits.ip.allow(remoteIp(r))
+			if !ok {
+				sendThrottled(w, retryAfterSeconds(retry), "Too many requests from "+remoteIp(r))
+				return
+			}
+		}
+
+		var slots chan struct{}
+		switch imageRouter.routeName(r) {
+		case "AddImageFile":
+			slots = limits.uploads
+		case "GetImageFile", "GetImageFileBlocks":
+			slots = limits.downloads
+		}
+		release, ok := acquireTransferSlot(slots)
+		if !ok {
+			sendThrottled(w, transferRetryAfter, "Too many concurrent transfers")
+			return
+		}
+		defer release()
+
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rateLimitKey{}, w.Header())))
+	})
+}
+
+func rateLimitState() map[string]interface{} {
+	limits := currentRateLimits()
+	state := map[string]interface{}{}
+	if limits.uploads != nil {
+		state["uploads"] = len(limits.uploads)
+	}
+	if limits.downloads != nil {
+		state["downloads"] = len(limits.downloads)
+	}
+	return state
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The interval between checking if the configuration file changed
+const configWatchInterval = 5 * time.Second
+
+// The configuration file the server was started with
+var configurationFile string
+
+// True if the configuration file was specified with -c
+var configurationFileRequired bool
+
+// Serialize the reloads (from SIGHUP and the watcher)
+var reloadLock sync.Mutex
+
+// The configuration from the latest reload (see currentConfiguration)
+var reloadedConfiguration atomic.Value
+
+/**
+ * Get a snapshot of the configuration with the settings from the latest
+ * reload. The reloadable settings (see applyReloadableSettings) must be
+ * read from the snapshot while the server is running, the other
+ * settings may be read from configuration as it isn't modified once the
+ * server is started. The returned configuration must not be modified.
+ */
+func currentConfiguration() *Configuration {
+	if current, ok := reloadedConfiguration.Load().(*Configuration); ok {
+		return current
+	}
+	return &configuration
+}
+
+/**
+ * Apply the settings which may be changed while the server is running
+ * (the user database, the authentication provider and the limits) from
+ * the configuration.
+ *
+ * @param to the configuration to update
+ * @param from the new configuration
+ */
+func applyReloadableSettings(to *Configuration, from *Configuration) {
+	to.Userdb = from.Userdb
+	to.Auth = from.Auth
+	to.ServerTiming = from.ServerTiming
+	to.EnforceSize = from.EnforceSize
+	to.Channels = from.Channels
+	to.MaxIconSize = from.MaxIconSize
+	to.MaxManifestSize = from.MaxManifestSize
+	to.MaxFileSize = from.MaxFileSize
+	to.Quota = from.Quota
+	to.RateLimit = from.RateLimit
+	to.Cors = from.Cors
+}
+
+/**
+ * Reload the configuration file. Only the user database, the
+ * authentication provider and the limits is changed (see
+ * applyReloadableSettings); the other settings (like the port and
+ * datadir) require a restart. The current configuration is kept if the
+ * new configuration is invalid.
+ */
+func reloadConfiguration() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	loaded, err := loadConfiguration(configurationFile, !configurationFileRequired)
+	if err != nil {
+		return err
+	}
+
+	previous := *currentConfiguration()
+	next := previous
+	applyReloadableSettings(&next, &loaded)
+
+	err = next.Validate()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+	reloadedConfiguration.Store(&next)
+
+	// Report the changes which didn't take effect
+	applyReloadableSettings(&loaded, &previous)
+	if !reflect.DeepEqual(loaded, previous) {
+		log.Printf("Some of the changes in %s require a restart", configurationFile)
+	}
+
+	err = initAuthProvider()
+	if err != nil {
+		log.Printf("Failed to initialize authentication provider: %v", err)
+	}
+	initRateLimits()
+	log.Printf("Reloaded configuration from %s", configurationFile)
+	return nil
+}
+
+func logReload() {
+	err := reloadConfiguration()
+	if err != nil {
+		log.Printf("Failed to reload configuration: %v", err)
+	}
+}
+
+// Reload the configuration when the server receives SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logReload()
+		}
+	}()
+}
+
+// Get the modification times of the configuration file and the user database file
+func configurationModified() string {
+	var modified []string
+	for _, path := range []string{configurationFile, configuration.UserdbFile} {
+		if len(path) == 0 {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			modified = append(modified, "")
+			continue
+		}
+		modified = append(modified, info.ModTime().String())
+	}
+	return strings.Join(modified, ",")
+}
+
+// Reload the configuration when the configuration file (or the user database file) is modified
+func watchConfigurationFile() {
+	if !configuration.WatchConfig {
+		return
+	}
+
+	go func() {
+		modified := configurationModified()
+		for range time.Tick(configWatchInterval) {
+			current := configurationModified()
+			if current == modified {
+				continue
+			}
+			modified = current
+			logReload()
+		}
+	}()
+}
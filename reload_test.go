@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfiguration(t *testing.T, content string) {
+	t.Helper()
+	err := os.WriteFile(configurationFile, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	configurationFile = filepath.Join(t.TempDir(), "config.json")
+	configurationFileRequired = true
+	writeTestConfiguration(t, `{"port": 8080, "userdb": [{"name": "first", "password": "secret"}]}`)
+	config, err := loadConfiguration(configurationFile, false)
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	configuration = config
+	configuration.Datadir = t.TempDir()
+	t.Cleanup(func() { reloadedConfiguration.Store(&configuration) })
+
+	handler := withServerTiming(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	request := httptest.NewRequest("GET", "/ping", nil)
+
+	// Serve requests while the configuration is reloaded (see go test -race)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			lookupUser("first")
+			handler(httptest.NewRecorder(), request)
+		}
+	}()
+
+	writeTestConfiguration(t, `{"port": 8080, "server_timing": true, "userdb": [{"name": "second", "password": "secret"}]}`)
+	err = reloadConfiguration()
+	<-done
+	if err != nil {
+		t.Fatalf("Failed to reload configuration: %v", err)
+	}
+
+	if lookupUser("first") != nil || lookupUser("second") == nil {
+		t.Errorf("The userdb wasn't reloaded")
+	}
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+	if len(recorder.Header().Get("Server-Timing")) == 0 {
+		t.Errorf("Expected the Server-Timing header once server_timing is enabled")
+	}
+}
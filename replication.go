@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/trondn/imgapi/client"
+)
+
+// The delay before the first retry (doubled for each attempt)
+const replicationInitialBackoff = time.Second
+
+// The maximum delay between the retries
+const replicationMaxBackoff = 10 * time.Minute
+
+// The number of attempts before giving up unless max_attempts is set
+const defaultReplicationMaxAttempts = 10
+
+// The number of failed replications to remember for each target
+const replicationFailedHistory = 100
+
+// A downstream IMGAPI server in the configuration file
+type ReplicationTarget struct {
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Token       string `json:"token"`
+	MaxAttempts int    `json:"max_attempts"`
+	// Push the files as deltas against the other versions (see delta.go)
+	Delta bool `json:"delta"`
+}
+
+// A change to push to a downstream server
+type replicationTask struct {
+	Uuid      string    `json:"uuid"`
+	Action    string    `json:"action"`
+	Queued    time.Time `json:"queued"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+/**
+ * The replicator for one downstream server. The changes is pushed in
+ * the order they happened by a background worker, and a failed change
+ * is retried with exponential backoff (blocking the changes queued
+ * after it) until max_attempts is reached.
+ */
+type replicator struct {
+	sync.Mutex
+	target      ReplicationTarget
+	client      *client.Client
+	queue       []*replicationTask
+	failed      []*replicationTask
+	replicated  int64
+	lastSuccess time.Time
+	lastError   string
+	wake        chan struct{}
+	// The files pushed as deltas and the bytes not sent
+	deltas     int64
+	deltaSaved int64
+}
+
+var replicators []*replicator
+
+// Start the replicators for the configured targets
+func startReplication() {
+	for _, target := range configuration.Replication {
+		r := &replicator{
+			target: target,
+			client: client.New(target.Url),
+			wake:   make(chan struct{}, 1),
+		}
+		if len(target.Token) > 0 {
+			r.client.SetToken(target.Token)
+		} else if len(target.Username) > 0 {
+			r.client.SetBasicAuth(target.Username, target.Password)
+		}
+		if r.target.MaxAttempts <= 0 {
+			r.target.MaxAttempts = defaultReplicationMaxAttempts
+		}
+
+		replicators = append(replicators, r)
+		go r.run()
+	}
+
+	if len(replicators) > 0 {
+		subscribeImageEvents(replicateImageEvent)
+	}
+}
+
+// Queue the activated and deleted images for replication
+func replicateImageEvent(event ImageEvent) {
+	var action string
+	switch event.Type {
+	case EventImageActivated:
+		action = "activate"
+	case EventImageDeleted:
+		action = "delete"
+	default:
+		return
+	}
+
+	for _, r := range replicators {
+		r.enqueue(event.Uuid, action)
+	}
+}
+
+func (r *replicator) enqueue(uuid string, action string) {
+	r.Lock()
+	defer r.Unlock()
+
+	// Only the latest change to the image matters (but leave the head
+	// of the queue alone as it may be in progress)
+	for i := 1; i < len(r.queue); i++ {
+		if r.queue[i].Uuid == uuid {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			i--
+		}
+	}
+	r.queue = append(r.queue, &replicationTask{Uuid: uuid, Action: action, Queued: time.Now().UTC()})
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get the time to wait before the next attempt
+func replicationBackoff(attempts int) time.Duration {
+	backoff := replicationInitialBackoff
+	for i := 1; i < attempts && backoff < replicationMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > replicationMaxBackoff {
+		backoff = replicationMaxBackoff
+	}
+	return backoff
+}
+
+func (r *replicator) run() {
+	for {
+		r.Lock()
+		if len(r.queue) == 0 {
+			r.Unlock()
+			<-r.wake
+			continue
+		}
+		task := r.queue[0]
+		r.Unlock()
+
+		err := r.replicate(task)
+
+		r.Lock()
+		r.queue = r.queue[1:]
+		if err == nil {
+			r.replicated++
+			r.lastSuccess = time.Now().UTC()
+			r.Unlock()
+			continue
+		}
+
+		task.Attempts++
+		task.LastError = fmt.Sprintf("%v", err)
+		r.lastError = task.LastError
+		if task.Attempts >= r.target.MaxAttempts {
+			log.Printf("Giving up replicating %s %s to %s: %v", task.Action, task.Uuid, r.target.Name, err)
+			r.failed = append(r.failed, task)
+			if len(r.failed) > replicationFailedHistory {
+				r.failed = r.failed[1:]
+			}
+			r.Unlock()
+			continue
+		}
+
+		// Retry the task before the rest of the queue
+		r.queue = append([]*replicationTask{task}, r.queue...)
+		r.Unlock()
+
+		backoff := replicationBackoff(task.Attempts)
+		log.Printf("Failed to replicate %s %s to %s (retry in %v): %v", task.Action, task.Uuid, r.target.Name, backoff, err)
+		time.Sleep(backoff)
+	}
+}
+
+func (r *replicator) replicate(task *replicationTask) error {
+	if task.Action == "delete" {
+		err := r.client.DeleteImage(task.Uuid)
+		if client.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return r.replicateImage(task.Uuid)
+}
+
+// Push the manifest, the files, the icon and the attachments and activate the image
+func (r *replicator) replicateImage(uuid string) error {
+	m, err := storage.GetManifest(uuid)
+	if err == ErrImageNotFound {
+		// The image was deleted (which is queued as well)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	remote, err := r.client.GetImage(uuid)
+	if err == nil {
+		if remote.State() != StateUnactivated {
+			return nil
+		}
+		// Start over with an incomplete image
+		err = r.client.DeleteImage(uuid)
+	} else if client.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	manifest := client.Manifest{}
+	for k, v := range m {
+		manifest[k] = v
+	}
+	_, err = r.client.ImportImage(manifest)
+	if err != nil {
+		return err
+	}
+
+	for index, entry := range getManifestFiles(m) {
+		file, _ := entry.(map[string]interface{})
+		compression, _ := file["compression"].(string)
+		sha1, _ := file["sha1"].(string)
+		err = r.pushFile(uuid, index, compression, sha1)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m["icon"] == true {
+		filename, content_type := getIconFile(uuid)
+		if len(filename) > 0 {
+			reader, err := storage.GetFile(uuid, filename)
+			if err != nil {
+				return err
+			}
+			_, err = r.client.AddImageIcon(uuid, reader, content_type)
+			reader.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range attachmentNames(m) {
+		err = r.pushAttachment(uuid, name, getManifestAttachments(m)[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.client.ActivateImage(uuid)
+	if err == nil && getImageState(m) == StateDisabled {
+		_, err = r.client.DisableImage(uuid)
+	}
+	return err
+}
+
+func (r *replicator) pushAttachment(uuid string, name string, entry interface{}) error {
+	attachment, _ := entry.(map[string]interface{})
+	contentType, _ := attachment["content_type"].(string)
+	sha256, _ := attachment["sha256"].(string)
+	reader, err := storage.GetFile(uuid, attachmentFileName(name))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = r.client.PutImageAttachment(uuid, name, reader, contentType, sha256)
+	return err
+}
+
+func (r *replicator) pushFile(uuid string, index int, compression string, sha1 string) error {
+	filename, ok := getImageFileAt(uuid, index)
+	if !ok {
+		return fmt.Errorf("File %d is missing", index)
+	}
+
+	if r.target.Delta && r.pushFileDelta(uuid, index, filename, compression, sha1) {
+		return nil
+	}
+
+	reader, err := storage.GetFile(uuid, filename)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	_, err = r.client.AddImageFileAt(uuid, index, reader, compression, sha1)
+	return err
+}
+
+/**
+ * Push the file as a delta against the same file of another version of
+ * the image on the downstream server, so only the blocks which isn't
+ * found in that file is sent.
+ *
+ * @return false if no base was found or the delta failed (the file
+ *         should be pushed as is)
+ */
+func (r *replicator) pushFileDelta(uuid string, index int, filename string, compression string, sha1 string) bool {
+	for _, base := range deltaBaseCandidates(uuid) {
+		remote, err := r.client.GetImageFileBlocks(base, index)
+		if err != nil {
+			continue
+		}
+		blocks := &fileBlocks{BlockSize: remote.BlockSize, Size: remote.Size, Blocks: remote.Blocks}
+		if blocks.validate() != nil {
+			continue
+		}
+
+		reader, err := storage.GetFile(uuid, filename)
+		if err != nil {
+			return false
+		}
+		info, err := storage.StatFile(uuid, filename)
+		if err != nil {
+			reader.Close()
+			return false
+		}
+
+		pr, pw := io.Pipe()
+		literal := make(chan int64, 1)
+		go func() {
+			n, err := writeDelta(pw, reader, blocks)
+			literal <- n
+			pw.CloseWithError(err)
+		}()
+		_, err = r.client.AddImageFileDelta(uuid, index, base, index, pr, compression, sha1)
+		pr.Close()
+		sent := <-literal
+		reader.Close()
+		if err != nil {
+			log.Printf("Failed to push %s/%s to %s as a delta against %s (pushing the file): %v",
+				uuid, filename, r.target.Name, base, err)
+			return false
+		}
+
+		log.Printf("Pushed %s/%s to %s as a delta against %s (%d of %d bytes sent)",
+			uuid, filename, r.target.Name, base, sent, info.Size)
+		r.Lock()
+		r.deltas++
+		r.deltaSaved += info.Size - sent
+		r.Unlock()
+		return true
+	}
+	return false
+}
+
+func (r *replicator) status() map[string]interface{} {
+	r.Lock()
+	defer r.Unlock()
+
+	var lastSuccess interface{}
+	if !r.lastSuccess.IsZero() {
+		lastSuccess = r.lastSuccess
+	}
+
+	queue := make([]replicationTask, 0, len(r.queue))
+	for _, task := range r.queue {
+		queue = append(queue, *task)
+	}
+	failed := make([]replicationTask, 0, len(r.failed))
+	for _, task := range r.failed {
+		failed = append(failed, *task)
+	}
+
+	return map[string]interface{}{
+		"name":         r.target.Name,
+		"url":          r.target.Url,
+		"pending":      len(r.queue),
+		"queue":        queue,
+		"replicated":   r.replicated,
+		"failed":       failed,
+		"last_success": lastSuccess,
+		"last_error":   r.lastError,
+		"deltas":       r.deltas,
+		"delta_saved":  r.deltaSaved,
+	}
+}
+
+func doServerGetReplication() (int, map[string]interface{}) {
+	targets := make([]interface{}, 0, len(replicators))
+	for _, r := range replicators {
+		targets = append(targets, r.status())
+	}
+	return Success, map[string]interface{}{
+		"targets": targets,
+	}
+}
+
+/*
+AdminGetReplication	GET /replication	Get the status of the replication to the downstream servers.
+*/
+func serverGetReplication(w http.ResponseWriter, r *http.Request) {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+		return
+	}
+
+	code, content = requireOperator(user)
+	if content == nil {
+		code, content = doServerGetReplication()
+	}
+	sendResponse(w, code, content)
+}
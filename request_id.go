@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+
+	"github.com/trondn/imgapi/errorcodes"
+)
+
+// The header with the request ID (in both the request and the response)
+const requestIdHeader = errorcodes.RequestIdHeader
+
+// The longest request ID accepted from the client
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// Generate a new random request ID
+func newRequestId() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Check if the request ID from the client may be used (printable ASCII only)
+func isValidRequestId(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the ID of the request (empty if the request didn't pass withRequestId)
+func requestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// Log the message (formatted as log.Printf) with the ID of the request
+func logRequestf(r *http.Request, format string, args ...interface{}) {
+	if id := requestId(r); len(id) > 0 {
+		format = "request_id=%s " + format
+		args = append([]interface{}{id}, args...)
+	}
+	log.Printf(format, args...)
+}
+
+/**
+ * Wrap the handler to give each request an ID which is sent in the
+ * X-Request-Id header, included in the error responses and logged in
+ * the access and audit logs. The X-Request-Id header in the request is
+ * used if it is provided (so that the ID may be traced through a proxy).
+ */
+func withRequestId(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIdHeader)
+		if !isValidRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(requestIdHeader, id)
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Large image files may be uploaded in chunks by using the
+// Content-Range header with PUT /images/:uuid/file:
+//
+//     Content-Range: bytes 0-1048575/4294967296
+//
+// Each chunk must start where the previous chunk ended. The chunks are
+// appended to a partial file in datadir/.uploads, and when the last
+// chunk is received the file is stored as if it was uploaded in a
+// single request (the sha1 and compression parameters should be sent
+// with the last chunk, but they are validated with every chunk). The
+// body of a chunk must match the Content-Range. Chunks for the same
+// image is serialized by the image lock. The client may ask how much of the file the
+// server has received by using:
+//
+//     Content-Range: bytes */4294967296
+
+func partialUploadDir() string {
+	if len(configuration.Datadir) == 0 {
+		return filepath.Join(os.TempDir(), "imgapi-uploads")
+	}
+	return filepath.Join(configuration.Datadir, ".uploads")
+}
+
+// Get the path of the partial upload of the file with the index
+func partialUploadPath(uuid string, index int) string {
+	if index == 0 {
+		return filepath.Join(partialUploadDir(), uuid)
+	}
+	return filepath.Join(partialUploadDir(), fmt.Sprintf("%s-%d", uuid, index))
+}
+
+// Remove the partial uploads for the image (if any)
+func removePartialUpload(uuid string) {
+	paths, _ := filepath.Glob(filepath.Join(partialUploadDir(), uuid+"*"))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+/**
+ * Parse the Content-Range header
+ *
+ * @param value the value of the header
+ * @return start the offset of the first byte (-1 for "*")
+ *         end the offset of the last byte
+ *         total the size of the complete file
+ */
+func parseContentRange(value string) (start int64, end int64, total int64, err error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range \"%s\"", value)
+	}
+
+	parts := strings.SplitN(value[len("bytes "):], "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range \"%s\"", value)
+	}
+
+	total, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || total <= 0 {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range \"%s\"", value)
+	}
+
+	if parts[0] == "*" {
+		return -1, -1, total, nil
+	}
+
+	bounds := strings.SplitN(parts[0], "-", 2)
+	if len(bounds) == 2 {
+		start, err = strconv.ParseInt(bounds[0], 10, 64)
+		if err == nil {
+			end, err = strconv.ParseInt(bounds[1], 10, 64)
+		}
+	}
+	if len(bounds) != 2 || err != nil || start > end || end >= total {
+		return 0, 0, 0, fmt.Errorf("Invalid Content-Range \"%s\"", value)
+	}
+
+	return start, end, total, nil
+}
+
+// The response telling the client how much of the file is received
+func uploadStatus(w http.ResponseWriter, code int, uuid string, offset int64, total int64) (int, map[string]interface{}) {
+	if offset > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", offset-1))
+	}
+	return code, map[string]interface{}{
+		"uuid":   uuid,
+		"offset": offset,
+		"size":   total,
+	}
+}
+
+func doServerAddImageFileChunk(w http.ResponseWriter, uuid string, params url.Values, r *http.Request) (int, map[string]interface{}) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		return errorResponse(CodeInvalidHeader, fmt.Sprintf("%v", err))
+	}
+
+	// Validate the parameters with every chunk so that the client learns
+	// about an invalid parameter before the whole file is uploaded
+	var p imageFileParams
+	code, content := parseImageFileParams(params, &p)
+	if content != nil {
+		return code, content
+	}
+	index := p.index
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		if err == ErrImageNotFound {
+			return errorResponse(CodeResourceNotFound, "The image does not exist")
+		}
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+
+	if !imageFileMutable(m) {
+		return errorResponse(CodeImageAlreadyActivated, "Can't replace file for an active image")
+	}
+
+	// The file is compressed by the client, so the size is known up front
+	limit, limitErr := uploadSizeLimit(uuid, m, index)
+	if limit >= 0 && total > limit {
+		os.Remove(partialUploadPath(uuid, index))
+		return uploadLimitResponse(limitErr, limit)
+	}
+
+	err = os.MkdirAll(partialUploadDir(), 0700)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to create upload directory: %v", err))
+	}
+
+	path := partialUploadPath(uuid, index)
+	var offset int64
+	info, err := os.Stat(path)
+	if err == nil {
+		offset = info.Size()
+	}
+
+	// The client asks for the status of the upload
+	if start == -1 {
+		return uploadStatus(w, Success, uuid, offset, total)
+	}
+
+	// Restart the upload if the client sends the first chunk again
+	if start == 0 {
+		offset = 0
+	}
+
+	if start != offset {
+		return uploadStatus(w, http.StatusRequestedRangeNotSatisfiable, uuid, offset, total)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if start == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to open partial upload: %v", err))
+	}
+
+	length := end - start + 1
+	n, err := io.CopyN(f, r.Body, length)
+	if err == nil {
+		// The body may not be longer than the range
+		if extra, _ := io.CopyN(ioutil.Discard, r.Body, 1); extra > 0 {
+			f.Truncate(start)
+			f.Close()
+			code, content := errorResponse(CodeInvalidHeader, fmt.Sprintf("The body is longer than the Content-Range (%d bytes)", length))
+			content["offset"] = start
+			return code, content
+		}
+	}
+	if err != nil {
+		// Drop the incomplete chunk so that the client may send it again
+		f.Truncate(start)
+		f.Close()
+		code, content := errorResponse(CodeUpload, fmt.Sprintf("Failed to receive chunk (got %d of %d bytes): %v", n, length, err))
+		content["offset"] = start
+		return code, content
+	}
+
+	err = f.Close()
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to write partial upload: %v", err))
+	}
+
+	offset = start + n
+	if offset < total {
+		return uploadStatus(w, http.StatusAccepted, uuid, offset, total)
+	}
+
+	// The upload is complete.. store the file
+	f, err = os.Open(path)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to open partial upload: %v", err))
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	return doServerAddImageFile(uuid, params, f)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Send the chunk of the file with the Content-Range header
+func uploadTestChunk(t *testing.T, uuid string, params url.Values, contentRange string, body string) (int, map[string]interface{}) {
+	t.Helper()
+	r := httptest.NewRequest("PUT", "/images/"+uuid+"/file", strings.NewReader(body))
+	r.Header.Set("Content-Range", contentRange)
+	return doServerAddImageFileChunk(httptest.NewRecorder(), uuid, params, r)
+}
+
+func TestUploadChunkLongerThanRange(t *testing.T) {
+	setupTestStorage(t)
+	uuid := "00000000-0000-0000-0000-000000000001"
+	m := testManifest("chunked")
+	m["state"] = StateUnactivated
+	addTestImage(t, uuid, m, "")
+
+	code, content := uploadTestChunk(t, uuid, url.Values{}, "bytes 0-4/10", "hello world")
+	if code != InvalidHeader || content["code"] != string(CodeInvalidHeader) {
+		t.Fatalf("Expected InvalidHeader, got %d: %v", code, content)
+	}
+	if info, err := os.Stat(partialUploadPath(uuid, 0)); err == nil && info.Size() != 0 {
+		t.Errorf("Expected the chunk to be dropped, got %d bytes", info.Size())
+	}
+
+	code, content = uploadTestChunk(t, uuid, url.Values{}, "bytes 0-4/10", "hello")
+	if code != http.StatusAccepted || content["offset"] != int64(5) {
+		t.Errorf("Expected the chunk to be accepted, got %d: %v", code, content)
+	}
+}
+
+func TestUploadChunkValidatesParameters(t *testing.T) {
+	setupTestStorage(t)
+	uuid := "00000000-0000-0000-0000-000000000001"
+	m := testManifest("chunked")
+	m["state"] = StateUnactivated
+	addTestImage(t, uuid, m, "")
+
+	for _, params := range []url.Values{{"compression": {"zip"}}, {"sha1": {"x"}, "unknown": {"1"}}} {
+		code, content := uploadTestChunk(t, uuid, params, "bytes 0-4/10", "hello")
+		if code != InvalidParameter || content["code"] != string(CodeInvalidParameter) {
+			t.Errorf("Expected InvalidParameter for %v, got %d: %v", params, code, content)
+		}
+	}
+	if _, err := os.Stat(partialUploadPath(uuid, 0)); err == nil {
+		t.Errorf("Expected no partial upload")
+	}
+}
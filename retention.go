@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The user the retention policies is recorded as in the audit log
+const retentionAuditUser = "retention"
+
+// The configuration of the retention policies in the configuration file
+type RetentionConfig struct {
+	// Seconds between each run (0 disables the retention policies)
+	Interval int `json:"interval"`
+	// The number of versions of each name (and owner) to keep (0 keeps all)
+	KeepVersions int `json:"keep_versions"`
+	// Seconds before unactivated images is deleted (0 keeps them)
+	UnactivatedTtl int `json:"unactivated_ttl"`
+	// Only log what would be deleted
+	DryRun bool `json:"dry_run"`
+}
+
+/**
+ * The retention policies deletes the images which is no longer needed:
+ *
+ *  - images with expires_at in the past
+ *  - the active (and disabled) images older than the newest
+ *    keep_versions versions with the same name and owner
+ *  - unactivated images older than unactivated_ttl
+ *
+ * Images with dependent images, and images with the tag "retain" set
+ * to true (except when they expire), is never deleted. The deletions
+ * is recorded in the audit log.
+ */
+type retentionPolicy struct {
+	sync.Mutex
+	stats retentionStats
+	stop  chan struct{}
+	// The first time each unactivated image was seen
+	seen map[string]time.Time
+}
+
+type retentionStats struct {
+	Runs          int64     `json:"runs"`
+	LastRun       time.Time `json:"last_run"`
+	LastDuration  float64   `json:"last_duration"`
+	ImagesDeleted int64     `json:"images_deleted"`
+	Errors        int64     `json:"errors"`
+	LastError     string    `json:"last_error,omitempty"`
+}
+
+var retention = &retentionPolicy{}
+
+// Start applying the retention policies in the background (if enabled)
+func startRetention() {
+	if configuration.Retention.Interval <= 0 {
+		return
+	}
+
+	retention.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(time.Duration(configuration.Retention.Interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !inMaintenance() {
+					retention.run(time.Now())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(retention.stop)
+}
+
+func stopRetention() {
+	if retention.stop != nil {
+		close(retention.stop)
+		retention.stop = nil
+	}
+}
+
+// Get the statistics (and configuration) for /state
+func (p *retentionPolicy) state() map[string]interface{} {
+	p.Lock()
+	defer p.Unlock()
+	return map[string]interface{}{
+		"enabled":         configuration.Retention.Interval > 0,
+		"interval":        configuration.Retention.Interval,
+		"keep_versions":   configuration.Retention.KeepVersions,
+		"unactivated_ttl": configuration.Retention.UnactivatedTtl,
+		"dry_run":         configuration.Retention.DryRun,
+		"stats":           p.stats,
+	}
+}
+
+func (p *retentionPolicy) fail(err error) {
+	log.Printf("retention: %v", err)
+	p.stats.Errors++
+	p.stats.LastError = fmt.Sprintf("%v", err)
+}
+
+// Get the time the image expires (false if it doesn't expire)
+func imageExpiresAt(m map[string]interface{}) (time.Time, bool) {
+	s, ok := m["expires_at"].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	return t, err == nil
+}
+
+// Check if the image is protected from keep_versions and unactivated_ttl
+func imageRetained(m map[string]interface{}) bool {
+	return getManifestTags(m)["retain"] == true
+}
+
+/**
+ * Get the images which isn't among the newest keep_versions versions
+ * with the same name and owner (only the active and disabled images is
+ * counted).
+ */
+func (p *retentionPolicy) oldVersions(entries []indexEntry) map[string]bool {
+	old := map[string]bool{}
+	keep := configuration.Retention.KeepVersions
+	if keep <= 0 {
+		return old
+	}
+
+	groups := map[string][]indexEntry{}
+	for _, entry := range entries {
+		switch getImageState(entry.manifest) {
+		case StateActive, StateDisabled:
+		default:
+			continue
+		}
+		name, _ := entry.manifest["name"].(string)
+		owner, _ := entry.manifest["owner"].(string)
+		groups[owner+"/"+name] = append(groups[owner+"/"+name], entry)
+	}
+
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			a, _ := group[i].manifest["version"].(string)
+			b, _ := group[j].manifest["version"].(string)
+			if c := compareVersions(a, b); c != 0 {
+				return c > 0
+			}
+			pa, _ := group[i].manifest["published_at"].(string)
+			pb, _ := group[j].manifest["published_at"].(string)
+			return pa > pb
+		})
+		if len(group) <= keep {
+			continue
+		}
+		for _, entry := range group[keep:] {
+			old[entry.uuid] = true
+		}
+	}
+	return old
+}
+
+/**
+ * Check if the unactivated image is older than unactivated_ttl. The age
+ * is counted from the last time one of its files was modified, or from
+ * the first time it was seen by the retention policies for images
+ * without files (the storage doesn't keep the time of the manifest).
+ */
+func (p *retentionPolicy) staleUnactivated(entry indexEntry, now time.Time, seen map[string]time.Time) bool {
+	ttl := configuration.Retention.UnactivatedTtl
+	if ttl <= 0 || getImageState(entry.manifest) != StateUnactivated {
+		return false
+	}
+
+	since, ok := p.seen[entry.uuid]
+	if !ok {
+		since = now
+	}
+	seen[entry.uuid] = since
+
+	names, err := storage.ListFiles(entry.uuid)
+	if err != nil {
+		p.fail(fmt.Errorf("Failed to list files for %s: %v", entry.uuid, err))
+		return false
+	}
+	var modified time.Time
+	for _, name := range names {
+		if name == "manifest.json" {
+			continue
+		}
+		info, err := storage.StatFile(entry.uuid, name)
+		if err == nil && info.ModTime.After(modified) {
+			modified = info.ModTime
+		}
+	}
+	if !modified.IsZero() {
+		since = modified
+	}
+	return now.Sub(since) > time.Duration(ttl)*time.Second
+}
+
+/**
+ * Delete the image (or just log it in dry-run mode) and record it in
+ * the audit log with the policy which deleted it as the action.
+ */
+func (p *retentionPolicy) delete(uuid string, policy string) {
+	if configuration.Retention.DryRun {
+		log.Printf("retention: would delete %s (%s)", uuid, policy)
+		return
+	}
+
+	defer lockImage(uuid)()
+	_, code, content := checkDependentImages(uuid, false)
+	if content == nil {
+		code, content = deleteImage(uuid)
+	}
+
+	entry := &auditEntry{
+		Time:     time.Now().UTC(),
+		User:     retentionAuditUser,
+		Method:   "DELETE",
+		Endpoint: "DeleteImage",
+		Uuid:     uuid,
+		Action:   policy,
+		Status:   code,
+		Outcome:  "success",
+	}
+	if content != nil {
+		entry.Outcome = "failure"
+		if code != ImageHasDependentImages {
+			p.fail(fmt.Errorf("Failed to delete %s: %v", uuid, content["message"]))
+		}
+	} else {
+		log.Printf("retention: deleted %s (%s)", uuid, policy)
+		p.stats.ImagesDeleted++
+	}
+	if auditLog.file != nil {
+		err := appendAuditEntry(entry)
+		if err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	}
+}
+
+// Apply the retention policies once
+func (p *retentionPolicy) run(now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	start := time.Now()
+	entries := index.list()
+	old := p.oldVersions(entries)
+	seen := map[string]time.Time{}
+	for _, entry := range entries {
+		if expires, ok := imageExpiresAt(entry.manifest); ok && !now.Before(expires) {
+			p.delete(entry.uuid, "expired")
+			continue
+		}
+		if imageRetained(entry.manifest) {
+			continue
+		}
+		if old[entry.uuid] {
+			p.delete(entry.uuid, "keep_versions")
+		} else if p.staleUnactivated(entry, now, seen) {
+			p.delete(entry.uuid, "unactivated")
+		}
+	}
+
+	p.seen = seen
+	p.stats.Runs++
+	p.stats.LastRun = start.UTC()
+	p.stats.LastDuration = time.Since(start).Seconds()
+}
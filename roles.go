@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+)
+
+/**
+ * The roles a user in the user database may have:
+ *
+ *  operator  - may perform all operations (the default)
+ *  user      - may create and modify images, but not import images
+ *              or delete images owned by other accounts
+ *  read-only - may only perform GET requests
+ */
+const (
+	RoleOperator = "operator"
+	RoleUser     = "user"
+	RoleReadOnly = "read-only"
+)
+
+// Get the role of the user (users without a role is an operator)
+func userRole(user *UserEntry) string {
+	if user == nil {
+		return ""
+	}
+	if len(user.Role) == 0 {
+		return RoleOperator
+	}
+	return user.Role
+}
+
+func isOperator(user *UserEntry) bool {
+	return userRole(user) == RoleOperator
+}
+
+// Verify that all of the users in the user database have a valid role
+func validateUserRoles(users []UserEntry) error {
+	for _, user := range users {
+		switch userRole(&user) {
+		case RoleOperator, RoleUser, RoleReadOnly:
+		default:
+			return fmt.Errorf("Invalid role \"%s\" for user %s", user.Role, user.Name)
+		}
+	}
+	return nil
+}
+
+// Verify that the user may modify data on the server
+func checkWriteAccess(user *UserEntry) (int, map[string]interface{}) {
+	if userRole(user) == RoleReadOnly {
+		return errorResponse(CodeNotAuthorizedError, fmt.Sprintf("User %s has read-only access", user.Name))
+	}
+	return Success, nil
+}
+
+func requireOperator(user *UserEntry) (int, map[string]interface{}) {
+	if !isOperator(user) {
+		return errorResponse(CodeOperatorOnly, "This operation is restricted to operators")
+	}
+	return Success, nil
+}
+
+/**
+ * Check if the image may be listed and fetched by the user. Public
+ * images are available to everyone, while private images are only
+ * available to operators, the owner and the accounts in the acl.
+ * Anonymous users only get active images. With public_read all of the
+ * images is treated as public.
+ */
+func imageAccessible(m map[string]interface{}, user *UserEntry) bool {
+	if user == nil && getImageState(m) != StateActive {
+		return false
+	}
+	if m["public"] == true || configuration.PublicRead || isOperator(user) {
+		return true
+	}
+	if user == nil || len(user.Uuid) == 0 {
+		return false
+	}
+	return m["owner"] == user.Uuid || stringInSlice(user.Uuid, getManifestAcl(m))
+}
+
+// Verify that the user owns the image (operators may modify all images)
+func checkImageOwner(uuid string, user *UserEntry) (int, map[string]interface{}) {
+	if isOperator(user) {
+		return Success, nil
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		if err == ErrImageNotFound {
+			return errorResponse(CodeResourceNotFound, "The image does not exist")
+		}
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+
+	if len(user.Uuid) == 0 || m["owner"] != user.Uuid {
+		return errorResponse(CodeNotImageOwner, fmt.Sprintf("User %s does not own image %s", user.Name, uuid))
+	}
+	return Success, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The values of the ":name" segments in the path of a route
+type routeVars map[string]string
+
+type routeHandler func(w http.ResponseWriter, r *http.Request, vars routeVars)
+
+type route struct {
+	// The name of the endpoint (as used in the IMGAPI documentation)
+	name     string
+	method   string
+	segments []string
+	handler  routeHandler
+}
+
+/**
+ * A pattern based router. Each route is registered with the method
+ * and a pattern like "/images/:uuid/file" where the segments starting
+ * with ":" match any (non-empty) value. The ":uuid" segment must be a
+ * valid UUID. The last segment may start with "*" to match the rest of
+ * the path (like "/v2/*path").
+ *
+ * Requests for a path without a route get 404, and requests with a
+ * method not registered for the path get 405 with the Allow header
+ * set.
+ */
+type router struct {
+	routes []*route
+}
+
+// The router used by the server (used to name the endpoints in the metrics)
+var imageRouter *router
+
+func newRouter() *router {
+	return &router{}
+}
+
+func (rt *router) handle(name, method, pattern string, handler routeHandler) {
+	rt.routes = append(rt.routes, &route{
+		name:     name,
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  handler,
+	})
+}
+
+// Split "/images/:uuid/file" into "images", ":uuid" and "file"
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+type routeMatch int
+
+const (
+	routeMismatch routeMatch = iota
+	routeMatched
+	routeInvalidUuid
+)
+
+// Match the segments of the path against the route
+func (rt *route) match(segments []string) (routeVars, routeMatch) {
+	last := rt.segments[len(rt.segments)-1]
+	if strings.HasPrefix(last, "*") {
+		if len(segments) < len(rt.segments) {
+			return nil, routeMismatch
+		}
+		n := len(rt.segments) - 1
+		segments = append(segments[:n:n], strings.Join(segments[n:], "/"))
+	} else if len(segments) != len(rt.segments) {
+		return nil, routeMismatch
+	}
+
+	vars := routeVars{}
+	invalid := false
+	for i, segment := range rt.segments {
+		if strings.HasPrefix(segment, "*") {
+			vars[segment[1:]] = segments[i]
+			continue
+		}
+		if !strings.HasPrefix(segment, ":") {
+			if segment != segments[i] {
+				return nil, routeMismatch
+			}
+			continue
+		}
+		if len(segments[i]) == 0 {
+			return nil, routeMismatch
+		}
+		if segment == ":uuid" && !isValidUuid(segments[i]) {
+			invalid = true
+		}
+		vars[segment[1:]] = segments[i]
+	}
+
+	if invalid {
+		return vars, routeInvalidUuid
+	}
+	return vars, routeMatched
+}
+
+/**
+ * Look up the route for the request
+ *
+ * @param r the request to look up
+ * @return route the route to use (nil if none)
+ *         vars the values of the variables in the path
+ *         allowed the methods allowed for the path if the method
+ *                 didn't match
+ *         invalid true if the path contained an invalid UUID
+ */
+func (rt *router) lookup(r *http.Request) (found *route, vars routeVars, allowed []string, invalid bool) {
+	method := r.Method
+	if len(method) == 0 {
+		method = "GET"
+	}
+
+	segments := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		v, match := route.match(segments)
+		switch match {
+		case routeInvalidUuid:
+			invalid = true
+		case routeMatched:
+			if route.method == method {
+				return route, v, nil, false
+			}
+			if !stringInSlice(route.method, allowed) {
+				allowed = append(allowed, route.method)
+			}
+		}
+	}
+
+	sort.Strings(allowed)
+	return nil, nil, allowed, invalid && len(allowed) == 0
+}
+
+// Get the name of the route for the request ("" if there is none)
+func (rt *router) routeName(r *http.Request) string {
+	route, _, _, _ := rt.lookup(r)
+	if route == nil {
+		return ""
+	}
+	return route.name
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, vars, allowed, invalid := rt.lookup(r)
+	if route != nil {
+		route.handler(w, r, vars)
+		return
+	}
+
+	if invalid {
+		sendError(w, CodeResourceNotFound, "Invalid UUID specified")
+		return
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		sendError(w, CodeMethodNotAllowed, fmt.Sprintf("%s is not allowed on %s", r.Method, r.URL.Path))
+		return
+	}
+
+	sendError(w, CodeResourceNotFound, "Requested resource does not exist")
+}
+
+// Use a handler without variables in the path as a route handler
+func routeFunc(handler http.HandlerFunc) routeHandler {
+	return func(w http.ResponseWriter, r *http.Request, vars routeVars) {
+		handler(w, r)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The seconds a scan may take unless timeout is set
+const defaultScanTimeout = 5 * 60
+
+// The size of the chunks sent to clamd
+const clamdChunkSize = 64 * 1024
+
+// The policies for the files where the scanner finds something (or fails)
+const (
+	scanPolicyQuarantine = "quarantine"
+	scanPolicyReject     = "reject"
+	scanPolicyWarn       = "warn"
+)
+
+// The status of a file in the scan entry in the files list
+const (
+	scanStatusClean    = "clean"
+	scanStatusInfected = "infected"
+	scanStatusError    = "error"
+)
+
+// The result of a scan
+type ScanResult struct {
+	Infected bool
+	// What was found (like "Eicar-Signature")
+	Signature string
+}
+
+/**
+ * A Scanner checks the uploaded files for malware (or anything else
+ * which shouldn't be published) before they're stored.
+ */
+type Scanner interface {
+	/**
+	 * Scan the file
+	 *
+	 * @param ctx cancelled when the scan times out
+	 * @param path the local file to scan
+	 * @return the result of the scan (err if the file couldn't be scanned)
+	 */
+	Scan(ctx context.Context, path string) (ScanResult, error)
+}
+
+// The configuration of the scanning of the uploaded files in the configuration file
+type ScanConfig struct {
+	Type string `json:"type"`
+	// The clamd socket (a path for a unix socket or host:port)
+	Address string `json:"address"`
+	// The command (and arguments) to run for the command scanner (the path is appended)
+	Command []string `json:"command"`
+	// What to do with the infected files: quarantine (the default), reject or warn
+	Policy string `json:"policy"`
+	// Seconds before the scan is aborted
+	Timeout int `json:"timeout"`
+}
+
+/**
+ * The registry of the available scanner types. Each entry creates a
+ * Scanner for the provided configuration.
+ */
+var scannerTypes = map[string]func(config ScanConfig) (Scanner, error){
+	"clamd":   newClamdScanner,
+	"command": newCommandScanner,
+}
+
+// Register a new scanner type to the registry
+func RegisterScannerType(name string, factory func(config ScanConfig) (Scanner, error)) {
+	scannerTypes[name] = factory
+}
+
+// The scanner used for the uploads (nil if scanning is disabled)
+var scanner Scanner
+
+var scanStats struct {
+	scanned  int64
+	infected int64
+	errors   int64
+}
+
+func scanPolicy() string {
+	if len(configuration.Scan.Policy) == 0 {
+		return scanPolicyQuarantine
+	}
+	return configuration.Scan.Policy
+}
+
+func scanTimeout() time.Duration {
+	if configuration.Scan.Timeout > 0 {
+		return time.Duration(configuration.Scan.Timeout) * time.Second
+	}
+	return defaultScanTimeout * time.Second
+}
+
+// Create the scanner specified in the configuration (nil if none)
+func newScanner(config ScanConfig) (Scanner, error) {
+	if len(config.Type) == 0 {
+		return nil, nil
+	}
+	factory, ok := scannerTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown scan type \"%s\"", config.Type)
+	}
+	switch config.Policy {
+	case "", scanPolicyQuarantine, scanPolicyReject, scanPolicyWarn:
+		break
+	default:
+		return nil, fmt.Errorf("The scan policy must be quarantine, reject or warn (not \"%s\")", config.Policy)
+	}
+	if config.Timeout < 0 {
+		return nil, errors.New("The scan timeout can't be negative")
+	}
+	return factory(config)
+}
+
+// Verify the scan configuration
+func validateScan(config ScanConfig) error {
+	_, err := newScanner(config)
+	return err
+}
+
+/**
+ * Scan the uploaded file before it is stored. With the reject policy
+ * the upload fails if the scanner finds something (or fails), while
+ * the quarantine and warn policies store the file with the result.
+ *
+ * @param uuid the image the file is uploaded to
+ * @param path the spooled file
+ * @return the scan entry for the files list (nil if scanning is
+ *         disabled) or the error to return to the client
+ */
+func scanImageFile(uuid string, path string) (map[string]interface{}, int, map[string]interface{}) {
+	if scanner == nil {
+		return nil, Success, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout())
+	result, err := scanner.Scan(ctx, path)
+	cancel()
+
+	atomic.AddInt64(&scanStats.scanned, 1)
+	entry := map[string]interface{}{
+		"scanner": configuration.Scan.Type,
+		"time":    time.Now().UTC().Format(time.RFC3339),
+		"status":  scanStatusClean,
+	}
+	switch {
+	case err != nil:
+		atomic.AddInt64(&scanStats.errors, 1)
+		entry["status"] = scanStatusError
+		entry["error"] = fmt.Sprintf("%v", err)
+		log.Printf("Failed to scan file for %s: %v", uuid, err)
+	case result.Infected:
+		atomic.AddInt64(&scanStats.infected, 1)
+		entry["status"] = scanStatusInfected
+		entry["signature"] = result.Signature
+		log.Printf("The file for %s is infected: %s", uuid, result.Signature)
+		m, _ := index.get(uuid)
+		publishEvent(ImageEvent{Type: EventFileInfected, Uuid: uuid, Error: result.Signature, Manifest: m})
+	}
+
+	if scanPolicy() == scanPolicyReject {
+		switch entry["status"] {
+		case scanStatusError:
+			code, content := errorResponse(CodeServiceUnavailableError, fmt.Sprintf("Failed to scan the file: %v", err))
+			return nil, code, content
+		case scanStatusInfected:
+			code, content := errorResponse(CodeUpload, fmt.Sprintf("The file is infected: %s", result.Signature))
+			return nil, code, content
+		}
+	}
+	return entry, Success, nil
+}
+
+/**
+ * Refuse to activate an image with a file which isn't clean when the
+ * quarantine policy is used (the image is kept unactivated until the
+ * file is replaced or the image is deleted).
+ */
+func checkActivationScan(m map[string]interface{}) (int, map[string]interface{}) {
+	if scanPolicy() != scanPolicyQuarantine {
+		return Success, nil
+	}
+	for index := range getManifestFiles(m) {
+		scan, _ := getDeclaredFileAt(m, index)["scan"].(map[string]interface{})
+		switch scan["status"] {
+		case scanStatusInfected:
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("File %d is quarantined (infected: %v)", index, scan["signature"]))
+		case scanStatusError:
+			return errorResponse(CodeValidationFailed, fmt.Sprintf("File %d is quarantined (the scan failed: %v)", index, scan["error"]))
+		}
+	}
+	return Success, nil
+}
+
+// Get the status of the scanning for /state
+func scanState() map[string]interface{} {
+	if scanner == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{
+		"enabled":  true,
+		"type":     configuration.Scan.Type,
+		"policy":   scanPolicy(),
+		"scanned":  atomic.LoadInt64(&scanStats.scanned),
+		"infected": atomic.LoadInt64(&scanStats.infected),
+		"errors":   atomic.LoadInt64(&scanStats.errors),
+	}
+}
+
+// The clamd scanner streams the file to clamd with INSTREAM
+type clamdScanner struct {
+	address string
+}
+
+func newClamdScanner(config ScanConfig) (Scanner, error) {
+	if len(config.Address) == 0 {
+		return nil, errors.New("clamd scan requires \"address\"")
+	}
+	return &clamdScanner{address: config.Address}, nil
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer f.Close()
+
+	network := "tcp"
+	if strings.HasPrefix(s.address, "/") {
+		network = "unix"
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, s.address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// The file is sent in chunks prefixed with the length, and a zero
+	// length chunk ends the stream
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	chunk := make([]byte, clamdChunkSize)
+	for err == nil {
+		var n int
+		n, err = f.Read(chunk)
+		if n > 0 {
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(n))
+			if _, err = conn.Write(length[:]); err == nil {
+				_, err = conn.Write(chunk[:n])
+			}
+		}
+	}
+	if err != io.EOF {
+		return ScanResult{}, err
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// Parse "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	}
+	return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+}
+
+/**
+ * The command scanner runs the command with the path of the file as the
+ * last argument. The exit status 0 means clean and 1 infected (like
+ * clamscan), where the output is used as the signature. Other exit
+ * statuses is failures.
+ */
+type commandScanner struct {
+	command []string
+}
+
+func newCommandScanner(config ScanConfig) (Scanner, error) {
+	if len(config.Command) == 0 {
+		return nil, errors.New("command scan requires \"command\"")
+	}
+	return &commandScanner{command: config.Command}, nil
+}
+
+func (s *commandScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	args := append(append([]string{}, s.command[1:]...), path)
+	cmd := exec.CommandContext(ctx, s.command[0], args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+
+	message := strings.TrimSpace(output.String())
+	if len(message) > 1024 {
+		message = message[:1024]
+	}
+	if err == nil {
+		return ScanResult{}, nil
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 1 {
+		return ScanResult{Infected: true, Signature: message}, nil
+	}
+	if len(message) > 0 {
+		return ScanResult{}, fmt.Errorf("%v: %s", err, message)
+	}
+	return ScanResult{}, err
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+/**
+ * A search expression is parsed from queries like
+ *
+ *     tag.role=db AND (os=linux OR os=bsd) AND NOT name~test
+ *
+ * The comparisons is "=" (equal), "!=" (not equal) and "~" (contains,
+ * ignoring case). The fields is the string and boolean fields of the
+ * manifest and "tag.name" for the tags. AND binds tighter than OR.
+ */
+type searchExpression interface {
+	match(m map[string]interface{}) bool
+}
+
+type searchAnd []searchExpression
+type searchOr []searchExpression
+type searchNot struct{ expression searchExpression }
+type searchComparison struct {
+	field    string
+	operator string
+	value    string
+}
+
+func (e searchAnd) match(m map[string]interface{}) bool {
+	for _, expression := range e {
+		if !expression.match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e searchOr) match(m map[string]interface{}) bool {
+	for _, expression := range e {
+		if expression.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e searchNot) match(m map[string]interface{}) bool {
+	return !e.expression.match(m)
+}
+
+// Get the value of the field (tag.name for the tags) as a string
+func searchFieldValue(m map[string]interface{}, field string) (string, bool) {
+	var value interface{}
+	var ok bool
+	if strings.HasPrefix(field, "tag.") {
+		tags, _ := m["tags"].(map[string]interface{})
+		value, ok = tags[field[4:]]
+	} else if field == "state" {
+		value, ok = getImageState(m), true
+	} else {
+		value, ok = m[field]
+	}
+	if !ok {
+		return "", false
+	}
+
+	switch value.(type) {
+	case string, bool, float64:
+		return fmt.Sprintf("%v", value), true
+	}
+	return "", false
+}
+
+func (e searchComparison) match(m map[string]interface{}) bool {
+	value, ok := searchFieldValue(m, e.field)
+	switch e.operator {
+	case "!=":
+		return !ok || value != e.value
+	case "~":
+		return ok && strings.Contains(strings.ToLower(value), strings.ToLower(e.value))
+	}
+	return ok && value == e.value
+}
+
+// Split the query in tokens (parentheses, operators, words and quoted strings)
+func tokenizeSearch(query string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '(' || c == ')' || c == '~' || c == '=':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '!' && i+1 < len(query) && query[i+1] == '=':
+			tokens = append(tokens, "!=")
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end == -1 {
+				return nil, fmt.Errorf("Unterminated string in query")
+			}
+			// Keep the quote so that the parser knows it isn't a keyword
+			tokens = append(tokens, query[i:i+end+1])
+			i += end + 2
+		default:
+			start := i
+			for i < len(query) && !strings.ContainsRune(" \t\r\n()~=!\"", rune(query[i])) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("Unexpected \"%c\" in query", c)
+			}
+			tokens = append(tokens, query[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+// A recursive descent parser for the search expressions
+type searchParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *searchParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *searchParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *searchParser) parseOr() (searchExpression, error) {
+	var or searchOr
+	for {
+		expression, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, expression)
+		if p.peek() != "OR" {
+			break
+		}
+		p.next()
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *searchParser) parseAnd() (searchExpression, error) {
+	var and searchAnd
+	for {
+		expression, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, expression)
+		if p.peek() != "AND" {
+			break
+		}
+		p.next()
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *searchParser) parseUnary() (searchExpression, error) {
+	switch p.peek() {
+	case "NOT":
+		p.next()
+		expression, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return searchNot{expression}, nil
+	case "(":
+		p.next()
+		expression, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("Missing \")\" in query")
+		}
+		return expression, nil
+	}
+
+	field := p.next()
+	if len(field) == 0 || strings.HasPrefix(field, "\"") || strings.ContainsAny(field, "()") {
+		return nil, fmt.Errorf("Expected a field name in query (not \"%s\")", field)
+	}
+	operator := p.next()
+	if operator != "=" && operator != "!=" && operator != "~" {
+		return nil, fmt.Errorf("Expected =, != or ~ after \"%s\" in query", field)
+	}
+	value := p.next()
+	if len(value) == 0 || value == "(" || value == ")" {
+		return nil, fmt.Errorf("Expected a value after \"%s%s\" in query", field, operator)
+	}
+	return searchComparison{field, operator, strings.Trim(value, "\"")}, nil
+}
+
+// Parse the search expression in the query parameter
+func parseSearchExpression(query string) (searchExpression, error) {
+	tokens, err := tokenizeSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &searchParser{tokens: tokens}
+	expression, err := p.parseOr()
+	if err == nil && p.pos < len(tokens) {
+		err = fmt.Errorf("Unexpected \"%s\" in query", tokens[p.pos])
+	}
+	return expression, err
+}
+
+/**
+ * Score how well the manifest match the free text words (0 if one of
+ * the words isn't found in the name, description or tags). Matches in
+ * the name counts more than matches in the description and tags.
+ */
+func searchTextScore(m map[string]interface{}, words []string) int {
+	name, _ := m["name"].(string)
+	description, _ := m["description"].(string)
+	name = strings.ToLower(name)
+	description = strings.ToLower(description)
+
+	var tags []string
+	if values, ok := m["tags"].(map[string]interface{}); ok {
+		for _, value := range values {
+			tags = append(tags, strings.ToLower(fmt.Sprintf("%v", value)))
+		}
+	}
+	tagText := strings.Join(tags, " ")
+
+	score := 0
+	for _, word := range words {
+		found := false
+		if name == word {
+			score += 10
+			found = true
+		} else if strings.Contains(name, word) {
+			score += 5
+			found = true
+		}
+		if strings.Contains(description, word) {
+			score += 2
+			found = true
+		}
+		if strings.Contains(tagText, word) {
+			score++
+			found = true
+		}
+		if !found {
+			return 0
+		}
+	}
+	return score
+}
+
+type searchResult struct {
+	indexEntry
+	score int
+}
+
+// Order the results by the sort parameter ("-" in front for descending)
+func sortSearchResults(results []searchResult, order string) error {
+	descending := strings.HasPrefix(order, "-")
+	key := strings.TrimPrefix(order, "-")
+
+	var less func(a, b searchResult) int
+	switch key {
+	case "relevance":
+		// Most relevant first unless "-relevance"
+		descending = !descending
+		less = func(a, b searchResult) int { return a.score - b.score }
+	case "name", "published_at", "uuid":
+		less = func(a, b searchResult) int {
+			va, _ := a.manifest[key].(string)
+			vb, _ := b.manifest[key].(string)
+			if key == "uuid" {
+				va, vb = a.uuid, b.uuid
+			}
+			return strings.Compare(va, vb)
+		}
+	case "version":
+		less = func(a, b searchResult) int {
+			va, _ := a.manifest["version"].(string)
+			vb, _ := b.manifest["version"].(string)
+			return compareVersions(va, vb)
+		}
+	default:
+		return fmt.Errorf("Invalid value for \"sort\": \"%s\"", order)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		c := less(results[i], results[j])
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	})
+	return nil
+}
+
+/**
+ * Search the images in the index
+ *
+ * q       free text matched against the name, description and tags
+ * query   a search expression (see searchExpression)
+ * version a version range (see parseVersionRange)
+ * sort    relevance (default with q), name, version, published_at or
+ *         uuid (default), with "-" in front for descending order
+ * limit, offset, state, channel and account like ListImages
+ */
+func doServerSearchImages(params url.Values, user *UserEntry) (int, []searchResult, map[string]interface{}) {
+	var words []string
+	var expression searchExpression
+	var versions versionRange
+	order := ""
+	limit := maxListLimit
+	offset := 0
+	visibility := url.Values{}
+
+	var err error
+	for k, v := range params {
+		switch k {
+		case "q":
+			words = strings.Fields(strings.ToLower(v[0]))
+		case "query":
+			expression, err = parseSearchExpression(v[0])
+		case "version":
+			versions, err = parseVersionRange(v[0])
+		case "sort":
+			order = v[0]
+		case "limit":
+			limit, err = strconv.Atoi(v[0])
+			if err != nil || limit < 1 || limit > maxListLimit {
+				err = fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+			}
+		case "offset":
+			offset, err = strconv.Atoi(v[0])
+			if err != nil || offset < 0 {
+				err = fmt.Errorf("Invalid offset \"%s\"", v[0])
+			}
+		case "state", "channel", "account":
+			visibility[k] = v
+		default:
+			err = fmt.Errorf("Invalid parameter: %s", k)
+		}
+		if err != nil {
+			code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+			return code, nil, content
+		}
+	}
+
+	if len(order) == 0 {
+		order = "uuid"
+		if len(words) > 0 {
+			order = "relevance"
+		}
+	}
+
+	// The state, channel and access filters is the same as for ListImages
+	filters, err := buildImageFilters(visibility, user)
+	if err != nil {
+		code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+		return code, nil, content
+	}
+
+	var results []searchResult
+	for _, entry := range index.list() {
+		include := true
+		for _, filter := range filters {
+			if !filter(entry.uuid, entry.manifest) {
+				include = false
+				break
+			}
+		}
+		if !include || (expression != nil && !expression.match(entry.manifest)) {
+			continue
+		}
+		if versions != nil {
+			version, _ := entry.manifest["version"].(string)
+			if !versions.match(version) {
+				continue
+			}
+		}
+		score := 0
+		if len(words) > 0 {
+			score = searchTextScore(entry.manifest, words)
+			if score == 0 {
+				continue
+			}
+		}
+		results = append(results, searchResult{entry, score})
+	}
+
+	err = sortSearchResults(results, order)
+	if err != nil {
+		code, content := errorResponse(CodeInvalidParameter, fmt.Sprintf("%v", err))
+		return code, nil, content
+	}
+
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return Success, results, nil
+}
+
+/*
+SearchImages	GET /images/search	Search the images with free text, tag expressions and version ranges.
+*/
+func serverSearchImages(w http.ResponseWriter, r *http.Request, params url.Values, user *UserEntry, uuid string) {
+	code, results, content := doServerSearchImages(params, user)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, result := range results {
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		a, _ := json.MarshalIndent(result.manifest, "  ", "  ")
+		buffer.Write(a)
+	}
+	buffer.WriteString("]")
+	timingMark(w, "storage")
+
+	if checkNotModified(w, r, contentEtag(buffer.Bytes()), time.Time{}) {
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(buffer.Bytes())
+}
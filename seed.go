@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/trondn/imgapi/client"
+)
+
+// The upstream server unless url is set
+const defaultSeedUrl = "https://images.smartos.org"
+
+// The seconds between the checks for new versions unless interval is set
+const defaultSeedInterval = 24 * 60 * 60
+
+// The tag set on the images imported by the seeding
+const seedSourceTag = "imgapi_seed"
+
+// The configuration of the seed images in the configuration file
+type SeedConfig struct {
+	// The upstream IMGAPI server
+	Url string `json:"url"`
+	// The uuids and name patterns (like "base-64-lts" or "minimal-*") to import
+	Images []string `json:"images"`
+	// The number of versions to import of each name (1 by default)
+	Latest int `json:"latest"`
+	// Seconds between the checks for new versions
+	Interval int `json:"interval"`
+}
+
+/**
+ * The seeding imports the configured images from the upstream server
+ * when the server starts (so a new server is preloaded with the base
+ * images) and keeps them updated: the latest versions of the name
+ * patterns is imported as they're published upstream, and the manifests
+ * of the seeded images is updated when they change upstream. Unlike the
+ * mirror only the selected images is imported, and the older versions
+ * is left alone.
+ */
+type seeder struct {
+	sync.Mutex
+	client   *client.Client
+	url      string
+	lastRun  time.Time
+	seeded   bool
+	imported int64
+	updated  int64
+	errors   int64
+	lastErr  string
+}
+
+var imageSeeder *seeder
+
+func seedInterval() time.Duration {
+	if configuration.Seed.Interval > 0 {
+		return time.Duration(configuration.Seed.Interval) * time.Second
+	}
+	return defaultSeedInterval * time.Second
+}
+
+func seedLatest() int {
+	if configuration.Seed.Latest > 0 {
+		return configuration.Seed.Latest
+	}
+	return 1
+}
+
+// Verify the seed configuration
+func validateSeed(config SeedConfig) error {
+	if config.Interval < 0 || config.Latest < 0 {
+		return fmt.Errorf("The seed interval and latest can't be negative")
+	}
+	for _, pattern := range config.Images {
+		if isValidUuid(pattern) {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+			return fmt.Errorf("Invalid seed image \"%s\"", pattern)
+		}
+	}
+	return nil
+}
+
+// Start seeding the images (if configured)
+func startSeed() {
+	if len(configuration.Seed.Images) == 0 {
+		return
+	}
+
+	source := strings.TrimRight(configuration.Seed.Url, "/")
+	if len(source) == 0 {
+		source = defaultSeedUrl
+	}
+	imageSeeder = &seeder{client: client.New(source), url: source}
+	imageSeeder.client.HttpClient = upstreamClient
+	go func() {
+		for {
+			if !inMaintenance() {
+				imageSeeder.run()
+			}
+			time.Sleep(seedInterval())
+		}
+	}()
+}
+
+func (s *seeder) fail(err error) {
+	log.Printf("seed: %v", err)
+	s.errors++
+	s.lastErr = fmt.Sprintf("%v", err)
+}
+
+/**
+ * Get the upstream images selected by the configuration. The uuids is
+ * always selected, while the latest versions (by published_at) of each
+ * name matching the patterns is selected.
+ */
+func (s *seeder) selectImages() (map[string]client.Manifest, error) {
+	selected := make(map[string]client.Manifest)
+	var all []client.Manifest
+
+	for _, pattern := range configuration.Seed.Images {
+		if isValidUuid(pattern) {
+			image, err := s.client.GetImage(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to get upstream image %s: %v", pattern, err)
+			}
+			selected[pattern] = image
+			continue
+		}
+
+		// Only list all of the upstream images if a pattern needs them
+		var candidates []client.Manifest
+		var err error
+		if strings.ContainsAny(pattern, "*?[") {
+			if all == nil {
+				all, err = s.client.ListImages(nil)
+			}
+			candidates = all
+		} else {
+			candidates, err = s.client.ListImages(url.Values{"name": {pattern}})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list upstream images: %v", err)
+		}
+
+		versions := make(map[string][]client.Manifest)
+		for _, image := range candidates {
+			if matched, _ := path.Match(pattern, image.Name()); matched && isValidUuid(image.Uuid()) {
+				versions[image.Name()] = append(versions[image.Name()], image)
+			}
+		}
+		for _, images := range versions {
+			sort.SliceStable(images, func(i, j int) bool {
+				a, _ := images[i]["published_at"].(string)
+				b, _ := images[j]["published_at"].(string)
+				return a > b
+			})
+			if len(images) > seedLatest() {
+				images = images[:seedLatest()]
+			}
+			for _, image := range images {
+				selected[image.Uuid()] = image
+			}
+		}
+	}
+	return selected, nil
+}
+
+// Import (or update) the selected images once
+func (s *seeder) run() {
+	s.Lock()
+	defer s.Unlock()
+	s.lastRun = time.Now().UTC()
+
+	selected, err := s.selectImages()
+	if err != nil {
+		s.fail(err)
+		return
+	}
+
+	uuids := make([]string, 0, len(selected))
+	for uuid := range selected {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	for _, uuid := range uuids {
+		s.seedImage(uuid, selected[uuid])
+	}
+
+	if !s.seeded {
+		log.Printf("seed: %d images is seeded from %s", len(selected), s.url)
+		s.seeded = true
+	}
+}
+
+// Import the image if it is missing, or update the manifest if it changed
+func (s *seeder) seedImage(uuid string, image client.Manifest) {
+	defer lockImage(uuid)()
+
+	local, err := storage.GetManifest(uuid)
+	if err == ErrImageNotFound {
+		code, content := doServerImportRemoteImage(uuid, url.Values{"source": {s.url}}, false)
+		if code != Success {
+			s.fail(fmt.Errorf("Failed to import %s: %v", uuid, content["message"]))
+			return
+		}
+		err = storage.PutManifest(uuid, taggedManifest(content, seedSourceTag, s.url))
+		if err != nil {
+			s.fail(fmt.Errorf("Failed to tag %s: %v", uuid, err))
+			return
+		}
+		log.Printf("seed: imported %s (%s %s)", uuid, image.Name(), image.Version())
+		s.imported++
+		return
+	}
+	if err != nil {
+		s.fail(fmt.Errorf("Failed to load manifest for %s: %v", uuid, err))
+		return
+	}
+
+	// Leave the images which wasn't imported by the seeding alone
+	tags, _ := local["tags"].(map[string]interface{})
+	if tags[seedSourceTag] != s.url {
+		return
+	}
+
+	// The import adds the checksums computed locally to the files, so
+	// the files is compared by the upstream checksums and kept as is
+	if !sameImageFiles(local, image) {
+		s.fail(fmt.Errorf("The files of %s changed upstream", uuid))
+		return
+	}
+	manifest := taggedManifest(image, seedSourceTag, s.url)
+	manifest["files"] = local["files"]
+	if attachments, ok := local["attachments"]; ok {
+		manifest["attachments"] = attachments
+	} else {
+		delete(manifest, "attachments")
+	}
+	if manifestsEqual(local, manifest) {
+		return
+	}
+
+	err = storage.PutManifest(uuid, manifest)
+	if err != nil {
+		s.fail(fmt.Errorf("Failed to update %s: %v", uuid, err))
+		return
+	}
+	log.Printf("seed: updated %s", uuid)
+	publishImageEvent(EventImageUpdated, uuid)
+	s.updated++
+}
+
+// Check if the files of the manifests has the same sizes and sha1 sums
+func sameImageFiles(local map[string]interface{}, upstream map[string]interface{}) bool {
+	files := getManifestFiles(local)
+	if len(files) != len(getManifestFiles(upstream)) {
+		return false
+	}
+	for i := range files {
+		localSize, _ := getDeclaredFileSize(local, i)
+		upstreamSize, _ := getDeclaredFileSize(upstream, i)
+		if getDeclaredFileAt(local, i)["sha1"] != getDeclaredFileAt(upstream, i)["sha1"] || localSize != upstreamSize {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the status of the seeding for /state
+func seedState() map[string]interface{} {
+	if imageSeeder == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+
+	imageSeeder.Lock()
+	defer imageSeeder.Unlock()
+	return map[string]interface{}{
+		"enabled":    true,
+		"url":        imageSeeder.url,
+		"interval":   int64(seedInterval().Seconds()),
+		"seeded":     imageSeeder.seeded,
+		"last_run":   imageSeeder.lastRun,
+		"imported":   imageSeeder.imported,
+		"updated":    imageSeeder.updated,
+		"errors":     imageSeeder.errors,
+		"last_error": imageSeeder.lastErr,
+	}
+}
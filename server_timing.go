@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type timingPhase struct {
+	name     string
+	duration time.Duration
+}
+
+/**
+ * timingWriter wraps the http.ResponseWriter and collects the time
+ * spent in the various phases of a request. The collected phases are
+ * sent back to the client in the Server-Timing header right before
+ * the response header is written.
+ *
+ * All measurements use time.Now() / time.Since() which use the
+ * monotonic clock so they are not affected by wall clock changes.
+ */
+type timingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	last        time.Time
+	phases      []timingPhase
+	wroteHeader bool
+}
+
+func (t *timingWriter) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, timingPhase{name, now.Sub(t.last)})
+	t.last = now
+}
+
+func (t *timingWriter) WriteHeader(code int) {
+	if !t.wroteHeader {
+		t.wroteHeader = true
+		var buffer bytes.Buffer
+		for _, phase := range t.phases {
+			fmt.Fprintf(&buffer, "%s;dur=%.3f, ", phase.name,
+				float64(phase.duration)/float64(time.Millisecond))
+		}
+		fmt.Fprintf(&buffer, "total;dur=%.3f",
+			float64(time.Since(t.start))/float64(time.Millisecond))
+		t.Header().Set("Server-Timing", buffer.String())
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *timingWriter) Write(data []byte) (int, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return t.ResponseWriter.Write(data)
+}
+
+// Let http.ResponseController reach the connection (see timeouts.go)
+func (t *timingWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// Pass on io.ReaderFrom so that the files may be sent with sendfile
+func (t *timingWriter) ReadFrom(reader io.Reader) (int64, error) {
+	if !t.wroteHeader {
+		t.WriteHeader(http.StatusOK)
+	}
+	return readFrom(t.ResponseWriter, reader)
+}
+
+// Flush the response to the client (used by the event stream)
+func (t *timingWriter) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/**
+ * Record the end of a phase called name (the phase started when the
+ * previous phase ended). This is a noop unless server timing is
+ * enabled in the configuration.
+ */
+func timingMark(w http.ResponseWriter, name string) {
+	t, ok := w.(*timingWriter)
+	if ok {
+		t.mark(name)
+	}
+}
+
+// Wrap the handler to collect timing information if enabled
+func withServerTiming(handler http.HandlerFunc) http.HandlerFunc {
+	// The setting may be changed when the configuration is reloaded
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !currentConfiguration().ServerTiming {
+			handler(w, r)
+			return
+		}
+
+		now := time.Now()
+		handler(&timingWriter{ResponseWriter: w, start: now, last: now}, r)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Get the names of the phases in the Server-Timing header
+func timingPhaseNames(header string) []string {
+	var names []string
+	for _, entry := range strings.Split(header, ",") {
+		if name := strings.TrimSpace(strings.SplitN(entry, ";", 2)[0]); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func TestServerTiming(t *testing.T) {
+	setupTestStorage(t)
+	uuid := "00000000-0000-0000-0000-000000000001"
+	addTestImage(t, uuid, testManifest("timing"), "")
+
+	configuration.ServerTiming = true
+	handler := withServerTiming(newImageRouter().ServeHTTP)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/images/"+uuid, nil))
+	if w.Code != Success {
+		t.Fatalf("GetImage returned %d: %s", w.Code, w.Body.String())
+	}
+
+	names := timingPhaseNames(w.Header().Get("Server-Timing"))
+	expected := []string{"auth", "storage", "serialize", "total"}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected the phases %v in \"%s\"", expected, w.Header().Get("Server-Timing"))
+	}
+
+	configuration.ServerTiming = false
+	w = httptest.NewRecorder()
+	withServerTiming(newImageRouter().ServeHTTP)(w, httptest.NewRequest("GET", "/images/"+uuid, nil))
+	if header := w.Header().Get("Server-Timing"); len(header) > 0 {
+		t.Errorf("Server-Timing is sent when disabled: %s", header)
+	}
+}
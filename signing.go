@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// The name of the file the signature is stored as
+const signatureFileName = "signature"
+
+// The namespace used with ssh-keygen -Y sign unless namespace is set
+const defaultSigningNamespace = "imgapi"
+
+// The maximum size of a signature
+const maxSignatureSize = 16 * 1024
+
+// The configuration of the image signatures in the configuration file
+type SigningConfig struct {
+	// The file with the trusted public keys (in authorized_keys format)
+	TrustedKeys string `json:"trusted_keys"`
+	// Require a valid signature from a trusted key to activate an image
+	Require   bool   `json:"require"`
+	Namespace string `json:"namespace"`
+}
+
+func signingNamespace() string {
+	if len(configuration.Signing.Namespace) > 0 {
+		return configuration.Signing.Namespace
+	}
+	return defaultSigningNamespace
+}
+
+/**
+ * Build the payload which is signed for the image. The payload contains
+ * the fields identifying the image and the digests of the files, which
+ * can't be changed after the image is activated:
+ *
+ *     imgapi-signature-v1
+ *     uuid 2b683a82-a066-11e3-97ab-2faa44701c5a
+ *     name base
+ *     version 13.4.0
+ *     file 0 sha256:9f86d081884c7d65...
+ *
+ * The sha256 of the file is used if present (sha1 otherwise). The values
+ * may not contain control characters (like newlines) so that one value
+ * can't be made to look like another line in the payload.
+ */
+func signingPayload(uuid string, m map[string]interface{}) ([]byte, error) {
+	files := getManifestFiles(m)
+	if len(files) == 0 {
+		return nil, errors.New("The image file must be uploaded before the image is signed")
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString("imgapi-signature-v1\n")
+	fmt.Fprintf(&buffer, "uuid %s\n", uuid)
+	for _, field := range []string{"name", "version"} {
+		value, ok := m[field].(string)
+		if !ok || !isSigningPayloadValue(value) {
+			return nil, fmt.Errorf("The %s of the image must be a string without control characters", field)
+		}
+		fmt.Fprintf(&buffer, "%s %s\n", field, value)
+	}
+	for index, entry := range files {
+		file, _ := entry.(map[string]interface{})
+		algorithm := "sha256"
+		sum, ok := file[algorithm].(string)
+		if !ok {
+			algorithm = "sha1"
+			sum, ok = file[algorithm].(string)
+		}
+		if !ok {
+			return nil, fmt.Errorf("The file %d has no digest", index)
+		}
+		if !isSigningPayloadValue(sum) {
+			return nil, fmt.Errorf("The %s of file %d is invalid", algorithm, index)
+		}
+		fmt.Fprintf(&buffer, "file %d %s:%s\n", index, algorithm, sum)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Check that the value is written as a single line in the payload
+func isSigningPayloadValue(value string) bool {
+	for _, c := range value {
+		if unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// A signature in the format created by ssh-keygen -Y sign
+type sshSignature struct {
+	publicKey []byte
+	namespace string
+	reserved  []byte
+	hashAlg   string
+	format    string
+	blob      []byte
+}
+
+/**
+ * Parse the armored signature:
+ *
+ *     -----BEGIN SSH SIGNATURE-----
+ *     U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAg...
+ *     -----END SSH SIGNATURE-----
+ */
+func parseSshSignature(armored []byte) (*sshSignature, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("The signature must be an armored SSH signature (ssh-keygen -Y sign)")
+	}
+
+	data := block.Bytes
+	if len(data) < 10 || string(data[:6]) != "SSHSIG" {
+		return nil, errors.New("Invalid SSH signature")
+	}
+	if binary.BigEndian.Uint32(data[6:10]) != 1 {
+		return nil, errors.New("Unsupported SSH signature version")
+	}
+
+	var fields [5][]byte
+	rest := data[10:]
+	for i := range fields {
+		var err error
+		fields[i], rest, err = readSshString(rest)
+		if err != nil {
+			return nil, errors.New("Invalid SSH signature")
+		}
+	}
+
+	format, blob, err := readSshString(fields[4])
+	if err == nil {
+		blob, _, err = readSshString(blob)
+	}
+	if err != nil {
+		return nil, errors.New("Invalid SSH signature")
+	}
+
+	return &sshSignature{
+		publicKey: fields[0],
+		namespace: string(fields[1]),
+		reserved:  fields[2],
+		hashAlg:   string(fields[3]),
+		format:    string(format),
+		blob:      blob,
+	}, nil
+}
+
+// Encode the value as a length prefixed string in the SSH wire format
+func sshString(value []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(value)))
+	return append(length, value...)
+}
+
+// Get the SHA256 fingerprint of the public key (as printed by ssh-keygen -l)
+func sshFingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Verify that the signature is made over the message in the namespace
+func (s *sshSignature) verify(message []byte, namespace string) error {
+	if s.namespace != namespace {
+		return fmt.Errorf("The signature is made for namespace \"%s\" (not \"%s\")", s.namespace, namespace)
+	}
+
+	var h hash.Hash
+	switch s.hashAlg {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return fmt.Errorf("Unsupported hash algorithm \"%s\"", s.hashAlg)
+	}
+	h.Write(message)
+
+	var signed bytes.Buffer
+	signed.WriteString("SSHSIG")
+	signed.Write(sshString([]byte(s.namespace)))
+	signed.Write(sshString(s.reserved))
+	signed.Write(sshString([]byte(s.hashAlg)))
+	signed.Write(sshString(h.Sum(nil)))
+	data := signed.Bytes()
+
+	key, err := parseSshPublicKey(s.publicKey)
+	if err != nil {
+		return err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var hash crypto.Hash
+		switch s.format {
+		case "rsa-sha2-256":
+			hash = crypto.SHA256
+		case "rsa-sha2-512":
+			hash = crypto.SHA512
+		default:
+			return fmt.Errorf("Unsupported signature format \"%s\"", s.format)
+		}
+		digest := hash.New()
+		digest.Write(data)
+		if rsa.VerifyPKCS1v15(k, hash, digest.Sum(nil), s.blob) == nil {
+			return nil
+		}
+
+	case *ecdsa.PublicKey:
+		var digest hash.Hash
+		switch s.format {
+		case "ecdsa-sha2-nistp256":
+			digest = sha256.New()
+		case "ecdsa-sha2-nistp384":
+			digest = sha512.New384()
+		case "ecdsa-sha2-nistp521":
+			digest = sha512.New()
+		default:
+			return fmt.Errorf("Unsupported signature format \"%s\"", s.format)
+		}
+		digest.Write(data)
+
+		r, rest, err := readSshString(s.blob)
+		var sv []byte
+		if err == nil {
+			sv, _, err = readSshString(rest)
+		}
+		if err != nil {
+			return errors.New("Invalid ECDSA signature")
+		}
+		if ecdsa.Verify(k, digest.Sum(nil), new(big.Int).SetBytes(r), new(big.Int).SetBytes(sv)) {
+			return nil
+		}
+
+	case ed25519.PublicKey:
+		if s.format != "ssh-ed25519" {
+			return fmt.Errorf("Unsupported signature format \"%s\"", s.format)
+		}
+		if ed25519.Verify(k, data, s.blob) {
+			return nil
+		}
+	}
+
+	return errors.New("Invalid signature")
+}
+
+// Read the public keys (in the SSH wire format) in the trusted_keys file
+func loadTrustedKeys(path string) ([][]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		blob, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key in %s: %v", path, err)
+		}
+		keys = append(keys, blob)
+	}
+	return keys, nil
+}
+
+// Check if the public key is in the trusted_keys file
+func isTrustedKey(key []byte) (bool, error) {
+	if len(configuration.Signing.TrustedKeys) == 0 {
+		return false, nil
+	}
+
+	keys, err := loadTrustedKeys(configuration.Signing.TrustedKeys)
+	if err != nil {
+		return false, err
+	}
+	for _, trusted := range keys {
+		if bytes.Equal(trusted, key) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+/**
+ * Verify the signature for the image
+ *
+ * @param uuid the image
+ * @param m the manifest of the image
+ * @param armored the signature
+ * @return signature the parsed signature
+ *         trusted true if the signature is made with a trusted key
+ *         err the error if the signature is invalid
+ */
+func verifyImageSignature(uuid string, m map[string]interface{}, armored []byte) (signature *sshSignature, trusted bool, err error) {
+	signature, err = parseSshSignature(armored)
+	if err != nil {
+		return nil, false, err
+	}
+
+	payload, err := signingPayload(uuid, m)
+	if err == nil {
+		err = signature.verify(payload, signingNamespace())
+	}
+	if err != nil {
+		return signature, false, err
+	}
+
+	trusted, err = isTrustedKey(signature.publicKey)
+	return signature, trusted, err
+}
+
+// Read the stored signature for the image (nil if there is none)
+func readImageSignature(uuid string) ([]byte, error) {
+	reader, err := storage.GetFile(uuid, signatureFileName)
+	if err == ErrImageNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+/**
+ * Verify that the image has a valid signature from a trusted key if
+ * signatures is required (called when the image is activated).
+ *
+ * @return the error to return to the client (nil if the image may be activated)
+ */
+func checkActivationSignature(uuid string, m map[string]interface{}) (int, map[string]interface{}) {
+	if !configuration.Signing.Require {
+		return Success, nil
+	}
+
+	armored, err := readImageSignature(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read signature: %v", err))
+	}
+	if armored == nil {
+		return errorResponse(CodeValidationFailed, "The image must be signed before it is activated")
+	}
+
+	_, trusted, err := verifyImageSignature(uuid, m, armored)
+	if err == nil && !trusted {
+		err = errors.New("The image is not signed with a trusted key")
+	}
+	if err != nil {
+		return errorResponse(CodeValidationFailed, fmt.Sprintf("Invalid signature: %v", err))
+	}
+	return Success, nil
+}
+
+func doServerGetImageSignature(uuid string) (int, map[string]interface{}) {
+	m, err := storage.GetManifest(uuid)
+	var armored []byte
+	if err == nil {
+		armored, err = readImageSignature(uuid)
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read signature: %v", err))
+	}
+	if armored == nil {
+		return errorResponse(CodeResourceNotFound, "The image is not signed")
+	}
+
+	signature, trusted, err := verifyImageSignature(uuid, m, armored)
+	content := map[string]interface{}{
+		"signature": string(armored),
+		"valid":     err == nil,
+		"trusted":   trusted,
+	}
+	if signature != nil {
+		content["key"] = sshFingerprint(signature.publicKey)
+		content["namespace"] = signature.namespace
+	}
+	if err != nil {
+		content["error"] = fmt.Sprintf("%v", err)
+	}
+	return Success, content
+}
+
+func doServerAddImageSignature(uuid string, reader io.Reader) (int, map[string]interface{}) {
+	armored, err := ioutil.ReadAll(io.LimitReader(reader, maxSignatureSize+1))
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+	if len(armored) > maxSignatureSize {
+		return errorResponse(CodePayloadTooLarge, fmt.Sprintf("The signature exceeds the maximum size of %d bytes", maxSignatureSize))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+
+	// Only accept signatures which would allow the image to be activated
+	_, trusted, err := verifyImageSignature(uuid, m, armored)
+	if err == nil && !trusted && len(configuration.Signing.TrustedKeys) > 0 {
+		err = errors.New("The image is not signed with a trusted key")
+	}
+	if err != nil {
+		return errorResponse(CodeValidationFailed, fmt.Sprintf("Invalid signature: %v", err))
+	}
+
+	_, err = storage.PutFile(uuid, signatureFileName, bytes.NewReader(armored))
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store signature: %v", err))
+	}
+	return doServerGetImageSignature(uuid)
+}
+
+/*
+GetImageSignature	GET /images/:uuid/signature	Get the signature of the image.
+*/
+func serverGetImageSignature(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerGetImageSignature(uuid)
+	sendResponse(w, code, content)
+}
+
+/*
+GetImageSigningPayload	GET /images/:uuid/signature/payload	Get the payload to sign for the image.
+*/
+func serverGetImageSigningPayload(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+
+	payload, err := signingPayload(uuid, m)
+	if err != nil {
+		sendError(w, CodeValidationFailed, fmt.Sprintf("%v", err))
+		return
+	}
+
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(Success)
+	w.Write(payload)
+}
+
+/*
+AddImageSignature	PUT /images/:uuid/signature	Add (or replace) the signature of the image.
+*/
+func serverAddImageSignature(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerAddImageSignature(uuid, r.Body)
+	sendResponse(w, code, content)
+}
+
+/*
+DeleteImageSignature	DELETE /images/:uuid/signature	Remove the signature of the image.
+*/
+func serverDeleteImageSignature(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+
+	// The signature is verified when the image is activated
+	if !imageFileMutable(m) {
+		sendError(w, CodeImageAlreadyActivated, "Can't remove the signature of an active image")
+		return
+	}
+
+	err = storage.DeleteFile(uuid, signatureFileName)
+	if err != nil && err != ErrImageNotFound {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to remove signature: %v", err))
+		return
+	}
+	sendResponse(w, NoContent, nil)
+}
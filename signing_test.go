@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSigningPayloadRejectsControlCharacters(t *testing.T) {
+	uuid := "00000000-0000-0000-0000-000000000001"
+	file := map[string]interface{}{"sha256": "9f86d081884c7d65"}
+
+	m := testManifest("base", file)
+	payload, err := signingPayload(uuid, m)
+	if err != nil {
+		t.Fatalf("Failed to create payload: %v", err)
+	}
+	expected := "imgapi-signature-v1\nuuid " + uuid + "\nname base\nversion 1.0.0\nfile 0 sha256:9f86d081884c7d65\n"
+	if string(payload) != expected {
+		t.Errorf("Expected the payload %q, got %q", expected, payload)
+	}
+
+	forged := []map[string]interface{}{
+		testManifest("base\nfile 1 sha256:0000", file),
+		testManifest("base", map[string]interface{}{"sha256": "9f86\nfile 1 sha256:0000"}),
+	}
+	forged = append(forged, testManifest("base", file), testManifest("base", file))
+	forged[2]["version"] = "1.0.0\r"
+	forged[3]["version"] = 1
+	for _, m := range forged {
+		_, err = signingPayload(uuid, m)
+		if err == nil {
+			t.Errorf("Expected the payload of %v to be rejected", m)
+		}
+	}
+}
+
+func TestDeleteSignatureOfActiveImage(t *testing.T) {
+	setupTestStorage(t)
+	uuid := "00000000-0000-0000-0000-000000000001"
+	addTestImage(t, uuid, testManifest("signed"), "")
+	_, err := storage.PutFile(uuid, signatureFileName, strings.NewReader("signature"))
+	if err != nil {
+		t.Fatalf("Failed to store signature: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	serverDeleteImageSignature(w, httptest.NewRequest("DELETE", "/images/"+uuid+"/signature", nil), url.Values{}, uuid)
+	if w.Code != ImageAlreadyActivated || !strings.Contains(w.Body.String(), string(CodeImageAlreadyActivated)) {
+		t.Errorf("Expected ImageAlreadyActivated, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := storage.StatFile(uuid, signatureFileName); err != nil {
+		t.Errorf("Expected the signature to be kept: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	ErrImageNotFound = errors.New("The image does not exist")
+	ErrImageExists   = errors.New("The image already exists")
+)
+
+// Information about a file stored for an image
+type FileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+/**
+ * Storage is the interface the request handlers use to access the
+ * images. Each image is identified by its uuid and consists of the
+ * manifest and a set of named files (the image file and the icon).
+ *
+ * The methods return ErrImageNotFound if the image (or the requested
+ * file) does not exist.
+ */
+type Storage interface {
+	// Reserve the uuid for a new image (ErrImageExists if it exists)
+	Create(uuid string) error
+
+	// Check if the image exists
+	Exists(uuid string) (bool, error)
+
+	// Get the manifest for the image
+	GetManifest(uuid string) (map[string]interface{}, error)
+
+	// Store the manifest for the image (replacing the current one)
+	PutManifest(uuid string, manifest map[string]interface{}) error
+
+	// Open the named file for reading (the caller must close it)
+	GetFile(uuid string, name string) (io.ReadCloser, error)
+
+	// Get information about the named file
+	StatFile(uuid string, name string) (FileInfo, error)
+
+	// Store the content of reader as the named file
+	PutFile(uuid string, name string, reader io.Reader) (int64, error)
+
+	// Move the local file at path into place as the named file
+	MoveFile(uuid string, name string, path string) (int64, error)
+
+	// Remove the named file
+	DeleteFile(uuid string, name string) error
+
+	// Remove the image and all of its files
+	Delete(uuid string) error
+
+	// List the uuid of all of the images
+	List() ([]string, error)
+
+	// List the names of the files stored for the image (including the manifest)
+	ListFiles(uuid string) ([]string, error)
+}
+
+// The configuration of the storage backend in the configuration file
+type StorageConfig struct {
+	Type      string `json:"type"`
+	Bucket    string `json:"bucket"`
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"`
+	// The layout of the local storage (1 or 2, see storage_local.go)
+	Layout int `json:"layout"`
+	// Store identical files once (see storage_dedup.go)
+	Dedup bool `json:"dedup"`
+}
+
+/**
+ * The registry of the available storage backends. Each entry creates
+ * the backend from the configuration.
+ */
+var storageTypes = map[string]func(config Configuration) (Storage, error){
+	"local": newLocalStorage,
+	"s3":    newS3Storage,
+}
+
+// Register a new storage backend to the registry
+func RegisterStorageType(name string, factory func(config Configuration) (Storage, error)) {
+	storageTypes[name] = factory
+}
+
+var storage Storage
+
+// Get the name of the storage backend specified in the configuration
+func storageType(config Configuration) string {
+	if len(config.Storage.Type) == 0 {
+		return "local"
+	}
+	return config.Storage.Type
+}
+
+// Create the storage backend specified in the configuration
+func newStorage(config Configuration) (Storage, error) {
+	name := storageType(config)
+	factory, ok := storageTypes[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage type \"%s\"", name)
+	}
+
+	return factory(config)
+}
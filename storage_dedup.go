@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// The directory in datadir holding the content of the deduplicated files
+const blobsDirName = ".blobs"
+
+/**
+ * With storage.dedup the local storage keeps the content of each file
+ * once, addressed by its sha256 in datadir/.blobs:
+ *
+ *     datadir/.blobs/3f/3f2a...e1              (the content)
+ *     datadir/ab/cd/abcd1234-.../file0.gz      (a hard link to the blob)
+ *
+ * The files of the images is hard links to the blobs, so they're read
+ * like any other file, and the link count of a blob is its reference
+ * count. A blob with a single link isn't used by any image, and is
+ * removed when the last file referencing it is deleted (or replaced).
+ * The files stored before dedup was enabled is converted in the
+ * background when the server starts.
+ */
+var dedupStats struct {
+	deduplicated int64
+	saved        int64
+	converted    int64
+	released     int64
+}
+
+// Get the path of the blob with the sha256 sum
+func (s *localStorage) blobPath(sum string) string {
+	return filepath.Join(s.root, blobsDirName, sum[0:2], sum)
+}
+
+// Check if the file is the last reference to a blob (the other link is the blob)
+func isLastBlobReference(info os.FileInfo) bool {
+	links, _, ok := fileLinks(info)
+	return ok && links == 2
+}
+
+// Compute the sha256 of the file at path
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/**
+ * Store the content of the file at path (with the sha256 sum) as a blob
+ * (unless the blob exists) and link the blob into place as filename.
+ * The file at path is removed unless it is filename.
+ */
+func (s *localStorage) linkBlob(path string, sum string, filename string) error {
+	s.blobs.Lock()
+	defer s.blobs.Unlock()
+
+	blob := s.blobPath(sum)
+	info, err := os.Stat(blob)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !exists {
+		err = os.MkdirAll(filepath.Dir(blob), 0777)
+		if err == nil {
+			err = os.Link(path, blob)
+		}
+		if err != nil {
+			return err
+		}
+		info, err = os.Stat(blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Link the blob next to the file and rename it into place so that
+	// readers never see a partial (or missing) file
+	previous, perr := os.Stat(filename)
+	if perr != nil || !os.SameFile(previous, info) {
+		link := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".link")
+		os.Remove(link)
+		err = os.Link(blob, link)
+		if err == nil {
+			err = os.Rename(link, filename)
+		}
+		if err != nil {
+			os.Remove(link)
+			return err
+		}
+	}
+	if path != filename {
+		os.Remove(path)
+	}
+
+	if exists {
+		atomic.AddInt64(&dedupStats.deduplicated, 1)
+		atomic.AddInt64(&dedupStats.saved, info.Size())
+	}
+	if perr == nil && !os.SameFile(previous, info) && isLastBlobReference(previous) {
+		s.sweepBlobs()
+	}
+	return nil
+}
+
+// Remove the file, and the blob if this was the last reference to it
+func (s *localStorage) unlinkFile(filename string) error {
+	s.blobs.Lock()
+	defer s.blobs.Unlock()
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filename)
+	if err == nil && isLastBlobReference(info) {
+		s.sweepBlobs()
+	}
+	return err
+}
+
+// Remove the directory of the image, and the blobs only used by the image
+func (s *localStorage) removeImageDir(dir string) error {
+	s.blobs.Lock()
+	defer s.blobs.Unlock()
+
+	files, _ := ioutil.ReadDir(dir)
+	release := false
+	for _, info := range files {
+		if info.Mode().IsRegular() && isLastBlobReference(info) {
+			release = true
+		}
+	}
+
+	err := os.RemoveAll(dir)
+	if release {
+		s.sweepBlobs()
+	}
+	return err
+}
+
+/**
+ * Remove the blobs which isn't referenced by any file (the caller must
+ * hold the blobs lock). The blobs is swept rather than looked up by the
+ * file, as the file don't know the sum of its blob.
+ */
+func (s *localStorage) sweepBlobs() {
+	root := filepath.Join(s.root, blobsDirName)
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if links, _, ok := fileLinks(info); ok && links == 1 {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove unused blob %s: %v", path, err)
+			} else {
+				atomic.AddInt64(&dedupStats.released, 1)
+			}
+		}
+		return nil
+	})
+}
+
+/**
+ * Replace the files stored before dedup was enabled with links to the
+ * blobs, and remove the unused blobs left behind if the server stopped
+ * while a file was replaced.
+ */
+func (s *localStorage) dedupImages() {
+	uuids, err := s.List()
+	if err != nil {
+		log.Printf("Failed to deduplicate the files in %s: %v", s.root, err)
+		return
+	}
+
+	for _, uuid := range uuids {
+		err = s.dedupImage(uuid)
+		if err != nil {
+			log.Printf("Failed to deduplicate the files of %s: %v", uuid, err)
+		}
+	}
+
+	s.blobs.Lock()
+	s.sweepBlobs()
+	s.blobs.Unlock()
+	if converted := atomic.LoadInt64(&dedupStats.converted); converted > 0 {
+		log.Printf("Deduplicated %d files in %s (%d bytes saved)", converted, s.root,
+			atomic.LoadInt64(&dedupStats.saved))
+	}
+}
+
+// Link the files of the image which isn't a blob yet
+func (s *localStorage) dedupImage(uuid string) error {
+	l := s.stripe(uuid)
+	l.Lock()
+	defer l.Unlock()
+
+	dir := s.dir(uuid)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return localStorageError(err)
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || info.Name() == "manifest.json" || strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if links, _, ok := fileLinks(info); !ok || links != 1 {
+			continue
+		}
+
+		filename := filepath.Join(dir, info.Name())
+		sum, err := sha256File(filename)
+		if err == nil {
+			err = s.linkBlob(filename, sum, filename)
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&dedupStats.converted, 1)
+	}
+	return nil
+}
+
+// Get the status of the deduplication for /state
+func dedupState() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":      configuration.Storage.Dedup,
+		"deduplicated": atomic.LoadInt64(&dedupStats.deduplicated),
+		"saved":        atomic.LoadInt64(&dedupStats.saved),
+		"converted":    atomic.LoadInt64(&dedupStats.converted),
+		"released":     atomic.LoadInt64(&dedupStats.released),
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The name of the file in datadir holding the version of the layout
+const localLayoutFileName = ".layout"
+
+// The layout used for new data directories unless storage.layout is set
+const defaultLocalLayout = 2
+
+/**
+ * The local storage keeps each image in a directory named by its
+ * uuid. With layout 1 the directories is located directly in the data
+ * directory, which gets slow with tens of thousands of images, so
+ * layout 2 shards them by the first four characters of the uuid:
+ *
+ *     datadir/.layout                          (contains "2")
+ *     datadir/ab/cd/abcd1234-.../manifest.json
+ *     datadir/ab/cd/abcd1234-.../image.gz
+ *     datadir/ab/cd/abcd1234-.../icon.png
+ *
+ * A data directory using layout 1 is migrated to layout 2 in the
+ * background while the server is running. Until the migration is
+ * complete the images is looked up in both locations, and the image is
+ * locked while it is moved.
+ */
+type localStorage struct {
+	root      string
+	layout    int
+	migrating bool
+	// Store the files as links to the blobs (see storage_dedup.go)
+	dedup bool
+	// Held (for reading) while an image directory is used
+	locks [256]sync.RWMutex
+	// Held while the blobs is linked or removed
+	blobs sync.Mutex
+	sync.Mutex
+}
+
+// Read the version of the layout from the marker file (0 if missing)
+func readLocalLayout(root string) (int, error) {
+	content, err := ioutil.ReadFile(filepath.Join(root, localLayoutFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	layout, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s in %s", localLayoutFileName, root)
+	}
+	return layout, nil
+}
+
+func writeLocalLayout(root string, layout int) error {
+	path := filepath.Join(root, localLayoutFileName)
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", layout)), 0644)
+}
+
+// Check if the data directory contains images stored with layout 1
+func hasFlatImages(root string) (bool, error) {
+	dir, err := ioutil.ReadDir(root)
+	if err != nil {
+		return false, err
+	}
+	for _, fileinfo := range dir {
+		if fileinfo.IsDir() && isValidUuid(fileinfo.Name()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newLocalStorage(config Configuration) (Storage, error) {
+	_, err := os.Stat(config.Datadir)
+	if err != nil && os.IsNotExist(err) {
+		err = os.MkdirAll(config.Datadir, 0777)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %s: %v", config.Datadir, err)
+	}
+
+	wanted := config.Storage.Layout
+	if wanted == 0 {
+		wanted = defaultLocalLayout
+	}
+
+	layout, err := readLocalLayout(config.Datadir)
+	if err != nil {
+		return nil, err
+	}
+	flat, err := hasFlatImages(config.Datadir)
+	if err != nil {
+		return nil, err
+	}
+	if layout == 0 && flat {
+		layout = 1
+	}
+	if layout > wanted {
+		return nil, fmt.Errorf("%s use layout %d (can't use layout %d)", config.Datadir, layout, wanted)
+	}
+
+	s := &localStorage{root: config.Datadir, layout: wanted, dedup: config.Storage.Dedup}
+	if wanted != 1 && !flat && layout != wanted {
+		err = writeLocalLayout(config.Datadir, wanted)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write %s: %v", localLayoutFileName, err)
+		}
+	}
+	s.migrating = wanted != 1 && flat
+
+	if s.migrating || s.dedup {
+		go func() {
+			if s.migrating {
+				s.migrate()
+			}
+			if s.dedup {
+				s.dedupImages()
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Get the directory of the image with layout 2
+func (s *localStorage) shardedDir(uuid string) string {
+	if len(uuid) < 4 {
+		return s.root + "/" + uuid
+	}
+	return s.root + "/" + uuid[0:2] + "/" + uuid[2:4] + "/" + uuid
+}
+
+func (s *localStorage) isMigrating() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.migrating
+}
+
+// Get the directory of the image
+func (s *localStorage) dir(uuid string) string {
+	if s.layout == 1 {
+		return s.root + "/" + uuid
+	}
+	if s.isMigrating() {
+		flat := s.root + "/" + uuid
+		if _, err := os.Stat(flat); err == nil {
+			return flat
+		}
+	}
+	return s.shardedDir(uuid)
+}
+
+// Get the lock of the image (the locks is striped over the uuids)
+func (s *localStorage) stripe(uuid string) *sync.RWMutex {
+	var h byte
+	for i := 0; i < len(uuid); i++ {
+		h = h*31 + uuid[i]
+	}
+	return &s.locks[h]
+}
+
+// Lock the image so that it isn't moved by the migration while it is used
+func (s *localStorage) lock(uuid string) *sync.RWMutex {
+	l := s.stripe(uuid)
+	l.RLock()
+	return l
+}
+
+/**
+ * Move the images from layout 1 to layout 2, and write the layout
+ * file when all of them is moved. The migration is retried the next
+ * time the server starts if it fails.
+ */
+func (s *localStorage) migrate() {
+	dir, err := ioutil.ReadDir(s.root)
+	if err != nil {
+		log.Printf("Failed to migrate %s to layout %d: %v", s.root, s.layout, err)
+		return
+	}
+
+	log.Printf("Migrating %s to layout %d", s.root, s.layout)
+	moved := 0
+	for _, fileinfo := range dir {
+		uuid := fileinfo.Name()
+		if !fileinfo.IsDir() || !isValidUuid(uuid) {
+			continue
+		}
+		err = s.migrateImage(uuid)
+		if err != nil {
+			log.Printf("Failed to migrate %s to layout %d: %v", uuid, s.layout, err)
+			return
+		}
+		moved++
+	}
+
+	err = writeLocalLayout(s.root, s.layout)
+	if err != nil {
+		log.Printf("Failed to write %s: %v", localLayoutFileName, err)
+		return
+	}
+
+	s.Lock()
+	s.migrating = false
+	s.Unlock()
+	log.Printf("Migrated %d images in %s to layout %d", moved, s.root, s.layout)
+}
+
+// Move the image into its sharded directory
+func (s *localStorage) migrateImage(uuid string) error {
+	l := s.stripe(uuid)
+	l.Lock()
+	defer l.Unlock()
+
+	flat := s.root + "/" + uuid
+	sharded := s.shardedDir(uuid)
+	err := os.MkdirAll(filepath.Dir(sharded), 0777)
+	if err == nil {
+		err = os.Rename(flat, sharded)
+	}
+	if err != nil {
+		return err
+	}
+	forgetManifest(flat + "/manifest.json")
+	return nil
+}
+
+func (s *localStorage) filename(uuid string, name string) (string, error) {
+	if len(name) == 0 || strings.Contains(name, "/") || name == "manifest.json" {
+		return "", fmt.Errorf("Invalid file name \"%s\"", name)
+	}
+	return s.dir(uuid) + "/" + name, nil
+}
+
+// Map the "not found" errors from the filesystem to ErrImageNotFound
+func localStorageError(err error) error {
+	if err != nil && os.IsNotExist(err) {
+		return ErrImageNotFound
+	}
+	return err
+}
+
+func (s *localStorage) Create(uuid string) error {
+	defer s.lock(uuid).RUnlock()
+	dir := s.dir(uuid)
+	err := os.MkdirAll(filepath.Dir(dir), 0777)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir, 0777)
+	if err != nil && os.IsExist(err) {
+		return ErrImageExists
+	}
+	return err
+}
+
+func (s *localStorage) Exists(uuid string) (bool, error) {
+	defer s.lock(uuid).RUnlock()
+	_, err := os.Stat(s.dir(uuid))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *localStorage) GetManifest(uuid string) (map[string]interface{}, error) {
+	defer s.lock(uuid).RUnlock()
+	m, err := LoadManifest(s.dir(uuid) + "/manifest.json")
+	return m, localStorageError(err)
+}
+
+func (s *localStorage) PutManifest(uuid string, manifest map[string]interface{}) error {
+	defer s.lock(uuid).RUnlock()
+	err := os.MkdirAll(s.dir(uuid), 0777)
+	if err != nil {
+		return err
+	}
+	return StoreManifest(s.dir(uuid)+"/manifest.json", manifest)
+}
+
+func (s *localStorage) GetFile(uuid string, name string) (io.ReadCloser, error) {
+	defer s.lock(uuid).RUnlock()
+	filename, err := s.filename(uuid, name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, localStorageError(err)
+	}
+	return f, nil
+}
+
+func (s *localStorage) StatFile(uuid string, name string) (info FileInfo, err error) {
+	defer s.lock(uuid).RUnlock()
+	filename, err := s.filename(uuid, name)
+	if err != nil {
+		return info, err
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return info, localStorageError(err)
+	}
+
+	return FileInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+/**
+ * Write the content to a temporary file and rename it into place once
+ * everything is written so that readers never see a partial file
+ */
+func (s *localStorage) PutFile(uuid string, name string, reader io.Reader) (int64, error) {
+	defer s.lock(uuid).RUnlock()
+	return s.putFile(uuid, name, reader)
+}
+
+// PutFile without locking the image
+func (s *localStorage) putFile(uuid string, name string, reader io.Reader) (int64, error) {
+	filename, err := s.filename(uuid, name)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.MkdirAll(s.dir(uuid), 0777)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(s.dir(uuid), "."+name)
+	if err != nil {
+		return 0, err
+	}
+
+	h := sha256.New()
+	if s.dedup {
+		reader = io.TeeReader(reader, h)
+	}
+	size, err := io.Copy(f, reader)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil && s.dedup {
+		err = s.linkBlob(f.Name(), hex.EncodeToString(h.Sum(nil)), filename)
+	} else if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	return size, nil
+}
+
+/**
+ * Rename the file into place. The file is copied if it is located on
+ * another filesystem than the data directory.
+ */
+func (s *localStorage) MoveFile(uuid string, name string, path string) (int64, error) {
+	defer s.lock(uuid).RUnlock()
+	filename, err := s.filename(uuid, name)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.MkdirAll(s.dir(uuid), 0777)
+	if err == nil {
+		err = os.Chmod(path, 0644)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if s.dedup {
+		// The blob is linked to the file if they're on the same filesystem
+		sum, err := sha256File(path)
+		if err != nil {
+			return 0, err
+		}
+		if s.linkBlob(path, sum, filename) == nil {
+			return info.Size(), nil
+		}
+	} else if os.Rename(path, filename) == nil {
+		return info.Size(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	return s.putFile(uuid, name, f)
+}
+
+func (s *localStorage) DeleteFile(uuid string, name string) error {
+	defer s.lock(uuid).RUnlock()
+	filename, err := s.filename(uuid, name)
+	if err != nil {
+		return err
+	}
+	if s.dedup {
+		return localStorageError(s.unlinkFile(filename))
+	}
+	return localStorageError(os.Remove(filename))
+}
+
+func (s *localStorage) Delete(uuid string) error {
+	defer s.lock(uuid).RUnlock()
+	// The flat directory is only used while it exists, so resolve it first
+	dir := s.dir(uuid)
+	_, err := os.Stat(dir)
+	if err != nil {
+		return localStorageError(err)
+	}
+
+	if s.dedup {
+		err = s.removeImageDir(dir)
+	} else {
+		err = os.RemoveAll(dir)
+	}
+	forgetManifest(dir + "/manifest.json")
+	return err
+}
+
+// Get the modification time of the directory of the image (see modTimeStorage)
+func (s *localStorage) ModTime(uuid string) (time.Time, error) {
+	defer s.lock(uuid).RUnlock()
+	info, err := os.Stat(s.dir(uuid))
+	if err != nil {
+		return time.Time{}, localStorageError(err)
+	}
+	return info.ModTime(), nil
+}
+
+// Move the image to datadir/.quarantine (see quarantineStorage)
+func (s *localStorage) Quarantine(uuid string) error {
+	defer s.lock(uuid).RUnlock()
+	dir := filepath.Join(s.root, quarantineDirName)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return err
+	}
+
+	imageDir := s.dir(uuid)
+	err = os.Rename(imageDir, filepath.Join(dir, uuid))
+	forgetManifest(imageDir + "/manifest.json")
+	return localStorageError(err)
+}
+
+func (s *localStorage) ListFiles(uuid string) ([]string, error) {
+	defer s.lock(uuid).RUnlock()
+	dir, err := ioutil.ReadDir(s.dir(uuid))
+	if err != nil {
+		return nil, localStorageError(err)
+	}
+
+	var names []string
+	for _, fileinfo := range dir {
+		if fileinfo.Mode().IsRegular() {
+			names = append(names, fileinfo.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *localStorage) List() ([]string, error) {
+	if s.layout == 1 {
+		return s.listDir(s.root)
+	}
+
+	/*
+	 * Include the images not migrated yet. The flat directory is read
+	 * first so that an image moved in between is listed twice (rather
+	 * than missing)
+	 */
+	var uuids []string
+	migrating := s.isMigrating()
+	if migrating {
+		flat, err := s.listDir(s.root)
+		if err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, flat...)
+	}
+
+	shards, err := filepath.Glob(s.root + "/[0-9a-fA-F][0-9a-fA-F]/[0-9a-fA-F][0-9a-fA-F]")
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range shards {
+		images, err := s.listDir(shard)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		uuids = append(uuids, images...)
+	}
+
+	if migrating {
+		seen := map[string]bool{}
+		unique := uuids[:0]
+		for _, uuid := range uuids {
+			if !seen[uuid] {
+				seen[uuid] = true
+				unique = append(unique, uuid)
+			}
+		}
+		uuids = unique
+	}
+	return uuids, nil
+}
+
+// List the image directories in dir
+func (s *localStorage) listDir(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for _, fileinfo := range entries {
+		// Skip the hidden directories (used for partial uploads) and the shards
+		if fileinfo.IsDir() && isValidUuid(fileinfo.Name()) {
+			uuids = append(uuids, fileinfo.Name())
+		}
+	}
+	return uuids, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The size of each part when uploading files with multipart upload
+const s3PartSize = 16 * 1024 * 1024
+
+/**
+ * The s3 storage keeps each image as a set of objects in a bucket in
+ * an S3 compatible object store (AWS, MinIO etc):
+ *
+ *     prefix/uuid/manifest.json
+ *     prefix/uuid/image.gz
+ *     prefix/uuid/icon.png
+ *
+ * Requests are signed with AWS Signature Version 4. If the endpoint is
+ * specified the bucket is addressed with path-style URLs (as used by
+ * MinIO), otherwise virtual-hosted URLs for AWS are used.
+ */
+type s3Storage struct {
+	bucket    string
+	endpoint  *url.URL
+	pathStyle bool
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+}
+
+func newS3Storage(config Configuration) (Storage, error) {
+	c := config.Storage
+	if len(c.Bucket) == 0 {
+		return nil, fmt.Errorf("s3 storage requires \"bucket\"")
+	}
+
+	s := &s3Storage{
+		bucket:    c.Bucket,
+		region:    c.Region,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		prefix:    strings.Trim(c.Prefix, "/"),
+		client:    http.DefaultClient,
+	}
+
+	if len(s.region) == 0 {
+		s.region = "us-east-1"
+	}
+	if len(s.accessKey) == 0 {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if len(s.secretKey) == 0 {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if len(s.prefix) > 0 {
+		s.prefix += "/"
+	}
+
+	endpoint := c.Endpoint
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", s.bucket, s.region)
+	} else {
+		s.pathStyle = true
+	}
+
+	var err error
+	s.endpoint, err = url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid s3 endpoint \"%s\": %v", endpoint, err)
+	}
+
+	return s, nil
+}
+
+// URI encode the string as specified by AWS Signature Version 4
+func s3Escape(s string, encodeSlash bool) string {
+	var buffer bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buffer.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buffer, "%%%02X", c)
+		}
+	}
+	return buffer.String()
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Add the AWS Signature Version 4 Authorization header to the request
+func (s *s3Storage) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzdate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzdate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	var query []string
+	for k, values := range req.URL.Query() {
+		for _, v := range values {
+			query = append(query, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	sort.Strings(query)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzdate + "\n"
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		strings.Join(query, "&"),
+		headers,
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	tosign := "AWS4-HMAC-SHA256\n" + amzdate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonical))
+
+	key := hmacSha256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, tosign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+/**
+ * Send a signed request for the object key (or the bucket if key is
+ * empty). A 404 from the server is returned as ErrImageNotFound, and
+ * other non 2xx responses is returned as errors.
+ */
+func (s *s3Storage) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = u.Path + "/" + s.bucket + "/" + key
+	} else {
+		u.Path = u.Path + "/" + key
+	}
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, sha256Hex(body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrImageNotFound
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, key, resp.Status, message)
+	}
+
+	return resp, nil
+}
+
+// Send the request and discard the response body
+func (s *s3Storage) doDiscard(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	resp, err := s.do(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+func (s *s3Storage) key(uuid string, name string) string {
+	return s.prefix + uuid + "/" + name
+}
+
+func (s *s3Storage) Create(uuid string) error {
+	exists, err := s.Exists(uuid)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrImageExists
+	}
+	return nil
+}
+
+func (s *s3Storage) Exists(uuid string) (bool, error) {
+	_, err := s.doDiscard("HEAD", s.key(uuid, "manifest.json"), nil, nil)
+	if err != nil {
+		if err == ErrImageNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3Storage) GetManifest(uuid string) (manifest map[string]interface{}, err error) {
+	resp, err := s.do("GET", s.key(uuid, "manifest.json"), nil, nil)
+	if err != nil {
+		return manifest, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(content, &manifest)
+	return manifest, err
+}
+
+func (s *s3Storage) PutManifest(uuid string, manifest map[string]interface{}) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.doDiscard("PUT", s.key(uuid, "manifest.json"), nil, content)
+	return err
+}
+
+func (s *s3Storage) GetFile(uuid string, name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.key(uuid, name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) StatFile(uuid string, name string) (info FileInfo, err error) {
+	resp, err := s.doDiscard("HEAD", s.key(uuid, name), nil, nil)
+	if err != nil {
+		return info, err
+	}
+
+	info.Size = resp.ContentLength
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+func (s *s3Storage) PutFile(uuid string, name string, reader io.Reader) (int64, error) {
+	return s.putObject(s.key(uuid, name), reader)
+}
+
+/**
+ * Files smaller than the part size is stored with a single PUT, and
+ * larger files use multipart upload so that the server don't need to
+ * know the size up front (or spool the file to the local disk).
+ */
+func (s *s3Storage) putObject(key string, reader io.Reader) (int64, error) {
+	buffer := make([]byte, s3PartSize)
+
+	n, err := io.ReadFull(reader, buffer)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = s.doDiscard("PUT", key, nil, buffer[:n])
+		if err != nil {
+			return 0, err
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	var initiated s3InitiateMultipartUploadResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	uploadId := url.Values{"uploadId": {initiated.UploadId}}
+	var complete s3CompleteMultipartUpload
+	var size int64
+
+	for n > 0 {
+		number := len(complete.Parts) + 1
+		query := url.Values{
+			"partNumber": {strconv.Itoa(number)},
+			"uploadId":   {initiated.UploadId},
+		}
+		resp, err = s.doDiscard("PUT", key, query, buffer[:n])
+		if err != nil {
+			break
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{number, resp.Header.Get("ETag")})
+		size += int64(n)
+
+		n, err = io.ReadFull(reader, buffer)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		} else if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		var content []byte
+		content, err = xml.Marshal(complete)
+		if err == nil {
+			_, err = s.doDiscard("POST", key, uploadId, content)
+		}
+	}
+
+	if err != nil {
+		s.doDiscard("DELETE", key, uploadId, nil)
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func (s *s3Storage) MoveFile(uuid string, name string, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	return s.PutFile(uuid, name, f)
+}
+
+func (s *s3Storage) DeleteFile(uuid string, name string) error {
+	_, err := s.doDiscard("DELETE", s.key(uuid, name), nil, nil)
+	return err
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// List the objects (or the "directories" if delimiter is set) below prefix
+func (s *s3Storage) list(prefix string, delimiter string) (keys []string, err error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	if len(delimiter) > 0 {
+		query.Set("delimiter", delimiter)
+	}
+
+	for {
+		resp, err := s.do("GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range result.Contents {
+			keys = append(keys, entry.Key)
+		}
+		for _, entry := range result.CommonPrefixes {
+			keys = append(keys, entry.Prefix)
+		}
+
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) Delete(uuid string) error {
+	keys, err := s.list(s.prefix+uuid+"/", "")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return ErrImageNotFound
+	}
+
+	for _, key := range keys {
+		_, err = s.doDiscard("DELETE", key, nil, nil)
+		if err != nil && err != ErrImageNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move the objects of the image below .quarantine/ in the prefix (see quarantineStorage)
+func (s *s3Storage) Quarantine(uuid string) error {
+	keys, err := s.list(s.prefix+uuid+"/", "")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		resp, err := s.do("GET", key, nil, nil)
+		if err != nil {
+			return err
+		}
+		_, err = s.putObject(s.prefix+quarantineDirName+"/"+strings.TrimPrefix(key, s.prefix), resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return s.Delete(uuid)
+}
+
+func (s *s3Storage) ListFiles(uuid string) ([]string, error) {
+	keys, err := s.list(s.prefix+uuid+"/", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, key := range keys {
+		names = append(names, strings.TrimPrefix(key, s.prefix+uuid+"/"))
+	}
+	return names, nil
+}
+
+func (s *s3Storage) List() ([]string, error) {
+	prefixes, err := s.list(s.prefix, "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var uuids []string
+	for _, prefix := range prefixes {
+		// Skip the other directories (like the trash)
+		uuid := strings.TrimSuffix(strings.TrimPrefix(prefix, s.prefix), "/")
+		if isValidUuid(uuid) {
+			uuids = append(uuids, uuid)
+		}
+	}
+	return uuids, nil
+}
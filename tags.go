@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// The maximum size of the value of a tag in PUT /images/:uuid/tags/:key
+const maxTagSize = 64 * 1024
+
+// Get the tags of the image (an empty map if it has none)
+func getManifestTags(m map[string]interface{}) map[string]interface{} {
+	tags, ok := m["tags"].(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return tags
+}
+
+// Verify that the only parameter is the key from the path
+func checkTagParameters(params url.Values) (int, map[string]interface{}) {
+	for k := range params {
+		if k != "key" {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+	return Success, nil
+}
+
+/*
+ListImageTags	GET /images/:uuid/tags	Get the tags of the image.
+*/
+func serverListImageTags(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+	sendResponse(w, Success, getManifestTags(m))
+}
+
+/*
+GetImageTag	GET /images/:uuid/tags/:key	Get the value of a tag of the image.
+*/
+func serverGetImageTag(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+		return
+	}
+	key := params.Get("key")
+	value, ok := getManifestTags(m)[key]
+	if !ok {
+		sendError(w, CodeResourceNotFound, fmt.Sprintf("The image has no tag \"%s\"", key))
+		return
+	}
+	sendResponse(w, Success, map[string]interface{}{key: value})
+}
+
+/**
+ * Set (or remove if value is nil) the tag in the manifest. The tags may
+ * be changed after the image is activated, and the If-Match header is
+ * only checked if it is present (as only the single tag is replaced).
+ */
+func setImageTag(r *http.Request, uuid string, key string, value interface{}) (int, map[string]interface{}) {
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to load manifest: %v", err))
+	}
+
+	if len(r.Header.Get("If-Match")) > 0 {
+		code, message := checkIfMatch(r, manifestEtag(m))
+		if message != nil {
+			return code, message
+		}
+	}
+
+	previous := make(map[string]interface{}, len(m))
+	tags := map[string]interface{}{}
+	for k, v := range m {
+		previous[k] = v
+	}
+	for k, v := range getManifestTags(m) {
+		tags[k] = v
+	}
+
+	if value == nil {
+		if _, ok := tags[key]; !ok {
+			return errorResponse(CodeResourceNotFound, fmt.Sprintf("The image has no tag \"%s\"", key))
+		}
+		delete(tags, key)
+	} else {
+		tags[key] = value
+	}
+
+	if len(tags) == 0 {
+		delete(m, "tags")
+	} else {
+		m["tags"] = tags
+	}
+	errs := validateManifest(m)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+
+	err = addManifestRevision(uuid, previous, r)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store history: %v", err))
+	}
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	publishImageEvent(EventImageUpdated, uuid)
+	return Success, m
+}
+
+// Set the tag to the JSON value (a string, number or boolean) in the body
+func doServerPutImageTag(r *http.Request, params url.Values, uuid string) (int, map[string]interface{}) {
+	code, content := checkTagParameters(params)
+	if content != nil {
+		return code, content
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTagSize+1))
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+	if len(body) > maxTagSize {
+		return errorResponse(CodePayloadTooLarge, fmt.Sprintf("The tag is too large (the limit is %d bytes)", maxTagSize))
+	}
+
+	var value interface{}
+	err = json.Unmarshal(body, &value)
+	if err != nil || value == nil {
+		return errorResponse(CodeInvalidParameter, "The body must be the JSON value of the tag (a string, number or boolean)")
+	}
+	return setImageTag(r, uuid, params.Get("key"), value)
+}
+
+/*
+PutImageTag	PUT /images/:uuid/tags/:key	Set a tag of the image (the body is the JSON value).
+*/
+func serverPutImageTag(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerPutImageTag(r, params, uuid)
+	if code == Success {
+		w.Header().Set("ETag", manifestEtag(content))
+	}
+	sendResponse(w, code, content)
+}
+
+/*
+DeleteImageTag	DELETE /images/:uuid/tags/:key	Remove a tag from the image.
+*/
+func serverDeleteImageTag(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := checkTagParameters(params)
+	if content == nil {
+		code, content = setImageTag(r, uuid, params.Get("key"), nil)
+	}
+	if code == Success {
+		w.Header().Set("ETag", manifestEtag(content))
+	}
+	sendResponse(w, code, content)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// The size of the chunks the files is sent in when slow_client_timeout is set
+const downloadChunkSize = 1024 * 1024
+
+/**
+ * Wrap the handler to limit the time spent on the requests to the
+ * endpoints in request_timeouts. Both the connection (so that a stuck
+ * client is disconnected) and the context of the request (so that the
+ * handler may give up) gets the deadline.
+ */
+func withRequestTimeout(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := configuration.RequestTimeouts[endpointName(r)]
+		if timeout <= 0 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		deadline := time.Now().Add(time.Duration(timeout) * time.Second)
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(deadline)
+		controller.SetWriteDeadline(deadline)
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+/**
+ * Send length bytes from the reader to the client. With
+ * slow_client_timeout the file is sent in chunks, and the write
+ * deadline is moved before each chunk so that a download only fails if
+ * the client doesn't receive a chunk within the timeout (instead of
+ * limiting the time to send the entire file like write_timeout). The
+ * deadline never goes past the deadline of the request (see
+ * request_timeouts). The client may resume an aborted download with
+ * Range.
+ */
+func copyToClient(w http.ResponseWriter, r *http.Request, reader io.Reader, length int64) (int64, error) {
+	timeout := time.Duration(configuration.SlowClientTimeout) * time.Second
+	if timeout <= 0 {
+		return io.CopyN(w, reader, length)
+	}
+
+	controller := http.NewResponseController(w)
+	requestDeadline, limited := r.Context().Deadline()
+	var sent int64
+	for sent < length {
+		deadline := time.Now().Add(timeout)
+		if limited && requestDeadline.Before(deadline) {
+			deadline = requestDeadline
+		}
+		controller.SetWriteDeadline(deadline)
+
+		chunk := length - sent
+		if chunk > downloadChunkSize {
+			chunk = downloadChunkSize
+		}
+		n, err := io.CopyN(w, reader, chunk)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+/**
+ * The certificate used by the server. It is reloaded from the files
+ * specified in the configuration when the server receives SIGHUP so
+ * that certificates may be renewed without restarting the server.
+ */
+type certificateStore struct {
+	sync.RWMutex
+	certificate *tls.Certificate
+}
+
+var certificates certificateStore
+
+func (c *certificateStore) load() error {
+	certificate, err := tls.LoadX509KeyPair(configuration.CertFile, configuration.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.certificate = &certificate
+	c.Unlock()
+	return nil
+}
+
+func (c *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.certificate, nil
+}
+
+// Reload the certificate every time the process receives SIGHUP
+func reloadCertificatesOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := certificates.load()
+			if err != nil {
+				log.Printf("Failed to reload certificate: %v", err)
+			} else {
+				log.Printf("Reloaded certificate from %s", configuration.CertFile)
+			}
+		}
+	}()
+}
+
+func tlsEnabled() bool {
+	return len(configuration.CertFile) > 0 || len(configuration.KeyFile) > 0
+}
+
+// Redirect all requests to the same resource on the https port
+func redirectToHttps(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+
+	target := "https://" + host
+	if port := listenPort(configuration); port != 443 && port != 0 {
+		target += ":" + strconv.Itoa(port)
+	}
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// The server redirecting plain http requests (if enabled)
+var redirectServer *http.Server
+
+/**
+ * Start listening for requests on the configured address (or Unix
+ * domain socket). If a certificate is configured the server use https,
+ * and optionally redirects plain http requests on the redirect port to
+ * https.
+ *
+ * @param server the server to start
+ * @return http.ErrServerClosed after the server is shut down
+ */
+func listenAndServe(server *http.Server) error {
+	listener, err := openListener(configuration)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening on %s", listener.Addr())
+	if !tlsEnabled() {
+		return server.Serve(listener)
+	}
+
+	err = certificates.load()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	reloadCertificatesOnSighup()
+
+	if configuration.RedirectPort > 0 {
+		host, _, _ := net.SplitHostPort(listenAddress(configuration))
+		redirectServer = &http.Server{
+			Addr:    net.JoinHostPort(host, strconv.Itoa(configuration.RedirectPort)),
+			Handler: withProxyHeaders(http.HandlerFunc(redirectToHttps)),
+		}
+		go func() {
+			err := redirectServer.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Printf("Failed to start http redirect: %v", err)
+			}
+		}()
+	}
+
+	server.TLSConfig = &tls.Config{
+		GetCertificate: certificates.getCertificate,
+	}
+	return server.ServeTLS(listener, "", "")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+ * An API token is presented by the client as "id.secret" in the
+ * Authorization header:
+ *
+ *     Authorization: Bearer id.secret
+ *
+ * Only the SHA256 of the secret is stored in the token database.
+ */
+type tokenEntry struct {
+	User    string `json:"user"`
+	Hash    string `json:"hash"`
+	Created string `json:"created"`
+}
+
+type tokenStore struct {
+	sync.Mutex
+	loaded bool
+	tokens map[string]tokenEntry
+}
+
+var tokens tokenStore
+
+var errTokenNotFound = errors.New("No such token")
+
+// Load the tokens from disk (the caller must hold the lock)
+func (t *tokenStore) load() error {
+	if t.loaded {
+		return nil
+	}
+
+	t.tokens = make(map[string]tokenEntry)
+	content, err := ioutil.ReadFile(configuration.TokenDb)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.loaded = true
+			return nil
+		}
+		return err
+	}
+
+	err = json.Unmarshal(content, &t.tokens)
+	if err != nil {
+		return err
+	}
+	t.loaded = true
+	return nil
+}
+
+// Write the tokens to disk (the caller must hold the lock)
+func (t *tokenStore) save() error {
+	content, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpfile := configuration.TokenDb + ".tmp"
+	err = ioutil.WriteFile(tmpfile, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpfile, configuration.TokenDb)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+	}
+	return err
+}
+
+func randomHex(size int) (string, error) {
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(data), nil
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a new token for the user and return the token to give to the client
+func (t *tokenStore) create(user string) (id string, token string, err error) {
+	id, err = randomHex(8)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	err = t.load()
+	if err != nil {
+		return "", "", err
+	}
+
+	t.tokens[id] = tokenEntry{
+		User:    user,
+		Hash:    hashTokenSecret(secret),
+		Created: time.Now().UTC().Format(time.RFC3339),
+	}
+	err = t.save()
+	if err != nil {
+		delete(t.tokens, id)
+		return "", "", err
+	}
+
+	return id, id + "." + secret, nil
+}
+
+// Revoke the token (only the owner of the token may revoke it)
+func (t *tokenStore) revoke(id string, user string) error {
+	t.Lock()
+	defer t.Unlock()
+	err := t.load()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := t.tokens[id]
+	if !ok || entry.User != user {
+		return errTokenNotFound
+	}
+
+	delete(t.tokens, id)
+	err = t.save()
+	if err != nil {
+		t.tokens[id] = entry
+	}
+	return err
+}
+
+// Get the name of the user the token belongs to
+func (t *tokenStore) verify(token string) (string, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Invalid token")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	err := t.load()
+	if err != nil {
+		return "", err
+	}
+
+	entry, ok := t.tokens[parts[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(entry.Hash), []byte(hashTokenSecret(parts[1]))) != 1 {
+		return "", errors.New("Invalid token")
+	}
+	return entry.User, nil
+}
+
+func authenticateToken(r *http.Request, token string) (*UserEntry, int, map[string]interface{}) {
+	username, err := tokens.verify(token)
+	if err == nil {
+		user := lookupUser(username)
+		if user != nil {
+			return user, Success, nil
+		}
+		err = fmt.Errorf("User %s does not exist", username)
+	} else if provider := currentAuthProvider(); provider != nil {
+		// The token may be issued by the authentication provider
+		user, providerErr := provider.AuthenticateToken(token)
+		if providerErr == nil {
+			return user, Success, nil
+		}
+		if providerErr != errUnsupportedCredentials {
+			err = providerErr
+		}
+	}
+
+	logRequestf(r, "Token authentication failed: %v", err)
+	code, content := errorResponse(CodeUnauthorizedError, fmt.Sprintf("%v", err))
+	return nil, code, content
+}
+
+// Authenticate the user for the token requests (nil if it failed)
+func tokenRequestUser(w http.ResponseWriter, r *http.Request) *UserEntry {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return nil
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+	}
+	return user
+}
+
+// CreateToken	POST /tokens	Create a new API token for the authenticated user.
+func serverCreateToken(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	user := tokenRequestUser(w, r)
+	if user == nil {
+		return
+	}
+
+	id, token, err := tokens.create(user.Name)
+	if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to create token: %v", err))
+		return
+	}
+
+	sendResponse(w, Success, map[string]interface{}{
+		"id":    id,
+		"token": token,
+		"user":  user.Name,
+	})
+}
+
+// DeleteToken	DELETE /tokens/:id	Revoke the API token.
+func serverDeleteToken(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	user := tokenRequestUser(w, r)
+	if user == nil {
+		return
+	}
+
+	err := tokens.revoke(vars["id"], user.Name)
+	if err == errTokenNotFound {
+		sendError(w, CodeResourceNotFound, "No such token")
+	} else if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to revoke token: %v", err))
+	} else {
+		sendResponse(w, NoContent, nil)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The default number of seconds deleted images is kept in the trash
+const defaultTrashRetention = 7 * 24 * 60 * 60
+
+// The file in the trash with the time the image was deleted
+const trashInfoFileName = "trash.json"
+
+// The configuration of the trash in the configuration file
+type TrashConfig struct {
+	Enabled bool `json:"enabled"`
+	// Seconds before deleted images is purged from the trash
+	Retention int `json:"retention"`
+}
+
+// The information stored with the image in the trash
+type trashInfo struct {
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+/**
+ * The trash is a separate storage (of the same type as the storage of
+ * the images) where deleted images is kept until they are restored or
+ * purged. The local storage keeps the trash in datadir/.trash and the s3
+ * storage below .trash/ in the prefix.
+ */
+var trash Storage
+
+func trashEnabled() bool {
+	return configuration.Trash.Enabled && trash != nil
+}
+
+func trashRetention() time.Duration {
+	if configuration.Trash.Retention > 0 {
+		return time.Duration(configuration.Trash.Retention) * time.Second
+	}
+	return defaultTrashRetention * time.Second
+}
+
+// Create the storage for the trash (nil if the trash isn't enabled)
+func newTrashStorage(config Configuration) (Storage, error) {
+	if !config.Trash.Enabled {
+		return nil, nil
+	}
+	config.Datadir = filepath.Join(config.Datadir, ".trash")
+	config.Storage.Prefix = strings.Trim(config.Storage.Prefix, "/")
+	if len(config.Storage.Prefix) > 0 {
+		config.Storage.Prefix += "/"
+	}
+	config.Storage.Prefix += ".trash"
+	return newStorage(config)
+}
+
+/**
+ * Copy the manifest and the files of the image from one storage to
+ * another and remove it from the first one. The files is copied before
+ * the manifest so that the image is complete once it appears.
+ */
+func moveImage(from Storage, to Storage, uuid string, skip string) error {
+	m, err := from.GetManifest(uuid)
+	if err != nil {
+		return err
+	}
+	names, err := from.ListFiles(uuid)
+	if err != nil {
+		return err
+	}
+
+	err = to.Create(uuid)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == "manifest.json" || name == skip {
+			continue
+		}
+		reader, err := from.GetFile(uuid, name)
+		if err == nil {
+			_, err = to.PutFile(uuid, name, reader)
+			reader.Close()
+		}
+		if err != nil {
+			to.Delete(uuid)
+			return fmt.Errorf("Failed to move %s: %v", name, err)
+		}
+	}
+	err = to.PutManifest(uuid, m)
+	if err != nil {
+		to.Delete(uuid)
+		return err
+	}
+	return from.Delete(uuid)
+}
+
+// Move the image to the trash (replacing an older copy of the image in the trash)
+func moveToTrash(uuid string) error {
+	exists, err := storage.Exists(uuid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrImageNotFound
+	}
+
+	err = trash.Delete(uuid)
+	if err != nil && err != ErrImageNotFound {
+		return err
+	}
+	err = moveImage(storage, trash, uuid, "")
+	if err != nil {
+		return err
+	}
+
+	info, _ := json.Marshal(trashInfo{DeletedAt: time.Now().UTC()})
+	_, err = trash.PutFile(uuid, trashInfoFileName, strings.NewReader(string(info)))
+	return err
+}
+
+// Get the time the image in the trash was deleted
+func trashDeletedAt(uuid string) (time.Time, error) {
+	reader, err := trash.GetFile(uuid, trashInfoFileName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	var info trashInfo
+	if err == nil {
+		err = json.Unmarshal(content, &info)
+	}
+	return info.DeletedAt, err
+}
+
+// Implemented by the storages which know when the image was last modified
+type modTimeStorage interface {
+	ModTime(uuid string) (time.Time, error)
+}
+
+/**
+ * Get the time the image in the trash was last modified. This is used
+ * as the deletion time for the images without a (valid) trash.json.
+ * The storages without modTimeStorage use the newest file of the image.
+ */
+func trashModTime(uuid string) (time.Time, error) {
+	if s, ok := trash.(modTimeStorage); ok {
+		return s.ModTime(uuid)
+	}
+
+	names, err := trash.ListFiles(uuid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var newest time.Time
+	for _, name := range names {
+		if name == "manifest.json" {
+			continue
+		}
+		info, err := trash.StatFile(uuid, name)
+		if err == nil && info.ModTime.After(newest) {
+			newest = info.ModTime
+		}
+	}
+	if newest.IsZero() {
+		return newest, fmt.Errorf("No files in %s", uuid)
+	}
+	return newest, nil
+}
+
+// Remove the images which has been in the trash longer than the retention period
+func purgeTrash() {
+	uuids, err := trash.List()
+	if err != nil {
+		log.Printf("trash: Failed to list the images: %v", err)
+		return
+	}
+
+	retention := trashRetention()
+	for _, uuid := range uuids {
+		deletedAt, err := trashDeletedAt(uuid)
+		if err != nil {
+			// The file is missing if the image is still being moved to the
+			// trash (or the move failed), so use the time it was last
+			// modified to purge it once it's older than the retention period
+			modified, merr := trashModTime(uuid)
+			if merr != nil {
+				log.Printf("trash: Failed to get the deletion time of %s: %v", uuid, err)
+				continue
+			}
+			deletedAt = modified
+		}
+		if time.Since(deletedAt) < retention {
+			continue
+		}
+		err = trash.Delete(uuid)
+		if err != nil && err != ErrImageNotFound {
+			log.Printf("trash: Failed to purge %s: %v", uuid, err)
+		} else {
+			log.Printf("trash: purged %s (deleted %s)", uuid, deletedAt.Format(time.RFC3339))
+		}
+	}
+}
+
+// Get the configuration for /state
+func trashState() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":   trashEnabled(),
+		"retention": int64(trashRetention().Seconds()),
+	}
+}
+
+var trashStop chan struct{}
+
+// Start purging the trash in the background (if enabled)
+func startTrashPurger() {
+	if !trashEnabled() {
+		return
+	}
+
+	interval := trashRetention()
+	if interval > time.Hour {
+		interval = time.Hour
+	}
+	trashStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		purgeTrash()
+		for {
+			select {
+			case <-ticker.C:
+				if !inMaintenance() {
+					purgeTrash()
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(trashStop)
+}
+
+func stopTrashPurger() {
+	if trashStop != nil {
+		close(trashStop)
+		trashStop = nil
+	}
+}
+
+// Authenticate the request and verify that the trash may be used by the user
+func trashRequest(w http.ResponseWriter, r *http.Request) bool {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return false
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+		return false
+	}
+
+	code, content = requireOperator(user)
+	if content == nil && !trashEnabled() {
+		code, content = errorResponse(CodeNotAvailable, "The trash is not enabled")
+	}
+	if content != nil {
+		sendResponse(w, code, content)
+		return false
+	}
+	return true
+}
+
+func trashNotFound(uuid string) (int, map[string]interface{}) {
+	return errorResponse(CodeResourceNotFound, fmt.Sprintf("Image %s is not in the trash", uuid))
+}
+
+// List the images in the trash (ordered by uuid)
+func doServerListTrash() (int, interface{}) {
+	uuids, err := trash.List()
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to list the trash: %v", err))
+	}
+	sort.Strings(uuids)
+
+	retention := trashRetention()
+	images := []map[string]interface{}{}
+	for _, uuid := range uuids {
+		m, err := trash.GetManifest(uuid)
+		if err != nil {
+			continue
+		}
+		entry := map[string]interface{}{"uuid": uuid, "manifest": m}
+		deletedAt, err := trashDeletedAt(uuid)
+		if err == nil {
+			entry["deleted_at"] = deletedAt.Format(time.RFC3339)
+			entry["purge_at"] = deletedAt.Add(retention).Format(time.RFC3339)
+		}
+		images = append(images, entry)
+	}
+	return Success, images
+}
+
+/*
+AdminListTrash	GET /trash	List the deleted images in the trash.
+*/
+func serverListTrash(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	if !trashRequest(w, r) {
+		return
+	}
+
+	code, content := doServerListTrash()
+	if code != Success {
+		sendResponse(w, code, content.(map[string]interface{}))
+		return
+	}
+	body, _ := json.MarshalIndent(content, "", "  ")
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(body)
+}
+
+/**
+ * Move the image back from the trash. The origin of the image must
+ * exist (restore the origin first if it is in the trash as well).
+ *
+ * @return the HTTP code and the manifest (or the error)
+ */
+func doServerRestoreImage(uuid string) (int, map[string]interface{}) {
+	m, err := trash.GetManifest(uuid)
+	if err == ErrImageNotFound {
+		return trashNotFound(uuid)
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read manifest: %v", err))
+	}
+
+	code, content := validateOrigin(m, nil, true)
+	if content != nil {
+		content["message"] = fmt.Sprintf("%v (restore the origin first)", content["message"])
+		return code, content
+	}
+
+	err = moveImage(trash, storage, uuid, trashInfoFileName)
+	if err == ErrImageExists {
+		return errorResponse(CodeImageUuidAlreadyExists, fmt.Sprintf("Image %s already exists", uuid))
+	}
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to restore image: %v", err))
+	}
+
+	publishImageEvent(EventImageCreated, uuid)
+	if getImageState(m) == StateActive {
+		publishImageEvent(EventImageActivated, uuid)
+	}
+	return Success, m
+}
+
+/*
+AdminRestoreImage	POST /trash/:uuid?action=restore	Restore the deleted image from the trash.
+*/
+func serverRestoreImage(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	if !trashRequest(w, r) {
+		return
+	}
+
+	uuid := vars["uuid"]
+	action := r.URL.Query().Get("action")
+	if action != "restore" {
+		sendError(w, CodeInvalidParameter, fmt.Sprintf("Invalid action \"%s\"", action))
+		return
+	}
+	code, content := trashNotFound(uuid)
+	if isValidUuid(uuid) {
+		unlock := lockImage(uuid)
+		code, content = doServerRestoreImage(uuid)
+		unlock()
+	}
+	sendResponse(w, code, content)
+}
+
+/*
+AdminPurgeImage	DELETE /trash/:uuid	Remove the deleted image from the trash.
+*/
+func serverPurgeImage(w http.ResponseWriter, r *http.Request, vars routeVars) {
+	if !trashRequest(w, r) {
+		return
+	}
+
+	uuid := vars["uuid"]
+	err := ErrImageNotFound
+	if isValidUuid(uuid) {
+		err = trash.Delete(uuid)
+	}
+	if err == ErrImageNotFound {
+		code, content := trashNotFound(uuid)
+		sendResponse(w, code, content)
+	} else if err != nil {
+		sendError(w, CodeInternalError, fmt.Sprintf("Failed to purge image: %v", err))
+	} else {
+		sendResponse(w, NoContent, nil)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPurgeTrashWithoutTrashInfo(t *testing.T) {
+	setupTestStorage(t)
+	configuration.Trash = TrashConfig{Enabled: true, Retention: 60}
+	var err error
+	trash, err = newTrashStorage(configuration)
+	if err != nil {
+		t.Fatalf("Failed to create trash: %v", err)
+	}
+	t.Cleanup(func() { trash = nil })
+
+	// Images left in the trash without trash.json by a failed move
+	expired := "00000000-0000-0000-0000-000000000001"
+	recent := "00000000-0000-0000-0000-000000000002"
+	for _, uuid := range []string{expired, recent} {
+		err = trash.Create(uuid)
+		if err == nil {
+			err = trash.PutManifest(uuid, testManifest("trashed"))
+		}
+		if err != nil {
+			t.Fatalf("Failed to add %s to the trash: %v", uuid, err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	err = os.Chtimes(trash.(*localStorage).dir(expired), old, old)
+	if err != nil {
+		t.Fatalf("Failed to set the modification time: %v", err)
+	}
+
+	purgeTrash()
+	if exists, _ := trash.Exists(expired); exists {
+		t.Errorf("Expected %s to be purged", expired)
+	}
+	if exists, _ := trash.Exists(recent); !exists {
+		t.Errorf("Expected %s to be kept until the retention period expires", recent)
+	}
+}
@@ -1,13 +1,101 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 )
 
-func serverUpdateImage(w http.ResponseWriter, r *http.Request, params url.Values, path string) {
-	sendResponse(w, InsufficientServerVersion, map[string]interface{}{
-		"code":    "InsufficientServerVersion",
-		"message": "Not implemented yet",
-	})
+/**
+ * Update the fields in the manifest with the fields in the JSON object
+ * in the body. A field set to null is removed from the manifest. The
+ * manifest must match the If-Match header of the request (see
+ * checkIfMatch). Nothing is stored for dry runs.
+ */
+func doServerUpdateImage(uuid string, params url.Values, r *http.Request) (int, map[string]interface{}) {
+	for k, _ := range params {
+		switch k {
+		case "action":
+			break
+		case "account":
+			fallthrough
+		case "channel":
+			return errorResponse(CodeInsufficientServerVersion, "The server does not support \"account\" and \"channel\"")
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize()+1))
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to read body: %v", err))
+	}
+	if int64(len(content)) > maxManifestSize() {
+		return errorResponse(CodePayloadTooLarge,
+			fmt.Sprintf("The update is too large (the limit is %d bytes)", maxManifestSize()))
+	}
+
+	var update map[string]interface{}
+	err = json.Unmarshal(content, &update)
+	if err != nil {
+		return errorResponse(CodeInvalidParameter, fmt.Sprintf("Failed to decode body: %v", err))
+	}
+
+	m, err := storage.GetManifest(uuid)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("The server failed to load manifest file: %v", err))
+	}
+
+	code, message := checkIfMatch(r, manifestEtag(m))
+	if message != nil {
+		return code, message
+	}
+
+	errs := validateManifestUpdate(update, getImageState(m) != StateUnactivated)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+
+	previous := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		previous[k] = v
+	}
+	for k, v := range update {
+		if v == nil {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+
+	errs = validateManifest(m)
+	if len(errs) > 0 {
+		return errs.response()
+	}
+	if isDryRun(r) {
+		return Success, m
+	}
+
+	err = addManifestRevision(uuid, previous, r)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store history: %v", err))
+	}
+	err = storage.PutManifest(uuid, m)
+	if err != nil {
+		return errorResponse(CodeInternalError, fmt.Sprintf("Failed to store manifest file: %v", err))
+	}
+
+	publishImageEvent(EventImageUpdated, uuid)
+	return Success, m
+}
+
+func serverUpdateImage(w http.ResponseWriter, r *http.Request, params url.Values, uuid string) {
+	code, content := doServerUpdateImage(uuid, params, r)
+	if code == Success {
+		w.Header().Set("ETag", manifestEtag(content))
+	}
+	sendResponse(w, code, content)
 }
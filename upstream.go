@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The number of attempts for a request unless max_attempts is set
+const defaultUpstreamMaxAttempts = 4
+
+// The number of failures in a row opening the breaker unless breaker_threshold is set
+const defaultBreakerThreshold = 5
+
+// The seconds the breaker stays open unless breaker_timeout is set
+const defaultBreakerTimeout = 60
+
+// The backoff before the first retry (doubled for each retry)
+const upstreamInitialBackoff = 500 * time.Millisecond
+
+// The upper limit for the backoff between the retries
+const upstreamMaxBackoff = 10 * time.Second
+
+// The configuration of the requests to the upstream servers in the configuration file
+type UpstreamConfig struct {
+	// The number of attempts before a request fails
+	MaxAttempts int `json:"max_attempts"`
+	// The number of failed requests in a row before the host is considered down
+	BreakerThreshold int `json:"breaker_threshold"`
+	// Seconds before a request is sent to a host which is down again
+	BreakerTimeout int `json:"breaker_timeout"`
+}
+
+// Verify the upstream configuration
+func validateUpstream(config UpstreamConfig) error {
+	if config.MaxAttempts < 0 || config.BreakerThreshold < 0 || config.BreakerTimeout < 0 {
+		return errors.New("The upstream max_attempts, breaker_threshold and breaker_timeout can't be negative")
+	}
+	return nil
+}
+
+func upstreamMaxAttempts() int {
+	if configuration.Upstream.MaxAttempts > 0 {
+		return configuration.Upstream.MaxAttempts
+	}
+	return defaultUpstreamMaxAttempts
+}
+
+func breakerThreshold() int {
+	if configuration.Upstream.BreakerThreshold > 0 {
+		return configuration.Upstream.BreakerThreshold
+	}
+	return defaultBreakerThreshold
+}
+
+func breakerTimeout() time.Duration {
+	if configuration.Upstream.BreakerTimeout > 0 {
+		return time.Duration(configuration.Upstream.BreakerTimeout) * time.Second
+	}
+	return defaultBreakerTimeout * time.Second
+}
+
+// The backoff before the retry after the number of attempts
+func upstreamBackoff(attempts int) time.Duration {
+	backoff := upstreamInitialBackoff
+	for i := 1; i < attempts && backoff < upstreamMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > upstreamMaxBackoff {
+		backoff = upstreamMaxBackoff
+	}
+	return backoff
+}
+
+/**
+ * The circuit breaker for an upstream host. The breaker opens when
+ * breaker_threshold requests in a row fail, and the requests to the
+ * host fails immediately until breaker_timeout has passed. A single
+ * request is then let through (half-open) to probe the host: the
+ * breaker closes if it succeeds, and opens again if it fails.
+ */
+type circuitBreaker struct {
+	host      string
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+
+	requests  int64
+	retries   int64
+	errors    int64
+	rejected  int64
+	opened    int64
+	lastError string
+	lastOk    time.Time
+}
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var upstreams = struct {
+	sync.Mutex
+	breakers map[string]*circuitBreaker
+}{breakers: make(map[string]*circuitBreaker)}
+
+// Get the breaker for the host (the caller must hold the upstreams lock)
+func getCircuitBreaker(host string) *circuitBreaker {
+	b, ok := upstreams.breakers[host]
+	if !ok {
+		b = &circuitBreaker{host: host, state: breakerClosed}
+		upstreams.breakers[host] = b
+	}
+	return b
+}
+
+// Check if a request may be sent to the host
+func (b *circuitBreaker) allow(now time.Time) error {
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			b.rejected++
+			return fmt.Errorf("%s is unavailable (%s), retry after %s", b.host, b.lastError,
+				b.openUntil.UTC().Format(time.RFC3339))
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return fmt.Errorf("%s is unavailable (%s)", b.host, b.lastError)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success(now time.Time) {
+	if b.state != breakerClosed {
+		log.Printf("upstream: %s is available again", b.host)
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+	b.lastOk = now
+}
+
+func (b *circuitBreaker) failure(now time.Time, err error) {
+	b.errors++
+	b.failures++
+	b.lastError = fmt.Sprintf("%v", err)
+	if b.state == breakerHalfOpen || b.failures >= breakerThreshold() {
+		if b.state != breakerOpen {
+			b.opened++
+			log.Printf("upstream: %s is unavailable after %d failures: %v", b.host, b.failures, err)
+		}
+		b.state = breakerOpen
+		b.openUntil = now.Add(breakerTimeout())
+	}
+	b.probing = false
+}
+
+/**
+ * Check if the request may succeed if it is retried: the network errors,
+ * the server errors (except 501 Not Implemented), 408 Request Timeout
+ * and 429 Too Many Requests. The other errors is returned to the caller
+ * as is (and isn't counted as failures of the host).
+ */
+func isTransientResponse(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return true
+	case resp.StatusCode == http.StatusNotImplemented:
+		return false
+	}
+	return resp.StatusCode >= 500
+}
+
+/**
+ * upstreamTransport performs the requests to the upstream servers (the
+ * sources of import-remote, the mirror and the seed images). The GET
+ * requests failing with a transient error is retried with exponential
+ * backoff up to max_attempts times, and the requests to a host which is
+ * down is rejected by its circuit breaker. A download which fails after
+ * the response headers is received isn't retried.
+ */
+type upstreamTransport struct {
+	base http.RoundTripper
+}
+
+var upstreamClient = &http.Client{Transport: &upstreamTransport{base: http.DefaultTransport}}
+
+// Wait for the backoff (or until the request is cancelled)
+func waitForRetry(req *http.Request, backoff time.Duration, resp *http.Response) error {
+	// Use the Retry-After from the server if it is reasonable
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 &&
+			time.Duration(seconds)*time.Second < upstreamMaxBackoff {
+			backoff = time.Duration(seconds) * time.Second
+		}
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := upstreamMaxAttempts()
+	if (req.Method != "GET" && req.Method != "HEAD") || req.Body != nil {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		now := time.Now()
+		upstreams.Lock()
+		b := getCircuitBreaker(req.URL.Host)
+		err := b.allow(now)
+		if err == nil {
+			b.requests++
+			if attempt > 1 {
+				b.retries++
+			}
+		}
+		upstreams.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		transient := err != nil || isTransientResponse(resp)
+
+		upstreams.Lock()
+		if !transient {
+			b.success(time.Now())
+		} else if err != nil {
+			b.failure(time.Now(), err)
+		} else {
+			b.failure(time.Now(), fmt.Errorf("%s %s returned %s", req.Method, req.URL.Redacted(), resp.Status))
+		}
+		open := b.state == breakerOpen
+		upstreams.Unlock()
+
+		if !transient || attempt >= attempts || open {
+			return resp, err
+		}
+
+		backoff := upstreamBackoff(attempt)
+		if err != nil {
+			log.Printf("upstream: %s %s failed (retry in %v): %v", req.Method, req.URL.Redacted(), backoff, err)
+		} else {
+			log.Printf("upstream: %s %s returned %s (retry in %v)", req.Method, req.URL.Redacted(), resp.Status, backoff)
+		}
+		err = waitForRetry(req, backoff, resp)
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Get the state of the circuit breakers for /state
+func upstreamState() []interface{} {
+	upstreams.Lock()
+	defer upstreams.Unlock()
+
+	hosts := make([]string, 0, len(upstreams.breakers))
+	for host := range upstreams.breakers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	state := make([]interface{}, 0, len(hosts))
+	for _, host := range hosts {
+		b := upstreams.breakers[host]
+		entry := map[string]interface{}{
+			"host":       host,
+			"state":      b.state,
+			"failures":   b.failures,
+			"requests":   b.requests,
+			"retries":    b.retries,
+			"errors":     b.errors,
+			"rejected":   b.rejected,
+			"opened":     b.opened,
+			"last_error": b.lastError,
+		}
+		if !b.lastOk.IsZero() {
+			entry["last_success"] = b.lastOk.UTC()
+		}
+		if b.state == breakerOpen {
+			entry["open_until"] = b.openUntil.UTC()
+		}
+		state = append(state, entry)
+	}
+	return state
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// The storage used by an owner as returned by /usage
+type ownerUsageEntry struct {
+	Owner  string `json:"owner"`
+	Images int    `json:"images"`
+	Bytes  int64  `json:"bytes"`
+	// The quota of the owner (0 means no limit)
+	Quota int64 `json:"quota"`
+}
+
+/**
+ * Get the number of images and the bytes of image files stored for
+ * each owner (the images without an owner is stored as ""). The sizes
+ * is the sizes in the manifests, like the quotas.
+ */
+func usageByOwner() map[string]*ownerUsageEntry {
+	usage := map[string]*ownerUsageEntry{}
+	for _, entry := range index.list() {
+		owner, _ := entry.manifest["owner"].(string)
+		u, ok := usage[owner]
+		if !ok {
+			u = &ownerUsageEntry{Owner: owner, Quota: ownerQuota(owner)}
+			usage[owner] = u
+		}
+		u.Images++
+		for i := range getManifestFiles(entry.manifest) {
+			size, _ := getDeclaredFileSize(entry.manifest, i)
+			u.Bytes += size
+		}
+	}
+	return usage
+}
+
+// Get the total usage (and the number of owners) for /state
+func usageState() map[string]interface{} {
+	var images int
+	var bytes int64
+	owners := 0
+	for owner, u := range usageByOwner() {
+		images += u.Images
+		bytes += u.Bytes
+		if len(owner) > 0 {
+			owners++
+		}
+	}
+
+	state := map[string]interface{}{
+		"images": images,
+		"bytes":  bytes,
+		"owners": owners,
+	}
+	if free, ok := uploadFreeSpace(); ok {
+		state["upload_space"] = free
+	}
+	return state
+}
+
+/**
+ * Get the usage of the owners. Operators get all of the owners (or the
+ * one in the owner parameter) while other users only get their own
+ * account.
+ */
+func doServerGetUsage(params url.Values, user *UserEntry) (int, map[string]interface{}) {
+	owner := ""
+	for k, v := range params {
+		switch k {
+		case "owner":
+			owner = v[0]
+			if !isValidUuid(owner) {
+				return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid owner \"%s\"", owner))
+			}
+		default:
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("Invalid parameter: %s", k))
+		}
+	}
+
+	if !isOperator(user) {
+		if len(owner) > 0 && owner != user.Uuid {
+			return errorResponse(CodeNotAuthorizedError, "Only operators may get the usage of other accounts")
+		}
+		owner = user.Uuid
+		if len(owner) == 0 {
+			return errorResponse(CodeInvalidParameter, fmt.Sprintf("User %s has no account uuid", user.Name))
+		}
+	}
+
+	usage := usageByOwner()
+	owners := []*ownerUsageEntry{}
+	if len(owner) > 0 {
+		u, ok := usage[owner]
+		if !ok {
+			u = &ownerUsageEntry{Owner: owner, Quota: ownerQuota(owner)}
+		}
+		owners = append(owners, u)
+	} else {
+		for name, u := range usage {
+			if len(name) > 0 {
+				owners = append(owners, u)
+			}
+		}
+		sort.Slice(owners, func(i, j int) bool { return owners[i].Owner < owners[j].Owner })
+	}
+
+	var images int
+	var bytes int64
+	for _, u := range owners {
+		images += u.Images
+		bytes += u.Bytes
+	}
+	return Success, map[string]interface{}{
+		"owners": owners,
+		"total":  map[string]interface{}{"images": images, "bytes": bytes},
+	}
+}
+
+/*
+GetUsage	GET /usage	Get the number of images and bytes stored by each owner.
+*/
+func serverGetUsage(w http.ResponseWriter, r *http.Request) {
+	user, code, content := authenticateRequest(r)
+	if content != nil {
+		sendResponse(w, code, content)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(UnauthorizedError)
+		return
+	}
+
+	code, content = doServerGetUsage(r.URL.Query(), user)
+	sendResponse(w, code, content)
+}
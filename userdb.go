@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The bcrypt cost used when hashing new passwords
+const passwordHashCost = bcrypt.DefaultCost
+
+/**
+ * The password hash schemes by name. A password hash has the format
+ * "$scheme$..." and the verifier for the scheme is called with the
+ * complete hash. Other schemes (like argon2) may be added with
+ * RegisterPasswordHashType.
+ */
+var passwordHashTypes = map[string]func(hash string, password string) (bool, error){
+	"2a": verifyBcrypt,
+	"2b": verifyBcrypt,
+	"2y": verifyBcrypt,
+}
+
+func RegisterPasswordHashType(name string, verify func(hash string, password string) (bool, error)) {
+	passwordHashTypes[name] = verify
+}
+
+// Get the scheme of the password hash ("" if it isn't a valid hash)
+func passwordHashType(hash string) string {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 3 || len(fields[0]) != 0 {
+		return ""
+	}
+	return fields[1]
+}
+
+// Hash the password with bcrypt ("$2a$cost$salt-and-hash")
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordHashCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func verifyBcrypt(hash string, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+/**
+ * The passwords verified against a hash (so that the expensive hash
+ * isn't computed for every request using Basic Auth). The key is a
+ * digest of the hash and the password.
+ */
+var verifiedPasswords struct {
+	sync.Mutex
+	digests map[string]bool
+}
+
+func verifiedPasswordDigest(hash string, password string) string {
+	digest := sha256.Sum256([]byte(hash + "\x00" + password))
+	return string(digest[:])
+}
+
+// Verify the password provided by the user
+func checkPassword(user *UserEntry, password string) bool {
+	if len(user.PasswordHash) == 0 {
+		return len(user.Password) > 0 &&
+			subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+
+	digest := verifiedPasswordDigest(user.PasswordHash, password)
+	verifiedPasswords.Lock()
+	ok := verifiedPasswords.digests[digest]
+	verifiedPasswords.Unlock()
+	if ok {
+		return true
+	}
+
+	verify, found := passwordHashTypes[passwordHashType(user.PasswordHash)]
+	if !found {
+		return false
+	}
+	ok, err := verify(user.PasswordHash, password)
+	if err != nil || !ok {
+		return false
+	}
+
+	verifiedPasswords.Lock()
+	if verifiedPasswords.digests == nil {
+		verifiedPasswords.digests = make(map[string]bool)
+	}
+	verifiedPasswords.digests[digest] = true
+	verifiedPasswords.Unlock()
+	return true
+}
+
+// Verify that the password hash of the user use a known scheme
+func validatePasswordHash(user UserEntry) error {
+	if len(user.PasswordHash) == 0 {
+		return nil
+	}
+	if _, ok := passwordHashTypes[passwordHashType(user.PasswordHash)]; !ok {
+		return fmt.Errorf("Unknown password hash for user %s", user.Name)
+	}
+	return nil
+}
+
+// Read the users from the user database file
+func loadUserdbFile(path string) ([]UserEntry, error) {
+	var users []UserEntry
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", path, err)
+	}
+	err = json.Unmarshal(content, &users)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+	return users, nil
+}
+
+// Write the user database file (replacing the file atomically)
+func saveUserdbFile(path string, users []UserEntry) error {
+	content, err := json.MarshalIndent(users, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".userdb")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(content, '\n'))
+	if err == nil {
+		err = f.Chmod(0600)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+/**
+ * Add the users in the user database file to the configuration (the
+ * file is created by imgapi -passwd, so it may not exist yet)
+ */
+func mergeUserdbFile(config *Configuration) error {
+	if len(config.UserdbFile) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(config.UserdbFile); os.IsNotExist(err) {
+		log.Printf("The user database %s does not exist", config.UserdbFile)
+		return nil
+	}
+
+	users, err := loadUserdbFile(config.UserdbFile)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		for _, existing := range config.Userdb {
+			if existing.Name == user.Name {
+				return fmt.Errorf("User %s is defined in both userdb and %s", user.Name, config.UserdbFile)
+			}
+		}
+		config.Userdb = append(config.Userdb, user)
+	}
+	return nil
+}
+
+/**
+ * Add or update the user in the user database file with a hashed
+ * password (used by imgapi -passwd). The file is created if it doesn't
+ * exist.
+ *
+ * @param path the user database file
+ * @param update the user to add (with the password in plain text)
+ */
+func setUserdbPassword(path string, update UserEntry) error {
+	var users []UserEntry
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		users, err = loadUserdbFile(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	hash, err := hashPassword(update.Password)
+	if err != nil {
+		return err
+	}
+
+	var user *UserEntry
+	for i := range users {
+		if users[i].Name == update.Name {
+			user = &users[i]
+		}
+	}
+	if user == nil {
+		users = append(users, UserEntry{Name: update.Name})
+		user = &users[len(users)-1]
+	}
+
+	user.Password = ""
+	user.PasswordHash = hash
+	if len(update.Role) > 0 {
+		user.Role = update.Role
+	}
+	if len(update.Uuid) > 0 {
+		user.Uuid = update.Uuid
+	}
+	return saveUserdbFile(path, users)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	user := &UserEntry{Name: "trond", PasswordHash: hash}
+	err = validatePasswordHash(*user)
+	if err != nil {
+		t.Errorf("The hash %s isn't valid: %v", hash, err)
+	}
+	if !checkPassword(user, "secret") {
+		t.Errorf("The password didn't match the hash")
+	}
+	if checkPassword(user, "wrong") {
+		t.Errorf("A wrong password matched the hash")
+	}
+
+	// The hashes created by htpasswd -B
+	user.PasswordHash = "$2y$05$Qh7CEqmiW9K4WJcBcWK1AuwX6e1Yz5bSkfjBxmnBuBnM1yEpVY1pW"
+	if validatePasswordHash(*user) != nil {
+		t.Errorf("The $2y$ bcrypt hashes isn't supported")
+	}
+
+	user.PasswordHash = "$unknown$secret"
+	if validatePasswordHash(*user) == nil {
+		t.Errorf("Expected an error for an unknown hash scheme")
+	}
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"regexp"
+)
+
+var uuidRegexp = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -8,3 +14,7 @@ func stringInSlice(a string, list []string) bool {
 	}
 	return false
 }
+
+func isValidUuid(uuid string) bool {
+	return uuidRegexp.MatchString(uuid)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// The header with the version of the server (in all responses)
+const versionHeader = "X-Imgapi-Version"
+
+// The header with the features enabled on the server (in all responses)
+const featuresHeader = "X-Imgapi-Features"
+
+// The features which is supported by all servers of this version
+var serverFeatures = []string{"accounts", "acl", "attachments", "bundles", "changes", "delta", "if-match",
+	"multiple-files", "range", "resumable-upload", "search", "signatures", "tokens"}
+
+/**
+ * Get the features supported by the server (the features which depend
+ * on the configuration is only included when they are enabled). The
+ * clients may use the features to adapt to the server instead of
+ * probing with requests which may fail.
+ */
+func enabledFeatures() []string {
+	features := append([]string{}, serverFeatures...)
+	optional := map[string]bool{
+		"channels":          channelsEnabled(),
+		"docker-registry":   configuration.DockerRegistry,
+		"gzip":              configuration.Gzip.Enabled,
+		"mirror":            imageMirror != nil,
+		"public-read":       configuration.PublicRead,
+		"quota":             quotaEnabled(),
+		"replication":       len(configuration.Replication) > 0,
+		"signing-required":  configuration.Signing.Require,
+		"swagger-ui":        configuration.SwaggerUi,
+		"tls":               tlsEnabled(),
+		"web-ui":            configuration.WebUi,
+		"if-match-optional": configuration.IfMatchOptional,
+	}
+	for name, enabled := range optional {
+		if enabled {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// Get the names of the implemented actions in the registry
+func implementedActions(actions map[string]ImageAction) []string {
+	names := []string{}
+	for name, action := range actions {
+		if action.Handler != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get the version and the capabilities of the server for /version
+func serverCapabilities() map[string]interface{} {
+	var storages, exporters, catalogs []string
+	for name := range storageTypes {
+		storages = append(storages, name)
+	}
+	for name := range exporterTypes {
+		exporters = append(exporters, name)
+	}
+	for name := range catalogTypes {
+		catalogs = append(catalogs, name)
+	}
+	sort.Strings(storages)
+	sort.Strings(exporters)
+	sort.Strings(catalogs)
+
+	return map[string]interface{}{
+		"version":        serverVersion,
+		"imgapi":         true,
+		"features":       enabledFeatures(),
+		"actions":        implementedActions(imageActions),
+		"create_actions": implementedActions(createImageActions),
+		"storage":        storageType(configuration),
+		"storage_types":  storages,
+		"exporter_types": exporters,
+		"catalog_types":  catalogs,
+	}
+}
+
+// Wrap the handler to add the version and the features to all of the responses
+func withVersionHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set(versionHeader, serverVersion)
+		h.Set(featuresHeader, strings.Join(enabledFeatures(), ", "))
+		handler.ServeHTTP(w, r)
+	})
+}
+
+/*
+Version	GET /version	Get the version of the server and the supported features, actions and storage types.
+*/
+func serverGetVersion(w http.ResponseWriter, r *http.Request) {
+	sendResponse(w, Success, serverCapabilities())
+}
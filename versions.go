@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ * Split the version in the release ("1.2.3") and the pre-release
+ * ("rc1") parts. "_" is treated like "." since it is common in the
+ * versions of the images (like "20.4_1").
+ */
+func splitVersion(version string) (release []string, prerelease []string) {
+	version = strings.Replace(version, "_", ".", -1)
+	if i := strings.Index(version, "-"); i != -1 {
+		prerelease = strings.Split(version[i+1:], ".")
+		version = version[:i]
+	}
+	return strings.Split(version, "."), prerelease
+}
+
+// Compare two version identifiers (numbers compares numerically before strings)
+func compareVersionIdentifiers(a string, b string) int {
+	na, aerr := strconv.ParseUint(a, 10, 64)
+	nb, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		if na == nb {
+			return 0
+		} else if na < nb {
+			return -1
+		}
+		return 1
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+/**
+ * Compare the versions like semver: the release identifiers is compared
+ * one by one (missing identifiers counts as 0), and a pre-release
+ * (after "-") is older than the release. Unlike semver the versions
+ * may have any number of identifiers.
+ *
+ * @return -1 if a is older than b, 1 if it is newer and 0 if equal
+ */
+func compareVersions(a string, b string) int {
+	ra, pa := splitVersion(a)
+	rb, pb := splitVersion(b)
+
+	for i := 0; i < len(ra) || i < len(rb); i++ {
+		ia, ib := "0", "0"
+		if i < len(ra) {
+			ia = ra[i]
+		}
+		if i < len(rb) {
+			ib = rb[i]
+		}
+		if c := compareVersionIdentifiers(ia, ib); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case len(pa) == 0 && len(pb) == 0:
+		return 0
+	case len(pa) == 0:
+		return 1
+	case len(pb) == 0:
+		return -1
+	}
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if c := compareVersionIdentifiers(pa[i], pb[i]); c != 0 {
+			return c
+		}
+	}
+	return compareVersionIdentifiers(strconv.Itoa(len(pa)), strconv.Itoa(len(pb)))
+}
+
+// A version range is a list of comparisons which all must match
+type versionRange []struct {
+	operator string
+	version  string
+}
+
+/**
+ * Parse a version range like ">=1.2 <2" (space separated comparisons
+ * with >, >=, <, <=, = or !=). A version without an operator must be
+ * equal.
+ */
+func parseVersionRange(value string) (versionRange, error) {
+	var r versionRange
+	for _, field := range strings.Fields(value) {
+		operator := "="
+		for _, op := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(field, op) {
+				operator = op
+				field = field[len(op):]
+				break
+			}
+		}
+		if !versionRegexp.MatchString(field) {
+			return nil, fmt.Errorf("Invalid version range \"%s\"", value)
+		}
+		r = append(r, struct {
+			operator string
+			version  string
+		}{operator, field})
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("Invalid version range \"%s\"", value)
+	}
+	return r, nil
+}
+
+// Check if the version is in the range
+func (r versionRange) match(version string) bool {
+	for _, comparison := range r {
+		c := compareVersions(version, comparison.version)
+		var ok bool
+		switch comparison.operator {
+		case ">=":
+			ok = c >= 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case "<":
+			ok = c < 0
+		case "!=":
+			ok = c != 0
+		default:
+			ok = c == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
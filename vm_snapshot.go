@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+/**
+ * A VmSnapshotProvider knows how to create an image file from an
+ * existing VM (used by CreateImageFromVm). The server takes care of
+ * creating the manifest, storing the file and activating the image.
+ */
+type VmSnapshotProvider interface {
+	/**
+	 * Create a snapshot of the VM
+	 *
+	 * @param vm the uuid of the VM
+	 * @param incremental true if the snapshot should be relative to
+	 *                    the origin image of the VM
+	 * @return snapshot the snapshot of the VM (the caller must close it)
+	 *         err The error object if something failed
+	 */
+	Snapshot(vm string, incremental bool) (snapshot *VmSnapshot, err error)
+}
+
+// The snapshot of a VM returned by the VmSnapshotProvider
+type VmSnapshot struct {
+	// The image file (Close returns the error if the snapshot failed)
+	Reader io.ReadCloser
+	// The compression used for the image file (gzip, bzip2 or none)
+	Compression string
+	// Manifest fields known by the provider (like os and type). The
+	// fields specified by the user takes precedence.
+	Manifest map[string]interface{}
+}
+
+// The configuration of the VM snapshot provider in the configuration file
+type VmSnapshotConfig struct {
+	Type        string   `json:"type"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	Compression string   `json:"compression"`
+}
+
+/**
+ * The registry of the available VM snapshot provider types. Each entry
+ * creates a VmSnapshotProvider for the provided configuration.
+ */
+var vmSnapshotProviderTypes = map[string]func(config VmSnapshotConfig) (VmSnapshotProvider, error){
+	"command": newCommandSnapshotProvider,
+}
+
+// Register a new VM snapshot provider type to the registry
+func RegisterVmSnapshotProviderType(name string, factory func(config VmSnapshotConfig) (VmSnapshotProvider, error)) {
+	vmSnapshotProviderTypes[name] = factory
+}
+
+// Returned when create-from-vm isn't configured
+var errNoVmSnapshotProvider = errors.New("The server is not configured to create images from VMs")
+
+// Get the VM snapshot provider from the configuration
+func getVmSnapshotProvider() (VmSnapshotProvider, error) {
+	return newVmSnapshotProvider(configuration.VmSnapshot)
+}
+
+// Create the VM snapshot provider from the configuration
+func newVmSnapshotProvider(config VmSnapshotConfig) (VmSnapshotProvider, error) {
+	if len(config.Type) == 0 {
+		return nil, errNoVmSnapshotProvider
+	}
+
+	factory, ok := vmSnapshotProviderTypes[config.Type]
+	if !ok {
+		return nil, fmt.Errorf("Unknown VM snapshot provider type \"%s\"", config.Type)
+	}
+
+	return factory(config)
+}
+
+/**
+ * The command provider runs an external command (like a script
+ * running zfs send or qemu-img) which writes the image file to
+ * standard output. The string "{vm_uuid}" in the arguments is replaced
+ * with the uuid of the VM, and the uuid and the incremental flag is
+ * also provided in the IMGAPI_VM_UUID and IMGAPI_INCREMENTAL
+ * environment variables.
+ */
+type commandSnapshotProvider struct {
+	config VmSnapshotConfig
+}
+
+func newCommandSnapshotProvider(config VmSnapshotConfig) (VmSnapshotProvider, error) {
+	if len(config.Command) == 0 {
+		return nil, fmt.Errorf("command VM snapshot provider requires \"command\"")
+	}
+	return &commandSnapshotProvider{config: config}, nil
+}
+
+func (p *commandSnapshotProvider) Snapshot(vm string, incremental bool) (*VmSnapshot, error) {
+	var args []string
+	for _, arg := range p.config.Args {
+		args = append(args, strings.Replace(arg, "{vm_uuid}", vm, -1))
+	}
+
+	cmd := exec.Command(p.config.Command, args...)
+	cmd.Env = append(os.Environ(),
+		"IMGAPI_VM_UUID="+vm,
+		fmt.Sprintf("IMGAPI_INCREMENTAL=%v", incremental))
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &commandReader{cmd: cmd, stdout: stdout}
+	cmd.Stderr = &reader.stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	compression := p.config.Compression
+	if len(compression) == 0 {
+		compression = "none"
+	}
+
+	return &VmSnapshot{Reader: reader, Compression: compression}, nil
+}
+
+// Read the output of the command (Close waits for the command to exit)
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	once   sync.Once
+	err    error
+}
+
+func (c *commandReader) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandReader) Close() error {
+	c.once.Do(func() {
+		// Don't let the command block writing output nobody reads
+		c.stdout.Close()
+		err := c.cmd.Wait()
+		if err != nil {
+			c.err = fmt.Errorf("%s failed: %v %s", c.cmd.Path, err,
+				strings.TrimSpace(c.stderr.String()))
+		}
+	})
+	return c.err
+}
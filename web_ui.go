@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+/**
+ * The web UI served at /ui (if web_ui is enabled). The page is self
+ * contained and use the JSON endpoints (ListImages and GetImage) to list
+ * and show the images, so it needs no extra support in the server.
+ * Everything from the manifests is inserted as text (not HTML).
+ */
+const webUiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Images</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; color: #222; }
+form { margin-bottom: 1em; }
+form label { margin-right: 1em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; }
+tbody tr { cursor: pointer; }
+tbody tr:hover { background: #f3f3f3; }
+#details { margin-top: 2em; }
+#details img { max-width: 128px; max-height: 128px; float: right; }
+pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Images</h1>
+<form id="filters">
+<label>Name <input name="name" placeholder="~substring"></label>
+<label>OS <input name="os" size="10"></label>
+<label>Type <input name="type" size="12"></label>
+<label>State <select name="state">
+<option value="">active</option>
+<option>all</option>
+<option>unactivated</option>
+<option>disabled</option>
+</select></label>
+<button type="submit">Search</button>
+</form>
+<p id="status"></p>
+<table>
+<thead><tr><th>Name</th><th>Version</th><th>OS</th><th>Type</th><th>State</th><th>Published</th><th>UUID</th></tr></thead>
+<tbody id="images"></tbody>
+</table>
+<div id="details"></div>
+<script>
+function element(tag, text) {
+  var e = document.createElement(tag);
+  if (text !== undefined && text !== null) {
+    e.textContent = text;
+  }
+  return e;
+}
+
+function request(path) {
+  return fetch(path, { credentials: "same-origin", headers: { "Accept": "application/json" } })
+    .then(function (resp) {
+      return resp.json().then(function (body) {
+        if (!resp.ok) {
+          throw new Error(body.message || resp.statusText);
+        }
+        return body;
+      });
+    });
+}
+
+function showError(err) {
+  var status = document.getElementById("status");
+  status.className = "error";
+  status.textContent = err.message;
+}
+
+function showImage(uuid) {
+  request("images/" + encodeURIComponent(uuid)).then(function (m) {
+    var details = document.getElementById("details");
+    details.textContent = "";
+    if (m.icon) {
+      var icon = element("img");
+      icon.src = "images/" + encodeURIComponent(uuid) + "/icon";
+      icon.alt = "icon";
+      details.appendChild(icon);
+    }
+    details.appendChild(element("h2", m.name + " " + m.version));
+    if (m.description) {
+      details.appendChild(element("p", m.description));
+    }
+    var files = element("ul");
+    (m.files || []).forEach(function (file, index) {
+      var link = element("a", "Download file " + index + " (" + file.size + " bytes, " + file.compression + ")");
+      link.href = "images/" + encodeURIComponent(uuid) + "/file" + (index > 0 ? "/" + index : "");
+      var item = element("li");
+      item.appendChild(link);
+      files.appendChild(item);
+    });
+    details.appendChild(files);
+    details.appendChild(element("pre", JSON.stringify(m, null, 2)));
+  }).catch(showError);
+}
+
+function listImages() {
+  var query = new URLSearchParams();
+  new FormData(document.getElementById("filters")).forEach(function (value, key) {
+    if (value) {
+      query.set(key, value);
+    }
+  });
+
+  var status = document.getElementById("status");
+  status.className = "";
+  status.textContent = "Loading...";
+  request("images?" + query.toString()).then(function (images) {
+    var body = document.getElementById("images");
+    body.textContent = "";
+    images.forEach(function (m) {
+      var row = element("tr");
+      [m.name, m.version, m.os, m.type, m.state, m.published_at, m.uuid].forEach(function (value) {
+        row.appendChild(element("td", value));
+      });
+      row.addEventListener("click", function () { showImage(m.uuid); });
+      body.appendChild(row);
+    });
+    status.textContent = images.length + " images";
+  }).catch(showError);
+}
+
+document.getElementById("filters").addEventListener("submit", function (e) {
+  e.preventDefault();
+  listImages();
+});
+listImages();
+</script>
+</body>
+</html>
+`
+
+// Serve the web UI
+func serverWebUi(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Server", "Norbye Public Images Repo")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(webUiPage)))
+	h.Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; img-src 'self'")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(webUiPage))
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The number of attempts before giving up unless max_attempts is set
+const defaultWebhookMaxAttempts = 5
+
+// The number of events waiting to be delivered before new events is dropped
+const webhookQueueSize = 1000
+
+// The timeout for each delivery
+const webhookTimeout = 30 * time.Second
+
+// A subscriber to the image events in the configuration file
+type Webhook struct {
+	Url string `json:"url"`
+	// The key used to sign the payload (see X-Imgapi-Signature)
+	Secret string `json:"secret"`
+	// The event types to deliver (all events if empty)
+	Events      []string `json:"events"`
+	MaxAttempts int      `json:"max_attempts"`
+}
+
+// The event types a webhook may subscribe to
+var webhookEvents = map[string]bool{
+	EventImageCreated:     true,
+	EventImageActivated:   true,
+	EventImageUpdated:     true,
+	EventImageDisabled:    true,
+	EventImageEnabled:     true,
+	EventImageDeleted:     true,
+	EventImagePromoted:    true,
+	EventFileUploaded:     true,
+	EventFileUploadFailed: true,
+	EventQuotaExceeded:    true,
+	EventFileInfected:     true,
+}
+
+/**
+ * The sender for one webhook. The events is POSTed as JSON in the order
+ * they happened by a background worker, and a failed delivery is
+ * retried with exponential backoff (see replicationBackoff) until
+ * max_attempts is reached.
+ */
+type webhookSender struct {
+	hook   Webhook
+	events map[string]bool
+	queue  chan ImageEvent
+	client *http.Client
+
+	sync.Mutex
+	delivered int64
+	failed    int64
+	dropped   int64
+	lastError string
+}
+
+var webhookSenders []*webhookSender
+
+// Start the senders for the configured webhooks
+func startWebhooks() {
+	for _, hook := range configuration.Webhooks {
+		s := &webhookSender{
+			hook:   hook,
+			events: make(map[string]bool),
+			queue:  make(chan ImageEvent, webhookQueueSize),
+			client: &http.Client{Timeout: webhookTimeout},
+		}
+		for _, event := range hook.Events {
+			s.events[event] = true
+		}
+		if s.hook.MaxAttempts <= 0 {
+			s.hook.MaxAttempts = defaultWebhookMaxAttempts
+		}
+
+		webhookSenders = append(webhookSenders, s)
+		go s.run()
+	}
+
+	if len(webhookSenders) > 0 {
+		subscribeImageEvents(queueWebhookEvent)
+	}
+}
+
+func queueWebhookEvent(event ImageEvent) {
+	for _, s := range webhookSenders {
+		if len(s.events) > 0 && !s.events[event.Type] {
+			continue
+		}
+
+		select {
+		case s.queue <- event:
+		default:
+			log.Printf("Dropping %s %s for webhook %s (queue full)", event.Type, event.Uuid, s.hook.Url)
+			s.Lock()
+			s.dropped++
+			s.Unlock()
+		}
+	}
+}
+
+// Sign the payload with HMAC-SHA256
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSender) run() {
+	for event := range s.queue {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode event: %v", err)
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			err = s.deliver(payload)
+			if err == nil {
+				s.Lock()
+				s.delivered++
+				s.Unlock()
+				break
+			}
+
+			s.Lock()
+			s.lastError = fmt.Sprintf("%v", err)
+			s.Unlock()
+			if attempt >= s.hook.MaxAttempts {
+				log.Printf("Giving up delivering %s %s to %s: %v", event.Type, event.Uuid, s.hook.Url, err)
+				s.Lock()
+				s.failed++
+				s.Unlock()
+				break
+			}
+
+			backoff := replicationBackoff(attempt)
+			log.Printf("Failed to deliver %s %s to %s (retry in %v): %v", event.Type, event.Uuid, s.hook.Url, backoff, err)
+			time.Sleep(backoff)
+		}
+	}
+}
+
+func (s *webhookSender) deliver(payload []byte) error {
+	req, err := http.NewRequest("POST", s.hook.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.hook.Secret) > 0 {
+		req.Header.Set("X-Imgapi-Signature", webhookSignature(s.hook.Secret, payload))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s returned %s", s.hook.Url, resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSender) status() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	return map[string]interface{}{
+		"url":        s.hook.Url,
+		"pending":    len(s.queue),
+		"delivered":  s.delivered,
+		"failed":     s.failed,
+		"dropped":    s.dropped,
+		"last_error": s.lastError,
+	}
+}
+
+// Get the status of the webhooks for /state
+func webhooksState() []interface{} {
+	state := make([]interface{}, 0, len(webhookSenders))
+	for _, s := range webhookSenders {
+		state = append(state, s.status())
+	}
+	return state
+}